@@ -4,9 +4,16 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/config"
 	"github.com/palzino/vidanalyser/internal/datatypes"
 	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/presets"
+	"github.com/palzino/vidanalyser/internal/transcoder"
 	"github.com/palzino/vidanalyser/internal/tree"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/users"
 )
 
 // formatTime converts total seconds into days, hours, minutes, and seconds
@@ -26,138 +33,217 @@ func estimateSize(length int, videoBitrateKbps int, audioBitrateKbps int) int64
 	return int64(length) * totalBitrate
 }
 
-// shouldTranscode determines if a video should be transcoded based on the target resolution
-func shouldTranscode(width, height int, targetResolution string) bool {
-	targetResolution = strings.ToLower(targetResolution)
-	switch targetResolution {
-	case "720p":
-		return width > 1280 || height > 720
-	case "1080p":
-		return width > 1920 || height > 1080
-	case "4k":
-		return width >= 3840 || height >= 2160
-	default:
-		return false
-	}
-}
-
-func AnalyzeDatabase() {
+// AnalyzeDatabase runs the interactive analysis session
+func AnalyzeDatabase() error {
 	// Get user input for filters
-	filters := getUserFilters()
+	filters, err := getUserFilters()
+	if err != nil {
+		return err
+	}
 
 	// Build directory tree
 	directoryTree, err := db.BuildDirectoryTree()
 	if err != nil {
-		fmt.Printf("Error building directory tree: %s\n", err)
-		return
+		return apperr.Wrap(apperr.Database, err, "error building directory tree")
 	}
 
-	// Create filter function
-	fileFilter := createFileFilter(filters)
-
 	for {
 		// Display current directory and get user selection
 		selectedNode, recursive := displayDirectoryAndGetSelection(directoryTree)
 		if selectedNode == nil {
-			return
+			return nil
 		}
 
-		// Get filtered files
-		selectedFiles := selectedNode.FilterFiles(fileFilter, recursive)
-
-		// Analyze selected files
-		analyzeFiles(selectedFiles, filters.targetBitrate)
+		// Totals come straight from SQL once any codecs not recorded by a
+		// scan have been probed
+		filter := filters.videoFilter(selectedNode.Path, recursive)
+		if len(filter.Codecs) > 0 {
+			if err := transcoder.ProbeMissingCodecs(filter); err != nil {
+				return apperr.Wrap(apperr.Database, err, "error probing codecs")
+			}
+		}
+		totals, err := db.AggregateVideos(filter)
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error analysing videos")
+		}
+		result := estimate(totals, filters.targetBitrate)
+		result.Directory = selectedNode.Path
+		result.Recursive = recursive
+		if output.JSON() {
+			output.Print(result)
+		} else {
+			printAnalysis(result)
+			load := func() ([]datatypes.VideoObject, error) { return selectFiles(filter) }
+			if queued, err := offerTranscode(result.Files, load); queued || err != nil {
+				return err
+			}
+		}
 
 		if !promptContinue() {
 			break
 		}
 	}
+	return nil
 }
 
 type AnalysisFilters struct {
 	minSize       float64
-	resolution    string
+	resolution    string // Exact WxH, a resolution class such as 1080p or "0" for all
 	minDuration   int
+	minBitrate    int     // Source bitrate in kbps
+	minBPP        float64 // Only set from a preset
+	withStreams   []db.StreamMatch
+	lackStreams   []db.StreamMatch
+	codecs        []string // ffprobe codec names, e.g. h264
 	targetBitrate int64
 }
 
-func getUserFilters() AnalysisFilters {
-	var f AnalysisFilters
-	fmt.Print("Enter minimum file size in GB (or 0 for all sizes): ")
-	fmt.Scanln(&f.minSize)
-	fmt.Print("Enter resolution to analyse (e.g., 1920x1080, or '0' for all resolutions): ")
-	fmt.Scanln(&f.resolution)
-	fmt.Print("Enter minimum duration in seconds (or 0 for all durations): ")
-	fmt.Scanln(&f.minDuration)
-	fmt.Print("Enter desired bitrate savings estimation: ")
-	fmt.Scanln(&f.targetBitrate)
-	return f
-}
-
-func createFileFilter(f AnalysisFilters) func(datatypes.VideoObject) bool {
-	return func(video datatypes.VideoObject) bool {
-		if f.minSize > 0 && float64(video.Size)/(1024*1024*1024) < f.minSize {
-			return false
+func getUserFilters() (AnalysisFilters, error) {
+	f := AnalysisFilters{resolution: "0"}
+	var presetName string
+	fmt.Print("Enter a filter preset name (leave empty to enter filters): ")
+	fmt.Scanln(&presetName)
+	if presetName != "" {
+		preset, err := presets.Get(presetName)
+		if err != nil {
+			return f, apperr.Wrap(apperr.Config, err, "error loading presets")
+		}
+		if preset == nil {
+			return f, apperr.New(apperr.NotFound, "preset %s not found", presetName)
+		}
+		f.minSize, f.minDuration, f.minBitrate, f.minBPP, f.codecs = preset.MinSizeGB, preset.MinDuration, preset.MinBitrate, preset.MinBPP, preset.Codecs
+		if preset.InputRes != "" {
+			f.resolution = preset.InputRes
+		}
+		if f.withStreams, f.lackStreams, err = preset.StreamMatches(); err != nil {
+			return f, apperr.Wrap(apperr.Config, err, "invalid preset "+presetName)
 		}
-		if f.resolution != "0" {
-			res := fmt.Sprintf("%dx%d", video.Width, video.Height)
-			if res != f.resolution {
-				return false
+	} else {
+		fmt.Print("Enter minimum file size in GB (or 0 for all sizes): ")
+		fmt.Scanln(&f.minSize)
+		fmt.Print("Enter resolution to analyse (e.g., 1920x1080, a class such as 480p/720p/1080p/1440p/4k/8k, or '0' for all resolutions): ")
+		fmt.Scanln(&f.resolution)
+		fmt.Print("Enter minimum duration in seconds (or 0 for all durations): ")
+		fmt.Scanln(&f.minDuration)
+		fmt.Print("Enter minimum source bitrate in kbps (or 0 for all bitrates): ")
+		fmt.Scanln(&f.minBitrate)
+		var codecs string
+		fmt.Print("Enter video codecs, comma separated (e.g. h264,mpeg2video, or leave empty for all codecs): ")
+		fmt.Scanln(&codecs)
+		for _, codec := range strings.Split(codecs, ",") {
+			if codec = strings.ToLower(strings.TrimSpace(codec)); codec != "" {
+				f.codecs = append(f.codecs, codec)
 			}
 		}
-		if f.minDuration > 0 && video.Length < f.minDuration {
-			return false
+		preset := presets.Preset{MinSizeGB: f.minSize, MinDuration: f.minDuration, MinBitrate: f.minBitrate, Codecs: f.codecs}
+		if datatypes.IsResolutionClass(f.resolution) {
+			preset.InputRes = strings.ToLower(f.resolution)
+		}
+		if preset.InputRes != "" || f.resolution == "0" || f.resolution == "" {
+			presets.OfferSave(preset)
 		}
-		return true
 	}
+	fmt.Print("Enter desired bitrate savings estimation: ")
+	fmt.Scanln(&f.targetBitrate)
+	return f, nil
 }
 
-func analyzeFiles(selectedFiles []datatypes.VideoObject, targetBitrate int64) {
-	totalLength := 0
-	totalSize := int64(0)
-	totalEstimatedSize := int64(0)
-	totalSavings := int64(0)
+// AnalysisResult is the estimate for one analysed selection
+type AnalysisResult struct {
+	Directory        string `json:"directory"`
+	Recursive        bool   `json:"recursive"`
+	Files            int    `json:"files"`
+	TotalLength      int    `json:"total_length"`      // Seconds
+	TotalSize        int64  `json:"total_size"`        // Bytes
+	TotalDiskSize    int64  `json:"total_disk_size"`   // Bytes allocated on disk
+	EstimatedSize    int64  `json:"estimated_size"`    // Bytes
+	EstimatedSavings int64  `json:"estimated_savings"` // Bytes
+	// Savings measured against the allocated size, which is what a compressed
+	// dataset actually frees; outputs are assumed not to compress further
+	EstimatedDiskSavings int64 `json:"estimated_disk_savings"` // Bytes
+}
 
-	videos, err := db.QueryAllVideos()
-	if err != nil {
-		fmt.Printf("Error querying videos: %s\n", err)
-		return
+// videoFilter turns the filters into a database filter for one directory
+func (f AnalysisFilters) videoFilter(directory string, recursive bool) db.VideoFilter {
+	return db.VideoFilter{
+		Directory:      directory,
+		Recursive:      recursive,
+		MinSizeGB:      f.minSize,
+		MinBitrate:     f.minBitrate,
+		MinDuration:    f.minDuration,
+		Resolution:     f.resolution,
+		MinBPP:         f.minBPP,
+		WithStreams:    f.withStreams,
+		WithoutStreams: f.lackStreams,
+		Codecs:         f.codecs,
 	}
+}
 
-	for _, video := range videos {
-		if containsVideo(selectedFiles, video) {
-			totalLength += video.Length
-			totalSize += int64(video.Size)
+// selectFiles loads the videos matching the filter
+func selectFiles(filter db.VideoFilter) ([]datatypes.VideoObject, error) {
+	videos, err := db.QueryFilteredVideos(filter)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.Database, err, "error querying videos")
+	}
+	return videos, nil
+}
 
-			// Estimate transcoded size for 720p, 1.5 Mbps video + 160 kbps audio
-			videoBitrate := int64(targetBitrate * 1024 * 1024 / 8) // 1.5 Mbps to bytes per second
-			const audioBitrate = int64(160 * 1024 / 8)             // 160 kbps to bytes per second
-			totalBitrate := videoBitrate + audioBitrate
-			estimatedSize := int64(video.Length) * totalBitrate
+// estimate predicts the transcoded size of the totals at the target bitrate
+// plus 160 kbps of audio
+func estimate(totals db.VideoTotals, targetBitrate int64) AnalysisResult {
+	videoBitrate := int64(targetBitrate * 1024 * 1024 / 8) // Bytes per second
+	const audioBitrate = int64(160 * 1024 / 8)             // 160 kbps to bytes per second
+	estimatedSize := totals.Length * (videoBitrate + audioBitrate)
 
-			totalEstimatedSize += estimatedSize
-			totalSavings += int64(video.Size) - estimatedSize
-		}
+	return AnalysisResult{
+		Files:                totals.Files,
+		TotalLength:          int(totals.Length),
+		TotalSize:            totals.Size,
+		TotalDiskSize:        totals.DiskSize,
+		EstimatedSize:        estimatedSize,
+		EstimatedSavings:     totals.Size - estimatedSize,
+		EstimatedDiskSavings: totals.DiskSize - estimatedSize,
 	}
+}
 
-	totalSizeGB := float64(totalSize) / (1024 * 1024 * 1024)
-	totalEstimatedSizeGB := float64(totalEstimatedSize) / (1024 * 1024 * 1024)
-	totalSavingsGB := float64(totalSavings) / (1024 * 1024 * 1024)
-
-	fmt.Printf("Total Selected Video Length: %d seconds\n", totalLength)
-	fmt.Printf("Total Original File Size: %.2f GB\n", totalSizeGB)
-	fmt.Printf("Estimated Transcoded Size: %.2f GB\n", totalEstimatedSizeGB)
-	fmt.Printf("Estimated Savings: %.2f GB\n", totalSavingsGB)
+// printAnalysis shows an analysis result in the terminal
+func printAnalysis(result AnalysisResult) {
+	fmt.Printf("Total Selected Video Length: %d seconds\n", result.TotalLength)
+	fmt.Printf("Total Original File Size: %s\n", units.Bytes(result.TotalSize))
+	fmt.Printf("Total Size On Disk: %s\n", units.Bytes(result.TotalDiskSize))
+	fmt.Printf("Estimated Transcoded Size: %s\n", units.Bytes(result.EstimatedSize))
+	fmt.Printf("Estimated Savings: %s\n", units.Bytes(result.EstimatedSavings))
+	if result.TotalDiskSize != result.TotalSize {
+		fmt.Printf("Estimated Savings On Disk: %s (files are compressed or sparse)\n", units.Bytes(result.EstimatedDiskSavings))
+	}
 }
 
-// containsVideo checks if a video is in the selected files
-func containsVideo(selectedFiles []datatypes.VideoObject, video datatypes.VideoObject) bool {
-	for _, v := range selectedFiles {
-		if v.FullFilePath == video.FullFilePath {
-			return true
-		}
+// offerTranscode asks whether to queue the analysed files and, if so, transcodes
+// exactly that selection. It reports whether the files were queued.
+func offerTranscode(count int, load func() ([]datatypes.VideoObject, error)) (bool, error) {
+	if count == 0 {
+		return false, nil
+	}
+	opts := transcoder.SelectionOptions{Concurrent: 1, SkipLowSavings: config.GetSkipLowSavings()}
+	hint := ""
+	if defaultProfile := users.DefaultProfile(config.GetCurrentUser()); defaultProfile != "" {
+		hint = fmt.Sprintf(" (e.g. %s)", defaultProfile)
+	}
+	fmt.Printf("Queue these %d files for transcoding? Enter a profile name%s, or leave empty to skip: ", count, hint)
+	fmt.Scanln(&opts.Profile)
+	if opts.Profile == "" {
+		return false, nil
+	}
+
+	fmt.Print("Enter desired concurrent transcodes: ")
+	fmt.Scanln(&opts.Concurrent)
+	fmt.Println("Auto delete original files after transcoding? (true/false)")
+	fmt.Scanln(&opts.AutoDelete)
+	selectedFiles, err := load()
+	if err != nil {
+		return true, err
 	}
-	return false
+	return true, transcoder.StartTranscodingFromAnalysis(selectedFiles, opts)
 }
 
 func promptContinue() bool {
@@ -0,0 +1,105 @@
+// Package apperr defines the error categories reported by the CLI and the
+// exit code each one maps to, so scripts can branch on the outcome of a command.
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Category classifies why a command failed
+type Category string
+
+const (
+	Usage          Category = "usage"
+	Config         Category = "config"
+	Database       Category = "db"
+	FFmpeg         Category = "ffmpeg"
+	NotFound       Category = "not-found"
+	PartialFailure Category = "partial-failure"
+	ReadOnly       Category = "read-only"
+	Internal       Category = "internal"
+)
+
+// exitCodes maps each category to the process exit code
+var exitCodes = map[Category]int{
+	Internal:       1,
+	Usage:          2,
+	Config:         3,
+	Database:       4,
+	FFmpeg:         5,
+	NotFound:       6,
+	PartialFailure: 7,
+	ReadOnly:       8,
+}
+
+// Error is an error tagged with a category
+type Error struct {
+	Category Category
+	Message  string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	if e.Message == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Message, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New creates a categorised error from a message
+func New(category Category, format string, args ...interface{}) error {
+	return &Error{Category: category, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrap tags err with a category and context message. It returns nil for a nil err.
+func Wrap(category Category, err error, message string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Category: category, Message: message, Err: err}
+}
+
+// CategoryOf returns the category of err, Internal for untagged errors
+func CategoryOf(err error) Category {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr.Category
+	}
+	return Internal
+}
+
+// ExitCode returns the process exit code for err, 0 for nil
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCodes[CategoryOf(err)]
+}
+
+// Report writes err to w, either as a human readable line or as a JSON object
+// like {"error": "...", "category": "db", "exit_code": 4}
+func Report(w io.Writer, err error, jsonOutput bool) {
+	if jsonOutput {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     err.Error(),
+			"category":  CategoryOf(err),
+			"exit_code": ExitCode(err),
+		})
+		return
+	}
+	if CategoryOf(err) == Usage {
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Error (%s): %s\n", CategoryOf(err), err)
+}
@@ -0,0 +1,144 @@
+// Package archive stores the rules that move files to cold storage, a local
+// directory or an rclone remote, once they are old enough and, optionally,
+// once they have been transcoded.
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+// What a rule leaves at the old path of an archived file
+const (
+	LeaveSymlink = "symlink" // A symbolic link to the archived file, for local roots
+	LeaveStub    = "stub"    // A <name>.archived text file naming where it went
+)
+
+// Rule moves the files under Path matching all of its conditions to Root,
+// keeping their paths below Path. Zero conditions match every file.
+type Rule struct {
+	Name       string   `json:"name"`
+	Path       string   `json:"path"`                   // Directory whose files are archived
+	Root       string   `json:"root,omitempty"`         // Archive directory or rclone remote:path; ARCHIVE_ROOT by default
+	MinAgeDays int      `json:"min_age_days,omitempty"` // Files unmodified for at least this many days
+	MinSizeGB  float64  `json:"min_size,omitempty"`     // Files must be at least this large
+	Codecs     []string `json:"codecs,omitempty"`       // ffprobe codec names, e.g. h264
+	Tags       []string `json:"tags,omitempty"`         // Tags files must all carry, e.g. kids
+	Transcoded bool     `json:"transcoded,omitempty"`   // Only originals whose transcode was kept
+	Leave      string   `json:"leave,omitempty"`        // "symlink", "stub" or nothing
+}
+
+// IsRemote reports whether root is an rclone remote:path rather than a local directory
+func IsRemote(root string) bool {
+	colon := strings.Index(root, ":")
+	return colon > 0 && !strings.ContainsAny(root[:colon], `/\`)
+}
+
+// Destination returns where the file at path is archived to
+func (r Rule) Destination(path string) (string, error) {
+	rel, err := filepath.Rel(r.Path, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under %s", path, r.Path)
+	}
+	if IsRemote(r.Root) {
+		return strings.TrimSuffix(r.Root, "/") + "/" + filepath.ToSlash(filepath.Join(r.Name, rel)), nil
+	}
+	return filepath.Join(r.Root, r.Name, rel), nil
+}
+
+// Describe summarises the conditions and destination, e.g.
+// "/mnt/movies, 365+ days old, transcoded -> b2:archive (symlink)"
+func (r Rule) Describe() string {
+	parts := []string{r.Path}
+	if r.MinAgeDays > 0 {
+		parts = append(parts, fmt.Sprintf("%d+ days old", r.MinAgeDays))
+	}
+	if r.MinSizeGB > 0 {
+		parts = append(parts, fmt.Sprintf("at least %g GB", r.MinSizeGB))
+	}
+	if len(r.Codecs) > 0 {
+		parts = append(parts, strings.Join(r.Codecs, "/"))
+	}
+	if len(r.Tags) > 0 {
+		parts = append(parts, "tagged "+strings.Join(r.Tags, "+"))
+	}
+	if r.Transcoded {
+		parts = append(parts, "transcoded")
+	}
+	description := strings.Join(parts, ", ") + " -> " + r.Root
+	if r.Leave != "" {
+		description += " (" + r.Leave + ")"
+	}
+	return description
+}
+
+// Validate checks the rule has a root outside its path and usable conditions
+func (r Rule) Validate() error {
+	if r.Name == "" || strings.ContainsAny(r.Name, `/\`) {
+		return fmt.Errorf("archive rule name %q must be set and cannot contain slashes", r.Name)
+	}
+	if !filepath.IsAbs(r.Path) {
+		return fmt.Errorf("archive rule %s: path must be absolute", r.Name)
+	}
+	if r.Root == "" {
+		return fmt.Errorf("archive rule %s: set a root or ARCHIVE_ROOT", r.Name)
+	}
+	if !IsRemote(r.Root) {
+		if !filepath.IsAbs(r.Root) {
+			return fmt.Errorf("archive rule %s: root must be absolute or an rclone remote:path", r.Name)
+		}
+		if rel, err := filepath.Rel(r.Path, r.Root); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("archive rule %s: root cannot be inside %s", r.Name, r.Path)
+		}
+	}
+	if r.MinAgeDays < 0 || r.MinSizeGB < 0 {
+		return fmt.Errorf("archive rule %s: minimums cannot be negative", r.Name)
+	}
+	switch r.Leave {
+	case "", LeaveStub:
+	case LeaveSymlink:
+		if IsRemote(r.Root) {
+			return fmt.Errorf("archive rule %s: symlinks need a local root, use stub for rclone remotes", r.Name)
+		}
+	default:
+		return fmt.Errorf("archive rule %s: leave must be symlink or stub", r.Name)
+	}
+	return nil
+}
+
+// Load reads the archival rules, filling in ARCHIVE_ROOT for rules without a
+// root. A missing file means no rules.
+func Load() ([]Rule, error) {
+	data, err := os.ReadFile(config.GetArchiveFile())
+	if os.IsNotExist(err) {
+		return []Rule{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive rules: %w", err)
+	}
+
+	var list []Rule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error decoding archive rules: %w", err)
+	}
+	for i, rule := range list {
+		rule.Path = filepath.Clean(rule.Path)
+		if rule.Root == "" {
+			rule.Root = config.GetArchiveRoot()
+		}
+		if rule.Tags, err = db.ParseTags(rule.Tags); err != nil {
+			return nil, fmt.Errorf("archive rule %s: %w", rule.Name, err)
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		list[i] = rule
+	}
+	return list, nil
+}
@@ -0,0 +1,88 @@
+package archive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsRemote(t *testing.T) {
+	tests := map[string]bool{
+		"b2:archive":           true,
+		"gdrive:":              true,
+		"s3:bucket/movies":     true,
+		"/mnt/archive":         false,
+		"/mnt/odd:name":        false,
+		"relative/dir:with":    false,
+		":local-backend:/path": false,
+		"":                     false,
+	}
+	for root, want := range tests {
+		if got := IsRemote(root); got != want {
+			t.Errorf("IsRemote(%q) = %v, want %v", root, got, want)
+		}
+	}
+}
+
+func TestDestination(t *testing.T) {
+	tests := []struct {
+		root, path, want string
+	}{
+		{"/mnt/archive", "/media/movies/Film (2001)/film.mkv", "/mnt/archive/old/Film (2001)/film.mkv"},
+		{"/mnt/archive/", "/media/movies/film.mkv", "/mnt/archive/old/film.mkv"},
+		{"b2:bucket", "/media/movies/Film (2001)/film.mkv", "b2:bucket/old/Film (2001)/film.mkv"},
+		{"b2:bucket/cold/", "/media/movies/film.mkv", "b2:bucket/cold/old/film.mkv"},
+	}
+	for _, tt := range tests {
+		rule := Rule{Name: "old", Path: "/media/movies", Root: tt.root}
+		got, err := rule.Destination(tt.path)
+		if err != nil {
+			t.Errorf("Destination(%q) with root %s: %s", tt.path, tt.root, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Destination(%q) with root %s = %q, want %q", tt.path, tt.root, got, tt.want)
+		}
+	}
+
+	rule := Rule{Name: "old", Path: "/media/movies", Root: "/mnt/archive"}
+	for _, outside := range []string{"/media/movies-extra/film.mkv", "/media/film.mkv", "/media/movies/../tv/show.mkv"} {
+		if got, err := rule.Destination(outside); err == nil {
+			t.Errorf("Destination(%q) = %q, want an error for a file outside the rule's path", outside, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Rule{Name: "old", Path: "/media/movies", Root: "/mnt/archive", MinAgeDays: 365, Leave: LeaveSymlink}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid rule rejected: %s", err)
+	}
+	remote := Rule{Name: "cold", Path: "/media/movies", Root: "b2:archive", Leave: LeaveStub}
+	if err := remote.Validate(); err != nil {
+		t.Fatalf("valid remote rule rejected: %s", err)
+	}
+
+	tests := map[string]func(r *Rule){
+		"name":            func(r *Rule) { r.Name = "" },
+		"slashes":         func(r *Rule) { r.Name = "a/b" },
+		"absolute":        func(r *Rule) { r.Path = "media/movies" },
+		"set a root":      func(r *Rule) { r.Root = "" },
+		"root must be":    func(r *Rule) { r.Root = "archive" },
+		"inside":          func(r *Rule) { r.Root = "/media/movies/archive" },
+		"negative":        func(r *Rule) { r.MinAgeDays = -1 },
+		"need a local":    func(r *Rule) { r.Root = "b2:archive" },
+		"symlink or stub": func(r *Rule) { r.Leave = "copy" },
+	}
+	for want, change := range tests {
+		rule := valid
+		change(&rule)
+		err := rule.Validate()
+		if err == nil {
+			t.Errorf("rule %+v accepted, want an error mentioning %q", rule, want)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("rule %+v rejected with %q, want it to mention %q", rule, err, want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/safety"
+	"github.com/palzino/vidanalyser/internal/transcoder"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// Candidate is a file an archival rule moves, and how that went
+type Candidate struct {
+	Rule        string `json:"rule"`
+	Path        string `json:"path"`
+	Destination string `json:"destination"`
+	Size        int64  `json:"size"`
+	Archived    bool   `json:"archived"`
+	Error       string `json:"error,omitempty"`
+}
+
+// find lists the recorded files a rule archives. Symbolic links recorded as
+// links, such as those left by earlier archiving, are never archived.
+func find(rule Rule, now time.Time) ([]Candidate, error) {
+	filter := db.VideoFilter{
+		Directory:  rule.Path,
+		Recursive:  true,
+		MinSizeGB:  rule.MinSizeGB,
+		Codecs:     rule.Codecs,
+		Tags:       rule.Tags,
+		Transcoded: rule.Transcoded,
+	}
+	if rule.MinAgeDays > 0 {
+		filter.ModifiedBefore = now.AddDate(0, 0, -rule.MinAgeDays)
+	}
+	if len(rule.Codecs) > 0 {
+		if err := transcoder.ProbeMissingCodecs(filter); err != nil {
+			return nil, err
+		}
+	}
+	videos, err := db.QueryFilteredVideos(filter)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []Candidate{}
+	for _, video := range videos {
+		if video.LinkTarget != "" {
+			continue
+		}
+		destination, err := rule.Destination(video.FullFilePath)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, Candidate{Rule: rule.Name, Path: video.FullFilePath, Destination: destination, Size: int64(video.Size)})
+	}
+	return candidates, nil
+}
+
+// archiveFiles finds the files every rule archives and, with move set, moves
+// them, records their new paths and leaves what the rule asks for behind.
+// Moving is refused in read-only mode.
+func archiveFiles(move bool) ([]Candidate, error) {
+	if move {
+		if err := safety.Check("archive"); err != nil {
+			return nil, err
+		}
+	}
+	list, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	all := []Candidate{}
+	for _, rule := range list {
+		candidates, err := find(rule, time.Now())
+		if err != nil {
+			return all, fmt.Errorf("error finding files for archive rule %s: %w", rule.Name, err)
+		}
+		for i := range candidates {
+			if !move {
+				continue
+			}
+			if err := archiveFile(rule, candidates[i]); err != nil {
+				candidates[i].Error = err.Error()
+				log.Printf("Error archiving %s: %s\n", candidates[i].Path, err)
+				continue
+			}
+			candidates[i].Archived = true
+			log.Printf("Archived %s to %s\n", candidates[i].Path, candidates[i].Destination)
+		}
+		all = append(all, candidates...)
+	}
+	return all, nil
+}
+
+// archiveFile moves one file to the archive and updates its record
+func archiveFile(rule Rule, candidate Candidate) error {
+	if err := moveFile(candidate.Path, candidate.Destination); err != nil {
+		return err
+	}
+	if err := db.ArchiveVideo(candidate.Path, candidate.Destination); err != nil {
+		return fmt.Errorf("moved to %s but not recorded: %w", candidate.Destination, err)
+	}
+	switch rule.Leave {
+	case LeaveSymlink:
+		if err := os.Symlink(candidate.Destination, candidate.Path); err != nil {
+			return fmt.Errorf("error leaving a symlink: %w", err)
+		}
+	case LeaveStub:
+		stub := fmt.Sprintf("Archived to %s on %s\n", candidate.Destination, time.Now().Format("2006-01-02"))
+		if err := os.WriteFile(candidate.Path+".archived", []byte(stub), 0644); err != nil {
+			return fmt.Errorf("error leaving a stub: %w", err)
+		}
+	}
+	return nil
+}
+
+// moveFile moves src to dest, with rclone for remotes. Local files are
+// renamed on the same device and otherwise copied, checked and removed.
+func moveFile(src, dest string) error {
+	if IsRemote(dest) {
+		if err := runner.Run("rclone", "moveto", src, dest); err != nil {
+			return fmt.Errorf("error moving %s to %s: %w", src, dest, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("error creating archive directory: %w", err)
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	source, sourceKnown := pathutil.DeviceID(src)
+	target, targetKnown := pathutil.DeviceID(filepath.Dir(dest))
+	if sourceKnown && targetKnown && source == target {
+		return os.Rename(src, dest)
+	}
+	return copyAndRemove(src, dest)
+}
+
+// copyAndRemove copies src to dest through a .partial file, keeping its
+// modification time, and removes src once the copy matches its SHA-256
+func copyAndRemove(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	partial := dest + ".partial"
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	copied, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && copied != info.Size() {
+		err = fmt.Errorf("copied %d of %d bytes", copied, info.Size())
+	}
+	if err == nil {
+		err = transcoder.VerifyCopy(src, partial)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("error copying %s to %s: %w", src, dest, err)
+	}
+	if err := os.Chtimes(partial, info.ModTime(), info.ModTime()); err != nil {
+		log.Printf("Error keeping the modification time of %s: %s\n", dest, err)
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		return fmt.Errorf("error moving %s into place: %w", dest, err)
+	}
+	return safety.Remove(src)
+}
+
+// Run archives the files matching every rule. The daemon runs it on SCHEDULE_ARCHIVE.
+func Run() error {
+	candidates, err := archiveFiles(true)
+	if err != nil {
+		return err
+	}
+	var size int64
+	archived, failed := 0, 0
+	for _, candidate := range candidates {
+		if candidate.Archived {
+			archived++
+			size += candidate.Size
+		} else {
+			failed++
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("Archived %d file(s) using %s, %d failed", archived, units.Bytes(size), failed)
+	log.Println(message)
+	utils.NotifySummary(message)
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be archived", failed)
+	}
+	return nil
+}
+
+// Show lists the files the archival rules would move, moving them when move is set
+func Show(move bool) error {
+	candidates, err := archiveFiles(move)
+	if err != nil {
+		return apperr.Wrap(apperr.Config, err, "error archiving")
+	}
+	failed := 0
+	for _, candidate := range candidates {
+		if candidate.Error != "" {
+			failed++
+		}
+	}
+	if output.JSON() {
+		if err := output.Print(candidates); err != nil {
+			return err
+		}
+	} else {
+		if len(candidates) == 0 {
+			fmt.Printf("Nothing to archive under the rules in %s\n", config.GetArchiveFile())
+		}
+		for _, candidate := range candidates {
+			status := "would move"
+			switch {
+			case candidate.Error != "":
+				status = "failed: " + candidate.Error
+			case candidate.Archived:
+				status = "moved"
+			}
+			fmt.Printf("%s -> %s (%s, %s)\n", candidate.Path, candidate.Destination, units.Bytes(candidate.Size), status)
+		}
+	}
+	if failed > 0 {
+		return apperr.New(apperr.PartialFailure, "%d of %d files could not be archived", failed, len(candidates))
+	}
+	return nil
+}
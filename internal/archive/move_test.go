@@ -0,0 +1,135 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// recordVideo writes a video under dir and records it in a fresh database
+func recordVideo(t *testing.T, dir, content string) string {
+	t.Helper()
+	if err := db.InitDatabase(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	path := filepath.Join(dir, "Film", "film.mkv")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	video := datatypes.VideoObject{Name: filepath.Base(path), Location: filepath.Dir(path), FullFilePath: path, Size: len(content), FileExtension: ".mkv"}
+	if err := db.InsertVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestArchiveFileMovesAndLeavesSymlink(t *testing.T) {
+	library, archive := t.TempDir(), t.TempDir()
+	path := recordVideo(t, library, "video")
+	rule := Rule{Name: "old", Path: library, Root: archive, Leave: LeaveSymlink}
+	destination, err := rule.Destination(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := archiveFile(rule, Candidate{Rule: rule.Name, Path: path, Destination: destination}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(destination); err != nil || string(data) != "video" {
+		t.Errorf("archive holds %q (%v), want the original", data, err)
+	}
+	if target, err := os.Readlink(path); err != nil || target != destination {
+		t.Errorf("left %q (%v) at the old path, want a link to %s", target, err, destination)
+	}
+	if video, err := db.QueryVideoByPath(destination); err != nil || video == nil {
+		t.Errorf("no record at the archived path (%v)", err)
+	}
+}
+
+func TestMoveFileToRemoteRunsRclone(t *testing.T) {
+	fake := &runner.Fake{}
+	defer runner.Use(fake)()
+	src := filepath.Join(t.TempDir(), "film.mkv")
+
+	if err := moveFile(src, "b2:archive/old/film.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls()
+	if len(calls) != 1 || calls[0][0] != "rclone" || calls[0][1] != "moveto" || calls[0][2] != src || calls[0][3] != "b2:archive/old/film.mkv" {
+		t.Errorf("ran %v, want one rclone moveto", calls)
+	}
+}
+
+func TestMoveFileRefusesExistingDestination(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "film.mkv"), filepath.Join(dir, "archive", "film.mkv")
+	for path, content := range map[string]string{src: "new", dest: "archived"} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := moveFile(src, dest); err == nil {
+		t.Fatal("moveFile replaced an existing archive file")
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "archived" {
+		t.Errorf("archive file now holds %q", data)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source was removed: %s", err)
+	}
+}
+
+func TestCopyAndRemoveAcrossDevices(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "film.mkv")
+	dest := filepath.Join(t.TempDir(), "film.mkv")
+	modTime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	if err := os.WriteFile(src, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyAndRemove(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("copy modified at %s, want the original's %s", info.ModTime(), modTime)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source was kept after a verified copy")
+	}
+	if _, err := os.Stat(dest + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial copy was left behind")
+	}
+}
+
+func TestCopyAndRemoveKeepsSourceInReadOnlyMode(t *testing.T) {
+	t.Setenv("READ_ONLY", "true")
+	src := filepath.Join(t.TempDir(), "film.mkv")
+	if err := os.WriteFile(src, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyAndRemove(src, filepath.Join(t.TempDir(), "film.mkv")); err == nil {
+		t.Error("copyAndRemove removed the source in read-only mode")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source was removed in read-only mode: %s", err)
+	}
+}
@@ -1,25 +1,90 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
-// LoadConfig loads the environment variables from the .env file
+// EnvFile is the config file read at startup and written by `init`
+const EnvFile = ".env"
+
+// fromFile holds the keys set from the config file, each with the
+// value it had in the environment before, or nil when it had none, so a key
+// later removed from the file goes back to that
+var fromFile = struct {
+	sync.Mutex
+	previous map[string]*string
+}{previous: map[string]*string{}}
+
+// LoadConfig loads the environment variables from the .env file, if there is
+// one. Variables already in the environment win over the file.
 func LoadConfig() {
-	err := godotenv.Load(".env")
+	values, err := godotenv.Read(EnvFile)
 	if err != nil {
 		log.Println("No .env file found. Falling back to system environment variables.")
-		os.Create(".env")
+		return
+	}
+	fromFile.Lock()
+	defer fromFile.Unlock()
+	for key, value := range values {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		fromFile.previous[key] = nil
+		os.Setenv(key, value)
+	}
+}
+
+// Reload re-reads the config file over the current environment so changed
+// settings apply without a restart. Keys removed from the file since the
+// last reload go back to their value from before, unset when they had none.
+// Nothing is changed if the file is invalid.
+func Reload() error {
+	values, err := godotenv.Read(EnvFile)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", EnvFile, err)
+	}
+	fromFile.Lock()
+	defer fromFile.Unlock()
+	for key, previous := range fromFile.previous {
+		if _, kept := values[key]; kept {
+			continue
+		}
+		if previous == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *previous)
+		}
+		delete(fromFile.previous, key)
 	}
+	for key, value := range values {
+		if _, tracked := fromFile.previous[key]; !tracked {
+			if current, ok := os.LookupEnv(key); ok {
+				fromFile.previous[key] = &current
+			} else {
+				fromFile.previous[key] = nil
+			}
+		}
+		os.Setenv(key, value)
+	}
+	return nil
 }
 
 // GetTelegramBotToken retrieves the Telegram bot token from the environment
 func GetTelegramBotToken() string {
-	token, exists := os.LookupEnv("TELEGRAM_BOT_TOKEN=")
-	if !exists || token == "" {
+	token := secret("TELEGRAM_BOT_TOKEN")
+	if token == "" {
 		log.Println("TELEGRAM_BOT_TOKEN is not set in the environment")
 		return ""
 	}
@@ -35,3 +100,1105 @@ func GetTelegramChatID() string {
 	}
 	return chatID
 }
+
+// GetDigestInterval returns how often a progress digest is sent while transcoding.
+// A zero interval disables digests and keeps the per-file notifications.
+func GetDigestInterval() time.Duration {
+	value, exists := os.LookupEnv("NOTIFY_DIGEST_INTERVAL")
+	if !exists || value == "" {
+		return 0
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid NOTIFY_DIGEST_INTERVAL %q: %s\n", value, err)
+		return 0
+	}
+	return interval
+}
+
+// GetQuietHours returns the start and end hour (0-23) of the window in which
+// digests are held back, e.g. NOTIFY_QUIET_HOURS=23-7
+func GetQuietHours() (int, int, bool) {
+	value, exists := os.LookupEnv("NOTIFY_QUIET_HOURS")
+	if !exists || value == "" {
+		return 0, 0, false
+	}
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		log.Printf("Invalid NOTIFY_QUIET_HOURS %q, expected start-end\n", value)
+		return 0, 0, false
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	end, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || start < 0 || start > 23 || end < 0 || end > 23 {
+		log.Printf("Invalid NOTIFY_QUIET_HOURS %q, hours must be 0-23\n", value)
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// SMTPSettings holds the mail server used for email notifications
+type SMTPSettings struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// GetSMTPSettings retrieves the SMTP configuration from the environment.
+// Email is considered disabled when no host or recipient is set.
+func GetSMTPSettings() (SMTPSettings, bool) {
+	settings := SMTPSettings{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: secret("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	for _, recipient := range strings.Split(os.Getenv("SMTP_TO"), ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			settings.To = append(settings.To, recipient)
+		}
+	}
+	if settings.Port == "" {
+		settings.Port = "587"
+	}
+	if settings.From == "" {
+		settings.From = settings.Username
+	}
+	if settings.Host == "" || len(settings.To) == 0 {
+		return settings, false
+	}
+	return settings, true
+}
+
+// GetReportSchedule returns the weekday and hour at which the weekly report is sent.
+// Defaults to Monday at 08:00 (REPORT_DAY=monday, REPORT_HOUR=8).
+func GetReportSchedule() (time.Weekday, int) {
+	day := time.Monday
+	if value := os.Getenv("REPORT_DAY"); value != "" {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(d.String(), value) || strings.EqualFold(d.String()[:3], value) {
+				day = d
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Printf("Invalid REPORT_DAY %q, using Monday\n", value)
+		}
+	}
+
+	hour := 8
+	if value := os.Getenv("REPORT_HOUR"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > 23 {
+			log.Printf("Invalid REPORT_HOUR %q, using 8\n", value)
+		} else {
+			hour = parsed
+		}
+	}
+	return day, hour
+}
+
+// GetCallbackURL returns the URL workers call back on when a job finishes.
+// It must be reachable from the workers (COORDINATOR_CALLBACK_URL).
+func GetCallbackURL() string {
+	callbackURL := os.Getenv("COORDINATOR_CALLBACK_URL")
+	if callbackURL == "" {
+		return "http://localhost:8080/callback"
+	}
+	return callbackURL
+}
+
+// GetDispatchPollInterval returns how often a coordinator asks workers about
+// the jobs it dispatched, catching results whose callback was missed
+// (DISPATCH_POLL_INTERVAL, default 30s)
+func GetDispatchPollInterval() time.Duration {
+	value := os.Getenv("DISPATCH_POLL_INTERVAL")
+	if value == "" {
+		return 30 * time.Second
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Printf("Invalid DISPATCH_POLL_INTERVAL %q, using 30s\n", value)
+		return 30 * time.Second
+	}
+	return interval
+}
+
+// GetProfilesFile returns the path of the JSON file holding transcode profiles
+func GetProfilesFile() string {
+	if path := os.Getenv("PROFILES_FILE"); path != "" {
+		return path
+	}
+	return "profiles.json"
+}
+
+// GetProfileSource returns the coordinator a worker takes its profiles from,
+// e.g. http://coordinator:8080 (PROFILE_SOURCE). Empty uses the local
+// profiles file.
+func GetProfileSource() string {
+	return strings.TrimSuffix(os.Getenv("PROFILE_SOURCE"), "/")
+}
+
+// GetProfileCacheTTL returns how long a worker uses the profiles it fetched
+// before asking the coordinator again (PROFILE_CACHE_TTL, default 1m)
+func GetProfileCacheTTL() time.Duration {
+	value := os.Getenv("PROFILE_CACHE_TTL")
+	if value == "" {
+		return time.Minute
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		log.Printf("Invalid PROFILE_CACHE_TTL %q, using 1m\n", value)
+		return time.Minute
+	}
+	return ttl
+}
+
+// GetProfileCacheFile returns where a worker keeps the profiles it last
+// fetched, used while the coordinator cannot be reached
+func GetProfileCacheFile() string {
+	if path := os.Getenv("PROFILE_CACHE_FILE"); path != "" {
+		return path
+	}
+	return "profiles.cache.json"
+}
+
+// GetPresetsFile returns the path of the JSON file holding filter presets
+func GetPresetsFile() string {
+	if path := os.Getenv("PRESETS_FILE"); path != "" {
+		return path
+	}
+	return "presets.json"
+}
+
+// GetRulesFile returns the path of the JSON file holding the ordered watch
+// mode rules that pick a profile for new files
+func GetRulesFile() string {
+	if path := os.Getenv("RULES_FILE"); path != "" {
+		return path
+	}
+	return "rules.json"
+}
+
+// GetRulesDefault returns what watch mode does with new files no rule matches
+// (RULES_DEFAULT): "ignore" (the default) or the name of a profile to queue them with
+func GetRulesDefault() string {
+	if value := strings.TrimSpace(os.Getenv("RULES_DEFAULT")); value != "" {
+		return value
+	}
+	return "ignore"
+}
+
+// GetQuotasFile returns the path of the JSON file holding the per-directory
+// size quotas (QUOTAS_FILE, default quotas.json)
+func GetQuotasFile() string {
+	if path := os.Getenv("QUOTAS_FILE"); path != "" {
+		return path
+	}
+	return "quotas.json"
+}
+
+// GetQuotaGrace returns how long after notifying that a directory is over its
+// quota the daemon waits before acting (QUOTA_GRACE, default 24h)
+func GetQuotaGrace() time.Duration {
+	value := os.Getenv("QUOTA_GRACE")
+	if value == "" {
+		return 24 * time.Hour
+	}
+	grace, err := time.ParseDuration(value)
+	if err != nil || grace < 0 {
+		log.Printf("Invalid QUOTA_GRACE %q, using 24h\n", value)
+		return 24 * time.Hour
+	}
+	return grace
+}
+
+// GetArchiveFile returns the path of the JSON file holding the archival rules
+// (ARCHIVE_FILE, default archive.json)
+func GetArchiveFile() string {
+	if path := os.Getenv("ARCHIVE_FILE"); path != "" {
+		return path
+	}
+	return "archive.json"
+}
+
+// GetArchiveRoot returns where archived files are moved (ARCHIVE_ROOT): a
+// local directory or an rclone remote:path. Empty leaves rules without their
+// own root disabled.
+func GetArchiveRoot() string {
+	return strings.TrimSpace(os.Getenv("ARCHIVE_ROOT"))
+}
+
+// GetUsersFile returns where named users are stored
+func GetUsersFile() string {
+	if path := os.Getenv("USERS_FILE"); path != "" {
+		return path
+	}
+	return "users.json"
+}
+
+// GetCurrentUser returns the user jobs are submitted as, set with --user
+func GetCurrentUser() string {
+	return os.Getenv("ZINOCODER_USER")
+}
+
+// GetDefaultProfile returns the name of the profile used when none is given
+func GetDefaultProfile() string {
+	return os.Getenv("DEFAULT_PROFILE")
+}
+
+// GetSizeUnits returns how sizes are shown and size filters read (SIZE_UNITS):
+// binary (default, 1024-based KB/MB/GB), decimal (1000-based) or iec (KiB/MiB/GiB)
+func GetSizeUnits() string {
+	switch units := strings.ToLower(os.Getenv("SIZE_UNITS")); units {
+	case "", "binary":
+		return "binary"
+	case "decimal", "iec":
+		return units
+	default:
+		log.Printf("Invalid SIZE_UNITS %q, expected binary, decimal or iec\n", units)
+		return "binary"
+	}
+}
+
+// GetLibraryPaths returns the configured library roots (LIBRARY_PATHS, comma separated)
+func GetLibraryPaths() []string {
+	var paths []string
+	for _, path := range strings.Split(os.Getenv("LIBRARY_PATHS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// LibraryScan is a library's own rescan schedule
+type LibraryScan struct {
+	Path     string
+	Interval time.Duration
+	// Minutes after midnight the scan may start between; equal values allow
+	// any time, and a window may run past midnight
+	WindowStart, WindowEnd int
+}
+
+// InWindow reports whether a scan of the library may start at t
+func (s LibraryScan) InWindow(t time.Time) bool {
+	if s.WindowStart == s.WindowEnd {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if s.WindowStart < s.WindowEnd {
+		return minute >= s.WindowStart && minute < s.WindowEnd
+	}
+	return minute >= s.WindowStart || minute < s.WindowEnd
+}
+
+// GetLibraryScans returns the per-library rescan schedules from
+// LIBRARY_SCANS, a comma separated list of path=interval entries with an
+// optional time window, e.g. /mnt/movies=6h@01:00-05:00,/mnt/tv=1h
+func GetLibraryScans() []LibraryScan {
+	var scans []LibraryScan
+	for _, entry := range strings.Split(os.Getenv("LIBRARY_SCANS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, spec, ok := strings.Cut(entry, "=")
+		interval, window, hasWindow := strings.Cut(spec, "@")
+		scan := LibraryScan{Path: filepath.Clean(strings.TrimSpace(path))}
+		var err error
+		if scan.Interval, err = time.ParseDuration(interval); !ok || path == "" || err != nil || scan.Interval <= 0 {
+			log.Printf("Ignoring invalid LIBRARY_SCANS entry %q\n", entry)
+			continue
+		}
+		if hasWindow {
+			start, end, found := strings.Cut(window, "-")
+			startMinute, startErr := clockMinutes(start)
+			endMinute, endErr := clockMinutes(end)
+			if !found || startErr != nil || endErr != nil {
+				log.Printf("Ignoring invalid LIBRARY_SCANS window %q, expected HH:MM-HH:MM\n", window)
+				continue
+			}
+			scan.WindowStart, scan.WindowEnd = startMinute, endMinute
+		}
+		scans = append(scans, scan)
+	}
+	return scans
+}
+
+// clockMinutes converts a HH:MM time of day into minutes after midnight
+func clockMinutes(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// OutputRoot sends the outputs of a library to a writable mirror tree
+type OutputRoot struct {
+	Library string // Library root the sources live under
+	Output  string // Root the relative source paths are recreated under
+}
+
+// GetRemoteOutputDir returns where outputs of sources at HTTP(S) URLs are
+// written (REMOTE_OUTPUT_DIR). Empty refuses to transcode them.
+func GetRemoteOutputDir() string {
+	if dir := strings.TrimSpace(os.Getenv("REMOTE_OUTPUT_DIR")); dir != "" {
+		return filepath.Clean(dir)
+	}
+	return ""
+}
+
+// GetSSHOptions returns extra ssh and scp options for ssh:// files
+// (SSH_OPTIONS), such as "-i /keys/seedbox -o ControlMaster=auto"
+func GetSSHOptions() []string {
+	return strings.Fields(os.Getenv("SSH_OPTIONS"))
+}
+
+// GetRemoteStagingDir returns where ssh:// sources are copied to be
+// transcoded and their outputs encoded before being copied back
+// (REMOTE_STAGING_DIR, default zinocoder-staging in the temp directory)
+func GetRemoteStagingDir() string {
+	if dir := strings.TrimSpace(os.Getenv("REMOTE_STAGING_DIR")); dir != "" {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(os.TempDir(), "zinocoder-staging")
+}
+
+// GetSweepPolicy returns what sweeps do with leftover temp outputs, tiny
+// outputs and two-pass logs (SWEEP_ORPHANS): report (default), delete or off
+func GetSweepPolicy() string {
+	value := strings.ToLower(os.Getenv("SWEEP_ORPHANS"))
+	switch value {
+	case "report", "delete", "off":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid SWEEP_ORPHANS %q, expected report, delete or off\n", value)
+	}
+	return "report"
+}
+
+// GetSweepMinAge returns how long a leftover must go unmodified before a
+// sweep reports it (SWEEP_MIN_AGE, default 24h), so running jobs are spared
+func GetSweepMinAge() time.Duration {
+	value := os.Getenv("SWEEP_MIN_AGE")
+	if value == "" {
+		return 24 * time.Hour
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		log.Printf("Invalid SWEEP_MIN_AGE %q, using 24h\n", value)
+		return 24 * time.Hour
+	}
+	return age
+}
+
+// GetWatchDebounce returns how long the watch command waits for a path to go
+// quiet before syncing it (WATCH_DEBOUNCE, default 5s), so a file still being
+// copied is probed once
+func GetWatchDebounce() time.Duration {
+	value := os.Getenv("WATCH_DEBOUNCE")
+	if value == "" {
+		return 5 * time.Second
+	}
+	debounce, err := time.ParseDuration(value)
+	if err != nil || debounce < 0 {
+		log.Printf("Invalid WATCH_DEBOUNCE %q, using 5s\n", value)
+		return 5 * time.Second
+	}
+	return debounce
+}
+
+// GetPreJobHook returns the shell command run before each job
+// (PRE_JOB_HOOK), e.g. to pause a torrent client. Empty runs nothing.
+func GetPreJobHook() string {
+	return strings.TrimSpace(os.Getenv("PRE_JOB_HOOK"))
+}
+
+// GetPostJobHook returns the shell command run after each job, whether it
+// succeeded or not (POST_JOB_HOOK). Empty runs nothing.
+func GetPostJobHook() string {
+	return strings.TrimSpace(os.Getenv("POST_JOB_HOOK"))
+}
+
+// GetHookTimeout returns how long a job hook may run before it is killed
+// (HOOK_TIMEOUT, default 5m)
+func GetHookTimeout() time.Duration {
+	value := os.Getenv("HOOK_TIMEOUT")
+	if value == "" {
+		return 5 * time.Minute
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Printf("Invalid HOOK_TIMEOUT %q, using 5m\n", value)
+		return 5 * time.Minute
+	}
+	return timeout
+}
+
+// GetSweepTinySize returns the size in bytes below which an output is taken
+// for a failed encode (SWEEP_TINY_MB, default 1)
+func GetSweepTinySize() int64 {
+	value := os.Getenv("SWEEP_TINY_MB")
+	if value == "" {
+		return 1 << 20
+	}
+	mb, err := strconv.ParseFloat(value, 64)
+	if err != nil || mb < 0 {
+		log.Printf("Invalid SWEEP_TINY_MB %q, using 1\n", value)
+		return 1 << 20
+	}
+	return int64(mb * (1 << 20))
+}
+
+// GetOutputRoot returns the root all outputs are written under, mirroring
+// their path inside the library (OUTPUT_ROOT). Empty writes next to the source.
+func GetOutputRoot() string {
+	if root := strings.TrimSpace(os.Getenv("OUTPUT_ROOT")); root != "" {
+		return filepath.Clean(root)
+	}
+	return ""
+}
+
+// GetOutputRoots reads OUTPUT_ROOTS, comma separated library=output pairs
+// such as /mnt/bluray=/mnt/encoded, for libraries on read-only media
+func GetOutputRoots() []OutputRoot {
+	var roots []OutputRoot
+	for _, entry := range strings.Split(os.Getenv("OUTPUT_ROOTS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		library, output, ok := strings.Cut(entry, "=")
+		library, output = strings.TrimSpace(library), strings.TrimSpace(output)
+		if !ok || library == "" || output == "" {
+			log.Printf("Invalid OUTPUT_ROOTS entry %q, expected library=output\n", entry)
+			continue
+		}
+		roots = append(roots, OutputRoot{Library: filepath.Clean(library), Output: filepath.Clean(output)})
+	}
+	return roots
+}
+
+// GetHardwareAccel returns the forced encoder hardware (nvidia, intel, cpu),
+// or "auto" to detect it for every transcode
+func GetHardwareAccel() string {
+	value := strings.ToLower(os.Getenv("HARDWARE_ACCEL"))
+	switch value {
+	case "nvidia", "intel", "cpu":
+		return value
+	default:
+		return "auto"
+	}
+}
+
+// Worker is a remote transcode server the coordinator hands jobs to
+type Worker struct {
+	Name       string
+	Addr       string
+	Concurrent int
+}
+
+// ErrNoWorkers is returned by GetWorkers when TRANSCODE_WORKERS is not set
+var ErrNoWorkers = errors.New("no transcode workers configured, set TRANSCODE_WORKERS")
+
+// GetWorkers returns the transcode servers from TRANSCODE_WORKERS, a comma
+// separated list of name=host:port/concurrency entries
+func GetWorkers() ([]Worker, error) {
+	value := os.Getenv("TRANSCODE_WORKERS")
+	if strings.TrimSpace(value) == "" {
+		return nil, ErrNoWorkers
+	}
+
+	var workers []Worker
+	for _, entry := range strings.Split(value, ",") {
+		name, addr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("invalid TRANSCODE_WORKERS entry %q, expected name=host:port/concurrency", entry)
+		}
+		worker := Worker{Name: name, Addr: addr, Concurrent: 1}
+		if addr, count, ok := strings.Cut(addr, "/"); ok {
+			worker.Addr = addr
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid concurrency in TRANSCODE_WORKERS entry %q", entry)
+			}
+			worker.Concurrent = n
+		}
+		workers = append(workers, worker)
+	}
+	return workers, nil
+}
+
+// DeviceLimit caps the jobs reading sources from one storage device at once
+type DeviceLimit struct {
+	Path       string // Any path on the device, usually its mount point
+	Concurrent int
+}
+
+// GetDeviceLimits returns the per-device job limits from DEVICE_CONCURRENCY, a
+// comma separated list of path=concurrency entries, e.g. /mnt/usb=1
+func GetDeviceLimits() []DeviceLimit {
+	var limits []DeviceLimit
+	for _, entry := range strings.Split(os.Getenv("DEVICE_CONCURRENCY"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		path, count, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		n, err := strconv.Atoi(count)
+		if !ok || path == "" || err != nil || n <= 0 {
+			log.Printf("Ignoring invalid DEVICE_CONCURRENCY entry %q\n", entry)
+			continue
+		}
+		limits = append(limits, DeviceLimit{Path: filepath.Clean(path), Concurrent: n})
+	}
+	return limits
+}
+
+// GetQueueOrder returns the order batches run their files in unless one is
+// given (QUEUE_ORDER): fifo (the default), smallest, shortest, savings or oldest
+func GetQueueOrder() string {
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("QUEUE_ORDER"))); value {
+	case "fifo", "smallest", "shortest", "savings", "oldest":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid QUEUE_ORDER %q, expected fifo, smallest, shortest, savings or oldest; using fifo\n", value)
+	}
+	return "fifo"
+}
+
+// GetShortSlotLimit returns the estimated encode time under which a job may
+// take the slot kept free of longer ones (RESERVE_SHORT_SLOT, e.g. 30m), so a
+// few multi-hour encodes cannot hold every slot; 0, the default, reserves none
+func GetShortSlotLimit() time.Duration {
+	value := os.Getenv("RESERVE_SHORT_SLOT")
+	if value == "" {
+		return 0
+	}
+	limit, err := time.ParseDuration(value)
+	if err != nil || limit < 0 {
+		log.Printf("Invalid RESERVE_SHORT_SLOT %q, reserving no slot\n", value)
+		return 0
+	}
+	return limit
+}
+
+// GetFFmpegNice returns the default nice level for ffmpeg (FFMPEG_NICE), 0 to leave it unchanged
+func GetFFmpegNice() int {
+	nice, _ := strconv.Atoi(os.Getenv("FFMPEG_NICE"))
+	return nice
+}
+
+// GetFFmpegIONice returns the default ionice setting for ffmpeg (FFMPEG_IONICE), e.g. idle
+func GetFFmpegIONice() string {
+	return os.Getenv("FFMPEG_IONICE")
+}
+
+// GetFFmpegSlice returns the default systemd slice for ffmpeg (FFMPEG_SLICE)
+func GetFFmpegSlice() string {
+	return os.Getenv("FFMPEG_SLICE")
+}
+
+// PowerSettings control when a worker stops picking up new jobs
+type PowerSettings struct {
+	PauseOnBattery bool
+	MaxCPUTemp     float64 // Degrees Celsius, 0 disables the check
+	MaxGPUTemp     float64 // Degrees Celsius, 0 disables the check
+	CheckInterval  time.Duration
+}
+
+// GetPowerSettings reads PAUSE_ON_BATTERY, MAX_CPU_TEMP, MAX_GPU_TEMP and
+// POWER_CHECK_INTERVAL. ok is false when no power checks are enabled.
+func GetPowerSettings() (PowerSettings, bool) {
+	settings := PowerSettings{CheckInterval: time.Minute}
+	settings.PauseOnBattery, _ = strconv.ParseBool(os.Getenv("PAUSE_ON_BATTERY"))
+	settings.MaxCPUTemp, _ = strconv.ParseFloat(os.Getenv("MAX_CPU_TEMP"), 64)
+	settings.MaxGPUTemp, _ = strconv.ParseFloat(os.Getenv("MAX_GPU_TEMP"), 64)
+	if value := os.Getenv("POWER_CHECK_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			log.Printf("Invalid POWER_CHECK_INTERVAL %q, using 1m\n", value)
+		} else {
+			settings.CheckInterval = interval
+		}
+	}
+	ok := settings.PauseOnBattery || settings.MaxCPUTemp > 0 || settings.MaxGPUTemp > 0
+	return settings, ok
+}
+
+// EnergySettings estimate the power drawn by encodes and what it costs
+type EnergySettings struct {
+	CPUWatts float64 // Draw while a software encode runs
+	GPUWatts float64 // Draw while a hardware encode runs
+	Price    float64 // Per kWh, 0 reports energy only
+	Currency string  // Shown after costs, e.g. EUR
+}
+
+// GetEnergySettings reads ENCODE_WATTS_CPU, ENCODE_WATTS_GPU, ELECTRICITY_PRICE
+// and ELECTRICITY_CURRENCY. ok is false when no wattage is set.
+func GetEnergySettings() (EnergySettings, bool) {
+	settings := EnergySettings{Currency: os.Getenv("ELECTRICITY_CURRENCY")}
+	settings.CPUWatts, _ = strconv.ParseFloat(os.Getenv("ENCODE_WATTS_CPU"), 64)
+	settings.GPUWatts, _ = strconv.ParseFloat(os.Getenv("ENCODE_WATTS_GPU"), 64)
+	settings.Price, _ = strconv.ParseFloat(os.Getenv("ELECTRICITY_PRICE"), 64)
+	return settings, settings.CPUWatts > 0 || settings.GPUWatts > 0
+}
+
+// MediaServerSettings describe the Plex or Jellyfin server whose viewers take
+// priority over transcoding
+type MediaServerSettings struct {
+	Kind       string // plex or jellyfin
+	URL        string
+	Token      string
+	MaxStreams int // Throttle once more than this many streams are playing
+	Concurrent int // Jobs allowed to run while throttled, 0 pauses them
+}
+
+// GetMediaServerSettings reads MEDIA_SERVER, MEDIA_SERVER_URL, MEDIA_SERVER_TOKEN,
+// MAX_MEDIA_STREAMS and THROTTLED_CONCURRENT. ok is false when no server is set.
+func GetMediaServerSettings() (MediaServerSettings, bool) {
+	settings := MediaServerSettings{
+		Kind:  strings.ToLower(os.Getenv("MEDIA_SERVER")),
+		URL:   strings.TrimRight(os.Getenv("MEDIA_SERVER_URL"), "/"),
+		Token: secret("MEDIA_SERVER_TOKEN"),
+	}
+	settings.MaxStreams, _ = strconv.Atoi(os.Getenv("MAX_MEDIA_STREAMS"))
+	settings.Concurrent, _ = strconv.Atoi(os.Getenv("THROTTLED_CONCURRENT"))
+	if settings.Kind != "plex" && settings.Kind != "jellyfin" {
+		if settings.Kind != "" {
+			log.Printf("Invalid MEDIA_SERVER %q, expected plex or jellyfin\n", settings.Kind)
+		}
+		return settings, false
+	}
+	if settings.URL == "" {
+		log.Println("MEDIA_SERVER_URL is not set in the environment")
+		return settings, false
+	}
+	return settings, true
+}
+
+// IdleSettings describe how quiet the machine must be before idle-only mode starts a job
+type IdleSettings struct {
+	MaxLoad     float64 // 1 minute load average
+	MaxDiskUtil float64 // Busiest disk, percent
+	MaxGPUUtil  float64 // Busiest NVIDIA GPU, percent
+	Duration    time.Duration
+}
+
+// GetIdleSettings reads IDLE_ONLY, IDLE_MAX_LOAD (default 1.0), IDLE_MAX_DISK_UTIL
+// and IDLE_MAX_GPU_UTIL (default 20%) and IDLE_DURATION (default 5m). ok is
+// false unless IDLE_ONLY is enabled.
+func GetIdleSettings() (IdleSettings, bool) {
+	settings := IdleSettings{MaxLoad: 1.0, MaxDiskUtil: 20, MaxGPUUtil: 20, Duration: 5 * time.Minute}
+	enabled, _ := strconv.ParseBool(os.Getenv("IDLE_ONLY"))
+	if !enabled {
+		return settings, false
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("IDLE_MAX_LOAD"), 64); err == nil && value > 0 {
+		settings.MaxLoad = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("IDLE_MAX_DISK_UTIL"), 64); err == nil && value > 0 {
+		settings.MaxDiskUtil = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("IDLE_MAX_GPU_UTIL"), 64); err == nil && value > 0 {
+		settings.MaxGPUUtil = value
+	}
+	if value := os.Getenv("IDLE_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			log.Printf("Invalid IDLE_DURATION %q, using 5m\n", value)
+		} else {
+			settings.Duration = duration
+		}
+	}
+	return settings, true
+}
+
+// GetMaintenanceSchedule returns the cron expression for a maintenance task,
+// read from SCHEDULE_<TASK> (e.g. SCHEDULE_SCAN="0 3 * * *"). Empty disables the task.
+func GetMaintenanceSchedule(task string) string {
+	key := "SCHEDULE_" + strings.ToUpper(strings.ReplaceAll(task, "-", "_"))
+	return strings.TrimSpace(os.Getenv(key))
+}
+
+// GetBackupDir returns where database snapshots are written (BACKUP_DIR),
+// defaulting to a backups directory next to the database
+func GetBackupDir(dbPath string) string {
+	if dir := os.Getenv("BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(dbPath), "backups")
+}
+
+// GetBackupKeep returns how many snapshots to keep (BACKUP_KEEP, default 7)
+func GetBackupKeep() int {
+	keep, err := strconv.Atoi(os.Getenv("BACKUP_KEEP"))
+	if err != nil || keep <= 0 {
+		return 7
+	}
+	return keep
+}
+
+// GetJobEventStep returns every how many percent a job's progress is recorded
+// as an event (JOB_EVENT_STEP, default 10)
+func GetJobEventStep() int {
+	step, err := strconv.Atoi(os.Getenv("JOB_EVENT_STEP"))
+	if err != nil || step <= 0 || step > 100 {
+		return 10
+	}
+	return step
+}
+
+// GetNotifyLevel returns the verbosity for a notification backend (telegram or
+// email) from NOTIFY_<BACKEND>_LEVEL: off, errors, summary or verbose.
+// Telegram defaults to verbose and email to off.
+func GetNotifyLevel(backend string) string {
+	value := strings.ToLower(os.Getenv("NOTIFY_" + strings.ToUpper(backend) + "_LEVEL"))
+	switch value {
+	case "off", "errors", "summary", "verbose":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid NOTIFY_%s_LEVEL %q\n", strings.ToUpper(backend), value)
+	}
+	if backend == "telegram" {
+		return "verbose"
+	}
+	return "off"
+}
+
+// GetMinExpectedSavings returns the expected savings, as a percentage of the
+// original size, below which a queued job is flagged (MIN_EXPECTED_SAVINGS, default 10)
+func GetMinExpectedSavings() float64 {
+	value, err := strconv.ParseFloat(os.Getenv("MIN_EXPECTED_SAVINGS"), 64)
+	if err != nil || value < 0 {
+		return 10
+	}
+	return value
+}
+
+// GetRetranscodeMinSavings returns the expected savings, as a percentage of
+// an output's size, an improved profile must reach before the output is worth
+// encoding again (RETRANSCODE_MIN_SAVINGS, default 20)
+func GetRetranscodeMinSavings() float64 {
+	value, err := strconv.ParseFloat(os.Getenv("RETRANSCODE_MIN_SAVINGS"), 64)
+	if err != nil || value < 0 {
+		return 20
+	}
+	return value
+}
+
+// GetSkipLowSavings reports whether flagged jobs are skipped rather than just
+// warned about (SKIP_LOW_SAVINGS)
+func GetSkipLowSavings() bool {
+	skip, _ := strconv.ParseBool(os.Getenv("SKIP_LOW_SAVINGS"))
+	return skip
+}
+
+// GetCoverArt returns what happens to embedded cover art (COVER_ART): "keep"
+// (the default) copies it to the output untouched, "drop" leaves it out
+func GetCoverArt() string {
+	return keepOrDrop("COVER_ART")
+}
+
+// GetAttachments returns what happens to Matroska attachments such as subtitle
+// fonts (ATTACHMENTS): "keep" (the default) or "drop"
+func GetAttachments() string {
+	return keepOrDrop("ATTACHMENTS")
+}
+
+// GetOutputCollision returns what happens when a job's output name already
+// exists (OUTPUT_COLLISION): "overwrite" (the default) replaces it once the new
+// output is verified, "version" writes name_v2 and so on, "skip" fails the job
+func GetOutputCollision() string {
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("OUTPUT_COLLISION"))); value {
+	case "overwrite", "version", "skip":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid OUTPUT_COLLISION %q, expected overwrite, version or skip; using overwrite\n", value)
+	}
+	return "overwrite"
+}
+
+// GetVideoStreams returns which video streams of a multi-stream source are
+// transcoded (VIDEO_STREAMS): "first" (the default), "largest" by resolution, or "all"
+func GetVideoStreams() string {
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("VIDEO_STREAMS"))); value {
+	case "first", "largest", "all":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid VIDEO_STREAMS %q, expected first, largest or all; using first\n", value)
+	}
+	return "first"
+}
+
+// GetDynamicHDR returns what happens to Dolby Vision and HDR10+ sources
+// (DYNAMIC_HDR): "strip" (the default) encodes them without the dynamic
+// metadata, "passthrough" keeps it where the encoder can, "skip" leaves them alone
+func GetDynamicHDR() string {
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("DYNAMIC_HDR"))); value {
+	case "skip", "strip", "passthrough":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid DYNAMIC_HDR %q, expected skip, strip or passthrough; stripping\n", value)
+	}
+	return "strip"
+}
+
+// GetTonemap returns how HDR sources are tone-mapped to SDR (TONEMAP):
+// "zscale" (the default) with ffmpeg's tonemap filter, "libplacebo" on the
+// GPU through Vulkan, or "off" to scale them untouched
+func GetTonemap() string {
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("TONEMAP"))); value {
+	case "zscale", "libplacebo", "off":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid TONEMAP %q, expected zscale, libplacebo or off; using zscale\n", value)
+	}
+	return "zscale"
+}
+
+// tonemapAlgorithms are the curves each TONEMAP chain knows: the tonemap
+// filter's for zscale and the tonemapping option's for libplacebo
+var tonemapAlgorithms = map[string][]string{
+	"zscale":     {"none", "linear", "gamma", "clip", "reinhard", "hable", "mobius"},
+	"libplacebo": {"auto", "clip", "st2094-40", "st2094-10", "bt2390", "bt2446a", "spline", "reinhard", "mobius", "hable", "gamma", "linear"},
+}
+
+// KnownTonemapAlgorithm reports whether the TONEMAP chain method knows the
+// curve algorithm. Any curve does for off, which tone-maps nothing.
+func KnownTonemapAlgorithm(method, algorithm string) bool {
+	return method == "off" || slices.Contains(tonemapAlgorithms[method], algorithm)
+}
+
+// TonemapAlgorithms returns the curves the TONEMAP chain method knows
+func TonemapAlgorithms(method string) []string {
+	return tonemapAlgorithms[method]
+}
+
+// GetTonemapAlgorithm returns the tone curve used by TONEMAP
+// (TONEMAP_ALGORITHM, default hable), e.g. hable, mobius, reinhard or, with
+// libplacebo, bt2390. Curves the chain does not know fall back to hable.
+func GetTonemapAlgorithm() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("TONEMAP_ALGORITHM")))
+	if value == "" {
+		return "hable"
+	}
+	if method := GetTonemap(); !KnownTonemapAlgorithm(method, value) {
+		log.Printf("Invalid TONEMAP_ALGORITHM %q for %s, expected one of %s; using hable\n", value, method, strings.Join(TonemapAlgorithms(method), ", "))
+		return "hable"
+	}
+	return value
+}
+
+// GetDeletionSync returns what watch mode does with the record of a file
+// deleted outside the program (DELETION_SYNC): "remove" (the default) deletes
+// it, "soft" keeps a summary in deleted_files, "off" leaves it for clean
+func GetDeletionSync() string {
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("DELETION_SYNC"))); value {
+	case "remove", "soft", "off":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid DELETION_SYNC %q, expected remove, soft or off; removing\n", value)
+	}
+	return "remove"
+}
+
+// GetReadOnly reports whether destructive operations are disabled
+// (READ_ONLY, also set by the --read-only flag)
+func GetReadOnly() bool {
+	readOnly, _ := strconv.ParseBool(os.Getenv("READ_ONLY"))
+	return readOnly
+}
+
+// GetSourceStableFor returns how long a source's size and modification time
+// must stay unchanged before it is transcoded (SOURCE_STABLE_FOR, default 5s,
+// 0 to skip the check)
+func GetSourceStableFor() time.Duration {
+	value := os.Getenv("SOURCE_STABLE_FOR")
+	if value == "" {
+		return 5 * time.Second
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < 0 {
+		log.Printf("Invalid SOURCE_STABLE_FOR %q, using 5s\n", value)
+		return 5 * time.Second
+	}
+	return window
+}
+
+// GetSourceStableTimeout returns how long to wait for a source that is still
+// being written before giving up on it (SOURCE_STABLE_TIMEOUT, default 30m)
+func GetSourceStableTimeout() time.Duration {
+	value := os.Getenv("SOURCE_STABLE_TIMEOUT")
+	if value == "" {
+		return 30 * time.Minute
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Printf("Invalid SOURCE_STABLE_TIMEOUT %q, using 30m\n", value)
+		return 30 * time.Minute
+	}
+	return timeout
+}
+
+// keepOrDrop reads a keep/drop setting, defaulting to keep
+func keepOrDrop(name string) string {
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv(name))); value {
+	case "keep", "drop":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid %s %q, expected keep or drop; keeping\n", name, value)
+	}
+	return "keep"
+}
+
+// GetSkipBelowBPP returns the bits per pixel per frame below which a file is
+// considered already efficiently encoded and never transcoded (SKIP_BELOW_BPP,
+// 0 to transcode everything)
+func GetSkipBelowBPP() float64 {
+	value, err := strconv.ParseFloat(os.Getenv("SKIP_BELOW_BPP"), 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+	return value
+}
+
+// GetAllowUnindexedPaths reports whether POST /transcode accepts library files
+// that are not in the database (ALLOW_UNINDEXED_PATHS)
+func GetAllowUnindexedPaths() bool {
+	allow, _ := strconv.ParseBool(os.Getenv("ALLOW_UNINDEXED_PATHS"))
+	return allow
+}
+
+// GetMinActualSavings returns the savings, as a percentage of the original
+// size, an output must reach to replace the original (MIN_ACTUAL_SAVINGS).
+// 0 only discards outputs larger than the original; ok is false when unset.
+func GetMinActualSavings() (float64, bool) {
+	value := os.Getenv("MIN_ACTUAL_SAVINGS")
+	if value == "" {
+		return 0, false
+	}
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil || percent < 0 {
+		log.Printf("Invalid MIN_ACTUAL_SAVINGS %q, keeping every output\n", value)
+		return 0, false
+	}
+	return percent, true
+}
+
+// AutoBitrateSettings shape the per-file bitrate of profiles using "auto"
+type AutoBitrateSettings struct {
+	Percent float64 // Share of the source video bitrate to target
+	MinBPP  float64 // Lowest bits per output pixel per frame
+	MaxBPP  float64 // Highest bits per output pixel per frame
+}
+
+// GetAutoBitrateSettings reads AUTO_BITRATE_PERCENT (default 50),
+// AUTO_BITRATE_MIN_BPP (default 0.04) and AUTO_BITRATE_MAX_BPP (default 0.1)
+func GetAutoBitrateSettings() AutoBitrateSettings {
+	settings := AutoBitrateSettings{Percent: 50, MinBPP: 0.04, MaxBPP: 0.1}
+	if value, err := strconv.ParseFloat(os.Getenv("AUTO_BITRATE_PERCENT"), 64); err == nil && value > 0 && value <= 100 {
+		settings.Percent = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("AUTO_BITRATE_MIN_BPP"), 64); err == nil && value > 0 {
+		settings.MinBPP = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("AUTO_BITRATE_MAX_BPP"), 64); err == nil && value > settings.MinBPP {
+		settings.MaxBPP = value
+	}
+	return settings
+}
+
+// GetLinkReplace returns how other hard links of a deleted original are
+// handled (LINK_REPLACE): hardlink or reflink replaces them with the output,
+// empty leaves them in place
+func GetLinkReplace() string {
+	value := strings.ToLower(os.Getenv("LINK_REPLACE"))
+	switch value {
+	case "", "hardlink", "reflink":
+		return value
+	}
+	log.Printf("Invalid LINK_REPLACE %q, expected hardlink or reflink\n", value)
+	return ""
+}
+
+// GetScanConflicts returns what scans do with a file whose length or
+// resolution no longer matches its entry (SCAN_CONFLICTS): update (default),
+// keep the old entry as a version, flag it for review, or prompt
+func GetScanConflicts() string {
+	value := strings.ToLower(os.Getenv("SCAN_CONFLICTS"))
+	switch value {
+	case "update", "keep", "flag", "prompt":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid SCAN_CONFLICTS %q, expected update, keep, flag or prompt\n", value)
+	}
+	return "update"
+}
+
+// GetFileHistory reports whether scans keep the entry of a changed file as
+// a superseded version (FILE_HISTORY, default true)
+func GetFileHistory() bool {
+	keep, err := strconv.ParseBool(os.Getenv("FILE_HISTORY"))
+	return keep || err != nil
+}
+
+// GetProbeCache reports whether ffprobe output is reused for files whose size
+// and modification time have not changed (PROBE_CACHE, default true)
+func GetProbeCache() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("PROBE_CACHE"))
+	return enabled || err != nil
+}
+
+// GetScanIncremental reports whether scans skip probing files whose size and
+// modification time match their entries (SCAN_INCREMENTAL, also set by scan
+// --incremental), by default false
+func GetScanIncremental() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("SCAN_INCREMENTAL"))
+	return enabled
+}
+
+// GetScanWorkers returns how many files a scan probes at once (SCAN_WORKERS,
+// also set by scan --workers), by default one per CPU
+func GetScanWorkers() int {
+	value := os.Getenv("SCAN_WORKERS")
+	if value == "" {
+		return runtime.NumCPU()
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid SCAN_WORKERS %q, using %d\n", value, runtime.NumCPU())
+		return runtime.NumCPU()
+	}
+	return n
+}
+
+// GetSymlinkPolicy returns how scans treat symbolic links (SCAN_SYMLINKS):
+// skip (default), follow or record
+func GetSymlinkPolicy() string {
+	value := strings.ToLower(os.Getenv("SCAN_SYMLINKS"))
+	switch value {
+	case "skip", "follow", "record":
+		return value
+	case "":
+	default:
+		log.Printf("Invalid SCAN_SYMLINKS %q, expected skip, follow or record\n", value)
+	}
+	return "skip"
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReloadUndoesRemovedKeys(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("ZC_TEST_SYSTEM", "system")
+	t.Setenv("ZC_TEST_ADDED", "")
+	os.Unsetenv("ZC_TEST_ADDED")
+
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(EnvFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ZC_TEST_SYSTEM=file\nZC_TEST_ADDED=file\n")
+	if got := os.Getenv("ZC_TEST_SYSTEM"); got != "file" {
+		t.Errorf("ZC_TEST_SYSTEM = %q after reload, want the file's value", got)
+	}
+
+	write("OTHER=1\n")
+	if got := os.Getenv("ZC_TEST_SYSTEM"); got != "system" {
+		t.Errorf("ZC_TEST_SYSTEM = %q once removed from the file, want the value from before", got)
+	}
+	if got, ok := os.LookupEnv("ZC_TEST_ADDED"); ok {
+		t.Errorf("ZC_TEST_ADDED = %q once removed from the file, want it unset", got)
+	}
+}
+
+func TestGetWorkers(t *testing.T) {
+	t.Setenv("TRANSCODE_WORKERS", "")
+	if _, err := GetWorkers(); !errors.Is(err, ErrNoWorkers) {
+		t.Errorf("GetWorkers without TRANSCODE_WORKERS returned %v, want ErrNoWorkers", err)
+	}
+
+	t.Setenv("TRANSCODE_WORKERS", "a=host-a:8080/2, b=host-b:8080")
+	workers, err := GetWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Worker{{Name: "a", Addr: "host-a:8080", Concurrent: 2}, {Name: "b", Addr: "host-b:8080", Concurrent: 1}}
+	if len(workers) != len(want) || workers[0] != want[0] || workers[1] != want[1] {
+		t.Errorf("GetWorkers() = %+v, want %+v", workers, want)
+	}
+
+	for _, invalid := range []string{"host-a:8080", "a=", "a=host-a:8080/0", "a=host-a:8080/two"} {
+		t.Setenv("TRANSCODE_WORKERS", invalid)
+		if workers, err := GetWorkers(); err == nil {
+			t.Errorf("GetWorkers with TRANSCODE_WORKERS=%q = %+v, want an error", invalid, workers)
+		}
+	}
+}
+
+func TestGetTonemapAlgorithm(t *testing.T) {
+	for _, test := range []struct {
+		tonemap, algorithm, want string
+	}{
+		{"", "", "hable"},
+		{"zscale", "Mobius", "mobius"},
+		{"zscale", "bt2390", "hable"},
+		{"libplacebo", "bt2390", "bt2390"},
+		{"libplacebo", "hable;drop", "hable"},
+	} {
+		t.Setenv("TONEMAP", test.tonemap)
+		t.Setenv("TONEMAP_ALGORITHM", test.algorithm)
+		if got := GetTonemapAlgorithm(); got != test.want {
+			t.Errorf("TONEMAP=%q TONEMAP_ALGORITHM=%q: got %q, want %q", test.tonemap, test.algorithm, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	encryptedPrefix = "enc:"
+	keyringValue    = "keyring:"
+	keyringService  = "zinocoder"
+)
+
+// secret returns GetSecret(name), logging errors and treating them as an unset secret
+func secret(name string) string {
+	value, err := GetSecret(name)
+	if err != nil {
+		log.Printf("Error reading secret %s: %s\n", name, err)
+		return ""
+	}
+	return value
+}
+
+// GetSecret returns a sensitive setting such as a token or password. The
+// variable may hold the value itself, an "enc:" value made by
+// `secret encrypt`, or "keyring:" to read it from the OS keyring. When it is
+// unset, NAME_FILE or the Docker secret /run/secrets/name supply the value.
+func GetSecret(name string) (string, error) {
+	value := os.Getenv(name)
+	switch {
+	case strings.HasPrefix(value, encryptedPrefix):
+		return decryptSecret(strings.TrimPrefix(value, encryptedPrefix))
+	case value == keyringValue:
+		return keyringLookup(name)
+	case value != "":
+		return value, nil
+	}
+
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		path = filepath.Join("/run/secrets", strings.ToLower(name))
+		if _, err := os.Stat(path); err != nil {
+			return "", nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// GetSecretsKeyFile returns where the key for "enc:" values is kept,
+// set with SECRETS_KEY_FILE (default secret.key in the user config directory)
+func GetSecretsKeyFile() string {
+	if path := os.Getenv("SECRETS_KEY_FILE"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "secret.key"
+	}
+	return filepath.Join(dir, "zinocoder", "secret.key")
+}
+
+// EncryptSecret encrypts a value for the config file, creating the key on first use
+func EncryptSecret(value string) (string, error) {
+	key, err := secretsKey(true)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	key, err := secretsKey(false)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value: too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt with %s: %w", GetSecretsKeyFile(), err)
+	}
+	return string(plain), nil
+}
+
+// secretsKey reads the hex-encoded AES-256 key, generating it when create is set
+func secretsKey(create bool) ([]byte, error) {
+	path := GetSecretsKeyFile()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("error generating key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("error creating key directory: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("error writing key: %w", err)
+		}
+		log.Printf("Created secrets key %s\n", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading secrets key: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secrets key %s must be 64 hex characters", path)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyringLookup reads a secret stored under the zinocoder service, using
+// secret-tool (libsecret) on Linux and the login keychain on macOS
+func keyringLookup(name string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", name, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "key", name)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keyring lookup with %s failed: %w", cmd.Args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
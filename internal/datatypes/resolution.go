@@ -0,0 +1,69 @@
+package datatypes
+
+import "strings"
+
+// ResolutionBound is a resolution class and the frame sizes that reach it,
+// measured on the long and short sides so portrait video classes like its
+// landscape equivalent. A frame reaches the class when its long side is at
+// least MinLong and its short side at least MinShort, so scope films cropped
+// to 1920x800 and 1920x1088 encodes count as 1080p, or when its short side
+// alone reaches MinLines, so 4:3 and anamorphic 1440x1080 sources do too,
+// while 1280x1024 stays 720p.
+type ResolutionBound struct {
+	Class    string
+	MinLong  int
+	MinShort int // Short side of the widest crop still in the class
+	MinLines int
+}
+
+// ResolutionBounds are the resolution classes from largest to smallest
+var ResolutionBounds = []ResolutionBound{
+	{"8k", 6400, 2600, 4000},
+	{"4k", 3200, 1300, 2000},
+	{"1440p", 2200, 800, 1400},
+	{"1080p", 1600, 600, 1040},
+	{"720p", 1100, 400, 700},
+	{"480p", 1, 1, 1},
+}
+
+// reaches reports whether a frame with the given long and short sides is in
+// the class or a larger one
+func (b ResolutionBound) reaches(long, short int) bool {
+	return (long >= b.MinLong && short >= b.MinShort) || short >= b.MinLines
+}
+
+// ResolutionClass names the class of a width and height, or returns "" when
+// the resolution is unknown
+func ResolutionClass(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return ""
+	}
+	long, short := max(width, height), min(width, height)
+	for _, bound := range ResolutionBounds {
+		if bound.reaches(long, short) {
+			return bound.Class
+		}
+	}
+	return ""
+}
+
+// IsResolutionClass reports whether name is one of the resolution classes,
+// in any case
+func IsResolutionClass(name string) bool {
+	for _, bound := range ResolutionBounds {
+		if strings.EqualFold(name, bound.Class) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolutionClassNames lists the classes from smallest to largest, e.g. for
+// usage messages
+func ResolutionClassNames() []string {
+	names := make([]string, len(ResolutionBounds))
+	for i, bound := range ResolutionBounds {
+		names[len(names)-1-i] = bound.Class
+	}
+	return names
+}
@@ -0,0 +1,35 @@
+package datatypes
+
+import "testing"
+
+func TestResolutionClass(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          string
+	}{
+		{7680, 4320, "8k"},
+		{3840, 2160, "4k"},
+		{4096, 2160, "4k"},
+		{3840, 1600, "4k"},
+		{2160, 3840, "4k"},
+		{2560, 1440, "1440p"},
+		{1920, 1080, "1080p"},
+		{1920, 1088, "1080p"},
+		{1920, 800, "1080p"},
+		{1440, 1080, "1080p"},
+		{1080, 1920, "1080p"},
+		{1280, 1024, "720p"},
+		{1280, 720, "720p"},
+		{960, 720, "720p"},
+		{720, 1280, "720p"},
+		{720, 576, "480p"},
+		{640, 480, "480p"},
+		{0, 1080, ""},
+		{1920, 0, ""},
+	}
+	for _, tt := range tests {
+		if got := ResolutionClass(tt.width, tt.height); got != tt.want {
+			t.Errorf("ResolutionClass(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package datatypes
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type VideoObject struct {
 	Name          string  `json:"name"`
@@ -14,6 +17,63 @@ type VideoObject struct {
 	Frames        int     `json:"frames"`    // Total number of frames
 	Bitrate       int     `json:"bitrate"`   // Bitrate of the video in bits per second
 	FileExtension string  `json:"file_extension"`
+	DiskSize      int     `json:"disk_size"` // Allocated bytes (st_blocks), below Size on compressed filesystems
+	Device        int64   `json:"device,omitempty"`
+	Inode         int64   `json:"inode,omitempty"`       // Files sharing Device and Inode are hard links of each other
+	Links         int     `json:"links,omitempty"`       // Number of hard links to the data
+	LinkTarget    string  `json:"link_target,omitempty"` // Set for symbolic links recorded without probing
+	SourcePath    string  `json:"source_path,omitempty"` // Original this file was transcoded from
+	BPP           float64 `json:"bpp,omitempty"`         // Bits per pixel per frame, as recorded at scan time
+	VideoCodec    string  `json:"video_codec,omitempty"` // ffprobe codec name of the first video stream, e.g. h264 or hevc
+	// One of the ResolutionBounds classes, e.g. 1080p, derived from Width and Height
+	ResolutionClass string `json:"resolution_class,omitempty"`
+	ModTime         int64  `json:"mtime,omitempty"` // Modification time in Unix nanoseconds, 0 when unknown
+	// SHA-256 of the first MiB, so the file is recognised after a move;
+	// empty for remote files and records made before it was kept
+	SampleHash string `json:"sample_hash,omitempty"`
+	// Every stream other than cover art, set by scans; the fields above
+	// describe the first video stream
+	Streams []Stream `json:"streams,omitempty"`
+}
+
+// VideoStreams returns the video streams among Streams, e.g. the angles of a concert remux
+func (v VideoObject) VideoStreams() []Stream {
+	var videos []Stream
+	for _, stream := range v.Streams {
+		if stream.Type == "video" {
+			videos = append(videos, stream)
+		}
+	}
+	return videos
+}
+
+// Stream is one video, audio, subtitle or data stream of a file
+type Stream struct {
+	Index      int     `json:"index"` // ffprobe stream index within the file
+	Type       string  `json:"type"`  // video, audio, subtitle, data or attachment
+	Codec      string  `json:"codec"`
+	Profile    string  `json:"profile,omitempty"`     // Codec profile, e.g. DTS-HD MA
+	Language   string  `json:"language,omitempty"`    // ISO 639-2, e.g. eng
+	Channels   int     `json:"channels,omitempty"`    // Audio only
+	SampleRate int     `json:"sample_rate,omitempty"` // Audio only, in Hz
+	Width      int     `json:"width,omitempty"`       // Video only
+	Height     int     `json:"height,omitempty"`
+	Framerate  float64 `json:"framerate,omitempty"`
+	Bitrate    int     `json:"bitrate,omitempty"` // Bits per second, 0 when the container does not report it
+	// Dispositions, as set on subtitle tracks
+	Default         bool `json:"default,omitempty"`
+	Forced          bool `json:"forced,omitempty"`
+	HearingImpaired bool `json:"hearing_impaired,omitempty"`
+}
+
+// BitsPerPixel is how many bits the video spends per pixel per frame, a
+// codec-independent measure of how efficiently it is encoded. It is 0 when
+// the resolution, framerate or bitrate is unknown.
+func (v VideoObject) BitsPerPixel() float64 {
+	if v.Width <= 0 || v.Height <= 0 || v.Framerate <= 0 || v.Bitrate <= 0 {
+		return 0
+	}
+	return float64(v.Bitrate) / (float64(v.Width*v.Height) * v.Framerate)
 }
 
 type TranscodedVideo struct {
@@ -28,6 +88,102 @@ type TranscodedVideo struct {
 	OldBitrate        int    `json:"old_bitrate"`
 	NewBitrate        int    `json:"new_bitrate"`
 	TimeTaken         int    `json:"time_taken"`
+	BatchID           int    `json:"batch_id,omitempty"`
+	FFmpegArgs        string `json:"ffmpeg_args,omitempty"`     // Full effective command line
+	Encoder           string `json:"encoder,omitempty"`         // e.g. libx264, h264_nvenc
+	EncoderVersion    string `json:"encoder_version,omitempty"` // First line of ffmpeg -version
+	Profile           string `json:"profile,omitempty"`
+	Discarded         bool   `json:"discarded,omitempty"` // Output saved too little and the original was kept
+	User              string `json:"user,omitempty"`      // Who submitted the job
+	// Measured from the output: its average bitrate in kbps and the encode speed
+	AchievedBitrate int     `json:"achieved_bitrate,omitempty"`
+	EncodeFPS       float64 `json:"encode_fps,omitempty"`
+	// Tags of the job; the original's tags are added when it is recorded
+	Tags []string `json:"tags,omitempty"`
+}
+
+// LineageLink is one transcode in a file's lineage. Paths are the files'
+// current paths while they are still recorded, otherwise the recorded ones.
+type LineageLink struct {
+	TranscodeID    int       `json:"transcode_id"`
+	OriginalID     int       `json:"original_id,omitempty"`
+	Original       string    `json:"original"`
+	OriginalExists bool      `json:"original_exists"` // Still in the files table
+	OutputID       int       `json:"output_id,omitempty"`
+	Output         string    `json:"output"`
+	OutputExists   bool      `json:"output_exists"`
+	Profile        string    `json:"profile,omitempty"`
+	Discarded      bool      `json:"discarded,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Batch is a single queue submission together with its aggregated results
+type Batch struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Profile    string     `json:"profile"`
+	User       string     `json:"user,omitempty"`
+	FileCount  int        `json:"file_count"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Completed  int        `json:"completed"`            // Number of transcodes recorded for the batch
+	SpaceSaved int64      `json:"space_saved"`          // Bytes saved across the batch
+	Duration   int        `json:"duration"`             // Wall-clock seconds, 0 while still running
+	EnergyKWh  float64    `json:"energy_kwh,omitempty"` // Estimated from encode time and ENCODE_WATTS_*
+	Cost       float64    `json:"cost,omitempty"`       // EnergyKWh at ELECTRICITY_PRICE
+}
+
+// Failure is a transcode attempt that did not complete and may need attention
+type Failure struct {
+	ID        int       `json:"id"`
+	FilePath  string    `json:"file_path"`
+	Error     string    `json:"error"`
+	BatchID   int       `json:"batch_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PeriodSavings is the transcode activity aggregated over one period (day, week, month or year)
+type PeriodSavings struct {
+	Period     string `json:"period"`
+	Transcodes int    `json:"transcodes"`
+	SpaceSaved int64  `json:"space_saved"`
+}
+
+// UserSavings aggregates transcode results for one submitting user
+type UserSavings struct {
+	User       string `json:"user"`
+	Transcodes int    `json:"transcodes"`
+	SpaceSaved int64  `json:"space_saved"`
+}
+
+// TagSavings aggregates the kept transcodes carrying one tag
+type TagSavings struct {
+	Tag        string `json:"tag"`
+	Transcodes int    `json:"transcodes"`
+	SpaceSaved int64  `json:"space_saved"`
+}
+
+// TagCount is a tag in use and how many files carry it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Files int    `json:"files"`
+}
+
+// EncoderSavings aggregates transcode results for one profile and encoder setting
+type EncoderSavings struct {
+	Profile        string  `json:"profile"`
+	Encoder        string  `json:"encoder"`
+	Resolution     string  `json:"resolution"`
+	Bitrate        int     `json:"bitrate"`
+	Transcodes     int     `json:"transcodes"`
+	SpaceSaved     int64   `json:"space_saved"`
+	AvgSavingsPct  float64 `json:"avg_savings_pct"`
+	AvgTimeSeconds float64 `json:"avg_time_seconds"`
+	// Averages over the transcodes that recorded them: the bitrate reached in
+	// kbps, as a percentage of the target, and the encode speed
+	AvgAchievedBitrate float64 `json:"avg_achieved_bitrate,omitempty"`
+	AvgBitrateOfTarget float64 `json:"avg_bitrate_of_target_pct,omitempty"`
+	AvgEncodeFPS       float64 `json:"avg_encode_fps,omitempty"`
 }
 
 type VideoObjects struct {
@@ -45,3 +201,209 @@ type Video struct {
 	ViewCount int       `json:"view_count"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// TranscodeRequest is the payload accepted by a transcode server's /transcode endpoint
+type TranscodeRequest struct {
+	Video       VideoObject `json:"video"`
+	Resolution  string      `json:"resolution"`
+	Bitrate     int         `json:"bitrate"`
+	AutoDelete  bool        `json:"autoDelete"`
+	CallbackURL string      `json:"callbackURL"` // The URL to notify on completion
+	Profile     string      `json:"profile,omitempty"`
+	User        string      `json:"user,omitempty"` // Whose default profile and notification targets apply
+	// Profile fields replaced for this job only, keyed by their JSON names
+	Overrides map[string]json.RawMessage `json:"overrides,omitempty"`
+	// Post progress to CallbackURL while running, every ProgressEvery percent
+	// and/or every ProgressSeconds seconds; neither set sends none
+	ProgressEvery   int `json:"progressEvery,omitempty"`
+	ProgressSeconds int `json:"progressSeconds,omitempty"`
+	// Labels recorded on the transcode, e.g. radarr-import
+	Tags []string `json:"tags,omitempty"`
+}
+
+// JobStatus is the lifecycle state of a job on a transcode server
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled" // Dropped before it started, e.g. its input was deleted
+)
+
+// Job is a transcode request tracked by a transcode server
+type Job struct {
+	ID int `json:"id"`
+	TranscodeRequest
+	Status JobStatus `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	// The profile the job runs with once its overrides are applied
+	Settings    json.RawMessage `json:"settings,omitempty"`
+	SubmittedAt time.Time       `json:"submitted_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	// The recorded transcode once completed, so a coordinator that missed
+	// the callback can still record it
+	Result *TranscodedVideo `json:"result,omitempty"`
+}
+
+// JobEvent is one step in the lifecycle of a job: queued, started, progress,
+// completed or failed
+type JobEvent struct {
+	ID         int       `json:"id"`
+	JobID      int       `json:"job_id"`
+	Event      string    `json:"event"`
+	Percentage float64   `json:"percentage,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TreeNode is a directory with the totals of everything below it, for
+// rendering the library as a treemap
+type TreeNode struct {
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Files    int        `json:"files"`
+	Size     int64      `json:"size"`      // Bytes
+	DiskSize int64      `json:"disk_size"` // Bytes allocated on disk
+	Savings  int64      `json:"savings"`   // Bytes the profile is expected to save
+	Children []TreeNode `json:"children,omitempty"`
+}
+
+// JobProgress is the live progress of a running transcode
+type JobProgress struct {
+	File             string  `json:"file"`
+	Percentage       float64 `json:"percentage"`
+	ElapsedSeconds   int     `json:"elapsed_seconds"`
+	RemainingSeconds int     `json:"remaining_seconds"`
+	FPS              float64 `json:"fps,omitempty"` // Current encode speed
+}
+
+// Project is a long-running library migration, such as moving everything to HEVC
+type Project struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Codec     string    `json:"codec"`               // Target ffprobe codec name, e.g. hevc
+	Directory string    `json:"directory,omitempty"` // Empty for the whole library
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ProjectSnapshot is a project's progress at one point in time
+type ProjectSnapshot struct {
+	Files         int       `json:"files"`
+	DoneFiles     int       `json:"done_files"`     // Already in the target codec
+	Size          int64     `json:"size"`           // Bytes across every file
+	RemainingSize int64     `json:"remaining_size"` // Bytes still to convert
+	TakenAt       time.Time `json:"taken_at"`
+}
+
+// Dispatch is a job a coordinator submitted to a transcode worker
+type Dispatch struct {
+	ID          int    `json:"id"`
+	BatchID     int    `json:"batch_id,omitempty"`
+	Server      string `json:"server"`
+	Addr        string `json:"addr"`
+	RemoteJobID int    `json:"remote_job_id"` // The job's ID on the worker
+	FilePath    string `json:"file_path"`
+	Status      string `json:"status"` // dispatched, completed or failed
+	Error       string `json:"error,omitempty"`
+}
+
+// ScanSnapshot is the size of a library root right after a scan
+type ScanSnapshot struct {
+	ID          int               `json:"id"`
+	Root        string            `json:"root"`
+	Files       int               `json:"files"`
+	Size        int64             `json:"size"`
+	DiskSize    int64             `json:"disk_size"`
+	Resolutions []ResolutionTotal `json:"resolutions"`
+	TakenAt     time.Time         `json:"taken_at"`
+}
+
+// ResolutionTotal is the share of a scan snapshot in one resolution class, or
+// "unknown" for files without a resolution
+type ResolutionTotal struct {
+	Resolution string `json:"resolution"`
+	Files      int    `json:"files"`
+	Size       int64  `json:"size"`
+}
+
+// ProjectStatus is a project's current progress and its daily burn-down
+type ProjectStatus struct {
+	Project         Project           `json:"project"`
+	Current         ProjectSnapshot   `json:"current"`
+	PercentComplete float64           `json:"percent_complete"` // Share of files already converted
+	Burndown        []ProjectSnapshot `json:"burndown"`         // Last snapshot of each day, oldest first
+	ETA             *time.Time        `json:"eta,omitempty"`    // Projected from the burn-down rate
+}
+
+// BuildInfo identifies a running binary and what it can do, for bug reports
+// and for checking a fleet of workers runs the same build
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	BuildTime string   `json:"build_time,omitempty"`
+	Modified  bool     `json:"modified,omitempty"` // Built from a tree with uncommitted changes
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`         // GOOS/GOARCH
+	FFmpeg    string   `json:"ffmpeg,omitempty"` // First line of ffmpeg -version, empty when not found
+	Hardware  string   `json:"hardware"`         // nvidia, intel or cpu
+	Features  []string `json:"features"`         // Optional integrations that are configured
+}
+
+// ReloadResult describes the configuration picked up by a live reload
+type ReloadResult struct {
+	Profiles   int       `json:"profiles"`
+	Workers    int       `json:"workers"`
+	ReloadedAt time.Time `json:"reloaded_at"`
+}
+
+// ScanConflict is a file a scan found no longer matching its entry, left
+// for review. Size and the dimensions are those of the file found on disk.
+type ScanConflict struct {
+	ID        int       `json:"id"`
+	Path      string    `json:"path"`
+	Reasons   string    `json:"reasons"`
+	Size      int       `json:"size"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Length    int       `json:"length"`
+	FlaggedAt time.Time `json:"flagged_at"`
+}
+
+// FileVersion is an entry a scan superseded when the file at its path
+// changed, as when a download manager upgrades a release in place
+type FileVersion struct {
+	ID           int       `json:"id"`
+	FileID       int       `json:"file_id"`
+	Path         string    `json:"path"`
+	Size         int       `json:"size"`
+	DiskSize     int       `json:"disk_size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Length       int       `json:"length"`
+	Framerate    float64   `json:"framerate"`
+	Bitrate      int       `json:"bitrate"`
+	VideoCodec   string    `json:"video_codec,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	SupersededAt time.Time `json:"superseded_at"`
+}
+
+// VersionGrowth is how much a file with superseded versions grew since its
+// first kept version
+type VersionGrowth struct {
+	Path        string `json:"path"`
+	Versions    int    `json:"versions"`
+	FirstSize   int64  `json:"first_size"`
+	CurrentSize int64  `json:"current_size"`
+}
+
+// Orphan is a file left behind by an interrupted or failed job: a temp
+// output, a tiny output or a two-pass log
+type Orphan struct {
+	Path       string    `json:"path"`
+	Kind       string    `json:"kind"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Removed    bool      `json:"removed"`
+}
@@ -0,0 +1,228 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// VideoFilter selects videos in SQL; zero values match every video
+type VideoFilter struct {
+	Directory   string // Empty for the whole library
+	Recursive   bool   // Include subdirectories of Directory
+	MinSizeGB   float64
+	MinBitrate  int     // Source bitrate in kbps files must exceed
+	MinDuration int     // Seconds
+	Resolution  string  // Exact WxH, or a resolution class such as 1080p
+	MinBPP      float64 // Bits per pixel per frame files must reach; leaves out already efficient encodes
+	MultiStream bool    // Only files with more than one video stream
+
+	// Only files with a stream matching each of WithStreams and none matching
+	// WithoutStreams. Files scanned before streams were recorded never match.
+	WithStreams    []StreamMatch
+	WithoutStreams []StreamMatch
+
+	// Only files carrying every one of Tags
+	Tags []string
+
+	// Only files whose first video stream is in one of Codecs, e.g. h264.
+	// Files whose codec is not recorded yet never match.
+	Codecs []string
+
+	// Only files last modified before ModifiedBefore, when set. Files whose
+	// modification time is not recorded yet never match.
+	ModifiedBefore time.Time
+	Transcoded     bool // Only originals with a transcode that was kept
+
+	// Also files moved to the archive, which are otherwise left out
+	IncludeArchived bool
+}
+
+// where builds the WHERE clause and its arguments. Subdirectories are matched
+// with a range on norm_path, which unlike LIKE can use files_norm_path.
+func (f VideoFilter) where() (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	if !f.IncludeArchived {
+		conditions = append(conditions, "archived_at IS NULL")
+	}
+	if f.Directory != "" {
+		dir := filepath.Clean(f.Directory)
+		switch {
+		case f.Recursive && dir == "/":
+		case f.Recursive:
+			// '0' sorts right after '/', so the range covers exactly dir/...
+			conditions = append(conditions, "norm_path >= ? AND norm_path < ?")
+			norm := pathutil.NFC(dir)
+			args = append(args, norm+"/", norm+"0")
+		default:
+			conditions = append(conditions, "location = ?")
+			args = append(args, dir)
+		}
+	}
+	if f.MinSizeGB > 0 {
+		conditions = append(conditions, "size >= ?")
+		args = append(args, units.FromGB(f.MinSizeGB))
+	}
+	if f.MinBitrate > 0 {
+		conditions = append(conditions, "bitrate / 1000 > ?")
+		args = append(args, f.MinBitrate)
+	}
+	if f.MinDuration > 0 {
+		conditions = append(conditions, "length >= ?")
+		args = append(args, f.MinDuration)
+	}
+	if f.MinBPP > 0 {
+		conditions = append(conditions, "bpp >= ?")
+		args = append(args, f.MinBPP)
+	}
+	if !f.ModifiedBefore.IsZero() {
+		conditions = append(conditions, "mtime > 0 AND mtime < ?")
+		args = append(args, f.ModifiedBefore.UnixNano())
+	}
+	if f.Transcoded {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM transcodes t WHERE t.OriginalVideo = files.full_file_path AND t.discarded = 0)")
+	}
+	if f.MultiStream {
+		conditions = append(conditions, "id IN (SELECT file_id FROM streams WHERE type = 'video' GROUP BY file_id HAVING COUNT(*) > 1)")
+	}
+	for _, match := range f.WithStreams {
+		condition, matchArgs := match.exists()
+		conditions = append(conditions, condition)
+		args = append(args, matchArgs...)
+	}
+	if len(f.WithoutStreams) > 0 {
+		conditions = append(conditions, "id IN (SELECT file_id FROM streams)")
+	}
+	for _, match := range f.WithoutStreams {
+		condition, matchArgs := match.exists()
+		conditions = append(conditions, "NOT "+condition)
+		args = append(args, matchArgs...)
+	}
+	if len(f.Codecs) > 0 {
+		conditions = append(conditions, "LOWER(video_codec) IN (?"+strings.Repeat(", ?", len(f.Codecs)-1)+")")
+		for _, codec := range f.Codecs {
+			args = append(args, strings.ToLower(codec))
+		}
+	}
+	for _, tag := range f.Tags {
+		condition, tagArgs := taggedWith(tag)
+		conditions = append(conditions, condition)
+		args = append(args, tagArgs...)
+	}
+	if datatypes.IsResolutionClass(f.Resolution) {
+		conditions = append(conditions, "resolution_class = ?")
+		args = append(args, strings.ToLower(f.Resolution))
+	} else if f.Resolution != "" && f.Resolution != "0" {
+		var width, height int
+		fmt.Sscanf(f.Resolution, "%dx%d", &width, &height)
+		conditions = append(conditions, "width = ? AND height = ?")
+		args = append(args, width, height)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// VideoTotals sums the videos matching a filter. Hard links are counted in
+// Files but their data only once in the totals.
+type VideoTotals struct {
+	Files    int
+	Length   int64 // Seconds
+	Size     int64 // Bytes
+	DiskSize int64 // Bytes allocated on disk
+}
+
+// AggregateVideos sums the videos matching filter without loading them
+func AggregateVideos(filter VideoFilter) (VideoTotals, error) {
+	where, args := filter.where()
+	query := `
+	SELECT COUNT(*),
+		COALESCE(SUM(CASE WHEN copy = 1 THEN length END), 0),
+		COALESCE(SUM(CASE WHEN copy = 1 THEN size END), 0),
+		COALESCE(SUM(CASE WHEN copy = 1 THEN disk END), 0)
+	FROM (
+		SELECT COALESCE(length, 0) AS length, size, COALESCE(disk_size, size) AS disk,
+			ROW_NUMBER() OVER (
+				PARTITION BY CASE WHEN COALESCE(inode, 0) = 0 THEN 'id:' || id ELSE device || ':' || inode END
+				ORDER BY id
+			) AS copy
+		FROM files
+		WHERE ` + where + `
+	);`
+	var totals VideoTotals
+	if err := DB.QueryRow(query, args...).Scan(&totals.Files, &totals.Length, &totals.Size, &totals.DiskSize); err != nil {
+		return totals, fmt.Errorf("error aggregating videos: %w", err)
+	}
+	return totals, nil
+}
+
+// QueryFilteredVideos returns the videos matching filter
+func QueryFilteredVideos(filter VideoFilter) ([]datatypes.VideoObject, error) {
+	videos := []datatypes.VideoObject{}
+	err := EachVideo(filter, func(video datatypes.VideoObject) error {
+		videos = append(videos, video)
+		return nil
+	})
+	return videos, err
+}
+
+// EachVideo streams the videos matching filter to fn in path order, without
+// holding them in memory. An error from fn stops the stream and is returned.
+// fn must not write to the database while the stream is open.
+func EachVideo(filter VideoFilter, fn func(datatypes.VideoObject) error) error {
+	where, args := filter.where()
+	rows, err := DB.Query(`SELECT `+videoColumns+` FROM files WHERE `+where+` ORDER BY full_file_path`, args...)
+	if err != nil {
+		return fmt.Errorf("error querying filtered videos: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return fmt.Errorf("error scanning video row: %w", err)
+		}
+		if err := fn(video); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// QueryVideoPage returns up to limit videos matching filter whose paths sort
+// after the cursor, and the cursor of the next page ("" after the last page)
+func QueryVideoPage(filter VideoFilter, after string, limit int) ([]datatypes.VideoObject, string, error) {
+	where, args := filter.where()
+	if after != "" {
+		where += " AND full_file_path > ?"
+		args = append(args, after)
+	}
+	// One extra row tells whether there is another page
+	args = append(args, limit+1)
+	rows, err := DB.Query(`SELECT `+videoColumns+` FROM files WHERE `+where+` ORDER BY full_file_path LIMIT ?`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("error querying video page: %w", err)
+	}
+	defer rows.Close()
+
+	videos := []datatypes.VideoObject{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("error scanning video row: %w", err)
+		}
+		videos = append(videos, video)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error querying video page: %w", err)
+	}
+	if len(videos) <= limit {
+		return videos, "", nil
+	}
+	videos = videos[:limit]
+	return videos, videos[limit-1].FullFilePath, nil
+}
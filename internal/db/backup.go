@@ -0,0 +1,155 @@
+package db
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/safety"
+)
+
+// backupSuffix marks compressed snapshots in the backup directory
+const backupSuffix = ".db.gz"
+
+// Backup writes a consistent, gzip-compressed snapshot of the database to the
+// backup directory, prunes old snapshots beyond the retention count and
+// returns the new snapshot's path.
+func Backup() (string, error) {
+	dir := config.GetBackupDir(Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating backup directory: %w", err)
+	}
+
+	// VACUUM INTO copies the live database without blocking on open readers
+	base := strings.TrimSuffix(filepath.Base(Path), filepath.Ext(Path))
+	snapshot := filepath.Join(dir, fmt.Sprintf("%s-%s", base, time.Now().Format("20060102-150405")))
+	raw := snapshot + ".db.tmp"
+	os.Remove(raw)
+	if _, err := DB.Exec(`VACUUM INTO ?`, raw); err != nil {
+		return "", fmt.Errorf("error snapshotting database: %w", err)
+	}
+	defer os.Remove(raw)
+
+	target := snapshot + backupSuffix
+	if err := gzipFile(raw, target); err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	if err := pruneBackups(dir, base, config.GetBackupKeep()); err != nil {
+		return target, err
+	}
+	return target, nil
+}
+
+func gzipFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("error creating backup: %w", err)
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return fmt.Errorf("error compressing backup: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error compressing backup: %w", err)
+	}
+	return out.Close()
+}
+
+// pruneBackups deletes the oldest snapshots of base so at most keep remain.
+// Timestamped names sort chronologically.
+func pruneBackups(dir, base string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, base+"-*"+backupSuffix))
+	if err != nil {
+		return fmt.Errorf("error listing backups: %w", err)
+	}
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			return fmt.Errorf("error removing old backup %s: %w", matches[0], err)
+		}
+		matches = matches[1:]
+	}
+	return nil
+}
+
+// Restore replaces the database with a snapshot made by Backup. The current
+// database is backed up first so a restore can itself be undone.
+func Restore(snapshot string) error {
+	if err := safety.Check("restore"); err != nil {
+		return err
+	}
+	in, err := os.Open(snapshot)
+	if err != nil {
+		return fmt.Errorf("error opening snapshot: %w", err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot %s: %w", snapshot, err)
+	}
+	defer zr.Close()
+
+	staged := Path + ".restore"
+	out, err := os.Create(staged)
+	if err != nil {
+		return fmt.Errorf("error staging restore: %w", err)
+	}
+	_, err = io.Copy(out, zr)
+	out.Close()
+	if err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("error decompressing snapshot: %w", err)
+	}
+
+	if _, err := Backup(); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("error backing up current database before restore: %w", err)
+	}
+
+	// The current database is kept aside until the snapshot opens, so every
+	// failure leaves it in place and open again
+	DB.Close()
+	previous := Path + ".previous"
+	if err := os.Rename(Path, previous); err != nil {
+		os.Remove(staged)
+		return reopenAfter(fmt.Errorf("error replacing database: %w", err))
+	}
+	if err := os.Rename(staged, Path); err != nil {
+		os.Remove(staged)
+		os.Rename(previous, Path)
+		return reopenAfter(fmt.Errorf("error replacing database: %w", err))
+	}
+	if err := InitDatabase(Path); err != nil {
+		if DB != nil {
+			DB.Close()
+		}
+		os.Rename(previous, Path)
+		return reopenAfter(fmt.Errorf("error opening restored database: %w", err))
+	}
+	os.Remove(previous)
+	return nil
+}
+
+// reopenAfter opens the database at Path again after a failed restore and
+// returns err, with any failure to reopen added to it
+func reopenAfter(err error) error {
+	if reopenErr := InitDatabase(Path); reopenErr != nil {
+		return fmt.Errorf("%w; error reopening database: %v", err, reopenErr)
+	}
+	return err
+}
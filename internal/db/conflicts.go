@@ -0,0 +1,53 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// FlagScanConflict records a file that no longer matches its entry. A file
+// already flagged has its conflict refreshed rather than flagged twice.
+func FlagScanConflict(found datatypes.VideoObject, reasons string) error {
+	result, err := DB.Exec(`UPDATE scan_conflicts SET reasons = ?, size = ?, width = ?, height = ?, length = ?
+		WHERE full_file_path = ? AND resolved_at IS NULL`,
+		reasons, found.Size, found.Width, found.Height, found.Length, found.FullFilePath)
+	if err != nil {
+		return fmt.Errorf("error flagging %s: %w", found.FullFilePath, err)
+	}
+	if changed, _ := result.RowsAffected(); changed > 0 {
+		return nil
+	}
+	if _, err := DB.Exec(`INSERT INTO scan_conflicts (full_file_path, reasons, size, width, height, length) VALUES (?, ?, ?, ?, ?, ?)`,
+		found.FullFilePath, reasons, found.Size, found.Width, found.Height, found.Length); err != nil {
+		return fmt.Errorf("error flagging %s: %w", found.FullFilePath, err)
+	}
+	return nil
+}
+
+// QueryScanConflicts returns the flagged files not yet resolved, oldest first
+func QueryScanConflicts() ([]datatypes.ScanConflict, error) {
+	rows, err := DB.Query(`SELECT id, full_file_path, reasons, size, COALESCE(width, 0), COALESCE(height, 0), COALESCE(length, 0), created_at
+		FROM scan_conflicts WHERE resolved_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying scan conflicts: %w", err)
+	}
+	defer rows.Close()
+	conflicts := []datatypes.ScanConflict{}
+	for rows.Next() {
+		var c datatypes.ScanConflict
+		if err := rows.Scan(&c.ID, &c.Path, &c.Reasons, &c.Size, &c.Width, &c.Height, &c.Length, &c.FlaggedAt); err != nil {
+			return nil, fmt.Errorf("error scanning scan conflict: %w", err)
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, rows.Err()
+}
+
+// ResolveScanConflict marks the conflict flagged for a file as resolved
+func ResolveScanConflict(filePath string) error {
+	if _, err := DB.Exec(`UPDATE scan_conflicts SET resolved_at = CURRENT_TIMESTAMP WHERE full_file_path = ? AND resolved_at IS NULL`, filePath); err != nil {
+		return fmt.Errorf("error resolving conflict of %s: %w", filePath, err)
+	}
+	return nil
+}
@@ -3,23 +3,32 @@ package db
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/safety"
+	"github.com/palzino/vidanalyser/internal/sshpath"
 	"github.com/palzino/vidanalyser/internal/tree"
 )
 
 var DB *sql.DB
 
-func InitDatabase(dbPath string) {
+// Path is the file the database was opened from
+var Path string
+
+// InitDatabase opens the SQLite database and creates or migrates its tables
+func InitDatabase(dbPath string) error {
 	var err error
+	Path = dbPath
+	InvalidateDirectoryTree()
 	DB, err = sql.Open("sqlite3", dbPath)
 	if err != nil {
-		log.Fatalf("Error opening database: %s\n", err)
+		return fmt.Errorf("error opening database: %w", err)
 	}
 
 	// Create the files table
@@ -41,7 +50,7 @@ func InitDatabase(dbPath string) {
 	);`
 	_, err = DB.Exec(filesTableQuery)
 	if err != nil {
-		log.Fatalf("Error creating files table: %s\n", err)
+		return fmt.Errorf("error creating files table: %w", err)
 	}
 
 	TranscodesTableQuery := `
@@ -63,33 +72,870 @@ func InitDatabase(dbPath string) {
 	);`
 	_, err = DB.Exec(TranscodesTableQuery)
 	if err != nil {
-		log.Fatalf("Error creating files table: %s\n", err)
+		return fmt.Errorf("error creating transcodes table: %w", err)
+	}
+
+	batchesTableQuery := `
+	CREATE TABLE IF NOT EXISTS batches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		profile TEXT NOT NULL,
+		file_count INTEGER NOT NULL,
+		started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		finished_at DATETIME
+	);`
+	_, err = DB.Exec(batchesTableQuery)
+	if err != nil {
+		return fmt.Errorf("error creating batches table: %w", err)
+	}
+
+	failuresTableQuery := `
+	CREATE TABLE IF NOT EXISTS failures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_path TEXT NOT NULL,
+		error TEXT NOT NULL,
+		batch_id INTEGER REFERENCES batches(id),
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = DB.Exec(failuresTableQuery)
+	if err != nil {
+		return fmt.Errorf("error creating failures table: %w", err)
+	}
+
+	projectsTableQuery := `
+	CREATE TABLE IF NOT EXISTS projects (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		codec TEXT NOT NULL,
+		directory TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS project_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		project_id INTEGER NOT NULL REFERENCES projects(id),
+		files INTEGER NOT NULL,
+		done_files INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		remaining_size INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS project_snapshots_project_id ON project_snapshots (project_id);`
+	_, err = DB.Exec(projectsTableQuery)
+	if err != nil {
+		return fmt.Errorf("error creating projects tables: %w", err)
+	}
+
+	// Library totals after every scan, for charting growth over time
+	scanSnapshotsTableQuery := `
+	CREATE TABLE IF NOT EXISTS scan_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		root TEXT NOT NULL,
+		files INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		disk_size INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS scan_snapshots_root ON scan_snapshots (root);
+	CREATE TABLE IF NOT EXISTS scan_snapshot_resolutions (
+		snapshot_id INTEGER NOT NULL REFERENCES scan_snapshots(id),
+		resolution TEXT NOT NULL,
+		files INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY (snapshot_id, resolution)
+	);`
+	if _, err := DB.Exec(scanSnapshotsTableQuery); err != nil {
+		return fmt.Errorf("error creating scan snapshots tables: %w", err)
+	}
+
+	// Jobs a coordinator handed to workers, so a restarted coordinator can
+	// follow the ones still running
+	dispatchesTableQuery := `
+	CREATE TABLE IF NOT EXISTS dispatches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		batch_id INTEGER REFERENCES batches(id),
+		server TEXT NOT NULL,
+		addr TEXT NOT NULL,
+		remote_job_id INTEGER NOT NULL DEFAULT 0,
+		file_path TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'dispatched',
+		error TEXT NOT NULL DEFAULT '',
+		dispatched_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		finished_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS dispatches_status ON dispatches (status);`
+	if _, err := DB.Exec(dispatchesTableQuery); err != nil {
+		return fmt.Errorf("error creating dispatches table: %w", err)
+	}
+
+	// Files deleted outside the program, kept when DELETION_SYNC is soft
+	deletedFilesTableQuery := `
+	CREATE TABLE IF NOT EXISTS deleted_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		full_file_path TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		width INTEGER,
+		height INTEGER,
+		length INTEGER,
+		bitrate INTEGER,
+		deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	if _, err = DB.Exec(deletedFilesTableQuery); err != nil {
+		return fmt.Errorf("error creating deleted_files table: %w", err)
+	}
+
+	// Entries superseded when a scan found a changed file at their path, and
+	// files flagged because they no longer match their entry (SCAN_CONFLICTS)
+	conflictsTableQuery := `
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		full_file_path TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		width INTEGER,
+		height INTEGER,
+		length INTEGER,
+		bitrate INTEGER,
+		reason TEXT NOT NULL DEFAULT '',
+		superseded_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS file_versions_file_id ON file_versions (file_id);
+	CREATE TABLE IF NOT EXISTS scan_conflicts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		full_file_path TEXT NOT NULL,
+		reasons TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		width INTEGER,
+		height INTEGER,
+		length INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		resolved_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS scan_conflicts_path ON scan_conflicts (full_file_path);`
+	if _, err := DB.Exec(conflictsTableQuery); err != nil {
+		return fmt.Errorf("error creating conflict tables: %w", err)
+	}
+
+	for column, definition := range map[string]string{
+		"disk_size":   "INTEGER",
+		"framerate":   "REAL",
+		"video_codec": "TEXT NOT NULL DEFAULT ''",
+	} {
+		if err := addColumnIfMissing("file_versions", column, definition); err != nil {
+			return fmt.Errorf("error migrating file_versions table: %w", err)
+		}
+	}
+	if _, err := DB.Exec(`CREATE INDEX IF NOT EXISTS file_versions_path ON file_versions (full_file_path)`); err != nil {
+		return fmt.Errorf("error creating index: %w", err)
+	}
+
+	// One row per stream of a file, recorded by scans
+	streamsTableQuery := `
+	CREATE TABLE IF NOT EXISTS streams (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL REFERENCES files(id),
+		stream_index INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		codec TEXT NOT NULL DEFAULT '',
+		width INTEGER,
+		height INTEGER,
+		framerate REAL,
+		bitrate INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS streams_file_id ON streams (file_id);`
+	_, err = DB.Exec(streamsTableQuery)
+	if err != nil {
+		return fmt.Errorf("error creating streams table: %w", err)
+	}
+	for _, column := range []string{"profile", "language"} {
+		if err := addColumnIfMissing("streams", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return fmt.Errorf("error migrating streams table: %w", err)
+		}
+	}
+	for _, column := range []string{"channels", "sample_rate"} {
+		if err := addColumnIfMissing("streams", column, "INTEGER"); err != nil {
+			return fmt.Errorf("error migrating streams table: %w", err)
+		}
+	}
+	for _, column := range []string{"default_track", "forced", "hearing_impaired"} {
+		if err := addColumnIfMissing("streams", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return fmt.Errorf("error migrating streams table: %w", err)
+		}
+	}
+	// ffprobe output by file version, so unchanged files are not probed again
+	probeCacheTableQuery := `
+	CREATE TABLE IF NOT EXISTS probe_cache (
+		cache_key TEXT PRIMARY KEY,
+		path TEXT NOT NULL,
+		version TEXT NOT NULL,
+		output BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS probe_cache_path ON probe_cache (path);`
+	if _, err := DB.Exec(probeCacheTableQuery); err != nil {
+		return fmt.Errorf("error creating probe_cache table: %w", err)
+	}
+
+	// Directories over their quota, by when their owners were notified
+	quotaNoticesTableQuery := `
+	CREATE TABLE IF NOT EXISTS quota_notices (
+		path TEXT PRIMARY KEY,
+		notified_at DATETIME NOT NULL
+	);`
+	if _, err := DB.Exec(quotaNoticesTableQuery); err != nil {
+		return fmt.Errorf("error creating quota_notices table: %w", err)
+	}
+
+	// Free-form labels on files, and on the transcodes made from them
+	tagsTableQuery := `
+	CREATE TABLE IF NOT EXISTS file_tags (
+		file_id INTEGER NOT NULL REFERENCES files(id),
+		tag TEXT NOT NULL,
+		PRIMARY KEY (file_id, tag)
+	);
+	CREATE INDEX IF NOT EXISTS file_tags_tag ON file_tags (tag);
+	CREATE TABLE IF NOT EXISTS transcode_tags (
+		transcode_id INTEGER NOT NULL REFERENCES transcodes(id),
+		tag TEXT NOT NULL,
+		PRIMARY KEY (transcode_id, tag)
+	);`
+	if _, err := DB.Exec(tagsTableQuery); err != nil {
+		return fmt.Errorf("error creating tag tables: %w", err)
+	}
+
+	// The subtitle tracks of each file, for deciding whether to copy or extract them
+	subtitleStreamsViewQuery := `
+	CREATE VIEW IF NOT EXISTS subtitle_streams AS
+	SELECT file_id, stream_index, codec AS format, language, default_track, forced, hearing_impaired
+	FROM streams WHERE type = 'subtitle';`
+	if _, err := DB.Exec(subtitleStreamsViewQuery); err != nil {
+		return fmt.Errorf("error creating subtitle_streams view: %w", err)
+	}
+
+	// One-off data migrations already applied, so they are not repeated on every start
+	migrationsTableQuery := `
+	CREATE TABLE IF NOT EXISTS migrations (
+		name TEXT PRIMARY KEY,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	if _, err := DB.Exec(migrationsTableQuery); err != nil {
+		return fmt.Errorf("error creating migrations table: %w", err)
+	}
+
+	jobEventsTableQuery := `
+	CREATE TABLE IF NOT EXISTS job_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		percentage REAL NOT NULL DEFAULT 0,
+		message TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS job_events_job_id ON job_events (job_id);`
+	_, err = DB.Exec(jobEventsTableQuery)
+	if err != nil {
+		return fmt.Errorf("error creating job_events table: %w", err)
+	}
+
+	for _, column := range []string{"disk_size", "device", "inode", "links"} {
+		if err := addColumnIfMissing("files", column, "INTEGER"); err != nil {
+			return fmt.Errorf("error migrating files table: %w", err)
+		}
+	}
+	if err := addColumnIfMissing("files", "link_target", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	if err := addColumnIfMissing("files", "source_path", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	if err := addColumnIfMissing("files", "sample_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	if err := addColumnIfMissing("files", "norm_path", "TEXT"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	// The codec of the first video stream, recorded by scans so files can be
+	// selected by codec in SQL. Files scanned before are filled in from their
+	// streams once, or probed on demand.
+	if err := addColumnIfMissing("files", "video_codec", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	if err := migrateOnce("video_codec", `UPDATE files SET video_codec = COALESCE((SELECT codec FROM streams
+		WHERE file_id = files.id AND type = 'video' ORDER BY stream_index LIMIT 1), '')
+		WHERE video_codec = ''`); err != nil {
+		return fmt.Errorf("error backfilling video codecs: %w", err)
+	}
+	// The class of the resolution, so files are filtered and grouped by it in SQL
+	if err := addColumnIfMissing("files", "resolution_class", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	// Rows scanned before, or classed on width or height alone, are classed once
+	if err := migrateOnce("resolution_class_long_short", `UPDATE files SET resolution_class = `+resolutionClassSQL()); err != nil {
+		return fmt.Errorf("error backfilling resolution classes: %w", err)
+	}
+	// Modification time in Unix nanoseconds, so incremental scans can skip
+	// probing unchanged files; 0 until the next scan records it
+	if err := addColumnIfMissing("files", "mtime", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	// When the file was moved to the archive, whose remote copies clean leaves alone
+	if err := addColumnIfMissing("files", "archived_at", "DATETIME"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	// Bits per pixel per frame, so already efficient files can be filtered in SQL
+	if err := addColumnIfMissing("files", "bpp", "REAL"); err != nil {
+		return fmt.Errorf("error migrating files table: %w", err)
+	}
+	if _, err := DB.Exec(`UPDATE files SET bpp = bitrate * 1.0 / (width * height * framerate)
+		WHERE bpp IS NULL AND width > 0 AND height > 0 AND framerate > 0 AND bitrate > 0`); err != nil {
+		return fmt.Errorf("error backfilling bits per pixel: %w", err)
+	}
+	if err := backfillNormPaths(); err != nil {
+		return err
+	}
+	// Indexes for the analyser's filters and directory ranges
+	for _, index := range []string{
+		"CREATE INDEX IF NOT EXISTS files_location ON files (location)",
+		"CREATE INDEX IF NOT EXISTS files_norm_path ON files (norm_path)",
+		"CREATE INDEX IF NOT EXISTS files_size ON files (size)",
+		"CREATE INDEX IF NOT EXISTS files_inode ON files (device, inode)",
+	} {
+		if _, err := DB.Exec(index); err != nil {
+			return fmt.Errorf("error creating index: %w", err)
+		}
+	}
+	if err := addColumnIfMissing("transcodes", "batch_id", "INTEGER REFERENCES batches(id)"); err != nil {
+		return fmt.Errorf("error migrating transcodes table: %w", err)
+	}
+	for _, column := range []string{"ffmpeg_args", "encoder", "encoder_version", "profile", "username"} {
+		if err := addColumnIfMissing("transcodes", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return fmt.Errorf("error migrating transcodes table: %w", err)
+		}
+	}
+	if err := addColumnIfMissing("transcodes", "discarded", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("error migrating transcodes table: %w", err)
+	}
+	// File IDs survive renames, unlike the path columns. Foreign keys are not
+	// enforced, so the IDs of deleted files remain and still chain transcodes.
+	for _, column := range []string{"original_id", "output_id"} {
+		if err := addColumnIfMissing("transcodes", column, "INTEGER REFERENCES files(id)"); err != nil {
+			return fmt.Errorf("error migrating transcodes table: %w", err)
+		}
+	}
+	if err := backfillTranscodeFileIDs(); err != nil {
+		return err
+	}
+	// Left NULL where they cannot be measured, so averages skip them
+	if err := addColumnIfMissing("transcodes", "achieved_bitrate", "INTEGER"); err != nil {
+		return fmt.Errorf("error migrating transcodes table: %w", err)
+	}
+	if err := addColumnIfMissing("transcodes", "encode_fps", "REAL"); err != nil {
+		return fmt.Errorf("error migrating transcodes table: %w", err)
+	}
+	if err := backfillTranscodeMetrics(); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("batches", "username", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("error migrating batches table: %w", err)
 	}
 
 	fmt.Println("Database initialized successfully.")
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table so databases created
+// by older versions pick up new fields without being recreated
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return fmt.Errorf("error scanning columns of %s: %w", table, err)
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding column %s to %s: %w", column, table, err)
+	}
+	return nil
+}
+
+// migrateOnce runs a data migration unless the migrations table records it
+// as applied, and records it in the same transaction
+func migrateOnce(name, query string) error {
+	var applied int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM migrations WHERE name = ?`, name).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO migrations (name) VALUES (?)`, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backfillNormPaths fills norm_path for rows recorded before it existed
+func backfillNormPaths() error {
+	rows, err := DB.Query(`SELECT full_file_path FROM files WHERE norm_path IS NULL`)
+	if err != nil {
+		return fmt.Errorf("error reading paths to normalise: %w", err)
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading paths to normalise: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+
+	for _, path := range paths {
+		if _, err := DB.Exec(`UPDATE files SET norm_path = ? WHERE full_file_path = ?`, pathutil.NFC(path), path); err != nil {
+			return fmt.Errorf("error normalising %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// nullableID stores zero IDs as NULL so optional foreign keys stay unset
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
 }
 
 func InsertVideo(video datatypes.VideoObject) error {
 	query := `
-	INSERT INTO files (name, location, full_file_path, size, width, height, length, framerate, frames, bitrate, file_extension)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	INSERT INTO files (name, location, full_file_path, size, width, height, length, framerate, frames, bitrate, file_extension, disk_size, device, inode, links, link_target, norm_path, bpp, video_codec, resolution_class, mtime, sample_hash)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`
 	_, err := DB.Exec(query, video.Name, video.Location, video.FullFilePath, video.Size, video.Width,
-		video.Height, video.Length, video.Framerate, video.Frames, video.Bitrate, video.FileExtension)
-	return err
+		video.Height, video.Length, video.Framerate, video.Frames, video.Bitrate, video.FileExtension, video.DiskSize,
+		video.Device, video.Inode, video.Links, video.LinkTarget, pathutil.NFC(video.FullFilePath), nullableBPP(video),
+		video.VideoCodec, datatypes.ResolutionClass(video.Width, video.Height), video.ModTime, video.SampleHash)
+	if err != nil {
+		return err
+	}
+	if err := replaceStreams(video.FullFilePath, video.Streams); err != nil {
+		return err
+	}
+	treeAdd(video)
+	return nil
+}
+
+// backfillTranscodeMetrics measures transcodes recorded before the achieved
+// bitrate and encode speed were, from their output and original files where
+// those are still recorded
+func backfillTranscodeMetrics() error {
+	for _, update := range []string{
+		`UPDATE transcodes SET achieved_bitrate = (SELECT CAST(transcodes.NewSize * 8 / 1000 / length AS INTEGER)
+			FROM files WHERE id = transcodes.output_id AND length > 0)
+		WHERE achieved_bitrate IS NULL AND discarded = 0 AND output_id IS NOT NULL`,
+		`UPDATE transcodes SET encode_fps = (SELECT 1.0 * frames / transcodes.TimeTaken
+			FROM files WHERE id = transcodes.original_id AND frames > 0)
+		WHERE encode_fps IS NULL AND TimeTaken > 0 AND original_id IS NOT NULL`,
+	} {
+		if _, err := DB.Exec(update); err != nil {
+			return fmt.Errorf("error measuring recorded transcodes: %w", err)
+		}
+	}
+	return nil
 }
 
 func InsertTranscode(t datatypes.TranscodedVideo) error {
 	query := `
-	INSERT INTO transcodes (OriginalVideo, Transcoded, OldExtension, NewExtension, OldSize, NewSize, OriginalRes, NewRes, OldBitrate, NewBitrate, TimeTaken)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	INSERT INTO transcodes (OriginalVideo, Transcoded, OldExtension, NewExtension, OldSize, NewSize, OriginalRes, NewRes, OldBitrate, NewBitrate, TimeTaken, batch_id,
+		ffmpeg_args, encoder, encoder_version, profile, discarded, username, original_id, output_id, achieved_bitrate, encode_fps)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+		(SELECT id FROM files WHERE full_file_path = ?), (SELECT id FROM files WHERE full_file_path = ?), ?, ?);
+	`
+	var encodeFPS interface{}
+	if t.EncodeFPS > 0 {
+		encodeFPS = t.EncodeFPS
+	}
+	result, err := DB.Exec(query, t.OriginalVideoPath, t.TranscodedPath, t.OldExtension, t.NewExtension, t.OldSize,
+		t.NewSize, t.OriginalRES, t.NewRES, t.OldBitrate, t.NewBitrate, t.TimeTaken, nullableID(t.BatchID),
+		t.FFmpegArgs, t.Encoder, t.EncoderVersion, t.Profile, t.Discarded, t.User, t.OriginalVideoPath, t.TranscodedPath,
+		nullableID(t.AchievedBitrate), encodeFPS)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error reading transcode id: %w", err)
+	}
+	return tagTranscode(id, t.OriginalVideoPath, t.Tags)
+}
+
+// CreateBatch records a new queue submission and returns its ID
+func CreateBatch(name, profile, user string, fileCount int) (int, error) {
+	query := `INSERT INTO batches (name, profile, username, file_count) VALUES (?, ?, ?, ?)`
+	result, err := DB.Exec(query, name, profile, user, fileCount)
+	if err != nil {
+		return 0, fmt.Errorf("error creating batch %s: %w", name, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error reading batch id: %w", err)
+	}
+	return int(id), nil
+}
+
+// FinishBatch marks a batch as finished so its wall-clock duration can be reported
+func FinishBatch(id int) error {
+	query := `UPDATE batches SET finished_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := DB.Exec(query, id); err != nil {
+		return fmt.Errorf("error finishing batch %d: %w", id, err)
+	}
+	return nil
+}
+
+// InsertFailure records a transcode attempt that did not complete
+func InsertFailure(filePath string, cause error, batchID int) error {
+	query := `INSERT INTO failures (file_path, error, batch_id) VALUES (?, ?, ?)`
+	if _, err := DB.Exec(query, filePath, cause.Error(), nullableID(batchID)); err != nil {
+		return fmt.Errorf("error recording failure for %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// sqlTime formats a time the way SQLite stores CURRENT_TIMESTAMP so the two compare correctly
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// QueryFailuresSince returns failures recorded after the given time, newest first
+func QueryFailuresSince(since time.Time) ([]datatypes.Failure, error) {
+	query := `
+	SELECT id, file_path, error, COALESCE(batch_id, 0), created_at
+	FROM failures
+	WHERE created_at >= ?
+	ORDER BY id DESC;
 	`
-	_, err := DB.Exec(query, t.OriginalVideoPath, t.TranscodedPath, t.OldExtension, t.NewExtension, t.OldSize,
-		t.NewSize, t.OriginalRES, t.NewRES, t.OldBitrate, t.NewBitrate, t.TimeTaken)
-	return err
+	rows, err := DB.Query(query, sqlTime(since))
+	if err != nil {
+		return nil, fmt.Errorf("error querying failures: %w", err)
+	}
+	defer rows.Close()
+
+	failures := []datatypes.Failure{}
+	for rows.Next() {
+		var failure datatypes.Failure
+		if err := rows.Scan(&failure.ID, &failure.FilePath, &failure.Error, &failure.BatchID, &failure.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning failure row: %w", err)
+		}
+		failures = append(failures, failure)
+	}
+	return failures, nil
+}
+
+// CountFilesAddedSince returns how many files were first recorded after the given time
+func CountFilesAddedSince(since time.Time) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM files WHERE created_at >= ?`
+	if err := DB.QueryRow(query, sqlTime(since)).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting added files: %w", err)
+	}
+	return count, nil
+}
+
+// QueryTranscodeTotalsSince returns the number of kept transcodes and bytes saved after the given time
+func QueryTranscodeTotalsSince(since time.Time) (int, int64, error) {
+	var count int
+	var saved int64
+	query := `SELECT COUNT(*), COALESCE(SUM(OldSize - NewSize), 0) FROM transcodes WHERE discarded = 0 AND created_at >= ?`
+	if err := DB.QueryRow(query, sqlTime(since)).Scan(&count, &saved); err != nil {
+		return 0, 0, fmt.Errorf("error querying transcode totals: %w", err)
+	}
+	return count, saved, nil
+}
+
+// QueryLifetimeSpaceSaved returns the number of transcodes and bytes saved across all runs
+func QueryLifetimeSpaceSaved() (int, int64, error) {
+	return QueryTranscodeTotalsSince(time.Time{})
+}
+
+// QueryUserSpaceSaved returns the number of transcodes and bytes saved for jobs submitted by user
+func QueryUserSpaceSaved(user string) (int, int64, error) {
+	var count int
+	var saved int64
+	query := `SELECT COUNT(*), COALESCE(SUM(OldSize - NewSize), 0) FROM transcodes WHERE discarded = 0 AND username = ?`
+	if err := DB.QueryRow(query, user).Scan(&count, &saved); err != nil {
+		return 0, 0, fmt.Errorf("error querying transcode totals for %s: %w", user, err)
+	}
+	return count, saved, nil
+}
+
+// QuerySavingsByUser returns the transcodes and bytes saved per submitting user,
+// most saved first. Jobs run without --user are grouped under an empty name.
+func QuerySavingsByUser() ([]datatypes.UserSavings, error) {
+	query := `
+	SELECT username, COUNT(*), COALESCE(SUM(OldSize - NewSize), 0)
+	FROM transcodes
+	WHERE discarded = 0
+	GROUP BY username
+	ORDER BY 3 DESC;
+	`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying savings by user: %w", err)
+	}
+	defer rows.Close()
+
+	savings := []datatypes.UserSavings{}
+	for rows.Next() {
+		var entry datatypes.UserSavings
+		if err := rows.Scan(&entry.User, &entry.Transcodes, &entry.SpaceSaved); err != nil {
+			return nil, fmt.Errorf("error scanning user savings row: %w", err)
+		}
+		savings = append(savings, entry)
+	}
+	return savings, nil
+}
+
+// QuerySavingsByEncoder compares results across profiles and encoder settings,
+// most transcodes first. An empty user includes every user's jobs.
+func QuerySavingsByEncoder(user string) ([]datatypes.EncoderSavings, error) {
+	query := `
+	SELECT profile, encoder, NewRes, NewBitrate, COUNT(*), COALESCE(SUM(OldSize - NewSize), 0),
+		COALESCE(AVG(CASE WHEN OldSize > 0 THEN 100.0 * (OldSize - NewSize) / OldSize END), 0),
+		COALESCE(AVG(TimeTaken), 0), COALESCE(AVG(achieved_bitrate), 0),
+		COALESCE(AVG(CASE WHEN NewBitrate > 0 THEN 100.0 * achieved_bitrate / NewBitrate END), 0),
+		COALESCE(AVG(encode_fps), 0)
+	FROM transcodes
+	WHERE discarded = 0 AND (? = '' OR username = ?)
+	GROUP BY profile, encoder, NewRes, NewBitrate
+	ORDER BY COUNT(*) DESC;
+	`
+	rows, err := DB.Query(query, user, user)
+	if err != nil {
+		return nil, fmt.Errorf("error querying savings by encoder: %w", err)
+	}
+	defer rows.Close()
+
+	savings := []datatypes.EncoderSavings{}
+	for rows.Next() {
+		var entry datatypes.EncoderSavings
+		if err := rows.Scan(&entry.Profile, &entry.Encoder, &entry.Resolution, &entry.Bitrate, &entry.Transcodes,
+			&entry.SpaceSaved, &entry.AvgSavingsPct, &entry.AvgTimeSeconds, &entry.AvgAchievedBitrate,
+			&entry.AvgBitrateOfTarget, &entry.AvgEncodeFPS); err != nil {
+			return nil, fmt.Errorf("error scanning encoder savings row: %w", err)
+		}
+		savings = append(savings, entry)
+	}
+	return savings, nil
+}
+
+// QueryLiveTranscodes returns the latest kept transcode of every output still
+// recorded in the files table, oldest first
+func QueryLiveTranscodes() ([]datatypes.TranscodedVideo, error) {
+	query := `
+	SELECT t.OriginalVideo, t.Transcoded, t.OldSize, t.NewSize, t.NewRes, t.NewBitrate, t.encoder, t.profile
+	FROM transcodes t
+	JOIN files f ON f.full_file_path = t.Transcoded
+	WHERE t.discarded = 0 AND t.id = (SELECT MAX(id) FROM transcodes WHERE Transcoded = t.Transcoded AND discarded = 0)
+	ORDER BY t.id;
+	`
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying transcoded outputs: %w", err)
+	}
+	defer rows.Close()
+
+	transcodes := []datatypes.TranscodedVideo{}
+	for rows.Next() {
+		var t datatypes.TranscodedVideo
+		if err := rows.Scan(&t.OriginalVideoPath, &t.TranscodedPath, &t.OldSize, &t.NewSize, &t.NewRES, &t.NewBitrate,
+			&t.Encoder, &t.Profile); err != nil {
+			return nil, fmt.Errorf("error scanning transcode row: %w", err)
+		}
+		transcodes = append(transcodes, t)
+	}
+	return transcodes, nil
+}
+
+// QueryOutputSizeRatio compares the size of past outputs with their nominal
+// size (video bitrate x duration), using outputs still in the files table.
+// Only transcodes with the given profile are used when profile is set.
+// It returns the ratio and the number of transcodes it is based on.
+func QueryOutputSizeRatio(profile string) (float64, int, error) {
+	query := `
+	SELECT COUNT(*), COALESCE(SUM(t.NewSize), 0), COALESCE(SUM(f.length * t.NewBitrate * 125), 0)
+	FROM transcodes t
+	JOIN files f ON f.full_file_path = t.Transcoded
+	WHERE f.length > 0 AND t.NewBitrate > 0 AND (? = '' OR t.profile = ?);
+	`
+	var count int
+	var actual, nominal float64
+	if err := DB.QueryRow(query, profile, profile).Scan(&count, &actual, &nominal); err != nil {
+		return 0, 0, fmt.Errorf("error querying output size ratio: %w", err)
+	}
+	if nominal == 0 {
+		return 0, 0, nil
+	}
+	return actual / nominal, count, nil
+}
+
+// QueryEncodePixelRate returns how many source pixels past transcodes encoded
+// per second on average, and how many transcodes that is measured from
+func QueryEncodePixelRate() (float64, int, error) {
+	query := `
+	SELECT COUNT(*), COALESCE(AVG(encode_fps
+		* CAST(substr(OriginalRes, 1, instr(OriginalRes, 'x') - 1) AS INTEGER)
+		* CAST(substr(OriginalRes, instr(OriginalRes, 'x') + 1) AS INTEGER)), 0)
+	FROM transcodes
+	WHERE encode_fps > 0 AND instr(OriginalRes, 'x') > 1;
+	`
+	var count int
+	var rate float64
+	if err := DB.QueryRow(query).Scan(&count, &rate); err != nil {
+		return 0, 0, fmt.Errorf("error querying encode speed: %w", err)
+	}
+	return rate, count, nil
+}
+
+// savingsPeriodFormats maps reporting periods to SQLite strftime formats
+var savingsPeriodFormats = map[string]string{
+	"day":   "%Y-%m-%d",
+	"week":  "%Y-W%W",
+	"month": "%Y-%m",
+	"year":  "%Y",
+}
+
+// QuerySavingsByPeriod groups transcode savings by day, week, month or year, newest first.
+// An empty user includes every user's jobs.
+func QuerySavingsByPeriod(period, user string) ([]datatypes.PeriodSavings, error) {
+	format, ok := savingsPeriodFormats[period]
+	if !ok {
+		return nil, fmt.Errorf("unknown period %q, use day, week, month or year", period)
+	}
+	query := `
+	SELECT strftime(?, created_at) AS period, COUNT(*), COALESCE(SUM(OldSize - NewSize), 0)
+	FROM transcodes
+	WHERE discarded = 0 AND (? = '' OR username = ?)
+	GROUP BY period
+	ORDER BY period DESC;
+	`
+	rows, err := DB.Query(query, format, user, user)
+	if err != nil {
+		return nil, fmt.Errorf("error querying savings by %s: %w", period, err)
+	}
+	defer rows.Close()
+
+	savings := []datatypes.PeriodSavings{}
+	for rows.Next() {
+		var entry datatypes.PeriodSavings
+		if err := rows.Scan(&entry.Period, &entry.Transcodes, &entry.SpaceSaved); err != nil {
+			return nil, fmt.Errorf("error scanning savings row: %w", err)
+		}
+		savings = append(savings, entry)
+	}
+	return savings, nil
+}
+
+// QueryBatchEncodeSeconds returns the encode time of a batch's transcodes per
+// encoder, including discarded attempts since they used power too
+func QueryBatchEncodeSeconds(batchID int) (map[string]int, error) {
+	rows, err := DB.Query(`SELECT encoder, COALESCE(SUM(TimeTaken), 0) FROM transcodes WHERE batch_id = ? GROUP BY encoder`, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying encode time of batch %d: %w", batchID, err)
+	}
+	defer rows.Close()
+
+	seconds := map[string]int{}
+	for rows.Next() {
+		var encoder string
+		var total int
+		if err := rows.Scan(&encoder, &total); err != nil {
+			return nil, fmt.Errorf("error scanning encode time row: %w", err)
+		}
+		seconds[encoder] = total
+	}
+	return seconds, nil
+}
+
+const batchSummaryQuery = `
+	SELECT b.id, b.name, b.profile, b.username, b.file_count, b.started_at, b.finished_at,
+		COUNT(t.id), COALESCE(SUM(t.OldSize - t.NewSize), 0)
+	FROM batches b
+	LEFT JOIN transcodes t ON t.batch_id = b.id AND t.discarded = 0
+`
+
+// QueryBatches returns the most recent batches, newest first, with their transcode results aggregated
+func QueryBatches(limit int) ([]datatypes.Batch, error) {
+	return queryBatches(batchSummaryQuery+` GROUP BY b.id ORDER BY b.id DESC LIMIT ?;`, limit)
+}
+
+// QueryBatch returns a single batch with its aggregated results, or nil if it does not exist
+func QueryBatch(id int) (*datatypes.Batch, error) {
+	batches, err := queryBatches(batchSummaryQuery+` WHERE b.id = ? GROUP BY b.id;`, id)
+	if err != nil || len(batches) == 0 {
+		return nil, err
+	}
+	return &batches[0], nil
+}
+
+func queryBatches(query string, args ...interface{}) ([]datatypes.Batch, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying batches: %w", err)
+	}
+	defer rows.Close()
+
+	batches := []datatypes.Batch{}
+	for rows.Next() {
+		var batch datatypes.Batch
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&batch.ID, &batch.Name, &batch.Profile, &batch.User, &batch.FileCount, &batch.StartedAt, &finishedAt,
+			&batch.Completed, &batch.SpaceSaved); err != nil {
+			return nil, fmt.Errorf("error scanning batch row: %w", err)
+		}
+		if finishedAt.Valid {
+			batch.FinishedAt = &finishedAt.Time
+			batch.Duration = int(finishedAt.Time.Sub(batch.StartedAt).Seconds())
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
 }
 
 func DeleteVideo(filePath string) error {
+	if _, err := DB.Exec(`DELETE FROM streams WHERE file_id IN (SELECT id FROM files WHERE full_file_path = ?)`, filePath); err != nil {
+		return fmt.Errorf("error deleting streams of %s: %w", filePath, err)
+	}
+	if _, err := DB.Exec(`DELETE FROM file_tags WHERE file_id IN (SELECT id FROM files WHERE full_file_path = ?)`, filePath); err != nil {
+		return fmt.Errorf("error deleting tags of %s: %w", filePath, err)
+	}
 	query := `DELETE FROM files WHERE full_file_path = ?`
 	result, err := DB.Exec(query, filePath)
 	if err != nil {
@@ -100,14 +946,29 @@ func DeleteVideo(filePath string) error {
 	if rowsAffected == 0 {
 		fmt.Printf("No database entry found for %s to delete.\n", filePath)
 	}
+	treeRemove(filePath)
 
 	return nil
 }
 
+// SoftDeleteVideo keeps a summary of the file's record in deleted_files,
+// under its file ID, before deleting the record
+func SoftDeleteVideo(filePath string) error {
+	query := `
+	INSERT INTO deleted_files (file_id, full_file_path, size, width, height, length, bitrate)
+	SELECT id, full_file_path, size, width, height, length, bitrate FROM files WHERE full_file_path = ?`
+	if _, err := DB.Exec(query, filePath); err != nil {
+		return fmt.Errorf("error keeping deleted video %s: %w", filePath, err)
+	}
+	return DeleteVideo(filePath)
+}
+
 func UpdateVideo(video datatypes.VideoObject) error {
 	query := `
 		UPDATE files SET
-			name = ?, location = ?, size = ?, width = ?, height = ?, length = ?, framerate = ?, frames = ?, bitrate = ?
+			name = ?, location = ?, size = ?, width = ?, height = ?, length = ?, framerate = ?, frames = ?, bitrate = ?, disk_size = ?,
+			device = ?, inode = ?, links = ?, link_target = ?, video_codec = ?, bpp = ?, resolution_class = ?, mtime = ?,
+			sample_hash = ?
 		WHERE full_file_path = ?
 	`
 	_, err := DB.Exec(query,
@@ -120,30 +981,78 @@ func UpdateVideo(video datatypes.VideoObject) error {
 		video.Framerate,
 		video.Frames,
 		video.Bitrate,
+		video.DiskSize,
+		video.Device,
+		video.Inode,
+		video.Links,
+		video.LinkTarget,
+		video.VideoCodec,
+		nullableBPP(video),
+		datatypes.ResolutionClass(video.Width, video.Height),
+		video.ModTime,
+		video.SampleHash,
 		video.FullFilePath,
 	)
 	if err != nil {
 		return fmt.Errorf("error updating video: %w", err)
 	}
+	if err := replaceStreams(video.FullFilePath, video.Streams); err != nil {
+		return err
+	}
+	treeReplace(video.FullFilePath, video.FullFilePath)
+	return nil
+}
+
+// SetVideoModTime records the modification time of a file whose entry is
+// otherwise unchanged
+func SetVideoModTime(filePath string, modTime int64) error {
+	if _, err := DB.Exec(`UPDATE files SET mtime = ? WHERE full_file_path = ?`, modTime, filePath); err != nil {
+		return fmt.Errorf("error updating modification time: %w", err)
+	}
 	return nil
 }
-func QueryVideoByPath(filePath string) (*datatypes.VideoObject, error) {
-	query := `SELECT name, location, full_file_path, size, width, height, length, framerate, frames, bitrate FROM files WHERE full_file_path = ?`
-	row := DB.QueryRow(query, filePath)
 
+// directoryPattern matches the normalised paths under directory, treating %
+// and _ in the name literally
+func directoryPattern(directory string) string {
+	return pathutil.EscapeLike(pathutil.NFC(directory)) + "%"
+}
+
+// videoColumns are the files columns read by scanVideo. Rows scanned before
+// disk_size was recorded report their apparent size.
+const videoColumns = `name, location, full_file_path, size, width, height, length, framerate, frames, bitrate, COALESCE(disk_size, size),
+	COALESCE(device, 0), COALESCE(inode, 0), COALESCE(links, 1), link_target, source_path, COALESCE(bpp, 0), video_codec, resolution_class, mtime, sample_hash`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanVideo reads one row selected with videoColumns
+func scanVideo(row rowScanner) (datatypes.VideoObject, error) {
 	var video datatypes.VideoObject
-	err := row.Scan(
-		&video.Name,
-		&video.Location,
-		&video.FullFilePath,
-		&video.Size,
-		&video.Width,
-		&video.Height,
-		&video.Length,
-		&video.Framerate,
-		&video.Frames,
-		&video.Bitrate,
-	)
+	err := row.Scan(&video.Name, &video.Location, &video.FullFilePath, &video.Size, &video.Width,
+		&video.Height, &video.Length, &video.Framerate, &video.Frames, &video.Bitrate, &video.DiskSize,
+		&video.Device, &video.Inode, &video.Links, &video.LinkTarget, &video.SourcePath, &video.BPP, &video.VideoCodec, &video.ResolutionClass, &video.ModTime, &video.SampleHash)
+	return video, err
+}
+
+// nullableBPP stores NULL for videos whose bits per pixel cannot be computed,
+// such as symbolic links recorded without probing
+func nullableBPP(video datatypes.VideoObject) interface{} {
+	if bpp := video.BitsPerPixel(); bpp > 0 {
+		return bpp
+	}
+	return nil
+}
+
+func QueryVideoByPath(filePath string) (*datatypes.VideoObject, error) {
+	// An exact match wins; otherwise the same name in another normalisation form
+	query := `SELECT ` + videoColumns + ` FROM files WHERE full_file_path = ? OR norm_path = ?
+		ORDER BY full_file_path = ? DESC LIMIT 1`
+	row := DB.QueryRow(query, filePath, pathutil.NFC(filePath), filePath)
+
+	video, err := scanVideo(row)
 	if err == sql.ErrNoRows {
 		return nil, nil // No matching video
 	} else if err != nil {
@@ -151,71 +1060,95 @@ func QueryVideoByPath(filePath string) (*datatypes.VideoObject, error) {
 	}
 	return &video, nil
 }
-func QueryVideos(directory string, minSize float64) ([]datatypes.VideoObject, error) {
+
+// QueryVideoByID returns the video with the given files.id, or nil if there is none
+func QueryVideoByID(id int) (*datatypes.VideoObject, error) {
+	query := `SELECT ` + videoColumns + ` FROM files WHERE id = ?`
+	video, err := scanVideo(DB.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error querying video %d: %w", id, err)
+	}
+	return &video, nil
+}
+
+func QueryAllVideos() ([]datatypes.VideoObject, error) {
+	return QueryFilteredVideos(VideoFilter{})
+}
+
+func QueryVideosByDirectory(directory string) ([]datatypes.VideoObject, error) {
 	query := `
-	SELECT name, location, full_file_path, size, width, height, length, framerate, frames, bitrate
-	FROM files
-	WHERE location LIKE ? AND size >= ?;
+		SELECT ` + videoColumns + `
+		FROM files WHERE norm_path LIKE ? ESCAPE '\'
 	`
-
-	rows, err := DB.Query(query, directory+"%", int(minSize*1024*1024*1024))
+	rows, err := DB.Query(query, directoryPattern(directory))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error querying videos by directory: %w", err)
 	}
 	defer rows.Close()
 
-	var videos []datatypes.VideoObject
+	videos := []datatypes.VideoObject{}
 	for rows.Next() {
-		var video datatypes.VideoObject
-		err := rows.Scan(&video.Name, &video.Location, &video.FullFilePath, &video.Size, &video.Width,
-			&video.Height, &video.Length, &video.Framerate, &video.Frames, &video.Bitrate)
+		video, err := scanVideo(rows)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("error scanning video row: %w", err)
 		}
 		videos = append(videos, video)
 	}
 	return videos, nil
 }
 
-func QueryAllVideos() ([]datatypes.VideoObject, error) {
-	query := `
-	SELECT name, location, full_file_path, size, width, height, length, framerate, frames, bitrate
-	FROM files;
-	`
-	rows, err := DB.Query(query)
+// QueryVideosUnder returns the videos recorded at path, or below it when path
+// was a directory
+func QueryVideosUnder(path string) ([]datatypes.VideoObject, error) {
+	video, err := QueryVideoByPath(path)
 	if err != nil {
-		return nil, fmt.Errorf("error querying all videos: %w", err)
+		return nil, err
+	}
+	if video != nil {
+		return []datatypes.VideoObject{*video}, nil
+	}
+	return QueryVideosByDirectory(path + string(filepath.Separator))
+}
+
+// QueryHardLinks returns the other recorded names of the file identified by
+// device and inode
+func QueryHardLinks(device, inode int64, exclude string) ([]datatypes.VideoObject, error) {
+	query := `SELECT ` + videoColumns + ` FROM files WHERE device = ? AND inode = ? AND full_file_path != ?`
+	rows, err := DB.Query(query, device, inode, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("error querying hard links: %w", err)
 	}
 	defer rows.Close()
 
-	var videos []datatypes.VideoObject
+	videos := []datatypes.VideoObject{}
 	for rows.Next() {
-		var video datatypes.VideoObject
-		err := rows.Scan(&video.Name, &video.Location, &video.FullFilePath, &video.Size, &video.Width,
-			&video.Height, &video.Length, &video.Framerate, &video.Frames, &video.Bitrate)
+		video, err := scanVideo(rows)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning video row: %w", err)
 		}
 		videos = append(videos, video)
 	}
-
 	return videos, nil
 }
 
-func QueryVideosByDirectory(directory string) ([]datatypes.VideoObject, error) {
+// QuerySampleVideos returns up to n randomly chosen videos under directory
+func QuerySampleVideos(directory string, n int) ([]datatypes.VideoObject, error) {
 	query := `
-		SELECT * FROM files WHERE location LIKE ?
+		SELECT ` + videoColumns + `
+		FROM files WHERE norm_path LIKE ? ESCAPE '\' ORDER BY RANDOM() LIMIT ?
 	`
-	rows, err := DB.Query(query, directory+"%")
+	rows, err := DB.Query(query, directoryPattern(directory), n)
 	if err != nil {
-		return nil, fmt.Errorf("error querying videos by directory: %w", err)
+		return nil, fmt.Errorf("error sampling videos: %w", err)
 	}
 	defer rows.Close()
 
 	videos := []datatypes.VideoObject{}
 	for rows.Next() {
-		var video datatypes.VideoObject
-		if err := rows.Scan(&video.Name, &video.Location, &video.FullFilePath, &video.Size, &video.Width, &video.Height, &video.Length, &video.Framerate, &video.Frames, &video.Bitrate); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning video row: %w", err)
 		}
 		videos = append(videos, video)
@@ -223,126 +1156,206 @@ func QueryVideosByDirectory(directory string) ([]datatypes.VideoObject, error) {
 	return videos, nil
 }
 
+// SetSourcePath records which original an output was transcoded from
+func SetSourcePath(outputPath, sourcePath string) error {
+	if _, err := DB.Exec(`UPDATE files SET source_path = ? WHERE full_file_path = ?`, sourcePath, outputPath); err != nil {
+		return fmt.Errorf("error recording source of %s: %w", outputPath, err)
+	}
+	treeReplace(outputPath, outputPath)
+	return nil
+}
+
 func UpdateVideoAfterTranscode(originalPath, newPath string, newSize int64) error {
 	query := `
-		UPDATE files SET full_file_path = ?, size = ? WHERE full_file_path = ?
+		UPDATE files SET full_file_path = ?, norm_path = ?, size = ?, video_codec = '', mtime = 0, sample_hash = '' WHERE full_file_path = ?
 	`
-	_, err := DB.Exec(query, newPath, newSize, originalPath)
+	_, err := DB.Exec(query, newPath, pathutil.NFC(newPath), newSize, originalPath)
 	if err != nil {
 		return fmt.Errorf("error updating video after transcode: %w", err)
 	}
+	// The output's streams are recorded by the next scan
+	if err := replaceStreams(newPath, nil); err != nil {
+		return err
+	}
+	treeReplace(originalPath, newPath)
 	return nil
 }
 
-func CleanDatabase() error {
+// CleanResult summarises a database cleanup
+type CleanResult struct {
+	Scanned      int         `json:"scanned"`
+	Moved        []MovedFile `json:"moved"`
+	Removed      []string    `json:"removed"`
+	PrunedProbes int64       `json:"pruned_probes"` // Cached probes of files gone or changed
+}
+
+// CleanDatabase drops records of files that no longer exist. Files that were
+// moved or renamed under searchRoots are detected and their records updated
+// instead, keeping their history. With no roots the library's common base
+// directory is searched, unless it is a filesystem root. Cached probes of
+// files that are gone or have changed are dropped too.
+func CleanDatabase(searchRoots []string) (CleanResult, error) {
+	result := CleanResult{Moved: []MovedFile{}, Removed: []string{}}
+	if err := safety.Check("clean"); err != nil {
+		return result, err
+	}
+
+	pruned, err := pruneProbeCache()
+	if err != nil {
+		return result, err
+	}
+	result.PrunedProbes = pruned
+	if pruned > 0 {
+		fmt.Printf("Pruned %d cached probes of missing or changed files\n", pruned)
+	}
+
 	// Query the database for all file paths
-	query := `SELECT full_file_path FROM files`
+	query := `SELECT full_file_path, size, length, sample_hash, archived_at IS NOT NULL FROM files`
 	rows, err := DB.Query(query)
 	if err != nil {
-		return fmt.Errorf("error querying database for cleanup: %w", err)
+		return result, fmt.Errorf("error querying database for cleanup: %w", err)
 	}
 	defer rows.Close()
 
-	var nonExistentFiles []string
+	var nonExistentFiles []datatypes.VideoObject
+	known := map[string]bool{}
 	var totalFiles int
+	var prefix commonPrefix
 
 	for rows.Next() {
-		var filePath string
-		if err := rows.Scan(&filePath); err != nil {
+		var video datatypes.VideoObject
+		var length sql.NullInt64
+		var archived bool
+		if err := rows.Scan(&video.FullFilePath, &video.Size, &length, &video.SampleHash, &archived); err != nil {
 			fmt.Printf("Error scanning file path: %s\n", err)
 			continue
 		}
-
+		video.Length = int(length.Int64)
+		known[video.FullFilePath] = true
 		totalFiles++
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			nonExistentFiles = append(nonExistentFiles, filePath)
+		// Files at a URL or on an ssh host are checked by rescanning them, not
+		// on disk, and files archived to an rclone remote not at all
+		if pathutil.IsURL(video.FullFilePath) || sshpath.Is(video.FullFilePath) || (archived && !filepath.IsAbs(video.FullFilePath)) {
+			continue
+		}
+		prefix.add(filepath.Dir(video.FullFilePath))
+		if _, err := os.Stat(video.FullFilePath); os.IsNotExist(err) {
+			nonExistentFiles = append(nonExistentFiles, video)
 		} else if err != nil {
 			// Handle unexpected errors during file system checks
-			fmt.Printf("Error checking file %s: %s\n", filePath, err)
+			fmt.Printf("Error checking file %s: %s\n", video.FullFilePath, err)
 		}
 	}
+	rows.Close()
 
 	// Log database scan results
 	fmt.Printf("Total files scanned in database: %d\n", totalFiles)
-	fmt.Printf("Files marked for removal: %d\n", len(nonExistentFiles))
+	fmt.Printf("Missing files: %d\n", len(nonExistentFiles))
+	result.Scanned = totalFiles
+	if len(nonExistentFiles) == 0 {
+		fmt.Println("No missing files found in the database.")
+		return result, nil
+	}
 
-	// Remove non-existent files from the database
-	for _, filePath := range nonExistentFiles {
-		if err := DeleteVideo(filePath); err != nil {
-			fmt.Printf("Error removing entry for %s: %s\n", filePath, err)
+	// Follow files that were moved rather than deleted. A filesystem root
+	// as the common base would walk every disk, so none is searched then.
+	if len(searchRoots) == 0 {
+		if base := prefix.dir(); filepath.Dir(base) != base {
+			searchRoots = []string{base}
 		} else {
-			fmt.Printf("Removed database entry for missing file: %s\n", filePath)
+			fmt.Println("Not looking for moved files: the library has no common base directory, set LIBRARY_PATHS")
+		}
+	}
+	moves := findMoves(nonExistentFiles, known, searchRoots)
+	for _, move := range moves {
+		if err := MoveVideo(move.From, move.To); err != nil {
+			fmt.Printf("Error updating moved file %s: %s\n", move.From, err)
+			continue
 		}
+		fmt.Printf("Detected move: %s -> %s\n", move.From, move.To)
+		result.Moved = append(result.Moved, move)
 	}
 
-	if len(nonExistentFiles) == 0 {
-		fmt.Println("No missing files found in the database.")
-	} else {
-		fmt.Printf("Cleaned %d entries from the database.\n", len(nonExistentFiles))
+	// Remove the files that really are gone
+	moved := map[string]bool{}
+	for _, move := range result.Moved {
+		moved[move.From] = true
+	}
+	for _, video := range nonExistentFiles {
+		if moved[video.FullFilePath] {
+			continue
+		}
+		if err := DeleteVideo(video.FullFilePath); err != nil {
+			fmt.Printf("Error removing entry for %s: %s\n", video.FullFilePath, err)
+		} else {
+			fmt.Printf("Removed database entry for missing file: %s\n", video.FullFilePath)
+			result.Removed = append(result.Removed, video.FullFilePath)
+		}
 	}
 
-	return nil
+	fmt.Printf("Updated %d moved files and cleaned %d entries from the database.\n", len(result.Moved), len(result.Removed))
+	return result, nil
 }
 
-func BuildDirectoryTree() (*tree.DirectoryNode, error) {
-	videos, err := QueryAllVideos()
+// buildDirectoryTree builds the directory tree from the database
+func buildDirectoryTree() (*tree.DirectoryNode, error) {
+	// Find the common base directory from the distinct locations first, so
+	// videos can be streamed straight into the tree
+	rows, err := DB.Query(`SELECT DISTINCT location FROM files WHERE archived_at IS NULL`)
 	if err != nil {
-		return nil, fmt.Errorf("error querying videos: %w", err)
+		return nil, fmt.Errorf("error querying locations: %w", err)
 	}
-
-	if len(videos) == 0 {
-		return tree.NewDirectoryNode("/"), nil
+	var prefix commonPrefix
+	for rows.Next() {
+		var location string
+		if err := rows.Scan(&location); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning location: %w", err)
+		}
+		prefix.add(location)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying locations: %w", err)
 	}
 
-	// Find common base directory
-	baseDir := findCommonPrefix(videos)
-	root := tree.NewDirectoryNode(baseDir)
-
-	// Add all videos to the tree
-	for _, video := range videos {
+	root := tree.NewDirectoryNode(prefix.dir())
+	err = EachVideo(VideoFilter{}, func(video datatypes.VideoObject) error {
 		root.AddVideo(video)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying videos: %w", err)
 	}
-
 	return root, nil
 }
 
-// findCommonPrefix finds the common prefix between two paths
-func findCommonPrefix(videos []datatypes.VideoObject) string {
-	if len(videos) == 0 {
-		return "/"
-	}
-
-	// Start with the first video's directory
-	commonBaseDir := filepath.Dir(videos[0].FullFilePath)
+// commonPrefix finds the common base directory of the directories added to it
+type commonPrefix struct {
+	base string
+	seen bool
+}
 
-	// Iterate over all videos to find the common base directory
-	for _, video := range videos {
-		videoDir := filepath.Dir(video.FullFilePath)
-		for !strings.HasPrefix(videoDir, commonBaseDir) {
-			// Move up one level in the common base directory
-			commonBaseDir = filepath.Dir(commonBaseDir)
-			if commonBaseDir == "/" {
-				return commonBaseDir
-			}
+func (c *commonPrefix) add(dir string) {
+	if !c.seen {
+		c.base, c.seen = dir, true
+		return
+	}
+	for dir != c.base && !strings.HasPrefix(dir, strings.TrimSuffix(c.base, string(filepath.Separator))+string(filepath.Separator)) {
+		// Move up one level in the common base directory, stopping at the
+		// filesystem root
+		parent := filepath.Dir(c.base)
+		if parent == c.base {
+			break
 		}
+		c.base = parent
 	}
-
-	return commonBaseDir
 }
 
-func IsInSelectedDirectory(location string, selectedDirs []string, recursive bool) bool {
-	for _, dir := range selectedDirs {
-		if recursive {
-			// Check if the video's location is within the directory or any of its subdirectories
-			if strings.HasPrefix(location, dir) {
-				return true
-			}
-		} else {
-			// Check if the video's location matches the directory exactly
-			if location == dir {
-				return true
-			}
-		}
+// dir returns the common base directory, or / when nothing was added
+func (c *commonPrefix) dir() string {
+	if !c.seen {
+		return "/"
 	}
-	return false
+	return c.base
 }
@@ -0,0 +1,280 @@
+package db
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/pkg/scanner"
+)
+
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	if err := InitDatabase(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+}
+
+func insertTestVideo(t *testing.T, path string) {
+	t.Helper()
+	video := datatypes.VideoObject{
+		Name:          filepath.Base(path),
+		Location:      filepath.Dir(path),
+		FullFilePath:  path,
+		Size:          1024,
+		FileExtension: filepath.Ext(path),
+	}
+	if err := InsertVideo(video); err != nil {
+		t.Fatalf("inserting %q: %s", path, err)
+	}
+}
+
+func TestQueryVideoByPathAcrossForms(t *testing.T) {
+	openTestDatabase(t)
+	stored := map[string]string{
+		// Recorded decomposed, as from a macOS share, and looked up composed
+		"/media/Ame\u0301lie (2001).mkv":       "/media/Amélie (2001).mkv",
+		"/media/\u1100\u1161\u11A8 (2019).mkv": "/media/각 (2019).mkv",
+		// Recorded composed and looked up decomposed
+		"/media/Crème brûlée 🍮 [1080p].mkv": "/media/Cre\u0300me bru\u0302le\u0301e 🍮 [1080p].mkv",
+		// Quotes and brackets are stored and matched as they are
+		"/media/He said \"hi\" & 'bye' {cut}.mkv": "/media/He said \"hi\" & 'bye' {cut}.mkv",
+	}
+	for path := range stored {
+		insertTestVideo(t, path)
+	}
+	for path, lookup := range stored {
+		video, err := QueryVideoByPath(lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video == nil {
+			t.Errorf("QueryVideoByPath(%q) found nothing", lookup)
+			continue
+		}
+		if video.FullFilePath != path {
+			t.Errorf("QueryVideoByPath(%q) = %q, want the recorded %q", lookup, video.FullFilePath, path)
+		}
+	}
+}
+
+func TestQueryVideosByDirectoryWildcards(t *testing.T) {
+	openTestDatabase(t)
+	insertTestVideo(t, "/media/100% real/a.mkv")
+	insertTestVideo(t, "/media/100X real/b.mkv")
+	insertTestVideo(t, "/media/a_b/c.mkv")
+	insertTestVideo(t, "/media/axb/d.mkv")
+
+	tests := map[string]string{
+		"/media/100% real": "/media/100% real/a.mkv",
+		"/media/a_b":       "/media/a_b/c.mkv",
+	}
+	for directory, want := range tests {
+		videos, err := QueryVideosByDirectory(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(videos) != 1 || videos[0].FullFilePath != want {
+			t.Errorf("QueryVideosByDirectory(%q) = %v, want only %q", directory, videos, want)
+		}
+	}
+}
+
+func TestArchivedVideosLeaveFilters(t *testing.T) {
+	openTestDatabase(t)
+	insertTestVideo(t, "/media/movies/a.mkv")
+	insertTestVideo(t, "/media/movies/b.mkv")
+	if err := ArchiveVideo("/media/movies/a.mkv", "b2:archive/old/a.mkv"); err != nil {
+		t.Fatal(err)
+	}
+
+	videos, err := QueryFilteredVideos(VideoFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 1 || videos[0].FullFilePath != "/media/movies/b.mkv" {
+		t.Errorf("QueryFilteredVideos = %v, want only the unarchived file", videos)
+	}
+	videos, err = QueryFilteredVideos(VideoFilter{IncludeArchived: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 2 {
+		t.Errorf("QueryFilteredVideos with IncludeArchived found %d files, want 2", len(videos))
+	}
+	root, err := BuildDirectoryTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := root.GetAllFiles(true); len(files) != 1 || files[0].FullFilePath != "/media/movies/b.mkv" {
+		t.Errorf("directory tree holds %v, want only the unarchived file", files)
+	}
+}
+
+func TestTagVideosUnderDirectory(t *testing.T) {
+	openTestDatabase(t)
+	insertTestVideo(t, "/media/kids/a.mkv")
+	insertTestVideo(t, "/media/kids/sub/b.mkv")
+	insertTestVideo(t, "/media/kids-extra/c.mkv")
+
+	files, err := TagVideos("/media/kids", []string{"kids"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 {
+		t.Errorf("TagVideos tagged %d files, want the 2 below the directory", files)
+	}
+	videos, err := QueryFilteredVideos(VideoFilter{Tags: []string{"kids"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, video := range videos {
+		if video.FullFilePath == "/media/kids-extra/c.mkv" {
+			t.Error("tagging /media/kids also tagged a file in /media/kids-extra")
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	openTestDatabase(t)
+	insertTestVideo(t, "/media/movies/kept.mkv")
+	snapshot, err := Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestVideo(t, "/media/movies/later.mkv")
+
+	if err := Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"/media/movies/kept.mkv": true, "/media/movies/later.mkv": false} {
+		video, err := QueryVideoByPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (video != nil) != want {
+			t.Errorf("%s recorded after restore: %v, want %v", path, video != nil, want)
+		}
+	}
+}
+
+func TestFailedRestoreKeepsDatabase(t *testing.T) {
+	openTestDatabase(t)
+	insertTestVideo(t, "/media/movies/kept.mkv")
+
+	// A snapshot that decompresses to something other than a database
+	snapshot := filepath.Join(t.TempDir(), "broken"+backupSuffix)
+	out, err := os.Create(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(out)
+	zw.Write([]byte("not a database, only some text long enough to fill a header"))
+	zw.Close()
+	out.Close()
+
+	if err := Restore(snapshot); err == nil {
+		t.Fatal("restoring a broken snapshot succeeded")
+	}
+	video, err := QueryVideoByPath("/media/movies/kept.mkv")
+	if err != nil {
+		t.Fatalf("database unusable after a failed restore: %s", err)
+	}
+	if video == nil {
+		t.Error("failed restore lost the current database")
+	}
+}
+
+func TestFindMovesBySampleHash(t *testing.T) {
+	// Two files of the same size, told apart only by their content
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.mkv"), filepath.Join(dir, "second.mkv")
+	if err := os.WriteFile(first, []byte("first video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("other video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := []datatypes.VideoObject{
+		{FullFilePath: "/gone/b.mkv", Size: 11, SampleHash: scanner.SampleHash(second)},
+		{FullFilePath: "/gone/a.mkv", Size: 11, SampleHash: scanner.SampleHash(first)},
+	}
+
+	moves := findMoves(missing, map[string]bool{}, []string{dir})
+	want := []MovedFile{{From: "/gone/b.mkv", To: second}, {From: "/gone/a.mkv", To: first}}
+	if len(moves) != len(want) {
+		t.Fatalf("found moves %v, want %v", moves, want)
+	}
+	for i := range want {
+		if moves[i] != want[i] {
+			t.Errorf("move %d = %v, want %v", i, moves[i], want[i])
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		dirs []string
+		want string
+	}{
+		{nil, "/"},
+		{[]string{"/media/movies"}, "/media/movies"},
+		{[]string{"/media/movies/a", "/media/movies/b"}, "/media/movies"},
+		{[]string{"/media/movies", "/media/movies-extra"}, "/media"},
+		{[]string{"/media/movies", "/mnt/tv"}, "/"},
+	}
+	for _, tt := range tests {
+		var prefix commonPrefix
+		for _, dir := range tt.dirs {
+			prefix.add(dir)
+		}
+		if got := prefix.dir(); got != tt.want {
+			t.Errorf("common prefix of %v = %q, want %q", tt.dirs, got, tt.want)
+		}
+	}
+}
+
+func TestCleanPrunesProbeCache(t *testing.T) {
+	openTestDatabase(t)
+	dir := t.TempDir()
+	kept, changed, deleted := filepath.Join(dir, "kept.mkv"), filepath.Join(dir, "changed.mkv"), filepath.Join(dir, "deleted.mkv")
+	for _, path := range []string{kept, changed, deleted} {
+		if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		version, _ := runner.FileVersion(path)
+		ProbeStore{}.SaveProbe(path, version, version+":"+path, []byte("{}"))
+	}
+	if err := os.WriteFile(changed, []byte("longer video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CleanDatabase(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PrunedProbes != 2 {
+		t.Errorf("pruned %d probes, want those of the changed and deleted files", result.PrunedProbes)
+	}
+	var paths []string
+	rows, err := DB.Query(`SELECT path FROM probe_cache`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		rows.Scan(&path)
+		paths = append(paths, path)
+	}
+	if len(paths) != 1 || paths[0] != kept {
+		t.Errorf("probe cache keeps %v, want only %s", paths, kept)
+	}
+}
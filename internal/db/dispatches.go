@@ -0,0 +1,96 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// InsertDispatch records a job about to be submitted to a worker and returns its ID
+func InsertDispatch(batchID int, server, addr, filePath string) (int, error) {
+	result, err := DB.Exec(`INSERT INTO dispatches (batch_id, server, addr, file_path) VALUES (?, ?, ?, ?)`,
+		nullableID(batchID), server, addr, filePath)
+	if err != nil {
+		return 0, fmt.Errorf("error recording dispatch of %s: %w", filePath, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error reading dispatch id: %w", err)
+	}
+	return int(id), nil
+}
+
+// SetDispatchRemoteID records the ID the worker gave a dispatched job
+func SetDispatchRemoteID(id, remoteJobID int) error {
+	if _, err := DB.Exec(`UPDATE dispatches SET remote_job_id = ? WHERE id = ?`, remoteJobID, id); err != nil {
+		return fmt.Errorf("error recording remote job of dispatch %d: %w", id, err)
+	}
+	return nil
+}
+
+// FinishDispatch marks a dispatched job completed or failed. It reports
+// whether this call finished it, so a job reported by both its callback and
+// a poll is only recorded once.
+func FinishDispatch(id int, status, errMsg string) (bool, error) {
+	result, err := DB.Exec(`UPDATE dispatches SET status = ?, error = ?, finished_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = 'dispatched'`, status, errMsg, id)
+	if err != nil {
+		return false, fmt.Errorf("error finishing dispatch %d: %w", id, err)
+	}
+	changed, err := result.RowsAffected()
+	return changed == 1, err
+}
+
+// dispatchColumns selects a dispatch for scanDispatches
+const dispatchColumns = `SELECT id, COALESCE(batch_id, 0), server, addr, remote_job_id, file_path, status, error FROM dispatches`
+
+func scanDispatches(rows *sql.Rows) ([]datatypes.Dispatch, error) {
+	defer rows.Close()
+	dispatches := []datatypes.Dispatch{}
+	for rows.Next() {
+		var d datatypes.Dispatch
+		if err := rows.Scan(&d.ID, &d.BatchID, &d.Server, &d.Addr, &d.RemoteJobID, &d.FilePath, &d.Status, &d.Error); err != nil {
+			return nil, fmt.Errorf("error scanning dispatch: %w", err)
+		}
+		dispatches = append(dispatches, d)
+	}
+	return dispatches, rows.Err()
+}
+
+// QueryOutstandingDispatches returns the dispatched jobs not yet finished, of
+// one batch or of every batch when batchID is 0, oldest first
+func QueryOutstandingDispatches(batchID int) ([]datatypes.Dispatch, error) {
+	rows, err := DB.Query(dispatchColumns+` WHERE status = 'dispatched' AND (? = 0 OR batch_id = ?) ORDER BY id`, batchID, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying outstanding dispatches: %w", err)
+	}
+	return scanDispatches(rows)
+}
+
+// QueryDispatch returns one dispatch, nil if there is none with that ID
+func QueryDispatch(id int) (*datatypes.Dispatch, error) {
+	rows, err := DB.Query(dispatchColumns+` WHERE id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("error querying dispatch %d: %w", id, err)
+	}
+	dispatches, err := scanDispatches(rows)
+	if err != nil || len(dispatches) == 0 {
+		return nil, err
+	}
+	return &dispatches[0], nil
+}
+
+// FindOutstandingDispatch returns the unfinished job dispatched to server for
+// filePath, for callbacks that do not name their dispatch
+func FindOutstandingDispatch(server, filePath string) (*datatypes.Dispatch, error) {
+	rows, err := DB.Query(dispatchColumns+` WHERE status = 'dispatched' AND server = ? AND file_path = ? ORDER BY id LIMIT 1`, server, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up dispatch of %s: %w", filePath, err)
+	}
+	dispatches, err := scanDispatches(rows)
+	if err != nil || len(dispatches) == 0 {
+		return nil, err
+	}
+	return &dispatches[0], nil
+}
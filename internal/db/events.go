@@ -0,0 +1,51 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// InsertJobEvent records a lifecycle event of a transcode server job
+func InsertJobEvent(jobID int, event string, percentage float64, message string) error {
+	query := `INSERT INTO job_events (job_id, event, percentage, message) VALUES (?, ?, ?, ?)`
+	if _, err := DB.Exec(query, jobID, event, percentage, message); err != nil {
+		return fmt.Errorf("error recording %s event for job %d: %w", event, jobID, err)
+	}
+	return nil
+}
+
+// QueryJobEvents returns the events of a job, oldest first
+func QueryJobEvents(jobID int) ([]datatypes.JobEvent, error) {
+	query := `
+	SELECT id, job_id, event, percentage, message, created_at
+	FROM job_events
+	WHERE job_id = ?
+	ORDER BY id;
+	`
+	rows, err := DB.Query(query, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying events of job %d: %w", jobID, err)
+	}
+	defer rows.Close()
+
+	events := []datatypes.JobEvent{}
+	for rows.Next() {
+		var event datatypes.JobEvent
+		if err := rows.Scan(&event.ID, &event.JobID, &event.Event, &event.Percentage, &event.Message, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning job event row: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// QueryLastJobID returns the highest job ID with recorded events, so a
+// restarted server does not reuse IDs
+func QueryLastJobID() (int, error) {
+	var id int
+	if err := DB.QueryRow(`SELECT COALESCE(MAX(job_id), 0) FROM job_events`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("error querying last job ID: %w", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// backfillTranscodeFileIDs links transcodes recorded before the file ID
+// columns existed to the files still at their paths
+func backfillTranscodeFileIDs() error {
+	for _, update := range []string{
+		`UPDATE transcodes SET original_id = (SELECT id FROM files WHERE full_file_path = transcodes.OriginalVideo) WHERE original_id IS NULL`,
+		`UPDATE transcodes SET output_id = (SELECT id FROM files WHERE full_file_path = transcodes.Transcoded) WHERE output_id IS NULL AND discarded = 0`,
+	} {
+		if _, err := DB.Exec(update); err != nil {
+			return fmt.Errorf("error linking transcodes to files: %w", err)
+		}
+	}
+	return nil
+}
+
+// lineageColumns selects a transcode with both of its files, for scanLineageLinks
+const lineageColumns = `t.id, COALESCE(t.original_id, 0), COALESCE(o.full_file_path, t.OriginalVideo), o.id IS NOT NULL,
+	COALESCE(t.output_id, 0), COALESCE(n.full_file_path, t.Transcoded), n.id IS NOT NULL, t.profile, t.discarded, t.created_at
+	FROM transcodes t
+	LEFT JOIN files o ON o.id = t.original_id
+	LEFT JOIN files n ON n.id = t.output_id`
+
+// scanLineageLinks reads rows selected with lineageColumns
+func scanLineageLinks(rows *sql.Rows) ([]datatypes.LineageLink, error) {
+	defer rows.Close()
+	links := []datatypes.LineageLink{}
+	for rows.Next() {
+		var link datatypes.LineageLink
+		if err := rows.Scan(&link.TranscodeID, &link.OriginalID, &link.Original, &link.OriginalExists,
+			&link.OutputID, &link.Output, &link.OutputExists, &link.Profile, &link.Discarded, &link.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning lineage row: %w", err)
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// fileIDForLineage returns the ID of the file at path, falling back to the
+// ID transcodes recorded for it once the file itself is gone
+func fileIDForLineage(path string) (int, error) {
+	var id sql.NullInt64
+	err := DB.QueryRow(`SELECT id FROM files WHERE full_file_path = ?`, path).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = DB.QueryRow(`
+		SELECT MAX(id) FROM (
+			SELECT original_id AS id FROM transcodes WHERE OriginalVideo = ?
+			UNION ALL SELECT output_id FROM transcodes WHERE Transcoded = ?
+		)`, path, path).Scan(&id)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error looking up %s: %w", path, err)
+	}
+	return int(id.Int64), nil
+}
+
+// QueryLineage returns every transcode leading to the file at path and every
+// transcode made from it or its descendants, oldest ancestor first. It is
+// empty for files that were never transcoded.
+func QueryLineage(path string) ([]datatypes.LineageLink, error) {
+	id, err := fileIDForLineage(path)
+	if err != nil || id == 0 {
+		return []datatypes.LineageLink{}, err
+	}
+
+	// Walk back through the transcodes that produced each ancestor
+	var ancestors []datatypes.LineageLink
+	seen := map[int]bool{id: true}
+	for current := id; ; {
+		rows, err := DB.Query(`SELECT `+lineageColumns+` WHERE t.output_id = ? AND t.discarded = 0 ORDER BY t.id DESC LIMIT 1`, current)
+		if err != nil {
+			return nil, fmt.Errorf("error querying lineage of %s: %w", path, err)
+		}
+		links, err := scanLineageLinks(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(links) == 0 {
+			break
+		}
+		ancestors = append(links, ancestors...)
+		if current = links[0].OriginalID; current == 0 || seen[current] {
+			break
+		}
+		seen[current] = true
+	}
+
+	// Then forward through everything made from the file, including
+	// discarded attempts, whose outputs are not followed further
+	lineage := ancestors
+	for queue := []int{id}; len(queue) > 0; queue = queue[1:] {
+		rows, err := DB.Query(`SELECT `+lineageColumns+` WHERE t.original_id = ? ORDER BY t.id`, queue[0])
+		if err != nil {
+			return nil, fmt.Errorf("error querying lineage of %s: %w", path, err)
+		}
+		links, err := scanLineageLinks(rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			lineage = append(lineage, link)
+			if !link.Discarded && link.OutputID != 0 && !seen[link.OutputID] {
+				seen[link.OutputID] = true
+				queue = append(queue, link.OutputID)
+			}
+		}
+	}
+	return lineage, nil
+}
+
+// QueryOrphanedOriginals returns the kept transcodes whose original is still
+// recorded but whose output has since been deleted, newest first
+func QueryOrphanedOriginals() ([]datatypes.LineageLink, error) {
+	rows, err := DB.Query(`SELECT ` + lineageColumns + `
+	WHERE t.discarded = 0 AND o.id IS NOT NULL AND t.output_id IS NOT NULL AND n.id IS NULL
+	ORDER BY t.id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying orphaned originals: %w", err)
+	}
+	return scanLineageLinks(rows)
+}
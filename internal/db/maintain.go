@@ -0,0 +1,58 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MaintainResult reports the outcome of a maintenance pass
+type MaintainResult struct {
+	Integrity  string `json:"integrity"`
+	SizeBefore int64  `json:"size_before"`
+	SizeAfter  int64  `json:"size_after"`
+}
+
+// Maintain checks the database for corruption, then compacts it with VACUUM
+// and refreshes the query planner statistics with ANALYZE. A failed integrity
+// check stops before anything is rewritten.
+func Maintain() (MaintainResult, error) {
+	var result MaintainResult
+	result.SizeBefore = fileSize(Path)
+
+	rows, err := DB.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return result, fmt.Errorf("error running integrity check: %w", err)
+	}
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("error reading integrity check: %w", err)
+		}
+		problems = append(problems, line)
+	}
+	rows.Close()
+	result.Integrity = strings.Join(problems, "; ")
+	if result.Integrity != "ok" {
+		return result, fmt.Errorf("integrity check failed: %s", result.Integrity)
+	}
+
+	if _, err := DB.Exec(`VACUUM`); err != nil {
+		return result, fmt.Errorf("error vacuuming database: %w", err)
+	}
+	if _, err := DB.Exec(`ANALYZE`); err != nil {
+		return result, fmt.Errorf("error analysing database: %w", err)
+	}
+	result.SizeAfter = fileSize(Path)
+	return result, nil
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,287 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/pkg/scanner"
+)
+
+// MovedFile is a record whose file was found at a new path
+type MovedFile struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// durationTolerance is how far apart, in seconds, two durations may be and still match
+const durationTolerance = 1
+
+// findMoves looks under roots for untracked video files that match missing
+// records by size, then by the hash of their first MiB when the record has
+// one and otherwise by duration. A file whose duration cannot be probed is
+// only matched when its size is unique among both the missing and the new files.
+func findMoves(missing []datatypes.VideoObject, known map[string]bool, roots []string) []MovedFile {
+	candidates := map[int][]string{}
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil // Unreadable directories just can't hold a match
+			}
+			if !info.IsDir() && scanner.CheckExtension(info.Name()) && !known[path] {
+				size := int(info.Size())
+				candidates[size] = append(candidates[size], path)
+			}
+			return nil
+		})
+	}
+
+	missingBySize := map[int]int{}
+	for _, video := range missing {
+		missingBySize[video.Size]++
+	}
+
+	// Each candidate is probed and hashed at most once, failures included
+	type probed struct {
+		length int
+		ok     bool
+	}
+	prober := scanner.FFProbe{}
+	durations := map[string]probed{}
+	probe := func(path string) (int, bool) {
+		if cached, ok := durations[path]; ok {
+			return cached.length, cached.ok
+		}
+		meta, err := prober.Probe(path)
+		result := probed{meta.Length, err == nil && meta.Length > 0}
+		durations[path] = result
+		return result.length, result.ok
+	}
+	hashes := map[string]string{}
+	hash := func(path string) string {
+		if sum, ok := hashes[path]; ok {
+			return sum
+		}
+		hashes[path] = scanner.SampleHash(path)
+		return hashes[path]
+	}
+
+	claimed := map[string]bool{}
+	var moves []MovedFile
+	for _, video := range missing {
+		paths := candidates[video.Size]
+		for _, path := range paths {
+			if claimed[path] {
+				continue
+			}
+			if video.SampleHash != "" {
+				if sum := hash(path); sum != "" {
+					if sum == video.SampleHash {
+						claimed[path] = true
+						moves = append(moves, MovedFile{From: video.FullFilePath, To: path})
+						break
+					}
+					continue
+				}
+			}
+			length, ok := probe(path)
+			matches := ok && video.Length > 0 && abs(length-video.Length) <= durationTolerance
+			unique := len(paths) == 1 && missingBySize[video.Size] == 1
+			if matches || (!ok && unique) {
+				claimed[path] = true
+				moves = append(moves, MovedFile{From: video.FullFilePath, To: path})
+				break
+			}
+		}
+	}
+	return moves
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// MoveVideo points a file record, and the transcodes referring to it, at a new path
+func MoveVideo(oldPath, newPath string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting move of %s: %w", oldPath, err)
+	}
+	defer tx.Rollback()
+	if err := moveVideo(tx, oldPath, newPath); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	treeReplace(oldPath, newPath)
+	return nil
+}
+
+// moveVideo rewrites the paths of a move within tx
+func moveVideo(tx *sql.Tx, oldPath, newPath string) error {
+	query := `UPDATE files SET name = ?, location = ?, full_file_path = ?, norm_path = ?, file_extension = ? WHERE full_file_path = ?`
+	if _, err := tx.Exec(query, filepath.Base(newPath), filepath.Dir(newPath), newPath, pathutil.NFC(newPath), filepath.Ext(newPath), oldPath); err != nil {
+		return fmt.Errorf("error moving video %s: %w", oldPath, err)
+	}
+	if _, err := tx.Exec(`UPDATE transcodes SET OriginalVideo = ? WHERE OriginalVideo = ?`, newPath, oldPath); err != nil {
+		return fmt.Errorf("error moving transcodes of %s: %w", oldPath, err)
+	}
+	if _, err := tx.Exec(`UPDATE transcodes SET Transcoded = ? WHERE Transcoded = ?`, newPath, oldPath); err != nil {
+		return fmt.Errorf("error moving transcodes of %s: %w", oldPath, err)
+	}
+	return nil
+}
+
+// ArchiveVideo points a file record, and the transcodes referring to it, at
+// the file's new path in the archive, a local path or an rclone remote:path,
+// and marks it archived, all in one transaction. Archived files drop out of
+// the directory tree and of every VideoFilter query.
+func ArchiveVideo(oldPath, newPath string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting archive of %s: %w", oldPath, err)
+	}
+	defer tx.Rollback()
+	if err := moveVideo(tx, oldPath, newPath); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE files SET archived_at = CURRENT_TIMESTAMP WHERE full_file_path = ?`, newPath); err != nil {
+		return fmt.Errorf("error marking %s archived: %w", newPath, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	treeRemove(oldPath)
+	return nil
+}
+
+// RelocateResult counts the records whose paths a relocation rewrites
+type RelocateResult struct {
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	DryRun     bool     `json:"dry_run"`
+	Files      int      `json:"files"`
+	Transcodes int      `json:"transcodes"`
+	Failures   int      `json:"failures"`
+	Projects   int      `json:"projects"`
+	Missing    int      `json:"missing"`   // Relocated files not found at their new path
+	Conflicts  []string `json:"conflicts"` // New paths already recorded for another file
+}
+
+// relocatedPaths lists, per table, the path columns a relocation rewrites
+var relocatedPaths = []struct{ table, column string }{
+	{"files", "full_file_path"},
+	{"files", "location"},
+	{"files", "norm_path"}, // Rewritten with the normalised roots
+	{"files", "source_path"},
+	{"files", "link_target"},
+	{"transcodes", "OriginalVideo"},
+	{"transcodes", "Transcoded"},
+	{"failures", "file_path"},
+	{"projects", "directory"},
+}
+
+// under matches paths in column equal to or below a root given by underArgs.
+// SQLite's substr counts characters and LIKE ignores case, so the prefix is
+// compared with substr on the root's length in characters.
+func under(column string) string {
+	return fmt.Sprintf("(%[1]s = ? OR substr(%[1]s, 1, ?) = ?)", column)
+}
+
+// underArgs returns the arguments of under for root; its second argument is
+// also where the rest of a path starts for substr
+func underArgs(root string) []interface{} {
+	return []interface{}{root, utf8.RuneCountInString(root) + 1, root + string(filepath.Separator)}
+}
+
+// Relocate rewrites every recorded path under from to the same path under
+// to, for a library moved to a new mount point, keeping its history. With
+// dryRun nothing is changed. It refuses to run when a new path is already
+// recorded for another file.
+func Relocate(from, to string, dryRun bool) (RelocateResult, error) {
+	from, to = filepath.Clean(from), filepath.Clean(to)
+	result := RelocateResult{From: from, To: to, DryRun: dryRun, Conflicts: []string{}}
+	if from == to {
+		return result, fmt.Errorf("the old and new roots are the same")
+	}
+	args := underArgs(from)
+	moved := func(path string) string {
+		return to + strings.TrimPrefix(path, from)
+	}
+
+	rows, err := DB.Query(`SELECT full_file_path FROM files WHERE `+under("full_file_path"), args...)
+	if err != nil {
+		return result, fmt.Errorf("error reading files under %s: %w", from, err)
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("error reading files under %s: %w", from, err)
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	for _, path := range paths {
+		existing, err := QueryVideoByPath(moved(path))
+		if err != nil {
+			return result, err
+		}
+		if existing != nil {
+			result.Conflicts = append(result.Conflicts, moved(path))
+		}
+		if _, err := os.Stat(moved(path)); err != nil {
+			result.Missing++
+		}
+	}
+	result.Files = len(paths)
+
+	transcodesQuery := `SELECT COUNT(*) FROM transcodes WHERE ` + under("OriginalVideo") + ` OR ` + under("Transcoded")
+	if err := DB.QueryRow(transcodesQuery, append(append([]interface{}{}, args...), args...)...).Scan(&result.Transcodes); err != nil {
+		return result, fmt.Errorf("error counting transcodes under %s: %w", from, err)
+	}
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM failures WHERE `+under("file_path"), args...).Scan(&result.Failures); err != nil {
+		return result, fmt.Errorf("error counting failures under %s: %w", from, err)
+	}
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM projects WHERE `+under("directory"), args...).Scan(&result.Projects); err != nil {
+		return result, fmt.Errorf("error counting projects under %s: %w", from, err)
+	}
+	if dryRun {
+		return result, nil
+	}
+	if len(result.Conflicts) > 0 {
+		return result, fmt.Errorf("%d relocated paths are already recorded; remove those records or rescan first", len(result.Conflicts))
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return result, fmt.Errorf("error starting relocation: %w", err)
+	}
+	defer tx.Rollback()
+	for _, path := range relocatedPaths {
+		oldRoot, newRoot := from, to
+		if path.column == "norm_path" {
+			oldRoot, newRoot = pathutil.NFC(from), pathutil.NFC(to)
+		}
+		query := fmt.Sprintf(`UPDATE %[1]s SET %[2]s = ? || substr(%[2]s, ?) WHERE %[3]s`, path.table, path.column, under(path.column))
+		rootArgs := underArgs(oldRoot)
+		if _, err := tx.Exec(query, append([]interface{}{newRoot, rootArgs[1]}, rootArgs...)...); err != nil {
+			return result, fmt.Errorf("error relocating %s.%s: %w", path.table, path.column, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("error committing relocation: %w", err)
+	}
+	InvalidateDirectoryTree()
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// ProbeStore keeps ffprobe output in the probe_cache table, for the
+// runner's ProbeCache
+type ProbeStore struct{}
+
+// LoadProbe returns the output saved under key
+func (ProbeStore) LoadProbe(key string) ([]byte, bool) {
+	var output []byte
+	if err := DB.QueryRow(`SELECT output FROM probe_cache WHERE cache_key = ?`, key).Scan(&output); err != nil {
+		return nil, false
+	}
+	return output, true
+}
+
+// SaveProbe saves the output of a probe of path at version, dropping those
+// saved before path last changed. Failures only cost a later probe, so they
+// are logged.
+func (ProbeStore) SaveProbe(path, version, key string, output []byte) {
+	if _, err := DB.Exec(`INSERT OR REPLACE INTO probe_cache (cache_key, path, version, output) VALUES (?, ?, ?, ?)`,
+		key, path, version, output); err != nil {
+		log.Printf("Error caching probe of %s: %s\n", path, err)
+		return
+	}
+	if _, err := DB.Exec(`DELETE FROM probe_cache WHERE path = ? AND version != ?`, path, version); err != nil {
+		log.Printf("Error pruning probe cache of %s: %s\n", path, err)
+	}
+}
+
+// ClearProbeCache drops every cached probe and returns how many there were
+func ClearProbeCache() (int64, error) {
+	result, err := DB.Exec(`DELETE FROM probe_cache`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// pruneProbeCache drops the cached probes of files that were deleted or
+// moved, or changed since they were probed, and returns how many it dropped
+func pruneProbeCache() (int64, error) {
+	rows, err := DB.Query(`SELECT DISTINCT path, version FROM probe_cache`)
+	if err != nil {
+		return 0, fmt.Errorf("error querying probe cache: %w", err)
+	}
+	var stale [][2]string
+	for rows.Next() {
+		var path, version string
+		if err := rows.Scan(&path, &version); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning probe cache: %w", err)
+		}
+		if current, ok := runner.FileVersion(path); !ok || current != version {
+			stale = append(stale, [2]string{path, version})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error querying probe cache: %w", err)
+	}
+
+	var pruned int64
+	for _, entry := range stale {
+		result, err := DB.Exec(`DELETE FROM probe_cache WHERE path = ? AND version = ?`, entry[0], entry[1])
+		if err != nil {
+			return pruned, fmt.Errorf("error pruning probe cache of %s: %w", entry[0], err)
+		}
+		count, _ := result.RowsAffected()
+		pruned += count
+	}
+	return pruned, nil
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// CreateProject records a new migration project and returns its ID
+func CreateProject(project datatypes.Project) (int, error) {
+	query := `INSERT INTO projects (name, codec, directory) VALUES (?, ?, ?)`
+	result, err := DB.Exec(query, project.Name, project.Codec, project.Directory)
+	if err != nil {
+		return 0, fmt.Errorf("error creating project %s: %w", project.Name, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error reading project id: %w", err)
+	}
+	return int(id), nil
+}
+
+// QueryProjects returns every project, oldest first
+func QueryProjects() ([]datatypes.Project, error) {
+	return queryProjects(`SELECT id, name, codec, directory, created_at FROM projects ORDER BY id`)
+}
+
+// QueryProject returns the named project, or nil if it does not exist
+func QueryProject(name string) (*datatypes.Project, error) {
+	projects, err := queryProjects(`SELECT id, name, codec, directory, created_at FROM projects WHERE name = ?`, name)
+	if err != nil || len(projects) == 0 {
+		return nil, err
+	}
+	return &projects[0], nil
+}
+
+func queryProjects(query string, args ...interface{}) ([]datatypes.Project, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying projects: %w", err)
+	}
+	defer rows.Close()
+
+	projects := []datatypes.Project{}
+	for rows.Next() {
+		var project datatypes.Project
+		if err := rows.Scan(&project.ID, &project.Name, &project.Codec, &project.Directory, &project.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning project row: %w", err)
+		}
+		projects = append(projects, project)
+	}
+	return projects, rows.Err()
+}
+
+// DeleteProject removes a project and its snapshots, reporting whether it existed
+func DeleteProject(name string) (bool, error) {
+	project, err := QueryProject(name)
+	if err != nil || project == nil {
+		return false, err
+	}
+	if _, err := DB.Exec(`DELETE FROM project_snapshots WHERE project_id = ?`, project.ID); err != nil {
+		return false, fmt.Errorf("error deleting snapshots of project %s: %w", name, err)
+	}
+	if _, err := DB.Exec(`DELETE FROM projects WHERE id = ?`, project.ID); err != nil {
+		return false, fmt.Errorf("error deleting project %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// QueryUnprobedPaths returns the videos matching filter, ignoring its codecs,
+// whose codec is not yet known
+func QueryUnprobedPaths(filter VideoFilter) ([]string, error) {
+	filter.Codecs = nil
+	where, args := filter.where()
+	rows, err := DB.Query(`SELECT full_file_path FROM files WHERE `+where+` AND video_codec = '' AND link_target = ''`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying unprobed videos: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("error scanning unprobed video row: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// SetVideoCodec records the probed codec of a video
+func SetVideoCodec(path, codec string) error {
+	if _, err := DB.Exec(`UPDATE files SET video_codec = ? WHERE full_file_path = ?`, codec, path); err != nil {
+		return fmt.Errorf("error recording codec of %s: %w", path, err)
+	}
+	return nil
+}
+
+// AggregateProject counts the videos matching filter and how many are already
+// in codec. Hard links are counted once and symbolic links not at all.
+func AggregateProject(filter VideoFilter, codec string) (datatypes.ProjectSnapshot, error) {
+	where, args := filter.where()
+	query := `
+	SELECT COUNT(*),
+		COALESCE(SUM(CASE WHEN done THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(size), 0),
+		COALESCE(SUM(CASE WHEN done THEN 0 ELSE size END), 0)
+	FROM (
+		SELECT size, LOWER(video_codec) = ? AS done,
+			ROW_NUMBER() OVER (
+				PARTITION BY CASE WHEN COALESCE(inode, 0) = 0 THEN 'id:' || id ELSE device || ':' || inode END
+				ORDER BY id
+			) AS copy
+		FROM files
+		WHERE ` + where + ` AND link_target = ''
+	)
+	WHERE copy = 1;`
+	var snapshot datatypes.ProjectSnapshot
+	err := DB.QueryRow(query, append([]interface{}{strings.ToLower(codec)}, args...)...).Scan(
+		&snapshot.Files, &snapshot.DoneFiles, &snapshot.Size, &snapshot.RemainingSize)
+	if err != nil {
+		return snapshot, fmt.Errorf("error aggregating project: %w", err)
+	}
+	return snapshot, nil
+}
+
+// InsertProjectSnapshot records a project's progress for its burn-down
+func InsertProjectSnapshot(projectID int, snapshot datatypes.ProjectSnapshot) error {
+	query := `INSERT INTO project_snapshots (project_id, files, done_files, size, remaining_size, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := DB.Exec(query, projectID, snapshot.Files, snapshot.DoneFiles, snapshot.Size, snapshot.RemainingSize, sqlTime(snapshot.TakenAt))
+	if err != nil {
+		return fmt.Errorf("error recording project snapshot: %w", err)
+	}
+	return nil
+}
+
+// QueryProjectBurndown returns the last snapshot of each day, oldest first
+func QueryProjectBurndown(projectID int) ([]datatypes.ProjectSnapshot, error) {
+	query := `
+	SELECT files, done_files, size, remaining_size, created_at
+	FROM project_snapshots
+	WHERE id IN (SELECT MAX(id) FROM project_snapshots WHERE project_id = ? GROUP BY date(created_at))
+	ORDER BY id;
+	`
+	rows, err := DB.Query(query, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying project burn-down: %w", err)
+	}
+	defer rows.Close()
+
+	snapshots := []datatypes.ProjectSnapshot{}
+	for rows.Next() {
+		var snapshot datatypes.ProjectSnapshot
+		if err := rows.Scan(&snapshot.Files, &snapshot.DoneFiles, &snapshot.Size, &snapshot.RemainingSize, &snapshot.TakenAt); err != nil {
+			return nil, fmt.Errorf("error scanning project snapshot row: %w", err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// QueryQuotaNotice returns when the owners were told the directory is over
+// its quota, or nil when they have not been
+func QueryQuotaNotice(path string) (*time.Time, error) {
+	var notifiedAt time.Time
+	err := DB.QueryRow(`SELECT notified_at FROM quota_notices WHERE path = ?`, path).Scan(&notifiedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying quota notice: %w", err)
+	}
+	return &notifiedAt, nil
+}
+
+// RecordQuotaNotice records that the owners were told the directory is over its quota
+func RecordQuotaNotice(path string, notifiedAt time.Time) error {
+	if _, err := DB.Exec(`INSERT OR REPLACE INTO quota_notices (path, notified_at) VALUES (?, ?)`, path, notifiedAt.UTC()); err != nil {
+		return fmt.Errorf("error recording quota notice: %w", err)
+	}
+	return nil
+}
+
+// ClearQuotaNotice forgets the notice of a directory, once it has been acted
+// on or is back under its quota
+func ClearQuotaNotice(path string) error {
+	if _, err := DB.Exec(`DELETE FROM quota_notices WHERE path = ?`, path); err != nil {
+		return fmt.Errorf("error clearing quota notice: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// resolutionClassSQL is the SQL for datatypes.ResolutionClass of a files row
+func resolutionClassSQL() string {
+	query := "CASE WHEN width IS NULL OR height IS NULL OR width <= 0 OR height <= 0 THEN ''"
+	for _, bound := range datatypes.ResolutionBounds {
+		query += fmt.Sprintf(" WHEN (MAX(width, height) >= %d AND MIN(width, height) >= %d) OR MIN(width, height) >= %d THEN '%s'",
+			bound.MinLong, bound.MinShort, bound.MinLines, bound.Class)
+	}
+	return query + " ELSE '' END"
+}
+
+// RecordScanSnapshot records the totals of the files under root, overall and
+// per resolution. Hard links are counted in Files but their data only once.
+func RecordScanSnapshot(root string) (datatypes.ScanSnapshot, error) {
+	root = filepath.Clean(root)
+	snapshot := datatypes.ScanSnapshot{Root: root, Resolutions: []datatypes.ResolutionTotal{}, TakenAt: time.Now()}
+	where, args := VideoFilter{Directory: root, Recursive: true}.where()
+	rows, err := DB.Query(`
+	SELECT resolution, COUNT(*),
+		COALESCE(SUM(CASE WHEN copy = 1 THEN size END), 0),
+		COALESCE(SUM(CASE WHEN copy = 1 THEN disk END), 0)
+	FROM (
+		SELECT CASE WHEN resolution_class = '' THEN 'unknown' ELSE resolution_class END AS resolution, size, COALESCE(disk_size, size) AS disk,
+			ROW_NUMBER() OVER (
+				PARTITION BY CASE WHEN COALESCE(inode, 0) = 0 THEN 'id:' || id ELSE device || ':' || inode END
+				ORDER BY id
+			) AS copy
+		FROM files
+		WHERE `+where+`
+	)
+	GROUP BY resolution
+	ORDER BY resolution`, args...)
+	if err != nil {
+		return snapshot, fmt.Errorf("error totalling %s: %w", root, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var total datatypes.ResolutionTotal
+		var diskSize int64
+		if err := rows.Scan(&total.Resolution, &total.Files, &total.Size, &diskSize); err != nil {
+			return snapshot, fmt.Errorf("error scanning resolution total: %w", err)
+		}
+		snapshot.Files += total.Files
+		snapshot.Size += total.Size
+		snapshot.DiskSize += diskSize
+		snapshot.Resolutions = append(snapshot.Resolutions, total)
+	}
+	if err := rows.Err(); err != nil {
+		return snapshot, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return snapshot, fmt.Errorf("error recording scan snapshot: %w", err)
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`INSERT INTO scan_snapshots (root, files, size, disk_size, created_at) VALUES (?, ?, ?, ?, ?)`,
+		root, snapshot.Files, snapshot.Size, snapshot.DiskSize, sqlTime(snapshot.TakenAt))
+	if err != nil {
+		return snapshot, fmt.Errorf("error recording scan snapshot: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return snapshot, fmt.Errorf("error reading scan snapshot id: %w", err)
+	}
+	snapshot.ID = int(id)
+	for _, total := range snapshot.Resolutions {
+		if _, err := tx.Exec(`INSERT INTO scan_snapshot_resolutions (snapshot_id, resolution, files, size) VALUES (?, ?, ?, ?)`,
+			id, total.Resolution, total.Files, total.Size); err != nil {
+			return snapshot, fmt.Errorf("error recording scan snapshot: %w", err)
+		}
+	}
+	return snapshot, tx.Commit()
+}
+
+// QueryScanSnapshots returns the snapshots of root, or of every root when it
+// is empty, oldest first. latestOnly keeps only the newest of each root.
+func QueryScanSnapshots(root string, latestOnly bool) ([]datatypes.ScanSnapshot, error) {
+	if root != "" {
+		root = filepath.Clean(root)
+	}
+	query := `SELECT id, root, files, size, disk_size, created_at FROM scan_snapshots WHERE (? = '' OR root = ?)`
+	if latestOnly {
+		query += ` AND id IN (SELECT MAX(id) FROM scan_snapshots GROUP BY root)`
+	}
+	rows, err := DB.Query(query+` ORDER BY id`, root, root)
+	if err != nil {
+		return nil, fmt.Errorf("error querying scan snapshots: %w", err)
+	}
+	snapshots := []datatypes.ScanSnapshot{}
+	byID := map[int]int{}
+	for rows.Next() {
+		snapshot := datatypes.ScanSnapshot{Resolutions: []datatypes.ResolutionTotal{}}
+		if err := rows.Scan(&snapshot.ID, &snapshot.Root, &snapshot.Files, &snapshot.Size, &snapshot.DiskSize, &snapshot.TakenAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning scan snapshot: %w", err)
+		}
+		byID[snapshot.ID] = len(snapshots)
+		snapshots = append(snapshots, snapshot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = DB.Query(`
+	SELECT r.snapshot_id, r.resolution, r.files, r.size
+	FROM scan_snapshot_resolutions r JOIN scan_snapshots s ON s.id = r.snapshot_id
+	WHERE (? = '' OR s.root = ?)
+	ORDER BY r.snapshot_id, r.resolution`, root, root)
+	if err != nil {
+		return nil, fmt.Errorf("error querying scan snapshot resolutions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var total datatypes.ResolutionTotal
+		if err := rows.Scan(&id, &total.Resolution, &total.Files, &total.Size); err != nil {
+			return nil, fmt.Errorf("error scanning scan snapshot resolution: %w", err)
+		}
+		if i, wanted := byID[id]; wanted {
+			snapshots[i].Resolutions = append(snapshots[i].Resolutions, total)
+		}
+	}
+	return snapshots, rows.Err()
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// replaceStreams records the streams of a file, replacing any recorded by an
+// earlier scan
+func replaceStreams(filePath string, streams []datatypes.Stream) error {
+	_, err := DB.Exec(`DELETE FROM streams WHERE file_id = (SELECT id FROM files WHERE full_file_path = ?)`, filePath)
+	if err != nil {
+		return fmt.Errorf("error clearing streams of %s: %w", filePath, err)
+	}
+	for _, stream := range streams {
+		_, err := DB.Exec(`
+		INSERT INTO streams (file_id, stream_index, type, codec, profile, language, channels, sample_rate, width, height, framerate, bitrate,
+			default_track, forced, hearing_impaired)
+		SELECT id, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? FROM files WHERE full_file_path = ?`,
+			stream.Index, stream.Type, stream.Codec, stream.Profile, stream.Language, stream.Channels, stream.SampleRate,
+			stream.Width, stream.Height, stream.Framerate, stream.Bitrate,
+			stream.Default, stream.Forced, stream.HearingImpaired, filePath)
+		if err != nil {
+			return fmt.Errorf("error recording stream %d of %s: %w", stream.Index, filePath, err)
+		}
+	}
+	return nil
+}
+
+// QueryStreams returns the streams recorded for a file in stream order
+func QueryStreams(filePath string) ([]datatypes.Stream, error) {
+	rows, err := DB.Query(`
+	SELECT s.stream_index, s.type, s.codec, s.profile, s.language, COALESCE(s.channels, 0), COALESCE(s.sample_rate, 0),
+		COALESCE(s.width, 0), COALESCE(s.height, 0), COALESCE(s.framerate, 0), COALESCE(s.bitrate, 0),
+		s.default_track, s.forced, s.hearing_impaired
+	FROM streams s JOIN files f ON f.id = s.file_id
+	WHERE f.full_file_path = ?
+	ORDER BY s.stream_index`, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error querying streams of %s: %w", filePath, err)
+	}
+	defer rows.Close()
+
+	streams := []datatypes.Stream{}
+	for rows.Next() {
+		var stream datatypes.Stream
+		if err := rows.Scan(&stream.Index, &stream.Type, &stream.Codec, &stream.Profile, &stream.Language, &stream.Channels, &stream.SampleRate,
+			&stream.Width, &stream.Height, &stream.Framerate, &stream.Bitrate,
+			&stream.Default, &stream.Forced, &stream.HearingImpaired); err != nil {
+			return nil, fmt.Errorf("error scanning stream row: %w", err)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, rows.Err()
+}
+
+// StreamMatch describes a stream a file must have, or lack, to match a
+// VideoFilter. Empty fields match anything.
+type StreamMatch struct {
+	Type     string // video, audio, subtitle, ...
+	Codec    string // Codec name, or the start of the codec profile, e.g. dts-hd
+	Language string // ISO 639-2, e.g. eng
+}
+
+// ParseStreamMatch reads "type[:codec][:language]", e.g. audio:dts-hd or subtitle::eng
+func ParseStreamMatch(value string) (StreamMatch, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(value)), ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return StreamMatch{}, fmt.Errorf("invalid stream match %q, expected type[:codec][:language]", value)
+	}
+	match := StreamMatch{Type: parts[0]}
+	if len(parts) > 1 {
+		match.Codec = parts[1]
+	}
+	if len(parts) > 2 {
+		match.Language = parts[2]
+	}
+	return match, nil
+}
+
+// ParseStreamMatches reads a comma separated list of stream matches
+func ParseStreamMatches(value string) ([]StreamMatch, error) {
+	var matches []StreamMatch
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		match, err := ParseStreamMatch(entry)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// String formats the match as ParseStreamMatch reads it
+func (m StreamMatch) String() string {
+	return strings.TrimRight(m.Type+":"+m.Codec+":"+m.Language, ":")
+}
+
+// exists returns an EXISTS subquery for files having a matching stream
+func (m StreamMatch) exists() (string, []interface{}) {
+	query := "EXISTS (SELECT 1 FROM streams s WHERE s.file_id = files.id AND s.type = ?"
+	args := []interface{}{m.Type}
+	if m.Codec != "" {
+		query += " AND (LOWER(s.codec) = ? OR LOWER(s.profile) LIKE ?)"
+		args = append(args, m.Codec, m.Codec+"%")
+	}
+	if m.Language != "" {
+		query += " AND s.language = ?"
+		args = append(args, m.Language)
+	}
+	return query + ")", args
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+)
+
+// ParseTag lowercases a tag and checks it is a single word of letters,
+// digits and - _ . :, e.g. 4k-archive or radarr-import
+func ParseTag(value string) (string, error) {
+	tag := strings.ToLower(strings.TrimSpace(value))
+	if tag == "" {
+		return "", fmt.Errorf("empty tag")
+	}
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return "", fmt.Errorf("invalid tag %q, use letters, digits and - _ . :", value)
+		}
+	}
+	return tag, nil
+}
+
+// ParseTags reads a list of tags, each possibly comma separated
+func ParseTags(values []string) ([]string, error) {
+	var tags []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			tag, err := ParseTag(part)
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// underPath is the condition for the files at path or below it, with its
+// arguments, on the files table aliased f
+func underPath(path string) (string, []interface{}) {
+	path = filepath.Clean(path)
+	return "(f.full_file_path = ? OR f.full_file_path LIKE ? ESCAPE '\\')", []interface{}{path, pathutil.EscapeLike(path+string(filepath.Separator)) + "%"}
+}
+
+// TagVideos adds tags to every recorded file at or below path and returns
+// how many files that was
+func TagVideos(path string, tags []string) (int, error) {
+	where, args := underPath(path)
+	var files int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM files f WHERE `+where, args...).Scan(&files); err != nil {
+		return 0, fmt.Errorf("error looking up %s: %w", path, err)
+	}
+	for _, tag := range tags {
+		query := `INSERT OR IGNORE INTO file_tags (file_id, tag) SELECT f.id, ? FROM files f WHERE ` + where
+		if _, err := DB.Exec(query, append([]interface{}{tag}, args...)...); err != nil {
+			return 0, fmt.Errorf("error tagging %s: %w", path, err)
+		}
+	}
+	return files, nil
+}
+
+// UntagVideos removes tags from every recorded file at or below path and
+// returns how many tags were removed
+func UntagVideos(path string, tags []string) (int, error) {
+	where, args := underPath(path)
+	removed := 0
+	for _, tag := range tags {
+		query := `DELETE FROM file_tags WHERE tag = ? AND file_id IN (SELECT f.id FROM files f WHERE ` + where + `)`
+		result, err := DB.Exec(query, append([]interface{}{tag}, args...)...)
+		if err != nil {
+			return removed, fmt.Errorf("error untagging %s: %w", path, err)
+		}
+		n, _ := result.RowsAffected()
+		removed += int(n)
+	}
+	return removed, nil
+}
+
+// QueryFileTags returns the tags of a file in alphabetical order
+func QueryFileTags(filePath string) ([]string, error) {
+	rows, err := DB.Query(`SELECT t.tag FROM file_tags t JOIN files f ON f.id = t.file_id
+		WHERE f.full_file_path = ? ORDER BY t.tag`, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error querying tags of %s: %w", filePath, err)
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("error scanning tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// QueryTagCounts returns every tag in use with how many files carry it
+func QueryTagCounts() ([]datatypes.TagCount, error) {
+	rows, err := DB.Query(`SELECT tag, COUNT(*) FROM file_tags GROUP BY tag ORDER BY tag`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying tags: %w", err)
+	}
+	defer rows.Close()
+	counts := []datatypes.TagCount{}
+	for rows.Next() {
+		var count datatypes.TagCount
+		if err := rows.Scan(&count.Tag, &count.Files); err != nil {
+			return nil, fmt.Errorf("error scanning tag count: %w", err)
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// taggedWith returns a condition on the files table for files carrying tag
+func taggedWith(tag string) (string, []interface{}) {
+	return "EXISTS (SELECT 1 FROM file_tags t WHERE t.file_id = files.id AND t.tag = ?)", []interface{}{tag}
+}
+
+// tagTranscode records the tags of a transcode: those given for its job
+// plus those its original carries
+func tagTranscode(id int64, original string, tags []string) error {
+	for _, tag := range tags {
+		if _, err := DB.Exec(`INSERT OR IGNORE INTO transcode_tags (transcode_id, tag) VALUES (?, ?)`, id, tag); err != nil {
+			return fmt.Errorf("error tagging transcode of %s: %w", original, err)
+		}
+	}
+	_, err := DB.Exec(`INSERT OR IGNORE INTO transcode_tags (transcode_id, tag)
+		SELECT ?, t.tag FROM file_tags t JOIN files f ON f.id = t.file_id WHERE f.full_file_path = ?`, id, original)
+	if err != nil {
+		return fmt.Errorf("error tagging transcode of %s: %w", original, err)
+	}
+	return nil
+}
+
+// QuerySavingsByTag totals the kept transcodes carrying each tag, most space
+// saved first. An empty user includes every user's jobs.
+func QuerySavingsByTag(user string) ([]datatypes.TagSavings, error) {
+	query := `
+	SELECT g.tag, COUNT(*), COALESCE(SUM(t.OldSize - t.NewSize), 0)
+	FROM transcode_tags g JOIN transcodes t ON t.id = g.transcode_id
+	WHERE t.discarded = 0 AND (? = '' OR t.username = ?)
+	GROUP BY g.tag
+	ORDER BY 3 DESC;
+	`
+	rows, err := DB.Query(query, user, user)
+	if err != nil {
+		return nil, fmt.Errorf("error querying savings by tag: %w", err)
+	}
+	defer rows.Close()
+	savings := []datatypes.TagSavings{}
+	for rows.Next() {
+		var entry datatypes.TagSavings
+		if err := rows.Scan(&entry.Tag, &entry.Transcodes, &entry.SpaceSaved); err != nil {
+			return nil, fmt.Errorf("error scanning tag savings row: %w", err)
+		}
+		savings = append(savings, entry)
+	}
+	return savings, rows.Err()
+}
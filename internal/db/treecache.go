@@ -0,0 +1,87 @@
+package db
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/tree"
+)
+
+// The directory tree is built once per process and then kept in step with
+// the writes made through this package, instead of rescanning the table every
+// time a menu opens. Writes by other processes are not seen until the next run.
+var (
+	treeMutex  sync.Mutex
+	cachedTree *tree.DirectoryNode
+)
+
+// BuildDirectoryTree returns the directory tree of every video, building it on
+// first use. The caller gets its own copy, so scans and watches updating the
+// cached tree cannot change it while it is being walked.
+func BuildDirectoryTree() (*tree.DirectoryNode, error) {
+	treeMutex.Lock()
+	defer treeMutex.Unlock()
+	if cachedTree == nil {
+		root, err := buildDirectoryTree()
+		if err != nil {
+			return nil, err
+		}
+		cachedTree = root
+	}
+	return cachedTree.Copy(), nil
+}
+
+// InvalidateDirectoryTree drops the cached tree so the next call rebuilds it
+func InvalidateDirectoryTree() {
+	treeMutex.Lock()
+	cachedTree = nil
+	treeMutex.Unlock()
+}
+
+// treeAdd adds a newly recorded video to the cached tree. A video outside the
+// tree's base directory moves the base, so the tree is rebuilt instead.
+func treeAdd(video datatypes.VideoObject) {
+	treeMutex.Lock()
+	defer treeMutex.Unlock()
+	if cachedTree == nil {
+		return
+	}
+	empty := len(cachedTree.Files) == 0 && len(cachedTree.Children) == 0
+	if empty || !cachedTree.Contains(filepath.Clean(video.Location)) {
+		cachedTree = nil
+		return
+	}
+	cachedTree.AddVideo(video)
+}
+
+// treeRemove removes a video from the cached tree
+func treeRemove(path string) {
+	treeMutex.Lock()
+	defer treeMutex.Unlock()
+	if cachedTree != nil {
+		cachedTree.RemoveVideo(path)
+	}
+}
+
+// treeReplace swaps the cached entry for oldPath with the row now stored at newPath
+func treeReplace(oldPath, newPath string) {
+	treeMutex.Lock()
+	cached := cachedTree != nil
+	treeMutex.Unlock()
+	if !cached {
+		return
+	}
+
+	treeRemove(oldPath)
+	video, err := QueryVideoByPath(newPath)
+	if err != nil {
+		log.Printf("Error refreshing directory tree: %s\n", err)
+		InvalidateDirectoryTree()
+		return
+	}
+	if video != nil {
+		treeAdd(*video)
+	}
+}
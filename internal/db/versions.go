@@ -0,0 +1,70 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// KeepFileVersion copies the entry of a file into file_versions before a
+// scan replaces it with the file now at its path. An entry already kept,
+// such as one kept for a conflict moments before, is not kept twice.
+func KeepFileVersion(filePath, reason string) error {
+	query := `
+	INSERT INTO file_versions (file_id, full_file_path, size, disk_size, width, height, length, framerate, bitrate, video_codec, reason)
+	SELECT f.id, f.full_file_path, f.size, COALESCE(f.disk_size, f.size), f.width, f.height, f.length, f.framerate, f.bitrate,
+		COALESCE((SELECT codec FROM streams WHERE file_id = f.id AND type = 'video' ORDER BY stream_index LIMIT 1), f.video_codec), ?
+	FROM files f WHERE f.full_file_path = ? AND NOT EXISTS (
+		SELECT 1 FROM file_versions v WHERE v.id = (SELECT MAX(id) FROM file_versions WHERE file_id = f.id)
+		AND v.size = f.size AND v.width IS f.width AND v.height IS f.height AND v.length IS f.length)`
+	if _, err := DB.Exec(query, reason, filePath); err != nil {
+		return fmt.Errorf("error keeping previous version of %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// QueryFileVersions returns the superseded entries of the file at path, oldest first
+func QueryFileVersions(filePath string) ([]datatypes.FileVersion, error) {
+	rows, err := DB.Query(`SELECT id, file_id, full_file_path, size, COALESCE(disk_size, size), COALESCE(width, 0), COALESCE(height, 0),
+		COALESCE(length, 0), COALESCE(framerate, 0), COALESCE(bitrate, 0), video_codec, reason, superseded_at
+		FROM file_versions WHERE full_file_path = ? ORDER BY id`, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error querying versions of %s: %w", filePath, err)
+	}
+	defer rows.Close()
+	versions := []datatypes.FileVersion{}
+	for rows.Next() {
+		var v datatypes.FileVersion
+		if err := rows.Scan(&v.ID, &v.FileID, &v.Path, &v.Size, &v.DiskSize, &v.Width, &v.Height,
+			&v.Length, &v.Framerate, &v.Bitrate, &v.VideoCodec, &v.Reason, &v.SupersededAt); err != nil {
+			return nil, fmt.Errorf("error scanning file version: %w", err)
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// QueryVersionGrowth compares the first kept size of every file with
+// versions to its current size, largest growth first. Files no longer in the
+// library are left out. A negative limit returns them all.
+func QueryVersionGrowth(limit int) ([]datatypes.VersionGrowth, error) {
+	rows, err := DB.Query(`
+	SELECT f.full_file_path, COUNT(*), (SELECT size FROM file_versions WHERE full_file_path = f.full_file_path ORDER BY id LIMIT 1), f.size
+	FROM file_versions v JOIN files f ON f.full_file_path = v.full_file_path
+	GROUP BY f.full_file_path
+	ORDER BY f.size - (SELECT size FROM file_versions WHERE full_file_path = f.full_file_path ORDER BY id LIMIT 1) DESC
+	LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying version growth: %w", err)
+	}
+	defer rows.Close()
+	growth := []datatypes.VersionGrowth{}
+	for rows.Next() {
+		var g datatypes.VersionGrowth
+		if err := rows.Scan(&g.Path, &g.Versions, &g.FirstSize, &g.CurrentSize); err != nil {
+			return nil, fmt.Errorf("error scanning version growth: %w", err)
+		}
+		growth = append(growth, g)
+	}
+	return growth, rows.Err()
+}
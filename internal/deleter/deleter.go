@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/palzino/vidanalyser/internal/safety"
 	"github.com/palzino/vidanalyser/internal/utils"
 )
 
@@ -17,9 +18,12 @@ type RenamedFile struct {
 
 // DeleteOriginalFiles reads a JSON file containing renamed file mappings and deletes the original files
 func DeleteOriginalFiles(jsonPath string) error {
+	if err := safety.Check("delete original files"); err != nil {
+		return err
+	}
 	file, err := os.Open(jsonPath)
 	if err != nil {
-		utils.SendTelegramMessage(fmt.Sprintf("Error opening JSON file: %s", err))
+		utils.NotifyError(fmt.Sprintf("Error opening JSON file: %s", err))
 		return err
 	}
 	defer file.Close()
@@ -27,25 +31,25 @@ func DeleteOriginalFiles(jsonPath string) error {
 	var renamedFiles []RenamedFile
 	err = json.NewDecoder(file).Decode(&renamedFiles)
 	if err != nil {
-		utils.SendTelegramMessage(fmt.Sprintf("Error decoding JSON data: %s", err))
+		utils.NotifyError(fmt.Sprintf("Error decoding JSON data: %s", err))
 		return err
 	}
 
 	queueLength := len(renamedFiles)
 	for _, renamedFile := range renamedFiles {
-		err := os.Remove(renamedFile.OriginalName)
+		err := safety.Remove(renamedFile.OriginalName)
 		if err != nil {
-			utils.SendTelegramMessage(fmt.Sprintf("Error deleting file %s: %s", renamedFile.OriginalName, err))
+			utils.NotifyError(fmt.Sprintf("Error deleting file %s: %s", renamedFile.OriginalName, err))
 		} else {
-			utils.SendTelegramMessage(fmt.Sprintf("Deleted original file: %s", renamedFile.OriginalName))
+			utils.NotifyVerbose(fmt.Sprintf("Deleted original file: %s", renamedFile.OriginalName))
 		}
 
 		// Notify remaining items in the queue
 		queueLength--
-		utils.SendTelegramMessage(fmt.Sprintf("Items left in queue: %d", queueLength))
+		utils.NotifyVerbose(fmt.Sprintf("Items left in queue: %d", queueLength))
 	}
 
 	// Notify when deletion is complete
-	utils.SendTelegramMessage("All original files have been deleted.")
+	utils.NotifySummary("All original files have been deleted.")
 	return nil
 }
@@ -0,0 +1,282 @@
+// Package fswatch follows changes to the files under library roots as they
+// happen, so records can be kept in step without rescanning. It is backed by
+// fsnotify, so it works wherever fsnotify does: inotify on Linux, kqueue on
+// macOS and the BSDs, and ReadDirectoryChangesW on Windows.
+package fswatch
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+)
+
+// renameWindow is how long a rename waits for the create naming its new
+// path. fsnotify reports a rename as the old name followed straight away by
+// the new one, so anything left unpaired after this went outside the roots.
+// fsnotify does not pass on the kernel's rename cookie, so a create is only
+// taken as the new name when it has the device and inode of the old one.
+const renameWindow = 100 * time.Millisecond
+
+// Handlers receive the changes under the watched roots. Any may be nil.
+type Handlers struct {
+	// Removed gets a file or directory deleted or moved out of the roots
+	Removed func(path string)
+	// Moved gets a file or directory renamed within the roots
+	Moved func(from, to string)
+	// Written gets a file created or written to, or moved in from outside
+	// the roots, once for every file of a directory moved in. A file being
+	// copied in is reported for every write, so callers debounce.
+	Written func(path string)
+	// Lost gets every root after the system dropped events, so callers
+	// rescan it for the changes they missed
+	Lost func(root string)
+}
+
+func (h Handlers) removed(path string) {
+	if h.Removed != nil {
+		h.Removed(path)
+	}
+}
+
+func (h Handlers) moved(from, to string) {
+	if h.Moved != nil {
+		h.Moved(from, to)
+	}
+}
+
+func (h Handlers) written(path string) {
+	if h.Written != nil {
+		h.Written(path)
+	}
+}
+
+func (h Handlers) lost(root string) {
+	if h.Lost != nil {
+		h.Lost(root)
+	}
+}
+
+// entry identifies a file or directory under the roots
+type entry struct {
+	id  [2]uint64 // Device and inode
+	dir bool
+}
+
+// watcher follows every directory under the library roots, which fsnotify
+// needs one by one
+type watcher struct {
+	*fsnotify.Watcher
+	h     Handlers
+	roots []string
+
+	entries    map[string]entry  // Every file and directory seen under the roots
+	renamed    string            // Old name of a rename waiting for its new one
+	movedDirs  map[string]string // Directories renamed within the roots, old name to new
+	renameWait <-chan time.Time
+}
+
+// Watch passes h every file or directory deleted, moved or written under
+// roots. It blocks.
+func Watch(roots []string, h Handlers) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	w := &watcher{Watcher: fsw, h: h, roots: roots, entries: map[string]entry{}, movedDirs: map[string]string{}}
+	watched := 0
+	for _, root := range roots {
+		watched += w.addTree(root, nil)
+	}
+	log.Printf("Watching %d directories\n", watched)
+
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(event)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Error watching files: %s\n", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				w.overflowed()
+			}
+		case <-w.renameWait:
+			w.flushRename()
+		}
+	}
+}
+
+// overflowed starts over after the system dropped events: every root is
+// walked again and passed to Lost
+func (w *watcher) overflowed() {
+	w.renamed, w.renameWait = "", nil
+	w.entries = map[string]entry{}
+	for _, root := range w.roots {
+		w.addTree(root, nil)
+		w.h.lost(root)
+	}
+}
+
+// handle passes one event on, pairing a rename with the create that follows it
+func (w *watcher) handle(event fsnotify.Event) {
+	path := event.Name
+	if event.Has(fsnotify.Create) && w.renamed != "" && w.sameFile(w.renamed, path) {
+		from := w.renamed
+		w.renamed, w.renameWait = "", nil
+		w.rekey(from, path)
+		w.h.moved(from, path)
+		if isDir(path) {
+			w.movedDirs[from] = path
+			w.addTree(path, nil)
+		}
+		return
+	}
+	w.flushRename()
+
+	switch {
+	case event.Has(fsnotify.Rename):
+		// A directory renamed within the roots then reports its own rename,
+		// under either name, after which fsnotify drops its watch, so it is
+		// watched again
+		for from, to := range w.movedDirs {
+			if path == from || path == to {
+				delete(w.movedDirs, from)
+				w.addTree(to, nil)
+				return
+			}
+		}
+		w.renamed = path
+		w.renameWait = time.After(renameWindow)
+	case event.Has(fsnotify.Remove):
+		w.forget(path)
+		w.h.removed(path)
+	case event.Has(fsnotify.Create) && isDir(path):
+		w.addTree(path, w.h.written)
+	case event.Has(fsnotify.Create), event.Has(fsnotify.Write):
+		w.remember(path)
+		w.h.written(path)
+	}
+}
+
+// flushRename reports a rename that got no new name as a removal
+func (w *watcher) flushRename() {
+	if w.renamed == "" {
+		return
+	}
+	path := w.renamed
+	w.renamed, w.renameWait = "", nil
+	w.forget(path)
+	w.h.removed(path)
+}
+
+// sameFile reports whether to is the file last seen at from, by device and
+// inode. Files that cannot be identified never match.
+func (w *watcher) sameFile(from, to string) bool {
+	old, known := w.entries[from]
+	if !known {
+		return false
+	}
+	info, err := os.Lstat(to)
+	if err != nil {
+		return false
+	}
+	id, ok := pathutil.FileID(info)
+	return ok && id == old.id
+}
+
+// remember records the device and inode of path
+func (w *watcher) remember(path string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	if id, ok := pathutil.FileID(info); ok {
+		w.entries[path] = entry{id: id, dir: info.IsDir()}
+	}
+}
+
+// forget drops what was recorded of path, and of everything below it when it
+// was a directory
+func (w *watcher) forget(path string) {
+	old, known := w.entries[path]
+	delete(w.entries, path)
+	if !known || !old.dir {
+		return
+	}
+	prefix := path + string(filepath.Separator)
+	for name := range w.entries {
+		if strings.HasPrefix(name, prefix) {
+			delete(w.entries, name)
+		}
+	}
+}
+
+// rekey moves what was recorded of from, and of everything below it when it
+// was a directory, to the new name to
+func (w *watcher) rekey(from, to string) {
+	old, known := w.entries[from]
+	if !known {
+		return
+	}
+	delete(w.entries, from)
+	w.entries[to] = old
+	if !old.dir {
+		return
+	}
+	prefix := from + string(filepath.Separator)
+	var below []string
+	for name := range w.entries {
+		if strings.HasPrefix(name, prefix) {
+			below = append(below, name)
+		}
+	}
+	for _, name := range below {
+		w.entries[to+strings.TrimPrefix(name, from)] = w.entries[name]
+		delete(w.entries, name)
+	}
+}
+
+// addTree watches dir and every directory below it, passing the files
+// already there to found when set, and returns how many directories it watched
+func (w *watcher) addTree(dir string, found func(path string)) int {
+	watched := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() || d.Type().IsRegular() {
+			w.remember(path)
+		}
+		if !d.IsDir() {
+			if found != nil && d.Type().IsRegular() {
+				found(path)
+			}
+			return nil
+		}
+		if err := w.Add(path); err != nil {
+			log.Printf("Error watching %s: %s\n", path, err)
+			return nil
+		}
+		watched++
+		return nil
+	})
+	return watched
+}
+
+// isDir reports whether path is a directory, without following links
+func isDir(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,132 @@
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the changes a watch passes on
+type recorder struct {
+	mu      sync.Mutex
+	removed []string
+	moved   [][2]string
+	written []string
+}
+
+func (r *recorder) handlers() Handlers {
+	return Handlers{
+		Removed: func(path string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.removed = append(r.removed, path)
+		},
+		Moved: func(from, to string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.moved = append(r.moved, [2]string{from, to})
+		},
+		Written: func(path string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.written = append(r.written, path)
+		},
+	}
+}
+
+// waitFor polls until done reports true, failing the test after a few seconds
+func (r *recorder) waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		ok := done()
+		r.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s: removed %v, moved %v, written %v", what, r.removed, r.moved, r.written)
+}
+
+// watchDir starts a watch on a fresh root holding the given files
+func watchDir(t *testing.T, files ...string) (string, *recorder) {
+	t.Helper()
+	root := t.TempDir()
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &recorder{}
+	go Watch([]string{root}, r.handlers())
+	// Give the watch time to add the tree before anything changes
+	time.Sleep(200 * time.Millisecond)
+	return root, r
+}
+
+func TestRenameWithinRootsIsMove(t *testing.T) {
+	root, r := watchDir(t, "a.mkv")
+	from, to := filepath.Join(root, "a.mkv"), filepath.Join(root, "b.mkv")
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	r.waitFor(t, "the move", func() bool { return len(r.moved) == 1 })
+	if r.moved[0] != [2]string{from, to} {
+		t.Errorf("moved %v, want %s to %s", r.moved[0], from, to)
+	}
+	if len(r.removed) != 0 {
+		t.Errorf("a move within the roots reported removals %v", r.removed)
+	}
+}
+
+func TestMoveOutThenCreateIsNotMove(t *testing.T) {
+	root, r := watchDir(t, "a.mkv")
+	outside := filepath.Join(t.TempDir(), "a.mkv")
+	if err := os.Rename(filepath.Join(root, "a.mkv"), outside); err != nil {
+		t.Fatal(err)
+	}
+	// An unrelated file created straight after must not be taken as the new name
+	created := filepath.Join(root, "other.mkv")
+	if err := os.WriteFile(created, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.waitFor(t, "the removal and the new file", func() bool {
+		return len(r.removed) == 1 && len(r.written) > 0
+	})
+	if len(r.moved) != 0 {
+		t.Errorf("reported moves %v for a file moved out of the roots", r.moved)
+	}
+	if r.removed[0] != filepath.Join(root, "a.mkv") || r.written[0] != created {
+		t.Errorf("removed %v and wrote %v, want %s removed and %s written", r.removed, r.written, filepath.Join(root, "a.mkv"), created)
+	}
+}
+
+func TestDirectoryMoveKeepsWatching(t *testing.T) {
+	root, r := watchDir(t, "movies/a.mkv")
+	from, to := filepath.Join(root, "movies"), filepath.Join(root, "films")
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	r.waitFor(t, "the directory move", func() bool { return len(r.moved) == 1 })
+	if r.moved[0] != [2]string{from, to} {
+		t.Errorf("moved %v, want %s to %s", r.moved[0], from, to)
+	}
+
+	// Files below the moved directory are still followed under the new name
+	inner := filepath.Join(to, "a.mkv")
+	if err := os.Rename(inner, filepath.Join(to, "b.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	r.waitFor(t, "the move inside the moved directory", func() bool { return len(r.moved) == 2 })
+	if r.moved[1] != [2]string{inner, filepath.Join(to, "b.mkv")} {
+		t.Errorf("moved %v, want %s to b.mkv", r.moved[1], inner)
+	}
+}
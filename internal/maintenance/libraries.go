@@ -0,0 +1,114 @@
+package maintenance
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/scanner"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// scanningDevices maps each disk a scan is reading to the library being
+// scanned, so libraries sharing a disk are scanned one after another
+var (
+	scanningMutex   sync.Mutex
+	scanningDone    = sync.NewCond(&scanningMutex)
+	scanningDevices = map[string]string{}
+	lastAttempts    = map[string]time.Time{}
+)
+
+// deviceKey identifies the disk holding path, or the path itself where
+// devices cannot be told apart
+func deviceKey(path string) string {
+	if id, ok := pathutil.DeviceID(path); ok {
+		return strconv.FormatUint(id, 10)
+	}
+	return path
+}
+
+// tryStartScan claims the disk of a library, failing while another scan reads it
+func tryStartScan(path string) bool {
+	key := deviceKey(path)
+	scanningMutex.Lock()
+	defer scanningMutex.Unlock()
+	if _, busy := scanningDevices[key]; busy {
+		return false
+	}
+	scanningDevices[key] = path
+	return true
+}
+
+// waitStartScan claims the disk of a library, waiting for any scan reading it
+func waitStartScan(path string) {
+	key := deviceKey(path)
+	scanningMutex.Lock()
+	defer scanningMutex.Unlock()
+	if other, busy := scanningDevices[key]; busy {
+		log.Printf("Waiting for the scan of %s, on the same disk, before scanning %s\n", other, path)
+	}
+	for {
+		if _, busy := scanningDevices[key]; !busy {
+			break
+		}
+		scanningDone.Wait()
+	}
+	scanningDevices[key] = path
+}
+
+// finishScan releases the disk claimed for a library
+func finishScan(path string) {
+	scanningMutex.Lock()
+	delete(scanningDevices, deviceKey(path))
+	scanningMutex.Unlock()
+	scanningDone.Broadcast()
+}
+
+// lastScanned returns when a library was last scanned in full, or when this
+// daemon last tried, whichever is later
+func lastScanned(path string) time.Time {
+	scanningMutex.Lock()
+	last := lastAttempts[path]
+	scanningMutex.Unlock()
+	snapshots, err := db.QueryScanSnapshots(path, true)
+	if err != nil {
+		log.Printf("Error reading the last scan of %s: %s\n", path, err)
+	} else if len(snapshots) > 0 && snapshots[0].TakenAt.After(last) {
+		last = snapshots[0].TakenAt
+	}
+	return last
+}
+
+// runLibraryScans starts the LIBRARY_SCANS libraries whose interval has passed
+// and whose window is open. A library whose disk is being scanned waits for a
+// later minute, so libraries on one disk never scan at the same time.
+func runLibraryScans(now time.Time) {
+	for _, scan := range config.GetLibraryScans() {
+		if !scan.InWindow(now) || now.Sub(lastScanned(scan.Path)) < scan.Interval {
+			continue
+		}
+		if !tryStartScan(scan.Path) {
+			continue
+		}
+		scanningMutex.Lock()
+		lastAttempts[scan.Path] = now
+		scanningMutex.Unlock()
+
+		go func(path string) {
+			defer finishScan(path)
+			log.Printf("Running scheduled scan of %s\n", path)
+			summary, err := scanner.ScanMasterDirectory(path)
+			log.Printf("Rescanned %s: %d files, %d new, %d updated\n", path, summary.Total, summary.Inserted, summary.Updated)
+			if err != nil {
+				message := fmt.Sprintf("Scheduled scan of %s failed: %s", path, err)
+				log.Println(message)
+				utils.NotifyError(message)
+			}
+		}(scan.Path)
+	}
+}
@@ -0,0 +1,184 @@
+// Package maintenance runs recurring housekeeping tasks on cron-style
+// schedules from the config, so the daemon needs no external cron entries.
+package maintenance
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/archive"
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/report"
+	"github.com/palzino/vidanalyser/internal/scanner"
+	"github.com/palzino/vidanalyser/internal/schedule"
+	"github.com/palzino/vidanalyser/internal/transcoder"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// Task is a named maintenance job
+type Task struct {
+	Name string
+	Run  func() error
+}
+
+// Tasks lists every task that can be scheduled, keyed by the suffix of its SCHEDULE_ variable
+var Tasks = []Task{
+	{Name: "scan", Run: rescanLibraries},
+	{Name: "watch", Run: watchLibraries},
+	{Name: "clean", Run: cleanDatabase},
+	{Name: "report", Run: report.SendWeekly},
+	{Name: "db-maintain", Run: maintainDatabase},
+	{Name: "backup", Run: backupDatabase},
+	{Name: "projects", Run: transcoder.SnapshotProjects},
+	{Name: "sweep", Run: transcoder.SweepOrphans},
+	{Name: "quotas", Run: transcoder.EnforceQuotas},
+	{Name: "archive", Run: archive.Run},
+}
+
+var (
+	runningMutex sync.Mutex
+	running      = map[string]bool{}
+)
+
+// Run checks the schedules at the start of every minute and starts due tasks.
+// Schedules are read each time, so a config reload applies straight away. It blocks.
+func Run() {
+	for _, task := range Tasks {
+		if expr := config.GetMaintenanceSchedule(task.Name); expr != "" {
+			log.Printf("Scheduled maintenance task %s: %s\n", task.Name, expr)
+		}
+	}
+	for _, scan := range config.GetLibraryScans() {
+		log.Printf("Scheduled scan of %s every %s\n", scan.Path, scan.Interval)
+	}
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		runDue(time.Now())
+	}
+}
+
+// runDue starts every task whose schedule matches now, skipping tasks still
+// running, and the library scans that are due
+func runDue(now time.Time) {
+	runLibraryScans(now)
+	for _, task := range Tasks {
+		expr := config.GetMaintenanceSchedule(task.Name)
+		if expr == "" {
+			continue
+		}
+		sched, err := schedule.Parse(expr)
+		if err != nil {
+			log.Printf("Invalid schedule for %s: %s\n", task.Name, err)
+			continue
+		}
+		if !sched.Matches(now) {
+			continue
+		}
+
+		runningMutex.Lock()
+		if running[task.Name] {
+			runningMutex.Unlock()
+			log.Printf("Maintenance task %s is still running, skipping\n", task.Name)
+			continue
+		}
+		running[task.Name] = true
+		runningMutex.Unlock()
+
+		go func(task Task) {
+			defer func() {
+				runningMutex.Lock()
+				delete(running, task.Name)
+				runningMutex.Unlock()
+			}()
+			log.Printf("Running maintenance task %s\n", task.Name)
+			if err := task.Run(); err != nil {
+				message := fmt.Sprintf("Maintenance task %s failed: %s", task.Name, err)
+				log.Println(message)
+				utils.NotifyError(message)
+				return
+			}
+			log.Printf("Maintenance task %s finished\n", task.Name)
+		}(task)
+	}
+}
+
+// rescanLibraries scans every configured library path
+func rescanLibraries() error {
+	paths := config.GetLibraryPaths()
+	if len(paths) == 0 {
+		return fmt.Errorf("LIBRARY_PATHS is not set")
+	}
+	var failed error
+	for _, path := range paths {
+		waitStartScan(path)
+		summary, err := scanner.ScanMasterDirectory(path)
+		finishScan(path)
+		log.Printf("Rescanned %s: %d files, %d new, %d updated\n", path, summary.Total, summary.Inserted, summary.Updated)
+		if err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// watchLibraries scans every configured library path and queues the new
+// files on this server with the profile their rule picks
+func watchLibraries() error {
+	paths := config.GetLibraryPaths()
+	if len(paths) == 0 {
+		return fmt.Errorf("LIBRARY_PATHS is not set")
+	}
+	var failed error
+	for _, path := range paths {
+		waitStartScan(path)
+		added, summary, err := scanner.ScanNewFiles(path)
+		finishScan(path)
+		if err != nil {
+			failed = err
+		}
+		queued, err := transcoder.QueueByRules(added)
+		if err != nil {
+			return err
+		}
+		log.Printf("Watched %s: %d files, %d new, %d queued\n", path, summary.Total, len(added), queued)
+	}
+	return failed
+}
+
+// cleanDatabase removes records of files that no longer exist
+func cleanDatabase() error {
+	if _, err := db.Backup(); err != nil {
+		return fmt.Errorf("error backing up database before clean: %w", err)
+	}
+	result, err := db.CleanDatabase(config.GetLibraryPaths())
+	if err != nil {
+		return err
+	}
+	log.Printf("Cleaned database: %d records checked, %d moved, %d removed\n", result.Scanned, len(result.Moved), len(result.Removed))
+	return nil
+}
+
+// maintainDatabase checks, vacuums and analyses the database
+func maintainDatabase() error {
+	result, err := db.Maintain()
+	if err != nil {
+		return err
+	}
+	log.Printf("Database maintained: %s -> %s\n", units.Bytes(result.SizeBefore), units.Bytes(result.SizeAfter))
+	return nil
+}
+
+// backupDatabase takes a rotated snapshot of the database
+func backupDatabase() error {
+	snapshot, err := db.Backup()
+	if err != nil {
+		return err
+	}
+	log.Printf("Database backed up to %s\n", snapshot)
+	return nil
+}
@@ -0,0 +1,34 @@
+// Package output switches the CLI between human readable and JSON output.
+package output
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+var (
+	jsonMode   bool
+	jsonWriter io.Writer = os.Stdout
+)
+
+// EnableJSON switches to JSON output. From then on stdout carries only the
+// JSON documents written by Print; human oriented messages printed with fmt
+// are redirected to stderr so they never corrupt the JSON stream.
+func EnableJSON() {
+	jsonMode = true
+	jsonWriter = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// JSON reports whether JSON output is enabled
+func JSON() bool {
+	return jsonMode
+}
+
+// Print writes v as an indented JSON document to the real stdout
+func Print(v interface{}) error {
+	encoder := json.NewEncoder(jsonWriter)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
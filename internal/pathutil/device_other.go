@@ -0,0 +1,15 @@
+//go:build !unix
+
+package pathutil
+
+import "os"
+
+// DeviceID is not available here; callers fall back to comparing paths
+func DeviceID(path string) (uint64, bool) {
+	return 0, false
+}
+
+// FileID is not available here; callers treat every file as unidentified
+func FileID(info os.FileInfo) ([2]uint64, bool) {
+	return [2]uint64{}, false
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package pathutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// DeviceID returns the storage device holding path
+func DeviceID(path string) (uint64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), true
+	}
+	return 0, false
+}
+
+// FileID returns the device and inode identifying the file behind info
+func FileID(info os.FileInfo) ([2]uint64, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}, true
+	}
+	return [2]uint64{}, false
+}
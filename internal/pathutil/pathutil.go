@@ -0,0 +1,60 @@
+// Package pathutil makes file names with accents, emoji, quotes and brackets
+// safe to compare, store and hand to external tools. Paths are always opened
+// with their original bytes; normalised forms are only used for matching.
+package pathutil
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxNameBytes is the longest file name (not path) most Linux filesystems accept
+const MaxNameBytes = 255
+
+// NFD returns s with precomposed characters split into a base character and
+// combining marks in canonical order, as macOS and some SMB shares store names
+func NFD(s string) string {
+	return norm.NFD.String(s)
+}
+
+// NFC returns s with base characters and combining marks composed into single
+// characters, as most Linux tools and keyboards produce names
+func NFC(s string) string {
+	return norm.NFC.String(s)
+}
+
+// Equal reports whether two names are the same once normalised
+func Equal(a, b string) bool {
+	return a == b || NFC(a) == NFC(b)
+}
+
+// EscapeLike escapes the SQL LIKE wildcards in s, so that names containing %
+// or _ only match themselves. Use it with ESCAPE '\'.
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// TruncateName shortens a file name to MaxNameBytes, keeping its extension and
+// never cutting a multi-byte character in half
+func TruncateName(name string) string {
+	if len(name) <= MaxNameBytes {
+		return name
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	limit := MaxNameBytes - len(ext)
+	for limit > 0 && !utf8.RuneStart(base[limit]) {
+		limit--
+	}
+	return base[:limit] + ext
+}
+
+// IsURL reports whether path is an HTTP(S) URL, such as a file served by a
+// storage host, rather than a local file
+func IsURL(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
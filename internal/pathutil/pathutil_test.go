@@ -0,0 +1,146 @@
+package pathutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// nastyNames is a corpus of file names that have broken scans, lookups or
+// ffmpeg runs: accents in both normalisation forms, scripts outside Latin,
+// emoji, quotes, brackets, shell and SQL wildcards, and protocol-like colons
+var nastyNames = []string{
+	"Amélie (2001).mkv",
+	"Ame\u0301lie (2001).mkv",
+	"Pokémon – Mewtwo Strikes Back.mp4",
+	"Tiếng Việt – Phở.mkv",
+	"Ελληνικά ταινία.mkv",
+	"Ёжик в тумане.avi",
+	"기생충 (2019).mkv",
+	"\u1100\u1161\u11A8 decomposed Hangul.mkv",
+	"がっこうぐらし!.mkv",
+	"か\u3099っこう decomposed kana.mkv",
+	"Crème brûlée 🍮 [1080p].mkv",
+	"👨‍👩‍👧‍👦 family 🎬.mp4",
+	`He said "hello" & 'bye'.mkv`,
+	"Movie [2020] {Director's Cut} (Extended).mkv",
+	"100% _real_ footage.mkv",
+	`back\slash.mkv`,
+	"$(touch pwned) `whoami`.mkv",
+	"-starts-with-dash.mkv",
+	"http:not-a-url.mkv",
+	"Série: épisode 1.mkv",
+	"  leading and trailing spaces  .mkv",
+	"tab\tin name.mkv",
+}
+
+func TestNormalisationCorpus(t *testing.T) {
+	for _, name := range nastyNames {
+		nfc, nfd := NFC(name), NFD(name)
+		if NFC(nfd) != nfc {
+			t.Errorf("NFC(NFD(%q)) = %q, want %q", name, NFC(nfd), nfc)
+		}
+		if NFD(nfc) != nfd {
+			t.Errorf("NFD(NFC(%q)) = %q, want %q", name, NFD(nfc), nfd)
+		}
+		if NFC(nfc) != nfc {
+			t.Errorf("NFC is not idempotent for %q", name)
+		}
+		if !Equal(nfc, nfd) || !Equal(name, nfd) {
+			t.Errorf("Equal does not match the forms of %q", name)
+		}
+		if !utf8.ValidString(nfc) || !utf8.ValidString(nfd) {
+			t.Errorf("normalising %q produced invalid UTF-8", name)
+		}
+	}
+}
+
+func TestNormalisationForms(t *testing.T) {
+	tests := []struct {
+		composed, decomposed string
+	}{
+		{"é", "e\u0301"},
+		{"ệ", "e\u0323\u0302"},
+		{"ά", "α\u0301"},
+		{"й", "и\u0306"},
+		{"각", "\u1100\u1161\u11A8"},
+		{"が", "か\u3099"},
+	}
+	for _, tt := range tests {
+		if got := NFC(tt.decomposed); got != tt.composed {
+			t.Errorf("NFC(%q) = %q, want %q", tt.decomposed, got, tt.composed)
+		}
+		if got := NFD(tt.composed); got != tt.decomposed {
+			t.Errorf("NFD(%q) = %q, want %q", tt.composed, got, tt.decomposed)
+		}
+	}
+	if Equal("Amélie.mkv", "Amelie.mkv") {
+		t.Error("Equal matched names that differ by an accent")
+	}
+}
+
+func TestCorpusOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range nastyNames {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+			t.Fatalf("creating %q: %s", name, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The filesystem keeps names byte for byte, so both forms of Amélie exist
+	if len(entries) != len(nastyNames) {
+		t.Fatalf("found %d files, want %d", len(entries), len(nastyNames))
+	}
+	found := NewSet()
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(dir, entry.Name())); err != nil {
+			t.Errorf("stat %q: %s", entry.Name(), err)
+		}
+		found.Add(filepath.Join(dir, entry.Name()))
+	}
+	for _, name := range nastyNames {
+		if !found.Has(filepath.Join(dir, NFD(name))) || !found.Has(filepath.Join(dir, NFC(name))) {
+			t.Errorf("set of scanned paths does not hold %q in both forms", name)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"100% _real_":         `100\% \_real\_`,
+		`back\slash`:          `back\\slash`,
+		"Movie [2020] (Cut)":  "Movie [2020] (Cut)",
+		"🍮 'quoted' \"name\"": "🍮 'quoted' \"name\"",
+	}
+	for in, want := range tests {
+		if got := EscapeLike(in); got != want {
+			t.Errorf("EscapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	for _, name := range nastyNames {
+		ext := filepath.Ext(name)
+		long := strings.Repeat(strings.TrimSuffix(name, ext), 20) + ext
+		got := TruncateName(long)
+		if len(got) > MaxNameBytes {
+			t.Errorf("TruncateName kept %d bytes of %q", len(got), name)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("TruncateName cut a character of %q in half", name)
+		}
+		if !strings.HasSuffix(got, ext) {
+			t.Errorf("TruncateName dropped the extension of %q", name)
+		}
+	}
+	if got := TruncateName("short.mkv"); got != "short.mkv" {
+		t.Errorf("TruncateName changed a short name to %q", got)
+	}
+}
@@ -0,0 +1,64 @@
+package pathutil
+
+import "path/filepath"
+
+// Set is a set of paths compared in their cleaned, normalised form, for
+// membership checks that stay constant time on large libraries
+type Set map[string]struct{}
+
+// NewSet returns a set holding paths
+func NewSet(paths ...string) Set {
+	s := make(Set, len(paths))
+	for _, path := range paths {
+		s.Add(path)
+	}
+	return s
+}
+
+// Add adds path and reports whether it was not already in the set
+func (s Set) Add(path string) bool {
+	key := setKey(path)
+	if _, exists := s[key]; exists {
+		return false
+	}
+	s[key] = struct{}{}
+	return true
+}
+
+// Has reports whether path is in the set
+func (s Set) Has(path string) bool {
+	_, exists := s[setKey(path)]
+	return exists
+}
+
+// DirSet reports whether locations are in any of a set of directories, in time
+// proportional to the depth of the location rather than the number of directories
+type DirSet struct {
+	dirs      Set
+	recursive bool
+}
+
+// NewDirSet returns a DirSet for dirs; recursive includes their subdirectories
+func NewDirSet(dirs []string, recursive bool) DirSet {
+	return DirSet{dirs: NewSet(dirs...), recursive: recursive}
+}
+
+// Contains reports whether location is one of the directories or, when
+// recursive, below one of them
+func (d DirSet) Contains(location string) bool {
+	dir := filepath.Clean(location)
+	for {
+		if d.dirs.Has(dir) {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if !d.recursive || parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+func setKey(path string) string {
+	return NFC(filepath.Clean(path))
+}
@@ -0,0 +1,175 @@
+// Package presets stores named filter combinations, such as "4k-over-10gb",
+// so the analyser and transcoder can recall them instead of re-entering them.
+package presets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+// Preset is a named set of selection filters; zero values match every video
+type Preset struct {
+	Name        string   `json:"name"`
+	MinSizeGB   float64  `json:"min_size,omitempty"`
+	MinBitrate  int      `json:"min_bitrate,omitempty"`  // Source bitrate in kbps files must exceed
+	MinDuration int      `json:"min_duration,omitempty"` // Seconds
+	InputRes    string   `json:"in_res,omitempty"`       // A resolution class, e.g. 1080p
+	Codecs      []string `json:"codecs,omitempty"`       // ffprobe codec names, e.g. h264
+	MinBPP      float64  `json:"min_bpp,omitempty"`      // Bits per pixel per frame files must reach
+	// Streams files must have, or lack, as type[:codec][:language], e.g.
+	// audio:dts-hd or subtitle::eng
+	HasStreams   []string `json:"has_streams,omitempty"`
+	LacksStreams []string `json:"lacks_streams,omitempty"`
+}
+
+// MatchesCodec reports whether the preset selects videos in this codec
+func (p Preset) MatchesCodec(codec string) bool {
+	if len(p.Codecs) == 0 {
+		return true
+	}
+	for _, wanted := range p.Codecs {
+		if strings.EqualFold(wanted, codec) {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe summarises the filters, e.g. "1080p, at least 10 GB"
+func (p Preset) Describe() string {
+	var parts []string
+	if p.InputRes != "" {
+		parts = append(parts, p.InputRes)
+	}
+	if p.MinSizeGB > 0 {
+		parts = append(parts, fmt.Sprintf("at least %g GB", p.MinSizeGB))
+	}
+	if p.MinBitrate > 0 {
+		parts = append(parts, fmt.Sprintf("above %d kbps", p.MinBitrate))
+	}
+	if p.MinDuration > 0 {
+		parts = append(parts, fmt.Sprintf("at least %d s long", p.MinDuration))
+	}
+	if p.MinBPP > 0 {
+		parts = append(parts, fmt.Sprintf("at least %g bpp", p.MinBPP))
+	}
+	if len(p.HasStreams) > 0 {
+		parts = append(parts, "with "+strings.Join(p.HasStreams, ", "))
+	}
+	if len(p.LacksStreams) > 0 {
+		parts = append(parts, "without "+strings.Join(p.LacksStreams, ", "))
+	}
+	if len(p.Codecs) > 0 {
+		parts = append(parts, "in "+strings.Join(p.Codecs, "/"))
+	}
+	if len(parts) == 0 {
+		return "every video"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Validate checks the preset can be used as a filter
+func (p Preset) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("preset name is required")
+	}
+	if p.InputRes != "" && !datatypes.IsResolutionClass(p.InputRes) {
+		return fmt.Errorf("preset %s: input resolution %q must be one of %s", p.Name, p.InputRes, strings.Join(datatypes.ResolutionClassNames(), ", "))
+	}
+	if p.MinSizeGB < 0 || p.MinBitrate < 0 || p.MinDuration < 0 || p.MinBPP < 0 {
+		return fmt.Errorf("preset %s: minimums cannot be negative", p.Name)
+	}
+	if _, _, err := p.StreamMatches(); err != nil {
+		return fmt.Errorf("preset %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+// StreamMatches parses HasStreams and LacksStreams
+func (p Preset) StreamMatches() (with, without []db.StreamMatch, err error) {
+	if with, err = db.ParseStreamMatches(strings.Join(p.HasStreams, ",")); err != nil {
+		return nil, nil, err
+	}
+	without, err = db.ParseStreamMatches(strings.Join(p.LacksStreams, ","))
+	return with, without, err
+}
+
+// Load reads all presets from the presets file. A missing file means no presets.
+func Load() ([]Preset, error) {
+	data, err := os.ReadFile(config.GetPresetsFile())
+	if os.IsNotExist(err) {
+		return []Preset{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading presets: %w", err)
+	}
+
+	var list []Preset
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error decoding presets: %w", err)
+	}
+	return list, nil
+}
+
+// Get returns the named preset, or nil if it does not exist
+func Get(name string) (*Preset, error) {
+	list, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		if p.Name == name {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+// Save adds the preset to the presets file, replacing one of the same name
+func Save(preset Preset) error {
+	if err := preset.Validate(); err != nil {
+		return err
+	}
+	list, err := Load()
+	if err != nil {
+		return err
+	}
+	kept := list[:0]
+	for _, p := range list {
+		if p.Name != preset.Name {
+			kept = append(kept, p)
+		}
+	}
+	list = append(kept, preset)
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding presets: %w", err)
+	}
+	if err := os.WriteFile(config.GetPresetsFile(), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing presets: %w", err)
+	}
+	return nil
+}
+
+// OfferSave asks for a name to save interactively entered filters under
+func OfferSave(preset Preset) {
+	fmt.Print("Save these filters as a preset? Enter a name, or leave empty to skip: ")
+	fmt.Scanln(&preset.Name)
+	if preset.Name == "" {
+		return
+	}
+	if err := Save(preset); err != nil {
+		fmt.Printf("Error saving preset: %s\n", err)
+		return
+	}
+	fmt.Printf("Saved preset %s\n", preset.Name)
+}
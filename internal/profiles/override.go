@@ -0,0 +1,151 @@
+package profiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Overrides replaces profile fields, keyed by their JSON names, for a single
+// job, e.g. {"bitrate": 1500, "keep_audio_languages": ["eng"]}
+type Overrides map[string]json.RawMessage
+
+// String lists the overrides as key=value pairs, for the --set flag
+func (o Overrides) String() string {
+	var pairs []string
+	for key, value := range o {
+		pairs = append(pairs, key+"="+string(value))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Set adds one key=value override. Values that are not JSON are taken as a
+// string, or a comma separated list for list fields such as keep_audio_languages.
+func (o *Overrides) Set(pair string) error {
+	key, value, found := strings.Cut(pair, "=")
+	key = strings.TrimSpace(key)
+	if !found || key == "" {
+		return fmt.Errorf("override %q must look like field=value", pair)
+	}
+	field, known := fieldTypes()[key]
+	if !known || key == "name" {
+		return fmt.Errorf("unknown profile field %s", key)
+	}
+	raw := json.RawMessage(value)
+	if !json.Valid(raw) {
+		var parsed interface{} = value
+		if field.Kind() == reflect.Slice {
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			parsed = items
+		}
+		raw, _ = json.Marshal(parsed)
+	}
+	if *o == nil {
+		*o = Overrides{}
+	}
+	(*o)[key] = raw
+	return nil
+}
+
+// fieldTypes returns the type of every profile field by its JSON name
+func fieldTypes() map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	profileType := reflect.TypeOf(Profile{})
+	for i := 0; i < profileType.NumField(); i++ {
+		name, _, _ := strings.Cut(profileType.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = profileType.Field(i).Type
+		}
+	}
+	return fields
+}
+
+// Override returns a copy of the profile with the overrides applied, validated
+// like a saved profile. The copy is named after the profile so it can be told
+// apart in job records.
+func (p Profile) Override(overrides Overrides) (Profile, error) {
+	fields := fieldTypes()
+	for key := range overrides {
+		if _, known := fields[key]; !known || key == "name" {
+			return Profile{}, fmt.Errorf("unknown profile field %s", key)
+		}
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return Profile{}, fmt.Errorf("error encoding profile: %w", err)
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return Profile{}, fmt.Errorf("error decoding profile: %w", err)
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	if data, err = json.Marshal(merged); err != nil {
+		return Profile{}, fmt.Errorf("error encoding overrides: %w", err)
+	}
+	var custom Profile
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return Profile{}, fmt.Errorf("invalid override: %w", err)
+	}
+	base := p.Name
+	if base == "" {
+		base = "custom"
+	}
+	custom.Name = fmt.Sprintf("%s+%d", base, nextTemporaryID())
+	if err := custom.Validate(); err != nil {
+		return Profile{}, err
+	}
+	return custom, nil
+}
+
+// temporary holds the profiles of jobs with overrides, which Get finds by
+// name without them ever being written to the profiles file
+var (
+	temporary      = make(map[string]Profile)
+	temporaryMutex sync.Mutex
+	lastTemporary  int
+)
+
+func nextTemporaryID() int {
+	temporaryMutex.Lock()
+	defer temporaryMutex.Unlock()
+	lastTemporary++
+	return lastTemporary
+}
+
+// AddTemporary makes a profile available to Get until RemoveTemporary
+func AddTemporary(profile Profile) {
+	temporaryMutex.Lock()
+	defer temporaryMutex.Unlock()
+	temporary[profile.Name] = profile
+}
+
+// RemoveTemporary forgets a profile added by AddTemporary
+func RemoveTemporary(name string) {
+	temporaryMutex.Lock()
+	defer temporaryMutex.Unlock()
+	delete(temporary, name)
+}
+
+// IsTemporary reports whether name is a profile added by AddTemporary
+func IsTemporary(name string) bool {
+	return getTemporary(name) != nil
+}
+
+// getTemporary returns a profile added by AddTemporary, or nil
+func getTemporary(name string) *Profile {
+	temporaryMutex.Lock()
+	defer temporaryMutex.Unlock()
+	if profile, exists := temporary[name]; exists {
+		return &profile
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+// Package profiles stores named transcode settings so they can be reused
+// across the interactive, non-interactive and API flows.
+package profiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+)
+
+// Profile is a named set of output settings
+type Profile struct {
+	Name       string `json:"name"`
+	Resolution string `json:"resolution"` // Output resolution, e.g. 1280x720
+	Bitrate    int    `json:"bitrate"`    // Output video bitrate in kbps, or AutoBitrate
+
+	// Output video codec: h264 (default), hevc or av1
+	Codec string `json:"codec,omitempty"`
+
+	// Constant quality (1-51, lower is better) to encode at instead of the
+	// bitrate, which then only caps it; 0 encodes at the bitrate
+	CRF int `json:"crf,omitempty"`
+
+	// Process isolation for ffmpeg; empty values fall back to the FFMPEG_* settings
+	Nice   int    `json:"nice,omitempty"`   // nice level, -20 to 19
+	IONice string `json:"ionice,omitempty"` // idle, best-effort:N or realtime:N
+	Slice  string `json:"slice,omitempty"`  // systemd slice (cgroup) to run ffmpeg in
+
+	// Files this profile never touches, whatever the selection filters match
+	ExcludeExtensions []string `json:"exclude_extensions,omitempty"` // e.g. .m4v
+	ExcludeCodecs     []string `json:"exclude_codecs,omitempty"`     // ffprobe codec names, e.g. av1
+	SkipBelowBPP      float64  `json:"skip_below_bpp,omitempty"`     // Already efficient encodes, overrides SKIP_BELOW_BPP
+
+	// Audio languages to keep (ISO 639-2, e.g. eng, jpn); other tagged tracks
+	// are dropped. Empty keeps whatever ffmpeg picks.
+	KeepAudioLanguages []string `json:"keep_audio_languages,omitempty"`
+
+	// Video streams of multi-stream sources to transcode: first, largest or
+	// all; empty falls back to VIDEO_STREAMS
+	VideoStreams string `json:"video_streams,omitempty"`
+
+	// Dolby Vision and HDR10+ sources: skip, strip or passthrough; empty
+	// falls back to DYNAMIC_HDR
+	DynamicHDR string `json:"dynamic_hdr,omitempty"`
+
+	// HDR to SDR tone-mapping: zscale, libplacebo or off, and the tone curve
+	// (e.g. hable, mobius); empty values fall back to TONEMAP and TONEMAP_ALGORITHM
+	Tonemap          string `json:"tonemap,omitempty"`
+	TonemapAlgorithm string `json:"tonemap_algorithm,omitempty"`
+
+	// "keep" or "drop"; empty values fall back to COVER_ART and ATTACHMENTS
+	CoverArt    string `json:"cover_art,omitempty"`   // Embedded cover pictures (mjpeg/png streams)
+	Attachments string `json:"attachments,omitempty"` // Matroska attachments such as fonts
+
+	// Root outputs are mirrored under instead of OUTPUT_ROOT
+	OutputRoot string `json:"output_root,omitempty"`
+
+	// When the output name exists: overwrite, version or skip; empty falls
+	// back to OUTPUT_COLLISION
+	OnCollision string `json:"on_collision,omitempty"`
+}
+
+// ExcludesExtension reports whether files with this extension are left alone
+func (p Profile) ExcludesExtension(ext string) bool {
+	ext = strings.TrimPrefix(ext, ".")
+	for _, excluded := range p.ExcludeExtensions {
+		if strings.EqualFold(strings.TrimPrefix(excluded, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludesCodec reports whether videos in this codec are left alone
+func (p Profile) ExcludesCodec(codec string) bool {
+	for _, excluded := range p.ExcludeCodecs {
+		if strings.EqualFold(excluded, codec) {
+			return true
+		}
+	}
+	return false
+}
+
+// BPPThreshold returns the bits per pixel per frame below which videos are
+// left alone, falling back to SKIP_BELOW_BPP
+func (p Profile) BPPThreshold() float64 {
+	if p.SkipBelowBPP > 0 {
+		return p.SkipBelowBPP
+	}
+	return config.GetSkipBelowBPP()
+}
+
+// VideoStreamPolicy returns which video streams of a multi-stream source are transcoded
+func (p Profile) VideoStreamPolicy() string {
+	if p.VideoStreams != "" {
+		return p.VideoStreams
+	}
+	return config.GetVideoStreams()
+}
+
+// CollisionPolicy returns what happens when the output name already exists:
+// overwrite, version or skip
+func (p Profile) CollisionPolicy() string {
+	if p.OnCollision != "" {
+		return p.OnCollision
+	}
+	return config.GetOutputCollision()
+}
+
+// TonemapMethod returns how HDR sources are tone-mapped to SDR: zscale,
+// libplacebo or off
+func (p Profile) TonemapMethod() string {
+	if p.Tonemap != "" {
+		return p.Tonemap
+	}
+	return config.GetTonemap()
+}
+
+// TonemapCurve returns the tone-mapping algorithm, e.g. hable. A
+// TONEMAP_ALGORITHM the profile's own tonemap chain does not know falls back
+// to hable.
+func (p Profile) TonemapCurve() string {
+	if p.TonemapAlgorithm != "" {
+		return p.TonemapAlgorithm
+	}
+	if curve := config.GetTonemapAlgorithm(); config.KnownTonemapAlgorithm(p.TonemapMethod(), curve) {
+		return curve
+	}
+	return "hable"
+}
+
+// KeepsCoverArt reports whether embedded cover art is copied to the output
+func (p Profile) KeepsCoverArt() bool {
+	if p.CoverArt != "" {
+		return p.CoverArt == "keep"
+	}
+	return config.GetCoverArt() == "keep"
+}
+
+// KeepsAttachments reports whether attachments are copied to the output
+func (p Profile) KeepsAttachments() bool {
+	if p.Attachments != "" {
+		return p.Attachments == "keep"
+	}
+	return config.GetAttachments() == "keep"
+}
+
+// AutoBitrate is the bitrate of profiles whose bitrate is "auto": each file
+// gets its own target derived from the source
+const AutoBitrate = -1
+
+// UnmarshalJSON accepts "auto" as well as a number of kbps for the bitrate
+func (p *Profile) UnmarshalJSON(data []byte) error {
+	type plain Profile
+	aux := struct {
+		*plain
+		Bitrate json.RawMessage `json:"bitrate"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.Bitrate) == 0 {
+		return nil
+	}
+	var text string
+	if json.Unmarshal(aux.Bitrate, &text) == nil {
+		bitrate, err := ParseBitrate(text)
+		p.Bitrate = bitrate
+		return err
+	}
+	return json.Unmarshal(aux.Bitrate, &p.Bitrate)
+}
+
+// MarshalJSON writes an automatic bitrate as "auto"
+func (p Profile) MarshalJSON() ([]byte, error) {
+	type plain Profile
+	var bitrate interface{} = p.Bitrate
+	if p.Bitrate == AutoBitrate {
+		bitrate = "auto"
+	}
+	return json.Marshal(struct {
+		plain
+		Bitrate interface{} `json:"bitrate"`
+	}{plain(p), bitrate})
+}
+
+// ParseBitrate converts "auto" or a number of kbps into a profile bitrate
+func ParseBitrate(value string) (int, error) {
+	if strings.EqualFold(value, "auto") {
+		return AutoBitrate, nil
+	}
+	bitrate, err := strconv.Atoi(value)
+	if err != nil || bitrate <= 0 {
+		return 0, fmt.Errorf("bitrate %q must be auto or a positive number of kbps", value)
+	}
+	return bitrate, nil
+}
+
+var resolutionPattern = regexp.MustCompile(`^\d+x\d+$`)
+
+// Validate checks that the profile can be handed to ffmpeg
+func (p Profile) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("profile name is required")
+	}
+	if !resolutionPattern.MatchString(p.Resolution) {
+		return fmt.Errorf("profile %s: resolution %q must look like 1280x720", p.Name, p.Resolution)
+	}
+	if p.Bitrate <= 0 && p.Bitrate != AutoBitrate {
+		return fmt.Errorf("profile %s: bitrate must be auto or a positive number of kbps", p.Name)
+	}
+	switch p.Codec {
+	case "", "h264", "hevc", "av1":
+	default:
+		return fmt.Errorf("profile %s: codec must be h264, hevc or av1", p.Name)
+	}
+	if p.CRF < 0 || p.CRF > 51 {
+		return fmt.Errorf("profile %s: crf must be between 1 and 51, or 0 to encode at the bitrate", p.Name)
+	}
+	if p.Nice < -20 || p.Nice > 19 {
+		return fmt.Errorf("profile %s: nice must be between -20 and 19", p.Name)
+	}
+	if _, _, err := ParseIONice(p.IONice); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	for setting, value := range map[string]string{"cover_art": p.CoverArt, "attachments": p.Attachments} {
+		if value != "" && value != "keep" && value != "drop" {
+			return fmt.Errorf("profile %s: %s must be keep or drop", p.Name, setting)
+		}
+	}
+	switch p.DynamicHDR {
+	case "", "skip", "strip", "passthrough":
+	default:
+		return fmt.Errorf("profile %s: dynamic_hdr must be skip, strip or passthrough", p.Name)
+	}
+	switch p.Tonemap {
+	case "", "zscale", "libplacebo", "off":
+	default:
+		return fmt.Errorf("profile %s: tonemap must be zscale, libplacebo or off", p.Name)
+	}
+	if method := p.TonemapMethod(); p.TonemapAlgorithm != "" && !config.KnownTonemapAlgorithm(method, p.TonemapAlgorithm) {
+		return fmt.Errorf("profile %s: tonemap_algorithm must be one of %s for %s", p.Name, strings.Join(config.TonemapAlgorithms(method), ", "), method)
+	}
+	switch p.VideoStreams {
+	case "", "first", "largest", "all":
+	default:
+		return fmt.Errorf("profile %s: video_streams must be first, largest or all", p.Name)
+	}
+	switch p.OnCollision {
+	case "", "overwrite", "version", "skip":
+	default:
+		return fmt.Errorf("profile %s: on_collision must be overwrite, version or skip", p.Name)
+	}
+	if p.SkipBelowBPP < 0 {
+		return fmt.Errorf("profile %s: skip_below_bpp cannot be negative", p.Name)
+	}
+	return nil
+}
+
+// ParseIONice converts an ionice setting such as "idle" or "best-effort:7" into
+// the class and level ionice expects. An empty value returns class 0.
+func ParseIONice(value string) (class int, level int, err error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+	name, levelText, hasLevel := strings.Cut(value, ":")
+	switch name {
+	case "realtime":
+		class = 1
+	case "best-effort":
+		class = 2
+	case "idle":
+		return 3, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("ionice %q must be idle, best-effort:N or realtime:N", value)
+	}
+	level = 4
+	if hasLevel {
+		level, err = strconv.Atoi(levelText)
+		if err != nil || level < 0 || level > 7 {
+			return 0, 0, fmt.Errorf("ionice level in %q must be between 0 and 7", value)
+		}
+	}
+	return class, level, nil
+}
+
+// Load reads all profiles from the profiles file, or from the coordinator
+// when PROFILE_SOURCE is set. A missing file means no profiles.
+func Load() ([]Profile, error) {
+	if source := config.GetProfileSource(); source != "" {
+		return loadRemote(source)
+	}
+	data, err := os.ReadFile(config.GetProfilesFile())
+	if os.IsNotExist(err) {
+		return []Profile{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading profiles: %w", err)
+	}
+
+	var list []Profile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error decoding profiles: %w", err)
+	}
+	return list, nil
+}
+
+// Save writes the profiles file, sorted by name
+func Save(list []Profile) error {
+	if source := config.GetProfileSource(); source != "" {
+		return fmt.Errorf("profiles are managed by the coordinator at %s", source)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding profiles: %w", err)
+	}
+	if err := os.WriteFile(config.GetProfilesFile(), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing profiles: %w", err)
+	}
+	return nil
+}
+
+// Get returns the named profile, or nil if it does not exist. Profiles with
+// a job's overrides are found as well as saved ones.
+func Get(name string) (*Profile, error) {
+	if profile := getTemporary(name); profile != nil {
+		return profile, nil
+	}
+	list, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		if p.Name == name {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+// Upsert validates a profile and adds it, replacing any profile with the same name
+func Upsert(profile Profile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	list, err := Load()
+	if err != nil {
+		return err
+	}
+	for i, p := range list {
+		if p.Name == profile.Name {
+			list[i] = profile
+			return Save(list)
+		}
+	}
+	return Save(append(list, profile))
+}
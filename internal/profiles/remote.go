@@ -0,0 +1,93 @@
+package profiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+)
+
+// remote caches the profiles a worker fetched from PROFILE_SOURCE, so every
+// worker runs a job named after a profile with the coordinator's settings
+var remote struct {
+	sync.Mutex
+	list      []Profile
+	fetchedAt time.Time // Last fetch, whether or not it succeeded
+	err       error     // Why the last fetch failed, nil after a success
+}
+
+// loadRemote returns the coordinator's profiles, fetching them again once
+// PROFILE_CACHE_TTL has passed since the last attempt. While the coordinator
+// cannot be reached the last fetched profiles are used, from
+// PROFILE_CACHE_FILE after a restart, and a failed fetch is not retried
+// before the TTL passes, so an outage does not stall every job on timeouts.
+func loadRemote(source string) ([]Profile, error) {
+	remote.Lock()
+	defer remote.Unlock()
+	if time.Since(remote.fetchedAt) < config.GetProfileCacheTTL() {
+		if remote.list != nil {
+			return append([]Profile(nil), remote.list...), nil
+		}
+		if remote.err != nil {
+			return nil, remote.err
+		}
+	}
+
+	list, err := fetchProfiles(source)
+	remote.fetchedAt, remote.err = time.Now(), err
+	if err == nil {
+		remote.list = list
+		if data, err := json.MarshalIndent(list, "", "  "); err == nil {
+			if err := os.WriteFile(config.GetProfileCacheFile(), append(data, '\n'), 0644); err != nil {
+				log.Printf("Error caching profiles: %s\n", err)
+			}
+		}
+		return append([]Profile(nil), list...), nil
+	}
+
+	if remote.list != nil {
+		log.Printf("Warning: using cached profiles, %s\n", err)
+		return append([]Profile(nil), remote.list...), nil
+	}
+	data, readErr := os.ReadFile(config.GetProfileCacheFile())
+	if readErr != nil {
+		return nil, err
+	}
+	var cached []Profile
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("error decoding cached profiles: %w", err)
+	}
+	log.Printf("Warning: using cached profiles from %s, %s\n", config.GetProfileCacheFile(), err)
+	remote.list = cached
+	return append([]Profile(nil), cached...), nil
+}
+
+// fetchProfiles asks the coordinator for its profiles
+func fetchProfiles(source string) ([]Profile, error) {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Get(source + "/profiles")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching profiles from %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching profiles from %s: %s", source, resp.Status)
+	}
+	var list []Profile
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error decoding profiles from %s: %w", source, err)
+	}
+	return list, nil
+}
+
+// Refresh makes the next Load fetch the coordinator's profiles again
+func Refresh() {
+	remote.Lock()
+	defer remote.Unlock()
+	remote.fetchedAt = time.Time{}
+}
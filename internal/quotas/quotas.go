@@ -0,0 +1,91 @@
+// Package quotas stores per-directory size limits, such as keeping /kids
+// under 500 GB, that the daemon enforces by transcoding or flagging files.
+package quotas
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// Flag is the action of quotas that tag deletion candidates instead of
+// transcoding
+const Flag = "flag"
+
+// DeleteTag is the tag given to the files a flagging quota picks for deletion
+const DeleteTag = "quota-delete"
+
+// Quota keeps the recorded files under Path below MaxGB, transcoding the files
+// expected to save the most with Profile, or flagging the largest files
+type Quota struct {
+	Path    string  `json:"path"`
+	MaxGB   float64 `json:"max_gb"`
+	Profile string  `json:"profile,omitempty"` // Profile to transcode with
+	Action  string  `json:"action,omitempty"`  // "flag" instead of a profile
+}
+
+// Flags reports whether the quota tags deletion candidates instead of transcoding
+func (q Quota) Flags() bool {
+	return q.Action == Flag
+}
+
+// Limit returns the quota in bytes
+func (q Quota) Limit() int64 {
+	return units.FromGB(q.MaxGB)
+}
+
+// Describe summarises the quota, e.g. "/kids under 500 GB -> 1080p-hevc"
+func (q Quota) Describe() string {
+	outcome := q.Profile
+	if q.Flags() {
+		outcome = "flag for deletion"
+	}
+	return fmt.Sprintf("%s under %g GB -> %s", q.Path, q.MaxGB, outcome)
+}
+
+// Validate checks the quota names an absolute directory, a limit and a single outcome
+func (q Quota) Validate() error {
+	if !filepath.IsAbs(q.Path) {
+		return fmt.Errorf("quota %q: path must be absolute", q.Path)
+	}
+	if q.MaxGB <= 0 {
+		return fmt.Errorf("quota %s: max_gb must be positive", q.Path)
+	}
+	switch {
+	case q.Action != "" && q.Action != Flag:
+		return fmt.Errorf("quota %s: action must be flag", q.Path)
+	case q.Flags() && q.Profile != "":
+		return fmt.Errorf("quota %s: a flag quota cannot name a profile", q.Path)
+	case !q.Flags() && q.Profile == "":
+		return fmt.Errorf("quota %s: a profile or action flag is required", q.Path)
+	}
+	return nil
+}
+
+// Load reads the quotas. A missing file means no quotas.
+func Load() ([]Quota, error) {
+	data, err := os.ReadFile(config.GetQuotasFile())
+	if os.IsNotExist(err) {
+		return []Quota{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading quotas: %w", err)
+	}
+
+	var list []Quota
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error decoding quotas: %w", err)
+	}
+	for i, quota := range list {
+		quota.Path = filepath.Clean(quota.Path)
+		if err := quota.Validate(); err != nil {
+			return nil, err
+		}
+		list[i] = quota
+	}
+	return list, nil
+}
@@ -0,0 +1,90 @@
+package report
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// Summary is the library activity over a reporting period
+type Summary struct {
+	From                time.Time           `json:"from"`
+	To                  time.Time           `json:"to"`
+	FilesAdded          int                 `json:"files_added"`
+	TranscodesCompleted int                 `json:"transcodes_completed"`
+	SpaceSaved          int64               `json:"space_saved"`
+	Failures            []datatypes.Failure `json:"failures"`
+}
+
+// BuildSummary collects the activity of the last period from the database
+func BuildSummary(period time.Duration) (Summary, error) {
+	to := time.Now()
+	from := to.Add(-period)
+	summary := Summary{From: from, To: to}
+
+	var err error
+	if summary.FilesAdded, err = db.CountFilesAddedSince(from); err != nil {
+		return summary, err
+	}
+	if summary.TranscodesCompleted, summary.SpaceSaved, err = db.QueryTranscodeTotalsSince(from); err != nil {
+		return summary, err
+	}
+	if summary.Failures, err = db.QueryFailuresSince(from); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// Text renders the summary as a plain text report
+func (s Summary) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ZinoCoder report %s - %s\n\n", s.From.Format("2006-01-02"), s.To.Format("2006-01-02"))
+	fmt.Fprintf(&b, "Files added: %d\n", s.FilesAdded)
+	fmt.Fprintf(&b, "Transcodes completed: %d\n", s.TranscodesCompleted)
+	fmt.Fprintf(&b, "Space saved: %s\n", units.Bytes(s.SpaceSaved))
+	fmt.Fprintf(&b, "Failures needing attention: %d\n", len(s.Failures))
+	for _, failure := range s.Failures {
+		fmt.Fprintf(&b, "  - %s (%s): %s\n", failure.FilePath, failure.CreatedAt.Format("2006-01-02 15:04"), failure.Error)
+	}
+	return b.String()
+}
+
+// SendWeekly builds the report for the last seven days and emails it
+func SendWeekly() error {
+	summary, err := BuildSummary(7 * 24 * time.Hour)
+	if err != nil {
+		return fmt.Errorf("error building weekly report: %w", err)
+	}
+	return utils.SendEmail("ZinoCoder weekly report", summary.Text())
+}
+
+// nextRun returns the next time after now that falls on the given weekday and hour
+func nextRun(now time.Time, day time.Weekday, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	next = next.AddDate(0, 0, (int(day)-int(now.Weekday())+7)%7)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// RunScheduler emails the weekly report at the configured day and hour. It blocks forever.
+func RunScheduler() {
+	for {
+		day, hour := config.GetReportSchedule()
+		next := nextRun(time.Now(), day, hour)
+		log.Printf("Next weekly report scheduled for %s\n", next.Format("Mon 2006-01-02 15:04"))
+		time.Sleep(time.Until(next))
+
+		if err := SendWeekly(); err != nil {
+			log.Printf("Error sending weekly report: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package report
+
+import (
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// Stats is the lifetime space-saved accounting plus a per-period breakdown
+type Stats struct {
+	User       string                     `json:"user,omitempty"`
+	Transcodes int                        `json:"transcodes"`
+	SpaceSaved int64                      `json:"space_saved"`
+	Period     string                     `json:"period"`
+	Periods    []datatypes.PeriodSavings  `json:"periods"`
+	Encoders   []datatypes.EncoderSavings `json:"encoders"`
+	Users      []datatypes.UserSavings    `json:"users,omitempty"` // Only when not limited to one user
+	Tags       []datatypes.TagSavings     `json:"tags,omitempty"`
+}
+
+// BuildStats aggregates savings from the transcodes table grouped by the given period.
+// A non-empty user limits the stats to that user's jobs.
+func BuildStats(period, user string) (Stats, error) {
+	stats := Stats{Period: period, User: user}
+	var err error
+	if user == "" {
+		stats.Transcodes, stats.SpaceSaved, err = db.QueryLifetimeSpaceSaved()
+	} else {
+		stats.Transcodes, stats.SpaceSaved, err = db.QueryUserSpaceSaved(user)
+	}
+	if err != nil {
+		return stats, err
+	}
+	if stats.Periods, err = db.QuerySavingsByPeriod(period, user); err != nil {
+		return stats, err
+	}
+	if stats.Encoders, err = db.QuerySavingsByEncoder(user); err != nil {
+		return stats, err
+	}
+	if user == "" {
+		if stats.Users, err = db.QuerySavingsByUser(); err != nil {
+			return stats, err
+		}
+	}
+	if stats.Tags, err = db.QuerySavingsByTag(user); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// ShowStats prints lifetime savings and the per-period breakdown
+func ShowStats(period, user string) error {
+	stats, err := BuildStats(period, user)
+	if err != nil {
+		return err
+	}
+	if output.JSON() {
+		return output.Print(stats)
+	}
+
+	if user != "" {
+		fmt.Printf("Jobs submitted by %s\n", user)
+	}
+	fmt.Printf("Lifetime: %d transcodes, %s saved\n", stats.Transcodes, units.Bytes(stats.SpaceSaved))
+	for _, entry := range stats.Periods {
+		fmt.Printf("%-10s %6d transcodes  %10s saved\n", entry.Period, entry.Transcodes, units.Bytes(entry.SpaceSaved))
+	}
+
+	if len(stats.Encoders) > 0 {
+		fmt.Println("\nBy profile and encoder:")
+	}
+	for _, entry := range stats.Encoders {
+		profile := entry.Profile
+		if profile == "" {
+			profile = "-"
+		}
+		encoder := entry.Encoder
+		if encoder == "" {
+			encoder = "unknown"
+		}
+		line := fmt.Sprintf("%-12s %-12s %-10s %6dk %6d transcodes  %5.1f%% avg savings  %6.0fs avg",
+			profile, encoder, entry.Resolution, entry.Bitrate, entry.Transcodes, entry.AvgSavingsPct, entry.AvgTimeSeconds)
+		if entry.AvgAchievedBitrate > 0 {
+			line += fmt.Sprintf("  %6.0fk achieved", entry.AvgAchievedBitrate)
+			if entry.AvgBitrateOfTarget > 0 {
+				line += fmt.Sprintf(" (%.0f%% of target)", entry.AvgBitrateOfTarget)
+			}
+		}
+		if entry.AvgEncodeFPS > 0 {
+			line += fmt.Sprintf("  %6.1f fps", entry.AvgEncodeFPS)
+		}
+		fmt.Println(line)
+	}
+
+	// Only worth a breakdown once jobs have been submitted as a named user
+	if len(stats.Users) > 1 || (len(stats.Users) == 1 && stats.Users[0].User != "") {
+		fmt.Println("\nBy user:")
+		for _, entry := range stats.Users {
+			name := entry.User
+			if name == "" {
+				name = "-"
+			}
+			fmt.Printf("%-12s %6d transcodes  %10s saved\n", name, entry.Transcodes, units.Bytes(entry.SpaceSaved))
+		}
+	}
+
+	if len(stats.Tags) > 0 {
+		fmt.Println("\nBy tag:")
+	}
+	for _, entry := range stats.Tags {
+		fmt.Printf("%-16s %6d transcodes  %10s saved\n", entry.Tag, entry.Transcodes, units.Bytes(entry.SpaceSaved))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Package rules stores the ordered watch mode rules that map the properties
+// of newly found files, such as 4K HDR or 1080p H.264 over 8 GB, to the
+// profile they are transcoded with.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+// Ignore is the action of rules that leave matching files alone
+const Ignore = "ignore"
+
+// Rule sends the files matching all of its conditions to a profile, or
+// ignores them. Zero conditions match every file.
+type Rule struct {
+	Name       string   `json:"name"`
+	InputRes   string   `json:"in_res,omitempty"`      // A resolution class, e.g. 1080p
+	HDR        *bool    `json:"hdr,omitempty"`         // PQ, HLG or Dolby Vision sources; unset matches either
+	Codecs     []string `json:"codecs,omitempty"`      // ffprobe codec names, e.g. h264
+	MinSizeGB  float64  `json:"min_size,omitempty"`    // Files must be at least this large
+	MinBitrate int      `json:"min_bitrate,omitempty"` // Source bitrate in kbps files must exceed
+	Tags       []string `json:"tags,omitempty"`        // Tags files must all carry, e.g. kids
+	Profile    string   `json:"profile,omitempty"`     // Profile to transcode with
+	Action     string   `json:"action,omitempty"`      // "ignore" instead of a profile
+}
+
+// Ignores reports whether matching files are left alone
+func (r Rule) Ignores() bool {
+	return r.Action == Ignore
+}
+
+// Describe summarises the conditions and outcome, e.g. "4k, HDR -> 4k-hevc-preserve"
+func (r Rule) Describe() string {
+	var parts []string
+	if r.InputRes != "" {
+		parts = append(parts, r.InputRes)
+	}
+	if r.HDR != nil {
+		if *r.HDR {
+			parts = append(parts, "HDR")
+		} else {
+			parts = append(parts, "SDR")
+		}
+	}
+	if len(r.Codecs) > 0 {
+		parts = append(parts, strings.Join(r.Codecs, "/"))
+	}
+	if r.MinSizeGB > 0 {
+		parts = append(parts, fmt.Sprintf("at least %g GB", r.MinSizeGB))
+	}
+	if r.MinBitrate > 0 {
+		parts = append(parts, fmt.Sprintf("above %d kbps", r.MinBitrate))
+	}
+	if len(r.Tags) > 0 {
+		parts = append(parts, "tagged "+strings.Join(r.Tags, "+"))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "every file")
+	}
+	outcome := r.Profile
+	if r.Ignores() {
+		outcome = Ignore
+	}
+	return strings.Join(parts, ", ") + " -> " + outcome
+}
+
+// Validate checks the rule has a single outcome and usable conditions
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name is required")
+	}
+	if r.InputRes != "" && !datatypes.IsResolutionClass(r.InputRes) {
+		return fmt.Errorf("rule %s: input resolution %q must be one of %s", r.Name, r.InputRes, strings.Join(datatypes.ResolutionClassNames(), ", "))
+	}
+	if r.MinSizeGB < 0 || r.MinBitrate < 0 {
+		return fmt.Errorf("rule %s: minimums cannot be negative", r.Name)
+	}
+	switch {
+	case r.Action != "" && r.Action != Ignore:
+		return fmt.Errorf("rule %s: action must be ignore", r.Name)
+	case r.Ignores() && r.Profile != "":
+		return fmt.Errorf("rule %s: an ignore rule cannot name a profile", r.Name)
+	case !r.Ignores() && r.Profile == "":
+		return fmt.Errorf("rule %s: a profile or action ignore is required", r.Name)
+	}
+	return nil
+}
+
+// Load reads the rules in the order they are tried. A missing file means no
+// rules, so every new file gets the RULES_DEFAULT action.
+func Load() ([]Rule, error) {
+	data, err := os.ReadFile(config.GetRulesFile())
+	if os.IsNotExist(err) {
+		return []Rule{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules: %w", err)
+	}
+
+	var list []Rule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error decoding rules: %w", err)
+	}
+	for i, rule := range list {
+		// Stored tags are normalised, so the rule's are too
+		if rule.Tags, err = db.ParseTags(rule.Tags); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		list[i] = rule
+	}
+	return list, nil
+}
+
+// Fallthrough returns the rule applied to files no rule matches, from RULES_DEFAULT
+func Fallthrough() Rule {
+	if value := config.GetRulesDefault(); value != Ignore {
+		return Rule{Name: "default", Profile: value}
+	}
+	return Rule{Name: "default", Action: Ignore}
+}
@@ -0,0 +1,57 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Fake records the commands it is asked to run instead of running them.
+// Respond, when set, supplies each command's output and error; started
+// processes write that output to stderr, as ffmpeg's progress would be.
+type Fake struct {
+	Respond func(name string, args []string) ([]byte, error)
+
+	mutex sync.Mutex
+	calls [][]string
+}
+
+// Calls returns every command run so far, each as name followed by its args
+func (f *Fake) Calls() [][]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([][]string(nil), f.calls...)
+}
+
+func (f *Fake) run(name string, args []string) ([]byte, error) {
+	f.mutex.Lock()
+	f.calls = append(f.calls, append([]string{name}, args...))
+	f.mutex.Unlock()
+	if f.Respond == nil {
+		return nil, nil
+	}
+	return f.Respond(name, args)
+}
+
+func (f *Fake) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return f.run(name, args)
+}
+
+func (f *Fake) Start(name string, args ...string) (Process, error) {
+	out, err := f.run(name, args)
+	return &fakeProcess{stderr: strings.NewReader(string(out)), err: err}, nil
+}
+
+type fakeProcess struct {
+	stderr io.Reader
+	err    error
+}
+
+func (p *fakeProcess) Stderr() io.Reader {
+	return p.stderr
+}
+
+func (p *fakeProcess) Wait() error {
+	return p.err
+}
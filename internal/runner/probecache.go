@@ -0,0 +1,104 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// probeCacheEntries bounds the outputs kept in memory; the store keeps the rest
+const probeCacheEntries = 4096
+
+// ProbeStore keeps ffprobe output across processes
+type ProbeStore interface {
+	// LoadProbe returns the output saved under key
+	LoadProbe(key string) ([]byte, bool)
+	// SaveProbe saves the output of a probe of path at version, its size
+	// and modification time, dropping those saved at other versions
+	SaveProbe(path, version, key string, output []byte)
+}
+
+// ProbeCache runs commands with another Runner, reusing the output of an
+// earlier identical ffprobe run while the probed file keeps its size and
+// modification time. Failed runs and files that cannot be stat'ed, such as
+// URLs, always run.
+type ProbeCache struct {
+	next  Runner
+	store ProbeStore // May be nil to cache in memory only
+
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+// NewProbeCache caches the ffprobe runs of next in memory and in store
+func NewProbeCache(next Runner, store ProbeStore) *ProbeCache {
+	return &ProbeCache{next: next, store: store, entries: map[string][]byte{}}
+}
+
+func (c *ProbeCache) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	path, version, key, ok := probeKey(name, args)
+	if !ok {
+		return c.next.Output(ctx, name, args...)
+	}
+
+	c.mu.Lock()
+	out, hit := c.entries[key]
+	c.mu.Unlock()
+	if !hit && c.store != nil {
+		out, hit = c.store.LoadProbe(key)
+	}
+	if hit {
+		c.remember(key, out)
+		return out, nil
+	}
+
+	out, err := c.next.Output(ctx, name, args...)
+	if err != nil {
+		return out, err
+	}
+	c.remember(key, out)
+	if c.store != nil {
+		c.store.SaveProbe(path, version, key, out)
+	}
+	return out, nil
+}
+
+func (c *ProbeCache) Start(name string, args ...string) (Process, error) {
+	return c.next.Start(name, args...)
+}
+
+// remember keeps an output in memory, starting over once the cache is full
+func (c *ProbeCache) remember(key string, out []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= probeCacheEntries {
+		c.entries = map[string][]byte{}
+	}
+	c.entries[key] = out
+}
+
+// probeKey identifies an ffprobe run by its arguments and the version of the
+// file it probes, which comes last: its size and modification time
+func probeKey(name string, args []string) (path, version, key string, ok bool) {
+	if name != "ffprobe" || len(args) == 0 {
+		return "", "", "", false
+	}
+	path = strings.TrimPrefix(args[len(args)-1], "file:")
+	version, ok = FileVersion(path)
+	if !ok {
+		return "", "", "", false
+	}
+	return path, version, version + ":" + strings.Join(args, "\x00"), true
+}
+
+// FileVersion returns the version probes of a regular file are cached at,
+// its size and modification time, or false when it cannot be stat'ed
+func FileVersion(path string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano()), true
+}
@@ -0,0 +1,199 @@
+// Package runner runs the external tools the transcoder relies on, such as
+// ffmpeg, ffprobe and nvidia-smi, behind the Runner interface. Tests swap in a
+// Fake to assert on command lines without the tools installed, and every
+// caller gets the same timeout and error handling.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout bounds tools run with Output and Run. Processes started
+// with Start, like a full encode, run until they exit.
+const Timeout = 5 * time.Minute
+
+// Runner starts external processes
+type Runner interface {
+	// Output runs a command to completion and returns its stdout
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+	// Start starts a long running command whose stderr is read while it runs
+	Start(name string, args ...string) (Process, error)
+}
+
+// Process is a command started by a Runner
+type Process interface {
+	// Stderr streams what the process writes to stderr
+	Stderr() io.Reader
+	// Wait waits for the process to exit, after Stderr has been read to the end
+	Wait() error
+}
+
+// Error is a command that could not be run or exited with an error
+type Error struct {
+	Name   string
+	Args   []string
+	Err    error
+	Stderr string // Last line the command wrote to stderr, when captured
+}
+
+func (e *Error) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Name, e.Err, e.Stderr)
+	}
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// CommandLine returns the command as it would be typed, for logs
+func (e *Error) CommandLine() string {
+	return strings.Join(append([]string{e.Name}, e.Args...), " ")
+}
+
+var (
+	current      Runner = Exec{}
+	currentMutex sync.RWMutex
+)
+
+// Use makes r run every command until the returned function restores the
+// previous runner
+func Use(r Runner) func() {
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	previous := current
+	current = r
+	return func() {
+		currentMutex.Lock()
+		defer currentMutex.Unlock()
+		current = previous
+	}
+}
+
+func get() Runner {
+	currentMutex.RLock()
+	defer currentMutex.RUnlock()
+	return current
+}
+
+// Output runs a command with the default timeout and returns its stdout
+func Output(name string, args ...string) ([]byte, error) {
+	return OutputWithin(Timeout, name, args...)
+}
+
+// OutputWithin runs a command like Output, killing it after timeout
+func OutputWithin(timeout time.Duration, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return get().Output(ctx, name, args...)
+}
+
+// Run runs a command with the default timeout, discarding its output
+func Run(name string, args ...string) error {
+	_, err := Output(name, args...)
+	return err
+}
+
+// Start starts a long running command
+func Start(name string, args ...string) (Process, error) {
+	return get().Start(name, args...)
+}
+
+// RunToExit runs a long command, such as an encode, without a timeout and
+// returns what it wrote to stderr
+func RunToExit(name string, args ...string) ([]byte, error) {
+	process, err := Start(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	stderr, _ := io.ReadAll(process.Stderr())
+	return stderr, process.Wait()
+}
+
+// Exec runs commands with os/exec
+type Exec struct{}
+
+func (Exec) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	return out, wrap(ctx, name, args, err, stderr.String())
+}
+
+func (Exec) Start(name string, args ...string) (Process, error) {
+	cmd := exec.Command(name, args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, wrap(context.Background(), name, args, err, "")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, wrap(context.Background(), name, args, err, "")
+	}
+	process := &execProcess{cmd: cmd, name: name, args: args}
+	process.stderr = io.TeeReader(stderr, &process.tail)
+	return process, nil
+}
+
+type execProcess struct {
+	cmd    *exec.Cmd
+	stderr io.Reader
+	tail   tail
+	name   string
+	args   []string
+}
+
+func (p *execProcess) Stderr() io.Reader {
+	return p.stderr
+}
+
+func (p *execProcess) Wait() error {
+	return wrap(context.Background(), p.name, p.args, p.cmd.Wait(), p.tail.String())
+}
+
+// tailSize is how much of a started process's stderr is kept for its error
+const tailSize = 4096
+
+// tail keeps the last tailSize bytes written to it
+type tail struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (t *tail) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.data = append(t.data, p...)
+	if len(t.data) > tailSize {
+		t.data = append([]byte(nil), t.data[len(t.data)-tailSize:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tail) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return string(t.data)
+}
+
+// wrap turns a failed run into an *Error naming the command, reporting a
+// timeout rather than the signal that ended the process
+func wrap(ctx context.Context, name string, args []string, err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out: %w", ctx.Err())
+	}
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	return &Error{Name: name, Args: args, Err: err, Stderr: strings.TrimSpace(lines[len(lines)-1])}
+}
@@ -0,0 +1,88 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaitReportsLastStderrLine(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run")
+	}
+	_, err := RunToExit("sh", "-c", "echo first >&2; echo 'last line' >&2; exit 3")
+	var runErr *Error
+	if !errors.As(err, &runErr) {
+		t.Fatalf("RunToExit returned %v, want an *Error", err)
+	}
+	if runErr.Stderr != "last line" {
+		t.Errorf("Stderr = %q, want the last line written", runErr.Stderr)
+	}
+}
+
+func TestFakeRecordsCalls(t *testing.T) {
+	fake := &Fake{Respond: func(name string, args []string) ([]byte, error) {
+		if name == "ffprobe" {
+			return []byte("{}"), nil
+		}
+		return []byte("frame=1\n"), errors.New("exit status 1")
+	}}
+	defer Use(fake)()
+
+	if out, err := Output("ffprobe", "-v", "error", "in.mkv"); err != nil || string(out) != "{}" {
+		t.Errorf("Output = %q, %v, want the fake's answer", out, err)
+	}
+	stderr, err := RunToExit("ffmpeg", "-i", "in.mkv", "out.mkv")
+	if err == nil || string(stderr) != "frame=1\n" {
+		t.Errorf("RunToExit = %q, %v, want the fake's output and error", stderr, err)
+	}
+	calls := fake.Calls()
+	if len(calls) != 2 || calls[0][0] != "ffprobe" || calls[1][0] != "ffmpeg" || calls[1][3] != "out.mkv" {
+		t.Errorf("recorded calls %v", calls)
+	}
+}
+
+func TestProbeCacheRerunsChangedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in.mkv")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake := &Fake{}
+	cache := NewProbeCache(fake, nil)
+	probe := func() {
+		t.Helper()
+		if _, err := cache.Output(context.Background(), "ffprobe", "-v", "error", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write("video", modTime)
+	probe()
+	probe()
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Fatalf("ran ffprobe %d times for an unchanged file, want 1", calls)
+	}
+
+	write("longer video", modTime)
+	probe()
+	if calls := len(fake.Calls()); calls != 2 {
+		t.Errorf("ran ffprobe %d times, want a new run once the size changed", calls)
+	}
+
+	write("longer video", modTime.Add(time.Minute))
+	probe()
+	if calls := len(fake.Calls()); calls != 3 {
+		t.Errorf("ran ffprobe %d times, want a new run once the modification time changed", calls)
+	}
+}
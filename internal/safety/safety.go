@@ -0,0 +1,42 @@
+// Package safety refuses destructive operations in read-only mode, so the
+// tool can be handed to others for analysis without risking the library.
+// Everything that deletes or replaces media files, or drops their records,
+// goes through it.
+package safety
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+)
+
+// ErrReadOnly is returned for every operation refused in read-only mode
+var ErrReadOnly = errors.New("refused in read-only mode")
+
+// Check returns an error naming action when read-only mode is on
+func Check(action string) error {
+	if config.GetReadOnly() {
+		return fmt.Errorf("%s: %w", action, ErrReadOnly)
+	}
+	return nil
+}
+
+// Remove deletes a media file unless read-only mode is on. Files on an ssh
+// host are deleted there; files at a URL belong to their host and are never
+// deleted.
+func Remove(path string) error {
+	if err := Check("delete " + path); err != nil {
+		return err
+	}
+	if pathutil.IsURL(path) {
+		return fmt.Errorf("%s is a remote file, delete it on its host", path)
+	}
+	if p, err := sshpath.Parse(path); err == nil {
+		return p.Remove()
+	}
+	return os.Remove(path)
+}
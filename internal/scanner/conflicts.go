@@ -0,0 +1,88 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/pkg/scanner"
+)
+
+// stdin is shared by every prompt, so answers typed ahead are not lost
+var stdin = bufio.NewReader(os.Stdin)
+
+// promptMutex lets one prompt at a time ask and read its answer, as the scan
+// workers find conflicts concurrently
+var promptMutex sync.Mutex
+
+// askConflict asks on the terminal what to do with a conflicting file.
+// Scans without a terminal, like the daemon's, flag it for review instead.
+func askConflict(conflict scanner.Conflict) scanner.ConflictPolicy {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return scanner.ConflictFlag
+	}
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+	fmt.Printf("\n%s no longer matches its entry: %s\n", conflict.Path, strings.Join(conflict.Reasons, ", "))
+	fmt.Printf("  recorded: %s, %dx%d, %ds\n", units.Bytes(int64(conflict.Recorded.Size)), conflict.Recorded.Width, conflict.Recorded.Height, conflict.Recorded.Length)
+	fmt.Printf("  on disk:  %s, %dx%d, %ds\n", units.Bytes(int64(conflict.Found.Size)), conflict.Found.Width, conflict.Found.Height, conflict.Found.Length)
+	for {
+		fmt.Print("[u]pdate the entry, [k]eep both with the old one as a version, or [f]lag for review? ")
+		answer, err := stdin.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "u", "update":
+			return scanner.ConflictUpdate
+		case "k", "keep":
+			return scanner.ConflictKeep
+		case "f", "flag":
+			return scanner.ConflictFlag
+		}
+		if err != nil {
+			return scanner.ConflictFlag
+		}
+	}
+}
+
+// ResolveConflict rescans a flagged file, updating its entry or keeping the
+// old entry as a version, and clears the flag
+func ResolveConflict(filePath, policy string) error {
+	switch scanner.ConflictPolicy(policy) {
+	case scanner.ConflictUpdate, scanner.ConflictKeep:
+	default:
+		return apperr.New(apperr.Usage, "unknown resolution %q, expected update or keep", policy)
+	}
+	resolver := scanner.New(dbStore{}, scanner.FFProbe{}, stdoutLogger{})
+	resolver.SetConflictPolicy(scanner.ConflictPolicy(policy), nil)
+	result := resolver.ProcessFile(filePath)
+	if result.Action == scanner.ActionFailed {
+		return apperr.Wrap(apperr.Internal, result.Err, "error rescanning "+filePath)
+	}
+	return db.ResolveScanConflict(filePath)
+}
+
+// ShowConflicts lists the files flagged for review
+func ShowConflicts() error {
+	conflicts, err := db.QueryScanConflicts()
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error reading conflicts")
+	}
+	if output.JSON() {
+		return output.Print(conflicts)
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("No files are flagged for review.")
+		return nil
+	}
+	for _, c := range conflicts {
+		fmt.Printf("%s  %s\n    %s (now %s, %dx%d, %ds)\n", c.FlaggedAt.Local().Format("2006-01-02 15:04"), c.Path,
+			c.Reasons, units.Bytes(int64(c.Size)), c.Width, c.Height, c.Length)
+	}
+	fmt.Println("Resolve with: conflicts resolve <path> update|keep")
+	return nil
+}
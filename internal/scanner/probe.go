@@ -0,0 +1,77 @@
+package scanner
+
+import (
+	"path/filepath"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+)
+
+// probeReport is everything known about one file, for seeing why it does or
+// does not match a filter
+type probeReport struct {
+	// What a scan would record now, streams included
+	Probed     datatypes.VideoObject `json:"probed"`
+	ProbeError string                `json:"probe_error,omitempty"`
+	// The database entry, nil when the file has not been scanned
+	Recorded *datatypes.VideoObject `json:"recorded"`
+	Tags     []string               `json:"tags,omitempty"`
+	Saved    bool                   `json:"saved,omitempty"`
+}
+
+// ShowProbe prints the metadata ffprobe extracts from a file next to its
+// database entry as JSON. With save the entry is inserted or replaced by what
+// was probed, even when its size has not changed.
+func ShowProbe(filePath string, save bool) error {
+	// Entries are recorded under absolute paths
+	if !pathutil.IsURL(filePath) && !sshpath.Is(filePath) {
+		if abs, err := filepath.Abs(filePath); err == nil {
+			filePath = abs
+		}
+	}
+	probed, probeErr := defaultScanner.Probe(filePath)
+	if probeErr != nil && probed.FullFilePath == "" {
+		return apperr.Wrap(apperr.NotFound, probeErr, "error probing "+filePath)
+	}
+	probed.BPP = probed.BitsPerPixel()
+	report := probeReport{Probed: probed}
+	if probeErr != nil {
+		report.ProbeError = probeErr.Error()
+	}
+
+	recorded, err := db.QueryVideoByPath(filePath)
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error reading entry")
+	}
+	if recorded != nil {
+		if recorded.Streams, err = db.QueryStreams(filePath); err != nil {
+			return apperr.Wrap(apperr.Database, err, "error reading streams")
+		}
+		if report.Tags, err = db.QueryFileTags(filePath); err != nil {
+			return apperr.Wrap(apperr.Database, err, "error reading tags")
+		}
+	}
+	report.Recorded = recorded
+
+	if save {
+		// A failed probe would blank the recorded metadata
+		if probeErr != nil {
+			output.Print(report)
+			return apperr.Wrap(apperr.FFmpeg, probeErr, "not saving "+filePath)
+		}
+		if recorded == nil {
+			err = db.InsertVideo(probed)
+		} else {
+			err = db.UpdateVideo(probed)
+		}
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error saving "+filePath)
+		}
+		report.Saved = true
+	}
+	return output.Print(report)
+}
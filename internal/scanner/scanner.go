@@ -1,257 +1,205 @@
 package scanner
 
 import (
-	"bufio"
-	"bytes"
-	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/config"
 	"github.com/palzino/vidanalyser/internal/datatypes"
 	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/pkg/scanner"
 )
 
-var videoExtensions = map[string]bool{
-	".mp4":  true,
-	".mkv":  true,
-	".avi":  true,
-	".mov":  true,
-	".m4v":  true,
-	".webm": true,
-}
-
-var videoObjects datatypes.VideoObjects
-var totalVideos int
-var mu sync.Mutex
+// dbStore adapts the package-level database functions to scanner.Store
+type dbStore struct{}
 
-// checkExtension checks if the file has a video extension
-func CheckExtension(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
-	return videoExtensions[ext]
+func (dbStore) QueryVideoByPath(filePath string) (*datatypes.VideoObject, error) {
+	return db.QueryVideoByPath(filePath)
 }
 
-// getFileSize returns the size of the file in bytes
-func getFileSize(filePath string) int64 {
-	info, err := os.Stat(filePath)
-	if err != nil {
-		fmt.Println("Error getting file size:", err)
-		return 0
-	}
-	return info.Size()
-}
-func getVideoMetadata(filePath string) (int, int, int, float64, int, int) {
-	ext := strings.ToLower(filepath.Ext(filePath))
-	switch ext {
-	case ".mp4", ".mov", ".m4v", ".avi":
-		return getMP4Metadata(filePath)
-	case ".mkv":
-		return getMKVMetadata(filePath)
-	default:
-		fmt.Println("Unsupported file type:", ext)
-		return 0, 0, 0, 0.0, 0, 0
-	}
+func (dbStore) InsertVideo(video datatypes.VideoObject) error {
+	return db.InsertVideo(video)
 }
 
-// getMP4Metadata uses ffprobe to extract video metadata
-func getMP4Metadata(filePath string) (int, int, int, float64, int, int) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
-		"-show_entries", "stream=width,height,avg_frame_rate,nb_frames,bit_rate,duration",
-		"-of", "csv=p=0", filePath)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error running ffprobe:", err, "for file:", filePath)
-		return 0, 0, 0, 0.0, 0, 0
-	}
-
-	width, height, duration := 0, 0, 0
-	framerate := 0.0
-	frames, bitrate := 0, 0
-
-	scanner := bufio.NewScanner(&out)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ",")
-		if len(parts) >= 6 {
-			width, _ = strconv.Atoi(parts[0])
-			height, _ = strconv.Atoi(parts[1])
-			framerate = parseFramerate(parts[2]) // Handle framerate as a fraction
-			durationFloat, _ := strconv.ParseFloat(parts[3], 64)
-			duration = int(durationFloat)
-			frames, _ = strconv.Atoi(parts[4])
-			bitrate, _ = strconv.Atoi(parts[5])
+// UpdateVideo keeps the previous entry as a version, unless FILE_HISTORY is
+// off, before recording the changed file
+func (dbStore) UpdateVideo(video datatypes.VideoObject) error {
+	if config.GetFileHistory() {
+		if err := db.KeepFileVersion(video.FullFilePath, describeChange(video)); err != nil {
+			return err
 		}
 	}
-	return width, height, duration, framerate, frames, bitrate
+	return db.UpdateVideo(video)
 }
 
-// getMKVMetadata extracts metadata for MKV files
-func getMKVMetadata(filePath string) (int, int, int, float64, int, int) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
-		"-show_entries", "stream=width,height,avg_frame_rate",
-		"-show_entries", "format=duration,bit_rate", "-of", "csv=p=0", filePath)
-	var out bytes.Buffer
-	cmd.Stdout = &out
+func (dbStore) SetModTime(filePath string, modTime int64) error {
+	return db.SetVideoModTime(filePath, modTime)
+}
 
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error running ffprobe for MKV:", err)
-		return 0, 0, 0, 0.0, 0, 0
-	}
+func (dbStore) KeepVersion(recorded datatypes.VideoObject, reason string) error {
+	return db.KeepFileVersion(recorded.FullFilePath, reason)
+}
+
+func (dbStore) FlagConflict(conflict scanner.Conflict) error {
+	return db.FlagScanConflict(conflict.Found, strings.Join(conflict.Reasons, ", "))
+}
 
-	width, height := 0, 0
-	duration := 0
-	framerate := 0.0
-	bitrate := 0
+// stdoutLogger prints scanner messages the way the CLI always has
+type stdoutLogger struct{}
 
-	scanner := bufio.NewScanner(&out)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ",")
-		if len(parts) >= 5 {
-			width, _ = strconv.Atoi(parts[0])
-			height, _ = strconv.Atoi(parts[1])
-			framerate = parseFramerate(parts[2])
+func (stdoutLogger) Printf(format string, args ...interface{}) {
+	fmt.Printf(format, args...)
+}
 
-			// Handle duration (from format section)
-			if parts[3] != "N/A" {
-				durationFloat, _ := strconv.ParseFloat(parts[3], 64)
-				duration = int(durationFloat)
-			}
+var defaultScanner = scanner.New(dbStore{}, scanner.FFProbe{}, stdoutLogger{})
+
+// applySymlinkPolicy picks up SCAN_SYMLINKS, SCAN_CONFLICTS, SCAN_WORKERS,
+// SCAN_INCREMENTAL and VIDEO_STREAMS before a scan, since the config is loaded after the scanner is created and
+// may be reloaded
+func applySymlinkPolicy() {
+	defaultScanner.SetSymlinkPolicy(scanner.SymlinkPolicy(config.GetSymlinkPolicy()))
+	defaultScanner.SetConflictPolicy(scanner.ConflictPolicy(config.GetScanConflicts()), askConflict)
+	defaultScanner.SetWorkers(config.GetScanWorkers())
+	defaultScanner.SetIncremental(config.GetScanIncremental())
+	defaultScanner.SetVideoStreamPolicy(config.GetVideoStreams())
+}
 
-			// Handle bitrate (from format section)
-			if parts[4] != "N/A" {
-				bitrate, _ = strconv.Atoi(parts[4])
-			}
-		}
+// printResult reports a failed file on stdout
+func printResult(result scanner.Result) {
+	if result.Err != nil {
+		fmt.Printf("Error processing %s: %s\n", result.Path, result.Err)
 	}
-	return width, height, duration, framerate, 0, bitrate // MKV does not reliably provide nb_frames
 }
 
-// parseFramerate converts a fraction string like "30000/1001" to a float
-func parseFramerate(fps string) float64 {
-	parts := strings.Split(fps, "/")
-	if len(parts) == 2 {
-		numerator, err1 := strconv.ParseFloat(parts[0], 64)
-		denominator, err2 := strconv.ParseFloat(parts[1], 64)
-		if err1 == nil && err2 == nil && denominator != 0 {
-			return numerator / denominator
-		}
-	}
-	// If it's not a fraction, attempt to parse as a float
-	if framerate, err := strconv.ParseFloat(fps, 64); err == nil {
-		return framerate
-	}
-	return 0.0
+// checkExtension checks if the file has a video extension
+func CheckExtension(filename string) bool {
+	return scanner.CheckExtension(filename)
 }
 
 // processFile extracts metadata from a video file and adds it to the list
 func ProcessFile(filePath string) {
-	fileSize := getFileSize(filePath)
-	width, height, length, framerate, frames, bitrate := getVideoMetadata(filePath)
-
-	mu.Lock()
-	defer mu.Unlock()
-	totalVideos++
-
-	obj := datatypes.VideoObject{
-		Name:          filepath.Base(filePath),
-		Location:      filepath.Dir(filePath),
-		FullFilePath:  filePath,
-		Size:          int(fileSize),
-		Width:         width,
-		Height:        height,
-		Length:        length,
-		Framerate:     framerate,
-		Frames:        frames,
-		Bitrate:       bitrate,
-		FileExtension: filepath.Ext(filePath),
-	}
-	// Check if the file existss in the database
-	existingVideo, err := db.QueryVideoByPath(filePath)
-	if err != nil && err != sql.ErrNoRows {
-		fmt.Printf("Error querying video from database: %s\n", err)
-		return
-	}
-
-	// If the file exists and the size matches, skip processing
-	if existingVideo != nil && existingVideo.Size == int(fileSize) {
-		return
-	}
-
-	// If the file exists but the size differs, update it; otherwise, insert it
-	if existingVideo != nil {
-		fmt.Printf("File exists but size differs. Updating entry: %s\n", filePath)
-		err = db.UpdateVideo(obj)
-		if err != nil {
-			fmt.Printf("Error updating video in database: %s\n", err)
-		}
-	} else {
-		err = db.InsertVideo(obj)
-		if err != nil {
-			fmt.Printf("Error inserting video into database: %s\n", err)
-		}
-	}
-
+	printResult(defaultScanner.ProcessFile(filePath))
 }
 
 // processDirectory scans a directory for video files
 func ProcessDirectory(directory string, wg *sync.WaitGroup) {
 	defer wg.Done()
-	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Println("Error walking path:", err)
-			return err
-		}
-		if !info.IsDir() && CheckExtension(info.Name()) {
-			ProcessFile(path)
+	applySymlinkPolicy()
+	if err := defaultScanner.ProcessDirectory(directory, printResult); err != nil {
+		fmt.Println("Error processing directory:", err)
+	}
+}
+
+// AddURL probes a file served over HTTP(S) and records it like a scanned file
+func AddURL(rawURL string) error {
+	if !pathutil.IsURL(rawURL) {
+		return apperr.New(apperr.Usage, "%s is not an http:// or https:// URL", rawURL)
+	}
+	if !CheckExtension(rawURL) {
+		return apperr.New(apperr.Usage, "%s does not name a video file", rawURL)
+	}
+	// Sizing the file up first tells a missing or unreachable file apart from
+	// a failure to record it
+	if _, err := scanner.StatURL(rawURL); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return apperr.Wrap(apperr.NotFound, err, "error adding "+rawURL)
 		}
+		return apperr.Wrap(apperr.Internal, err, "error adding "+rawURL)
+	}
+	result := defaultScanner.ProcessFile(rawURL)
+	if result.Action == scanner.ActionFailed {
+		return apperr.Wrap(apperr.Database, result.Err, "error adding "+rawURL)
+	}
+	if result.Err != nil {
+		fmt.Printf("Added %s without its metadata: %s\n", rawURL, result.Err)
 		return nil
-	})
-	if err != nil {
-		fmt.Println("Error processing directory:", err)
 	}
+	fmt.Printf("Added %s (%dx%d, %ds)\n", rawURL, result.Video.Width, result.Video.Height, result.Video.Length)
+	return nil
 }
 
 // GetTotalVideos returns the total number of processed videos
 func GetTotalVideos() int {
-	mu.Lock()
-	defer mu.Unlock()
-	return totalVideos
+	return defaultScanner.Total()
 }
 
 // ProcessMasterDirectory now returns a WaitGroup for synchronization
 func ProcessMasterDirectory(masterFolder string) *sync.WaitGroup {
+	applySymlinkPolicy()
 	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		summary, err := defaultScanner.Scan(masterFolder, printResult)
+		if err != nil {
+			fmt.Println("Error reading master folder:", err)
+			return
+		}
+		for _, err := range summary.Errors {
+			fmt.Println("Error processing directory:", err)
+		}
+	}()
+	return wg
+}
 
-	files, err := os.ReadDir(masterFolder)
-	if err != nil {
-		fmt.Println("Error reading master folder:", err)
-		return wg
-	}
+// ScanMasterDirectory scans a library root and blocks until it is done. It
+// returns a partial-failure error when some files could not be processed.
+func ScanMasterDirectory(masterFolder string) (scanner.Summary, error) {
+	return scanMasterDirectory(masterFolder, nil)
+}
 
-	// Process files in master directory
-	for _, file := range files {
-		if !file.IsDir() && CheckExtension(file.Name()) {
-			filePath := filepath.Join(masterFolder, file.Name())
-			ProcessFile(filePath)
+// ScanNewFiles scans a library root like ScanMasterDirectory and also returns
+// the videos recorded for the first time, for watch mode to act on
+func ScanNewFiles(masterFolder string) ([]datatypes.VideoObject, scanner.Summary, error) {
+	var newMu sync.Mutex
+	var added []datatypes.VideoObject
+	summary, err := scanMasterDirectory(masterFolder, func(result scanner.Result) {
+		if result.Action == scanner.ActionInserted && result.Err == nil {
+			newMu.Lock()
+			added = append(added, result.Video)
+			newMu.Unlock()
 		}
-	}
+	})
+	return added, summary, err
+}
 
-	// Process subdirectories
-	for _, subdir := range files {
-		if subdir.IsDir() {
-			wg.Add(1)
-			go ProcessDirectory(filepath.Join(masterFolder, subdir.Name()), wg)
+// scanMasterDirectory scans a library root, passing every result to onResult when set
+func scanMasterDirectory(masterFolder string, onResult func(scanner.Result)) (scanner.Summary, error) {
+	applySymlinkPolicy()
+	var failedMu sync.Mutex
+	failed := 0
+	summary, err := defaultScanner.Scan(masterFolder, func(result scanner.Result) {
+		printResult(result)
+		if result.Err != nil {
+			failedMu.Lock()
+			failed++
+			failedMu.Unlock()
+		}
+		if onResult != nil {
+			onResult(result)
 		}
+	})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return summary, apperr.Wrap(apperr.NotFound, err, "library path does not exist")
+		}
+		return summary, apperr.Wrap(apperr.Internal, err, "error scanning library")
 	}
-
-	return wg
+	for _, err := range summary.Errors {
+		fmt.Println("Error processing directory:", err)
+	}
+	if _, err := db.RecordScanSnapshot(masterFolder); err != nil {
+		log.Println(err)
+	}
+	if failed > 0 || len(summary.Errors) > 0 {
+		return summary, apperr.New(apperr.PartialFailure, "%d of %d files and %d directories could not be processed",
+			failed, summary.Total, len(summary.Errors))
+	}
+	return summary, nil
 }
@@ -0,0 +1,78 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+)
+
+// ShowTags prints the tags of a file, or without a path every tag in use
+// with how many files carry it
+func ShowTags(filePath string) error {
+	if filePath == "" {
+		counts, err := db.QueryTagCounts()
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error reading tags")
+		}
+		if output.JSON() {
+			return output.Print(counts)
+		}
+		if len(counts) == 0 {
+			fmt.Println("No files are tagged yet.")
+		}
+		for _, count := range counts {
+			fmt.Printf("%-20s %6d files\n", count.Tag, count.Files)
+		}
+		return nil
+	}
+
+	tags, err := db.QueryFileTags(filePath)
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error reading tags")
+	}
+	if output.JSON() {
+		return output.Print(map[string]interface{}{"path": filePath, "tags": tags})
+	}
+	if len(tags) == 0 {
+		fmt.Printf("%s has no tags.\n", filePath)
+		return nil
+	}
+	fmt.Printf("%s: %s\n", filePath, strings.Join(tags, ", "))
+	return nil
+}
+
+// EditTags adds or removes tags on the file at path, or on every recorded
+// file below it when path is a directory
+func EditTags(path string, add bool, values []string) error {
+	tags, err := db.ParseTags(values)
+	if err != nil {
+		return apperr.Wrap(apperr.Usage, err, "invalid tag")
+	}
+	if !add {
+		removed, err := db.UntagVideos(path, tags)
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error removing tags")
+		}
+		if output.JSON() {
+			return output.Print(map[string]interface{}{"path": path, "removed": removed})
+		}
+		fmt.Printf("Removed %d tag(s) under %s\n", removed, path)
+		return nil
+	}
+
+	files, err := db.TagVideos(path, tags)
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error adding tags")
+	}
+	if files == 0 {
+		return apperr.New(apperr.NotFound, "%s is not in the database, scan it first", path)
+	}
+	if output.JSON() {
+		return output.Print(map[string]interface{}{"path": path, "files": files, "tags": tags})
+	}
+	fmt.Printf("Tagged %d file(s) under %s with %s\n", files, path, strings.Join(tags, ", "))
+	return nil
+}
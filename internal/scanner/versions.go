@@ -0,0 +1,93 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// describeChange summarises how video differs from its recorded entry, to
+// label the version kept of that entry
+func describeChange(video datatypes.VideoObject) string {
+	recorded, err := db.QueryVideoByPath(video.FullFilePath)
+	if err != nil || recorded == nil {
+		return "changed"
+	}
+	var changes []string
+	if recorded.Size != video.Size {
+		changes = append(changes, fmt.Sprintf("size %s -> %s", units.Bytes(int64(recorded.Size)), units.Bytes(int64(video.Size))))
+	}
+	if before, after := recorded.VideoCodec, video.VideoCodec; before != after && before != "" && after != "" {
+		changes = append(changes, fmt.Sprintf("codec %s -> %s", before, after))
+	}
+	if len(changes) == 0 {
+		return "changed"
+	}
+	return strings.Join(changes, ", ")
+}
+
+// ShowVersions prints the superseded versions of a file next to its current
+// entry, or without a path, the files that grew most across their versions
+func ShowVersions(filePath string) error {
+	if filePath == "" {
+		return showVersionGrowth()
+	}
+	versions, err := db.QueryFileVersions(filePath)
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error reading versions")
+	}
+	current, err := db.QueryVideoByPath(filePath)
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error reading entry")
+	}
+	if output.JSON() {
+		return output.Print(map[string]interface{}{"path": filePath, "current": current, "versions": versions})
+	}
+	if len(versions) == 0 {
+		fmt.Printf("No earlier versions of %s are recorded.\n", filePath)
+		return nil
+	}
+	fmt.Println(filePath)
+	for _, v := range versions {
+		fmt.Printf("  until %s  %9s  %4dx%-4d  %-5s  %ds  %s\n", v.SupersededAt.Local().Format("2006-01-02 15:04"),
+			units.Bytes(int64(v.Size)), v.Width, v.Height, v.VideoCodec, v.Length, v.Reason)
+	}
+	if current == nil {
+		fmt.Println("  The file is no longer in the library.")
+		return nil
+	}
+	fmt.Printf("  %-22s  %9s  %4dx%d\n", "current", units.Bytes(int64(current.Size)), current.Width, current.Height)
+	first := int64(versions[0].Size)
+	fmt.Printf("  Size change since the first recorded version: %s\n", units.Bytes(int64(current.Size)-first))
+	return nil
+}
+
+// showVersionGrowth lists the files that grew most since their first kept
+// version, with the total, to measure how much upgrades cost in space
+func showVersionGrowth() error {
+	growth, err := db.QueryVersionGrowth(-1)
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error reading versions")
+	}
+	if output.JSON() {
+		return output.Print(growth)
+	}
+	if len(growth) == 0 {
+		fmt.Println("No files have earlier versions recorded.")
+		return nil
+	}
+	var total int64
+	for i, g := range growth {
+		total += g.CurrentSize - g.FirstSize
+		if i < 20 {
+			fmt.Printf("%10s -> %-10s %d version(s)  %s\n", units.Bytes(g.FirstSize), units.Bytes(g.CurrentSize), g.Versions, g.Path)
+		}
+	}
+	fmt.Printf("%d file(s) with earlier versions changed by %s in total.\n", len(growth), units.Bytes(total))
+	return nil
+}
@@ -0,0 +1,167 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/fswatch"
+	"github.com/palzino/vidanalyser/internal/safety"
+	"github.com/palzino/vidanalyser/pkg/scanner"
+)
+
+// watchQueue holds the paths changed since they were last synced, with the
+// time of their latest event
+type watchQueue struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+// touch queues path, restarting its debounce
+func (q *watchQueue) touch(path string) {
+	q.mu.Lock()
+	q.pending[path] = time.Now()
+	q.mu.Unlock()
+}
+
+// due removes and returns the paths quiet for at least debounce, parents first
+func (q *watchQueue) due(debounce time.Duration) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var paths []string
+	for path, at := range q.pending {
+		if time.Since(at) >= debounce {
+			paths = append(paths, path)
+			delete(q.pending, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// moved records a rename straight away, so the history of the file follows
+// it. A pending path is requeued under its new name; a path never recorded
+// is synced as a new one.
+func (q *watchQueue) moved(from, to string) {
+	q.mu.Lock()
+	_, pending := q.pending[from]
+	delete(q.pending, from)
+	q.mu.Unlock()
+
+	videos, err := db.QueryVideosUnder(from)
+	if err != nil {
+		fmt.Printf("Error looking up moved %s: %s\n", from, err)
+	}
+	for _, video := range videos {
+		newPath := to + strings.TrimPrefix(video.FullFilePath, from)
+		if err := db.MoveVideo(video.FullFilePath, newPath); err != nil {
+			fmt.Printf("Error recording move of %s: %s\n", video.FullFilePath, err)
+			continue
+		}
+		fmt.Printf("Moved %s to %s\n", video.FullFilePath, newPath)
+	}
+	if pending || len(videos) == 0 {
+		q.touch(to)
+	}
+}
+
+// lost queues a root whose events were dropped for a rescan, along with every
+// file recorded under it that is gone, so their records are removed
+func (q *watchQueue) lost(root string) {
+	fmt.Printf("Missed changes under %s, rescanning it\n", root)
+	videos, err := db.QueryVideosUnder(root)
+	if err != nil {
+		fmt.Printf("Error looking up videos under %s: %s\n", root, err)
+	}
+	for _, video := range videos {
+		if _, err := os.Lstat(video.FullFilePath); os.IsNotExist(err) {
+			q.touch(video.FullFilePath)
+		}
+	}
+	q.touch(root)
+}
+
+// syncPath brings the records at or below path in line with the disk: files
+// are probed, directories scanned, and the records of anything gone deleted
+func syncPath(path string) {
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		removeRecorded(path)
+	case err != nil:
+		fmt.Printf("Error reading %s: %s\n", path, err)
+	case info.IsDir():
+		if err := defaultScanner.ProcessDirectory(path, printWatchResult); err != nil {
+			fmt.Printf("Error scanning %s: %s\n", path, err)
+		}
+	case CheckExtension(path):
+		printWatchResult(defaultScanner.ProcessFile(path))
+	}
+}
+
+// removeRecorded deletes the records of the videos that were at or below
+// path, or soft-deletes them when DELETION_SYNC is soft
+func removeRecorded(path string) {
+	if err := safety.Check("remove record of deleted " + path); err != nil {
+		fmt.Println(err)
+		return
+	}
+	videos, err := db.QueryVideosUnder(path)
+	if err != nil {
+		fmt.Printf("Error looking up deleted %s: %s\n", path, err)
+		return
+	}
+	remove := db.DeleteVideo
+	if config.GetDeletionSync() == "soft" {
+		remove = db.SoftDeleteVideo
+	}
+	for _, video := range videos {
+		if err := remove(video.FullFilePath); err != nil {
+			fmt.Printf("Error removing deleted %s: %s\n", video.FullFilePath, err)
+			continue
+		}
+		fmt.Printf("Removed %s\n", video.FullFilePath)
+	}
+}
+
+// printWatchResult reports each file the watch added or changed
+func printWatchResult(result scanner.Result) {
+	switch result.Action {
+	case scanner.ActionInserted, scanner.ActionUpdated, scanner.ActionFlagged:
+		fmt.Printf("%s %s\n", strings.ToUpper(string(result.Action[:1]))+string(result.Action[1:]), result.Path)
+	}
+	printResult(result)
+}
+
+// Watch keeps the files table in step with videos added, changed, moved or
+// deleted under roots without rescanning them. Changes are synced once a
+// path has been quiet for WATCH_DEBOUNCE. It blocks.
+func Watch(roots []string) error {
+	applySymlinkPolicy()
+	debounce := config.GetWatchDebounce()
+	queue := &watchQueue{pending: map[string]time.Time{}}
+
+	interval := debounce / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	go func() {
+		for range time.Tick(interval) {
+			for _, path := range queue.due(debounce) {
+				syncPath(path)
+			}
+		}
+	}()
+
+	return fswatch.Watch(roots, fswatch.Handlers{
+		Removed: queue.touch,
+		Moved:   queue.moved,
+		Written: queue.touch,
+		Lost:    queue.lost,
+	})
+}
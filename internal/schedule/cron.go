@@ -0,0 +1,105 @@
+// Package schedule parses cron-style expressions ("minute hour day month weekday")
+// used to run recurring maintenance inside the daemon.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute, hour, day, month, weekday map[int]bool
+}
+
+// field bounds in expression order
+var fieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// aliases for common schedules
+var aliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@nightly": "0 3 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// Parse reads a five field cron expression. Each field accepts *, numbers,
+// ranges (1-5), lists (1,3,5) and steps (*/15). Weekdays run from 0 (Sunday).
+func Parse(expr string) (Schedule, error) {
+	if alias, ok := aliases[strings.TrimSpace(expr)]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return Schedule{}, fmt.Errorf("schedule %q must have 5 fields: minute hour day month weekday", expr)
+	}
+
+	var sets [5]map[int]bool
+	for i, field := range fields {
+		set, err := parseField(field, fieldRanges[i][0], fieldRanges[i][1])
+		if err != nil {
+			return Schedule{}, fmt.Errorf("schedule %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	return Schedule{minute: sets[0], hour: sets[1], day: sets[2], month: sets[3], weekday: sets[4]}, nil
+}
+
+func parseField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			low, high, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(low); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(high); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// Matches reports whether the schedule fires during the minute containing t
+func (s Schedule) Matches(t time.Time) bool {
+	return s.minute[t.Minute()] && s.hour[t.Hour()] && s.day[t.Day()] &&
+		s.month[int(t.Month())] && s.weekday[int(t.Weekday())]
+}
+
+// Next returns the first minute after t at which the schedule fires, or the
+// zero time if it never does within a year
+func (s Schedule) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	for limit := next.AddDate(1, 0, 0); next.Before(limit); next = next.Add(time.Minute) {
+		if s.Matches(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,249 @@
+// Package setup implements the interactive first-run wizard behind `init`.
+package setup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/transcoder"
+)
+
+// wizard holds the answers collected so far, keyed by env var name
+type wizard struct {
+	reader *bufio.Reader
+	values map[string]string
+}
+
+// RunWizard walks through the settings the tool needs and writes them to the
+// config file, keeping any existing values as defaults.
+func RunWizard() error {
+	values, err := godotenv.Read(config.EnvFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading %s: %w", config.EnvFile, err)
+	}
+	if values == nil {
+		values = map[string]string{}
+	}
+	w := &wizard{reader: bufio.NewReader(os.Stdin), values: values}
+
+	fmt.Println("ZinoCoder setup. Press enter to keep the value shown in brackets.")
+
+	w.libraryPaths()
+	if err := checkFFmpeg(); err != nil {
+		return err
+	}
+	w.hardware()
+	w.telegram()
+	w.smtp()
+	w.digest()
+	profile := w.defaultProfile()
+
+	if err := godotenv.Write(w.values, config.EnvFile); err != nil {
+		return fmt.Errorf("error writing %s: %w", config.EnvFile, err)
+	}
+	fmt.Printf("Configuration written to %s\n", config.EnvFile)
+
+	os.Setenv("PROFILES_FILE", w.values["PROFILES_FILE"])
+	if err := profiles.Upsert(profile); err != nil {
+		return fmt.Errorf("error saving default profile: %w", err)
+	}
+	fmt.Printf("Profile %s saved to %s\n", profile.Name, config.GetProfilesFile())
+	return nil
+}
+
+// ask prompts for a value, returning def when the answer is empty
+func (w *wizard) ask(prompt, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", prompt, def)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+	answer, _ := w.reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return def
+	}
+	return answer
+}
+
+// askValid repeats a prompt until validate accepts the answer
+func (w *wizard) askValid(prompt, def string, validate func(string) error) string {
+	for {
+		answer := w.ask(prompt, def)
+		err := validate(answer)
+		if err == nil {
+			return answer
+		}
+		fmt.Println("Invalid value:", err)
+	}
+}
+
+// set stores a value, dropping keys left empty so they fall back to defaults
+func (w *wizard) set(key, value string) {
+	if value == "" {
+		delete(w.values, key)
+		return
+	}
+	w.values[key] = value
+}
+
+// secret prompts for a token or password without echoing the current one.
+// New values are stored encrypted; "keyring:" and "enc:" answers are kept as given.
+func (w *wizard) secret(key, prompt string) {
+	if w.values[key] != "" {
+		prompt += " (enter to keep the current one)"
+	}
+	answer := w.ask(prompt, "")
+	if answer == "" {
+		return
+	}
+	if strings.HasPrefix(answer, "keyring:") || strings.HasPrefix(answer, "enc:") {
+		w.set(key, answer)
+		return
+	}
+	encrypted, err := config.EncryptSecret(answer)
+	if err != nil {
+		fmt.Printf("Could not encrypt %s, storing it as plain text: %s\n", key, err)
+		encrypted = answer
+	}
+	w.set(key, encrypted)
+}
+
+func (w *wizard) libraryPaths() {
+	paths := w.askValid("Library paths (comma separated)", w.values["LIBRARY_PATHS"], func(answer string) error {
+		if answer == "" {
+			return fmt.Errorf("at least one library path is required")
+		}
+		for _, path := range strings.Split(answer, ",") {
+			info, err := os.Stat(strings.TrimSpace(path))
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", path)
+			}
+		}
+		return nil
+	})
+	w.set("LIBRARY_PATHS", paths)
+}
+
+// checkFFmpeg makes sure ffmpeg and ffprobe are installed and prints their version
+func checkFFmpeg() error {
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			return fmt.Errorf("%s not found in PATH, install it and run init again", tool)
+		}
+		out, err := runner.Output(path, "-version")
+		if err != nil {
+			return fmt.Errorf("error running %s: %w", tool, err)
+		}
+		version, _, _ := strings.Cut(string(out), "\n")
+		fmt.Printf("Found %s: %s\n", path, version)
+	}
+	return nil
+}
+
+func (w *wizard) hardware() {
+	os.Unsetenv("HARDWARE_ACCEL")
+	detected := transcoder.DetectHardware()
+	fmt.Println("Detected encoder hardware:", detected)
+
+	def := w.values["HARDWARE_ACCEL"]
+	if def == "" {
+		def = "auto"
+	}
+	accel := w.askValid("Hardware acceleration (auto, nvidia, intel, cpu)", def, func(answer string) error {
+		switch answer {
+		case "auto", "nvidia", "intel", "cpu":
+			return nil
+		}
+		return fmt.Errorf("must be auto, nvidia, intel or cpu")
+	})
+	w.set("HARDWARE_ACCEL", accel)
+}
+
+func (w *wizard) telegram() {
+	w.secret("TELEGRAM_BOT_TOKEN", "Telegram bot token (empty to disable)")
+	if w.values["TELEGRAM_BOT_TOKEN"] == "" {
+		delete(w.values, "TELEGRAM_CHAT_ID")
+		return
+	}
+	w.set("TELEGRAM_CHAT_ID", w.askValid("Telegram chat ID", w.values["TELEGRAM_CHAT_ID"], func(answer string) error {
+		if _, err := strconv.ParseInt(answer, 10, 64); err != nil {
+			return fmt.Errorf("chat ID must be a number")
+		}
+		return nil
+	}))
+}
+
+func (w *wizard) smtp() {
+	w.set("SMTP_HOST", w.ask("SMTP host for email reports (empty to disable)", w.values["SMTP_HOST"]))
+	if w.values["SMTP_HOST"] == "" {
+		return
+	}
+	def := w.values["SMTP_PORT"]
+	if def == "" {
+		def = "587"
+	}
+	w.set("SMTP_PORT", w.askValid("SMTP port", def, func(answer string) error {
+		if port, err := strconv.Atoi(answer); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("port must be between 1 and 65535")
+		}
+		return nil
+	}))
+	w.set("SMTP_USERNAME", w.ask("SMTP username", w.values["SMTP_USERNAME"]))
+	w.secret("SMTP_PASSWORD", "SMTP password")
+	w.set("SMTP_FROM", w.ask("From address", w.values["SMTP_FROM"]))
+	w.set("SMTP_TO", w.askValid("Report recipients (comma separated)", w.values["SMTP_TO"], func(answer string) error {
+		if !strings.Contains(answer, "@") {
+			return fmt.Errorf("at least one email address is required")
+		}
+		return nil
+	}))
+}
+
+func (w *wizard) digest() {
+	w.set("NOTIFY_DIGEST_INTERVAL", w.askValid("Progress digest interval, e.g. 1h (empty for per-file notifications)",
+		w.values["NOTIFY_DIGEST_INTERVAL"], func(answer string) error {
+			if answer == "" {
+				return nil
+			}
+			_, err := time.ParseDuration(answer)
+			return err
+		}))
+}
+
+func (w *wizard) defaultProfile() profiles.Profile {
+	def := w.values["PROFILES_FILE"]
+	if def == "" {
+		def = "profiles.json"
+	}
+	w.set("PROFILES_FILE", w.ask("Profiles file", def))
+
+	def = w.values["DEFAULT_PROFILE"]
+	if def == "" {
+		def = "default"
+	}
+	profile := profiles.Profile{Name: w.ask("Default profile name", def)}
+	profile.Resolution = w.askValid("Output resolution (e.g. 1280x720)", "1280x720", func(answer string) error {
+		return profiles.Profile{Name: profile.Name, Resolution: answer, Bitrate: 1}.Validate()
+	})
+	bitrate := w.askValid("Output bitrate in kbps, or auto to derive it from each source", "2000", func(answer string) error {
+		_, err := profiles.ParseBitrate(answer)
+		return err
+	})
+	profile.Bitrate, _ = profiles.ParseBitrate(bitrate)
+	w.set("DEFAULT_PROFILE", profile.Name)
+	return profile
+}
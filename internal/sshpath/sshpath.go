@@ -0,0 +1,176 @@
+// Package sshpath reaches files on another host, such as a seedbox, through
+// the system ssh and scp. Such files are named ssh://[user@]host[:port]/path;
+// commands run on the host with its own shell and tools, ffprobe included.
+package sshpath
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// Path is a file or directory on a remote host
+type Path struct {
+	Dest string // [user@]host, as ssh takes it
+	Port string
+	Path string // Absolute path on the host
+}
+
+// Is reports whether name is an ssh:// path
+func Is(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "ssh://")
+}
+
+// Parse reads an ssh://[user@]host[:port]/path name
+func Parse(name string) (Path, error) {
+	u, err := url.Parse(name)
+	if err != nil || !Is(name) || u.Hostname() == "" || u.Path == "" {
+		return Path{}, fmt.Errorf("invalid ssh path %q, expected ssh://[user@]host[:port]/path", name)
+	}
+	p := Path{Dest: u.Hostname(), Port: u.Port(), Path: u.Path}
+	if u.User != nil {
+		p.Dest = u.User.Username() + "@" + p.Dest
+	}
+	return p, nil
+}
+
+// String formats the path as Parse reads it
+func (p Path) String() string {
+	host := p.Dest
+	if p.Port != "" {
+		host += ":" + p.Port
+	}
+	return "ssh://" + host + p.Path
+}
+
+// Join returns the path of name inside directory p
+func (p Path) Join(name string) Path {
+	p.Path = path.Join(p.Path, name)
+	return p
+}
+
+// Dir returns the directory holding p
+func (p Path) Dir() Path {
+	p.Path = path.Dir(p.Path)
+	return p
+}
+
+// sshArgs are the options every ssh and scp call gets: batch mode, so a
+// missing key fails instead of prompting, and SSH_OPTIONS
+func sshArgs(portFlag, port string) []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if port != "" {
+		args = append(args, portFlag, port)
+	}
+	return append(args, config.GetSSHOptions()...)
+}
+
+// quote makes an argument safe for the remote shell
+func quote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// command builds the ssh arguments running name with args on the host
+func (p Path) command(name string, args ...string) []string {
+	remote := []string{quote(name)}
+	for _, arg := range args {
+		remote = append(remote, quote(arg))
+	}
+	return append(append(sshArgs("-p", p.Port), p.Dest), strings.Join(remote, " "))
+}
+
+// Output runs a command on the host with the default timeout and returns its stdout
+func (p Path) Output(name string, args ...string) ([]byte, error) {
+	return runner.Output("ssh", p.command(name, args...)...)
+}
+
+// Size returns the size of the file at p
+func (p Path) Size() (int64, error) {
+	out, err := p.Output("stat", "-L", "-c", "%s", p.Path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading size of %s: %w", p, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected size of %s: %q", p, out)
+	}
+	return size, nil
+}
+
+// List returns every regular file under the directory p. Names are read
+// NUL-separated, so names holding newlines come through whole.
+func (p Path) List() ([]Path, error) {
+	out, err := p.Output("find", "-L", p.Path, "-type", "f", "-print0")
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", p, err)
+	}
+	var files []Path
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			file := p
+			file.Path = name
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// Checksum returns the SHA-256 of the file at p, computed on the host
+func (p Path) Checksum() (string, error) {
+	out, err := p.Output("sha256sum", p.Path)
+	if err != nil {
+		return "", fmt.Errorf("error checksumming %s: %w", p, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no checksum returned for %s", p)
+	}
+	return fields[0], nil
+}
+
+// Remove deletes the file at p
+func (p Path) Remove() error {
+	if _, err := p.Output("rm", "-f", p.Path); err != nil {
+		return fmt.Errorf("error removing %s: %w", p, err)
+	}
+	return nil
+}
+
+// Rename moves the file at p to to, on the same host
+func (p Path) Rename(to Path) error {
+	if _, err := p.Output("mv", "-f", p.Path, to.Path); err != nil {
+		return fmt.Errorf("error moving %s to %s: %w", p, to.Path, err)
+	}
+	return nil
+}
+
+// scpSpec names the file at p for scp
+func (p Path) scpSpec() string {
+	return p.Dest + ":" + p.Path
+}
+
+// Pull copies the file at p to local, without a timeout since sources are large
+func (p Path) Pull(local string) error {
+	args := append(sshArgs("-P", p.Port), "-q", p.scpSpec(), local)
+	if _, err := runner.RunToExit("scp", args...); err != nil {
+		return fmt.Errorf("error copying %s to %s: %w", p, local, err)
+	}
+	return nil
+}
+
+// Push copies local to p, creating its directory
+func (p Path) Push(local string) error {
+	if _, err := p.Output("mkdir", "-p", path.Dir(p.Path)); err != nil {
+		return fmt.Errorf("error creating %s: %w", p.Dir(), err)
+	}
+	args := append(sshArgs("-P", p.Port), "-q", local, p.scpSpec())
+	if _, err := runner.RunToExit("scp", args...); err != nil {
+		return fmt.Errorf("error copying %s to %s: %w", local, p, err)
+	}
+	return nil
+}
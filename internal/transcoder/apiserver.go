@@ -3,28 +3,31 @@ package transcoder
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/palzino/vidanalyser/internal/apperr"
 	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/report"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/safety"
 	"github.com/palzino/vidanalyser/internal/scanner"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/users"
 	"github.com/palzino/vidanalyser/internal/utils"
 )
 
-// Request payload structure
-type TranscodeRequest struct {
-	Video       datatypes.VideoObject `json:"video"`
-	Resolution  string                `json:"resolution"`
-	Bitrate     int                   `json:"bitrate"`
-	AutoDelete  bool                  `json:"autoDelete"`
-	CallbackURL string                `json:"callbackURL"` // The URL to notify on completion
-}
+// TranscodeRequest is the payload accepted by the /transcode endpoint
+type TranscodeRequest = datatypes.TranscodeRequest
 
 // Handle the transcoding request
 func handleTranscode(w http.ResponseWriter, r *http.Request) {
@@ -42,143 +45,736 @@ func handleTranscode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate the input
-	if req.Resolution == "" || req.Bitrate <= 0 || req.Video.FullFilePath == "" {
+	// Check the path before anything probes it
+	if req.Video.FullFilePath == "" {
 		http.Error(w, "Invalid input parameters.", http.StatusBadRequest)
 		return
 	}
+	// Everything else about the video comes from its recorded row, never the client
+	video, status, err := validateRequestPath(req.Video.FullFilePath)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	req.Video = video
 
-	// Perform transcoding
-	go func() {
-		APITranscode(req.Video, req.Resolution, req.Bitrate, req.AutoDelete, req.CallbackURL)
+	if req.AutoDelete {
+		if err := safety.Check("autoDelete"); err != nil {
+			http.Error(w, fmt.Sprintf("%s.", err), http.StatusForbidden)
+			return
+		}
+	}
+
+	// A submitting user's default profile applies when no output settings are given
+	if req.User != "" && req.Profile == "" && req.Resolution == "" {
+		req.Profile = users.DefaultProfile(req.User)
+	}
+
+	// Overrides run the job with a one-off copy of the profile
+	var settings json.RawMessage
+	if len(req.Overrides) > 0 {
+		custom, err := overriddenProfile(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid overrides: %s.", err), http.StatusBadRequest)
+			return
+		}
+		profiles.AddTemporary(custom)
+		req.Profile, req.Resolution, req.Bitrate = custom.Name, custom.Resolution, custom.Bitrate
+		settings, _ = json.Marshal(custom)
+	}
+	rejected := true
+	defer func() {
+		if rejected && settings != nil {
+			profiles.RemoveTemporary(req.Profile)
+		}
 	}()
 
-	// Respond to the client
+	// A named profile fills in any output settings the request leaves out
+	if req.Profile != "" {
+		profile, err := profiles.Get(req.Profile)
+		if err != nil || profile == nil {
+			http.Error(w, fmt.Sprintf("Unknown profile %s.", req.Profile), http.StatusBadRequest)
+			return
+		}
+		if req.Resolution == "" {
+			req.Resolution = profile.Resolution
+		}
+		if req.Bitrate <= 0 {
+			req.Bitrate = profile.Bitrate
+		}
+		if reason := excludedBy(*profile, req.Video); reason != "" {
+			http.Error(w, fmt.Sprintf("Profile %s excludes %s.", profile.Name, reason), http.StatusUnprocessableEntity)
+			return
+		}
+	} else if reason := excludedBy(profiles.Profile{}, req.Video); reason != "" {
+		http.Error(w, fmt.Sprintf("Skipping %s.", reason), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Validate the input
+	if req.Resolution == "" || (req.Bitrate <= 0 && req.Bitrate != profiles.AutoBitrate) || req.Video.FullFilePath == "" {
+		http.Error(w, "Invalid input parameters.", http.StatusBadRequest)
+		return
+	}
+	if req.ProgressEvery < 0 || req.ProgressSeconds < 0 {
+		http.Error(w, "Invalid progress interval.", http.StatusBadRequest)
+		return
+	}
+	if req.Tags, err = db.ParseTags(req.Tags); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid tags: %s.", err), http.StatusBadRequest)
+		return
+	}
+	// Perform transcoding
+	rejected = false
+	job := addJob(req, settings)
+	go runJob(job)
+
+	// Respond to the client with the accepted job
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte("Transcoding job accepted and started."))
+	json.NewEncoder(w).Encode(job)
 }
 
-func TranscodeServer() {
-	// Define the route for the transcoding endpoint
-	http.HandleFunc("/transcode", handleTranscode)
+// overriddenProfile applies a request's overrides to its profile, or to its
+// own resolution and bitrate when it names none. Settings given in the
+// request itself take precedence over the profile's.
+func overriddenProfile(req TranscodeRequest) (profiles.Profile, error) {
+	var base profiles.Profile
+	if req.Profile != "" {
+		named, err := profiles.Get(req.Profile)
+		if err != nil || named == nil {
+			return base, fmt.Errorf("unknown profile %s", req.Profile)
+		}
+		base = *named
+	}
+	if req.Resolution != "" {
+		base.Resolution = req.Resolution
+	}
+	if req.Bitrate > 0 || req.Bitrate == profiles.AutoBitrate {
+		base.Bitrate = req.Bitrate
+	}
+	return base.Override(req.Overrides)
+}
 
-	// Start the HTTP server
-	port := 8080
-	fmt.Printf("Starting server on port %d...\n", port)
-	err := http.ListenAndServe(":"+strconv.Itoa(port), nil)
+// runJob executes an accepted job and reports failures to its callback URL
+func runJob(job datatypes.Job) {
+	if job.Settings != nil {
+		defer profiles.RemoveTemporary(job.Profile)
+	}
+	releaseDevice := waitForDevice(job.Video.FullFilePath)
+	defer releaseDevice()
+	done := waitToStart()
+	defer done()
+	// Pick up a cancellation or a renamed input while the job waited
+	if current, exists := getJob(job.ID); exists {
+		job = current
+	}
+	if job.Status == datatypes.JobCancelled {
+		return
+	}
+	setJobStatus(job.ID, datatypes.JobRunning, nil)
+	log.Printf("Job %d started: %s\n", job.ID, job.Video.FullFilePath)
+	stopWatching := watchJobProgress(job.Video.FullFilePath, job)
+	defer stopWatching()
+	result, err := withHooks(job.Video, job.Profile, func() (*datatypes.TranscodedVideo, error) {
+		return APITranscode(job.Video, job.Resolution, job.Bitrate, job.AutoDelete, job.CallbackURL, job.Profile, job.User, job.Tags)
+	})
 	if err != nil {
-		fmt.Printf("Error starting server: %s\n", err)
+		setJobStatus(job.ID, datatypes.JobFailed, err)
+		log.Printf("Job %d failed for %s: %s\n", job.ID, job.Video.FullFilePath, err)
+		utils.NotifyUser(job.User, utils.LevelError, fmt.Sprintf("Job %d failed for %s: %s", job.ID, job.Video.FullFilePath, err))
+		if job.CallbackURL != "" {
+			postCallback(job.Video.FullFilePath, job.CallbackURL, map[string]interface{}{
+				"status": "failed",
+				"error":  err.Error(),
+				"video":  job.Video,
+			})
+		}
+		return
 	}
+	setJobResult(job.ID, result)
+	setJobStatus(job.ID, datatypes.JobCompleted, nil)
+	log.Printf("Job %d completed: %s\n", job.ID, job.Video.FullFilePath)
+	utils.NotifyUser(job.User, utils.LevelVerbose, fmt.Sprintf("Job %d completed: %s", job.ID, job.Video.FullFilePath))
 }
 
-func APITranscode(video datatypes.VideoObject, resolution string, bitrate int, autoDelete bool, callbackURL string) {
-	newName := generateNewName(video.Name)
-	outputPath := filepath.Join(video.Location, newName)
+// handleJobs lists every job accepted by this server
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method. Only GET is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listJobs())
+}
 
-	// Get the original file size
-	originalSize, err := getFileSize(video.FullFilePath)
+// handleJobEvents returns the recorded lifecycle events of one job, oldest first
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		message := fmt.Sprintf("Error getting file size for %s: %s", video.FullFilePath, err)
-		fmt.Println(message)
-		utils.SendTelegramMessage(message)
+		http.Error(w, "Invalid job ID.", http.StatusBadRequest)
+		return
+	}
+	events, err := db.QueryJobEvents(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying job events: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if _, known := getJob(id); !known && len(events) == 0 {
+		http.Error(w, fmt.Sprintf("Unknown job %d.", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// handleProgress returns the live progress of running transcodes
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method. Only GET is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listProgress())
+}
+
+// handleVideos lists videos in the database, filtered by ?dir=, ?min_size= (GB),
+// ?min_bitrate= (kbps), ?min_bpp=, ?multi_stream=1, ?has_stream= and ?lacks_stream=
+func handleVideos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method. Only GET is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	minSize := 0.0
+	if minSizeParam := r.URL.Query().Get("min_size"); minSizeParam != "" {
+		parsed, err := strconv.ParseFloat(minSizeParam, 64)
+		if err != nil {
+			http.Error(w, "Invalid min_size.", http.StatusBadRequest)
+			return
+		}
+		minSize = parsed
+	}
+	minBitrate := 0
+	if minBitrateParam := r.URL.Query().Get("min_bitrate"); minBitrateParam != "" {
+		parsed, err := strconv.Atoi(minBitrateParam)
+		if err != nil {
+			http.Error(w, "Invalid min_bitrate.", http.StatusBadRequest)
+			return
+		}
+		minBitrate = parsed
+	}
+	minBPP := 0.0
+	if minBPPParam := r.URL.Query().Get("min_bpp"); minBPPParam != "" {
+		parsed, err := strconv.ParseFloat(minBPPParam, 64)
+		if err != nil {
+			http.Error(w, "Invalid min_bpp.", http.StatusBadRequest)
+			return
+		}
+		minBPP = parsed
+	}
+	filter := db.VideoFilter{
+		Directory:  r.URL.Query().Get("dir"),
+		Recursive:  true,
+		MinSizeGB:  minSize,
+		MinBitrate: minBitrate,
+		MinBPP:     minBPP,
+		// ?multi_stream=1 lists the files with more than one video stream
+		MultiStream: r.URL.Query().Get("multi_stream") == "1",
+	}
+	// ?tag= may repeat; files must carry every tag given
+	tags, err := db.ParseTags(r.URL.Query()["tag"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid tag: %s", err), http.StatusBadRequest)
+		return
+	}
+	filter.Tags = tags
+	// ?resolution= takes a resolution class such as 1080p, or an exact WxH
+	filter.Resolution = r.URL.Query().Get("resolution")
+	// ?codec= may repeat; files must be in one of the codecs given, e.g. h264
+	filter.Codecs = r.URL.Query()["codec"]
+	// ?has_stream= and ?lacks_stream= take type[:codec][:language], e.g. audio:dts-hd
+	for param, matches := range map[string]*[]db.StreamMatch{"has_stream": &filter.WithStreams, "lacks_stream": &filter.WithoutStreams} {
+		for _, value := range r.URL.Query()[param] {
+			match, err := db.ParseStreamMatch(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: %s", param, err), http.StatusBadRequest)
+				return
+			}
+			*matches = append(*matches, match)
+		}
+	}
+
+	// With ?limit= the listing is paged, the next page starting after the
+	// X-Next-After cursor; without it every match is streamed
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit.", http.StatusBadRequest)
+			return
+		}
+		videos, next, err := db.QueryVideoPage(filter, r.URL.Query().Get("after"), limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying videos: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if next != "" {
+			w.Header().Set("X-Next-After", next)
+		}
+		json.NewEncoder(w).Encode(videos)
+		return
+	}
+
+	// Nothing is sent until the first video is read, so a failing query is
+	// still answered with an error status. A failure once the listing has
+	// started leaves the array unclosed, so clients cannot take the partial
+	// listing for a whole one, and is named in the X-Stream-Error trailer.
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Trailer", "X-Stream-Error")
+		io.WriteString(w, "[")
+		started = true
+	}
+	err = db.EachVideo(filter, func(video datatypes.VideoObject) error {
+		data, err := json.Marshal(video)
+		if err != nil {
+			return err
+		}
+		if started {
+			io.WriteString(w, ",")
+		} else {
+			start()
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error streaming videos: %s\n", err)
+		if !started {
+			http.Error(w, fmt.Sprintf("Error querying videos: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Stream-Error", err.Error())
+		return
+	}
+	if !started {
+		start()
+	}
+	io.WriteString(w, "]\n")
+}
+
+// handleVideoStreams returns the streams recorded for ?path=
+func handleVideoStreams(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing path.", http.StatusBadRequest)
+		return
+	}
+	streams, err := db.QueryStreams(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying streams: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(streams)
+}
+
+// handleTree returns directory totals for a treemap, ?depth= levels deep
+// (default 1) below ?dir=, with savings estimated for ?profile= (default
+// the ?user='s default profile or DEFAULT_PROFILE)
+func handleTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method. Only GET is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	depth := 1
+	if depthParam := r.URL.Query().Get("depth"); depthParam != "" {
+		parsed, err := strconv.Atoi(depthParam)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid depth.", http.StatusBadRequest)
+			return
+		}
+		depth = parsed
+	}
+	profile := r.URL.Query().Get("profile")
+	if profile == "" {
+		profile = users.DefaultProfile(r.URL.Query().Get("user"))
+	}
+
+	node, err := BuildTreemap(r.URL.Query().Get("dir"), depth, profile)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if apperr.CategoryOf(err) == apperr.NotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node)
+}
+
+// handleBatches lists recent batches, or a single batch when ?id= is given
+func handleBatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method. Only GET is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if idParam := r.URL.Query().Get("id"); idParam != "" {
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			http.Error(w, "Invalid batch id.", http.StatusBadRequest)
+			return
+		}
+		batch, err := db.QueryBatch(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying batch: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if batch == nil {
+			http.Error(w, "Batch not found.", http.StatusNotFound)
+			return
+		}
+		addEnergy(batch)
+		json.NewEncoder(w).Encode(batch)
+		return
+	}
+
+	limit := 50
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		if parsed, err := strconv.Atoi(limitParam); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+	batches, err := db.QueryBatches(limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying batches: %s", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range batches {
+		addEnergy(&batches[i])
+	}
+	json.NewEncoder(w).Encode(batches)
+}
 
-	// Determine the encoding method based on hardware support
-	var encoder string
-	var scaleFilter string
-	hardware := detectHardware()
+// handleStats returns lifetime and per-period space saved, grouped by ?period= (default month)
+// and limited to jobs submitted by ?user= when given
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method. Only GET is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "month"
+	}
+	stats, err := report.BuildStats(period, r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building stats: %s", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
 
-	switch hardware {
-	case "nvidia":
-		encoder = "h264_nvenc"
-		scaleFilter = fmt.Sprintf("scale_npp=%s", resolution)
-	case "intel":
-		encoder = "h264_qsv"
-		scaleFilter = fmt.Sprintf("scale=%s", resolution) // QSV uses standard scaling
+// handleTags lists the tags in use with GET, or with POST adds and removes
+// the tags of the file or directory at path
+func handleTags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if path := r.URL.Query().Get("path"); path != "" {
+			tags, err := db.QueryFileTags(path)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying tags: %s", err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "tags": tags})
+			return
+		}
+		counts, err := db.QueryTagCounts()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying tags: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counts)
+	case http.MethodPost:
+		var req struct {
+			Path   string   `json:"path"`
+			Add    []string `json:"add"`
+			Remove []string `json:"remove"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		add, err := db.ParseTags(req.Add)
+		if err == nil {
+			req.Remove, err = db.ParseTags(req.Remove)
+		}
+		if err != nil || req.Path == "" || len(add)+len(req.Remove) == 0 {
+			http.Error(w, "Invalid input parameters.", http.StatusBadRequest)
+			return
+		}
+		// A directory tags every recorded file below it, so only the path is checked
+		if status, err := checkLibraryPath(req.Path); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		files, err := db.TagVideos(req.Path, add)
+		if err == nil {
+			_, err = db.UntagVideos(req.Path, req.Remove)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating tags: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if len(add) > 0 && files == 0 {
+			http.Error(w, "No recorded files at that path.", http.StatusNotFound)
+			return
+		}
+		tags, _ := db.QueryFileTags(req.Path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"path": req.Path, "tags": tags})
 	default:
-		encoder = "libx264"
-		scaleFilter = fmt.Sprintf("scale=%s", resolution) // CPU uses standard scaling
+		http.Error(w, "Invalid request method. Only GET and POST are allowed.", http.StatusMethodNotAllowed)
 	}
+}
 
-	// Prepare FFmpeg command with selected encoder
-	ffmpegCmd := []string{
-		"ffmpeg", "-y", "-i", video.FullFilePath, "-vf", scaleFilter, "-c:a", "copy",
-		"-c:v", encoder, "-b:v", fmt.Sprintf("%dk", bitrate), "-nostats", "-progress", "pipe:2", outputPath,
+// handleProjects returns the progress and burn-down of every migration
+// project, or of the one named in the path. Codecs are not probed here, that
+// is left to SCHEDULE_PROJECTS, so the answer never waits on ffprobe.
+func handleProjects(w http.ResponseWriter, r *http.Request) {
+	statuses, err := ProjectStatuses(r.PathValue("name"), false, false)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUnknownProject) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.PathValue("name") != "" {
+		json.NewEncoder(w).Encode(statuses[0])
+		return
+	}
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// handleVersion returns the server's build information
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BuildInfo())
+}
 
-	// Add hardware acceleration flags if supported
-	if hardware == "nvidia" {
-		ffmpegCmd = append([]string{"ffmpeg", "-y", "-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}, ffmpegCmd[2:]...)
-	} else if hardware == "intel" {
-		ffmpegCmd = append([]string{"ffmpeg", "-y", "-hwaccel", "qsv"}, ffmpegCmd[2:]...)
+// handleProfiles returns the saved profiles, so workers with PROFILE_SOURCE
+// pointing here run named profiles with the same settings
+func handleProfiles(w http.ResponseWriter, r *http.Request) {
+	list, err := profiles.Load()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
 
-	cmd := exec.Command(ffmpegCmd[0], ffmpegCmd[1:]...)
+func TranscodeServer() {
+	seedJobIDs()
+	startPrometheusEndpoint()
+	go func() {
+		// Fill the project gauges without waiting for SCHEDULE_PROJECTS
+		if _, err := ProjectStatuses("", false, true); err != nil {
+			fmt.Printf("Error measuring projects: %s\n", err)
+		}
+	}()
 
-	// Print the FFmpeg command for debugging
-	commandMessage := fmt.Sprintf("Running FFmpeg command: %s", strings.Join(ffmpegCmd, " "))
-	fmt.Println(commandMessage)
-	utils.SendTelegramMessage(commandMessage)
+	// Define the route for the transcoding endpoint
+	http.HandleFunc("/transcode", handleTranscode)
+	http.HandleFunc("/batches", handleBatches)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/jobs", handleJobs)
+	http.HandleFunc("GET /jobs/{id}/events", handleJobEvents)
+	http.HandleFunc("/progress", handleProgress)
+	http.HandleFunc("/videos", handleVideos)
+	http.HandleFunc("GET /videos/streams", handleVideoStreams)
+	http.HandleFunc("/tags", handleTags)
+	http.HandleFunc("/tree", handleTree)
+	http.HandleFunc("/config/reload", handleReload)
+	http.HandleFunc("GET /version", handleVersion)
+	http.HandleFunc("GET /profiles", handleProfiles)
+	http.HandleFunc("GET /logs", handleLogs)
+	http.HandleFunc("GET /projects", handleProjects)
+	http.HandleFunc("GET /projects/{name}", handleProjects)
 
-	// Capture stderr for progress updates
-	stderr, err := cmd.StderrPipe()
+	// Start the HTTP server
+	port := 8080
+	fmt.Printf("Starting server on port %d...\n", port)
+	err := http.ListenAndServe(":"+strconv.Itoa(port), nil)
 	if err != nil {
-		message := fmt.Sprintf("Error capturing FFmpeg stderr: %s", err)
+		fmt.Printf("Error starting server: %s\n", err)
+	}
+}
+
+// APITranscode transcodes a video for a remote coordinator and posts the result
+// to callbackURL on success. It returns the recorded transcode; failures are
+// returned so the caller can report them.
+func APITranscode(video datatypes.VideoObject, resolution string, bitrate int, autoDelete bool, callbackURL string, profile string, user string, tags []string) (*datatypes.TranscodedVideo, error) {
+	outputPath, err := outputPathFor(video, profile)
+	if err != nil {
+		message := fmt.Sprintf("Error choosing output for %s: %s", video.FullFilePath, err)
 		fmt.Println(message)
-		utils.SendTelegramMessage(message)
-		return
+		utils.NotifyError(message)
+		return nil, err
 	}
+	bitrate = targetBitrate(video, resolution, bitrate)
 
-	// Initialize progress tracking
-	progressKey := video.FullFilePath
-	progressMutex.Lock()
-	if _, exists := progressMap[progressKey]; !exists {
-		progressMap[progressKey] = &Progress{}
-		progressKeys = append(progressKeys, progressKey) // Maintain order
+	// Make sure the source is there and complete before starting ffmpeg
+	if err := waitForStableSource(video.FullFilePath); err != nil {
+		message := fmt.Sprintf("Skipping %s: %s", video.FullFilePath, err)
+		fmt.Println(message)
+		utils.NotifyError(message)
+		return nil, err
+	}
+
+	// Get the original file size
+	originalSize, err := getFileSize(video.FullFilePath)
+	if err != nil {
+		message := fmt.Sprintf("Error getting file size for %s: %s", video.FullFilePath, err)
+		fmt.Println(message)
+		utils.NotifyError(message)
+		return nil, err
 	}
-	progressMutex.Unlock()
 
-	// Start the FFmpeg process
-	timer := time.Now()
-	if err := cmd.Start(); err != nil {
-		message := fmt.Sprintf("Error starting FFmpeg process: %s", err)
+	// An existing output is skipped, versioned or replaced once the new one checks out
+	target, replacing, err := collisionTarget(outputPath, profile)
+	if err != nil {
+		message := fmt.Sprintf("Skipping %s: %s", video.FullFilePath, err)
 		fmt.Println(message)
-		utils.SendTelegramMessage(message)
-		return
+		utils.NotifyError(message)
+		return nil, err
+	}
+	if !replacing {
+		outputPath = target
 	}
 
-	// Goroutine to parse progress
-	go parseProgress(stderr, video.Length, time.Now(), progressKey)
+	// Outputs for another device are staged in the output directory and moved after
+	encodePath := encodePathFor(video, target)
+	// A staged encode finished by an interrupted run only needs its copy
+	resumed := stagedOutputReady(encodePath)
 
-	// Wait for FFmpeg to finish
-	if err := cmd.Wait(); err != nil {
-		message := fmt.Sprintf("Error during transcoding: %s", err)
+	// Sources on an ssh host are copied here for ffmpeg and its probes
+	input, err := localSource(video, resumed)
+	if err != nil {
+		message := fmt.Sprintf("Error fetching %s: %s", video.FullFilePath, err)
 		fmt.Println(message)
-		utils.SendTelegramMessage(message)
-		return
+		utils.NotifyError(message)
+		return nil, err
 	}
-	timeTaken := time.Since(timer)
+	defer releaseSource(video, input)
+	ffmpegCmd, encoder := buildFFmpegCommand(input, encodePath, resolution, bitrate, profile)
+
+	var timeTaken time.Duration
+	if resumed {
+		fmt.Printf("Resuming delivery of %s, already encoded\n", outputPath)
+	} else {
+		// Print the FFmpeg command for debugging
+		commandMessage := fmt.Sprintf("Running FFmpeg command: %s", strings.Join(ffmpegCmd, " "))
+		fmt.Println(commandMessage)
+		notifyFileEvent(commandMessage)
+
+		// Track progress until this job finishes, successfully or not
+		progressKey := video.FullFilePath
+		trackProgress(progressKey)
+		defer untrackProgress(progressKey)
+
+		// Start the FFmpeg process
+		timer := time.Now()
+		cmd, err := runner.Start(ffmpegCmd[0], ffmpegCmd[1:]...)
+		if err != nil {
+			message := fmt.Sprintf("Error starting FFmpeg process: %s", err)
+			fmt.Println(message)
+			utils.NotifyError(message)
+			return nil, err
+		}
+
+		// Parse progress until ffmpeg closes stderr, keeping its last lines
+		tail := &stderrTail{}
+		parseProgress(cmd.Stderr(), video.Length, time.Now(), progressKey, tail)
 
-	// Remove progress tracking entry after completion
-	progressMutex.Lock()
-	delete(progressMap, progressKey)
-	progressMutex.Unlock()
+		// Wait for FFmpeg to finish
+		if err := cmd.Wait(); err != nil {
+			failure := &ffmpegError{Err: err, Encoder: encoder, Stderr: tail.String()}
+			fmt.Printf("Error during transcoding: %s\n", failure)
+			utils.NotifyError(failureMessage(video.FullFilePath, failure))
+			return nil, failure
+		}
+		timeTaken = time.Since(timer)
+	}
+	if err := finishStagedEncode(encodePath, target, resumed); err != nil {
+		message := fmt.Sprintf("Error delivering %s: %s", target, err)
+		fmt.Println(message)
+		utils.NotifyError(message)
+		return nil, err
+	}
+	if replacing {
+		if err := replaceVerified(target, outputPath, video); err != nil {
+			fmt.Println(err)
+			utils.NotifyError(err.Error())
+			return nil, err
+		}
+	}
 
 	// Get the new file size
 	newSize, err := getFileSize(outputPath)
 	if err != nil {
 		message := fmt.Sprintf("Error getting file size for %s: %s", outputPath, err)
 		fmt.Println(message)
-		utils.SendTelegramMessage(message)
+		utils.NotifyError(message)
+		return nil, err
+	}
+
+	newObj := datatypes.TranscodedVideo{
+		OriginalVideoPath: video.FullFilePath,
+		TranscodedPath:    outputPath,
+		OldExtension:      filepath.Ext(video.FullFilePath),
+		NewExtension:      filepath.Ext(outputPath),
+		OldSize:           int(originalSize),
+		NewSize:           int(newSize),
+		OriginalRES:       fmt.Sprintf("%dx%d", video.Width, video.Height),
+		NewRES:            resolution,
+		OldBitrate:        video.Bitrate,
+		NewBitrate:        bitrate,
+		TimeTaken:         int(timeTaken.Seconds()),
+		AchievedBitrate:   achievedBitrate(video, newSize),
+		EncodeFPS:         encodeFPS(video, timeTaken),
+		FFmpegArgs:        strings.Join(ffmpegCmd, " "),
+		Encoder:           encoder,
+		EncoderVersion:    encoderVersion(),
+		Profile:           profile,
+		User:              user,
+		Tags:              tags,
+	}
+
+	// Keep the original when the output saved too little, recording the attempt
+	if keepOriginal(originalSize, newSize) {
+		newObj.Discarded = true
+		discardOutput(video.FullFilePath, outputPath, originalSize, newSize)
 		if callbackURL != "" {
-			sendCallback(callbackURL, map[string]interface{}{
-				"status": "failed",
-				"error":  message,
-				"video":  video,
+			postCallback(video.FullFilePath, callbackURL, map[string]interface{}{
+				"status":     "success",
+				"new_object": newObj,
 			})
 		}
-
+		return &newObj, nil
 	}
 
 	// Calculate space saved
@@ -193,24 +789,12 @@ func APITranscode(video datatypes.VideoObject, resolution string, bitrate int, a
 	renamedFilesMutex.Lock()
 	scanner.ProcessFile(outputPath)
 	renamedFilesMutex.Unlock()
-
-	// Display individual file completion and updated total space saved
-
-	newObj := datatypes.TranscodedVideo{
-		OriginalVideoPath: video.FullFilePath,
-		TranscodedPath:    outputPath,
-		OldExtension:      filepath.Ext(video.FullFilePath),
-		NewExtension:      filepath.Ext(outputPath),
-		OldSize:           int(originalSize),
-		NewSize:           int(newSize),
-		OriginalRES:       fmt.Sprintf("%dx%d", video.Width, video.Height),
-		NewRES:            resolution,
-		OldBitrate:        video.Bitrate,
-		NewBitrate:        bitrate,
-		TimeTaken:         int(timeTaken.Seconds()),
+	if err := db.SetSourcePath(outputPath, video.FullFilePath); err != nil {
+		fmt.Println(err)
 	}
+
 	if callbackURL != "" {
-		sendCallback(callbackURL, map[string]interface{}{
+		postCallback(video.FullFilePath, callbackURL, map[string]interface{}{
 			"status":     "success",
 			"new_object": newObj,
 		})
@@ -220,17 +804,28 @@ func APITranscode(video datatypes.VideoObject, resolution string, bitrate int, a
 	displaySpaceSaved() // CLI notification
 
 	if autoDelete {
-		err := os.Remove(video.FullFilePath)
-		if err != nil {
-			fmt.Println("Error deleting file", video.FullFilePath)
+		if err := safety.Remove(video.FullFilePath); err != nil {
+			fmt.Println("Error deleting file", video.FullFilePath, err)
+		} else {
+			fmt.Println("file has been deleted: ", video.FullFilePath)
+			if err := db.DeleteVideo(video.FullFilePath); err != nil {
+				fmt.Printf("Error deleting video %s from database: %s\n", video.FullFilePath, err)
+			}
+			replaceLinks(video, outputPath)
 		}
-		fmt.Println("file has been deleted: ", video.FullFilePath)
 	}
-	completionMessage := fmt.Sprintf("Transcoding completed: %s -> %s\nSpace saved for this file: %.2f GB",
-		video.FullFilePath, outputPath, float64(spaceSaved)/(1024*1024*1024), "Total space saved so far: %.2f GB", float64(totalSpaceSaved)/(1024*1024*1024))
-	utils.SendTelegramMessage(completionMessage)
+	spaceSavedMutex.Lock()
+	completionMessage := fmt.Sprintf("Transcoding completed: %s -> %s\nSpace saved for this file: %s\nTotal space saved so far: %s",
+		video.FullFilePath, outputPath, units.Bytes(spaceSaved), units.Bytes(totalSpaceSaved))
+	spaceSavedMutex.Unlock()
+	notifyFileEvent(completionMessage)
+	return &newObj, nil
 }
 
+// callbackClient posts callbacks, giving up on receivers that hang
+var callbackClient = &http.Client{Timeout: 30 * time.Second}
+
+// sendCallback posts payload as JSON to callbackURL, logging failures
 func sendCallback(callbackURL string, payload map[string]interface{}) {
 	// Serialize the payload to JSON
 	jsonPayload, err := json.Marshal(payload)
@@ -240,7 +835,7 @@ func sendCallback(callbackURL string, payload map[string]interface{}) {
 	}
 
 	// Send POST request to the callback URL
-	resp, err := http.Post(callbackURL, "application/json", bytes.NewBuffer(jsonPayload))
+	resp, err := callbackClient.Post(callbackURL, "application/json", bytes.NewBuffer(jsonPayload))
 	if err != nil {
 		fmt.Printf("Error sending callback to %s: %s\n", callbackURL, err)
 		return
@@ -0,0 +1,55 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+// openTestDatabase opens a fresh database for the duration of the test
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	if err := db.InitDatabase(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+}
+
+func TestHandleVideosStreamsMatches(t *testing.T) {
+	openTestDatabase(t)
+	for _, path := range []string{"/media/movies/a.mkv", "/media/movies/b.mkv"} {
+		video := datatypes.VideoObject{Name: filepath.Base(path), Location: filepath.Dir(path), FullFilePath: path, Size: 1024, FileExtension: ".mkv"}
+		if err := db.InsertVideo(video); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handleVideos(recorder, httptest.NewRequest(http.MethodGet, "/videos?dir=/media/movies", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	var videos []datatypes.VideoObject
+	if err := json.Unmarshal(recorder.Body.Bytes(), &videos); err != nil {
+		t.Fatalf("invalid listing %q: %s", recorder.Body, err)
+	}
+	if len(videos) != 2 {
+		t.Errorf("listed %d videos, want 2", len(videos))
+	}
+}
+
+func TestHandleVideosReportsQueryErrors(t *testing.T) {
+	openTestDatabase(t)
+	db.DB.Close()
+
+	recorder := httptest.NewRecorder()
+	handleVideos(recorder, httptest.NewRequest(http.MethodGet, "/videos", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status %d with the database closed, want %d; body %q", recorder.Code, http.StatusInternalServerError, recorder.Body)
+	}
+}
@@ -1,15 +1,24 @@
 package transcoder
 
 import (
-	"bytes"
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/palzino/vidanalyser/internal/config"
 	"github.com/palzino/vidanalyser/internal/datatypes"
 	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/units"
 	"github.com/palzino/vidanalyser/internal/utils"
+	"github.com/palzino/vidanalyser/pkg/client"
 )
 
 type Server struct {
@@ -21,76 +30,179 @@ type Servers struct {
 	servers []Server
 }
 
-func sendToTranscodingServer(server Server, video datatypes.VideoObject, resolution string, bitrate int, autoDelete bool) error {
-	// Construct the server's transcoding URL
-	url := fmt.Sprintf("http://%s/transcode", server.addr)
+// dispatcher hands jobs to workers and follows them until they finish. Its
+// state is kept in the dispatches table, so a restarted coordinator can pick
+// up jobs still running on the workers.
+type dispatcher struct {
+	free     chan Server       // One entry per free worker slot
+	servers  map[string]Server // By name
+	finished chan struct{}     // Signalled whenever a dispatch finishes
 
-	// Client's callback URL
-	callbackURL := "http://<client_ip>:<client_port>/callback"
+	mu        sync.Mutex
+	remoteIDs map[int]int // Worker job IDs the dispatches table failed to record, by dispatch
+}
 
-	// Payload with video and callback URL
-	payload := map[string]interface{}{
-		"file_path":    video.FullFilePath,
-		"resolution":   resolution,
-		"bitrate":      bitrate,
-		"auto_delete":  autoDelete,
-		"callback_url": callbackURL,
+func newDispatcher(servers []Server) *dispatcher {
+	d := &dispatcher{servers: make(map[string]Server), finished: make(chan struct{}, 1)}
+	slots := 0
+	for _, server := range servers {
+		slots += server.concurrent
+	}
+	d.free = make(chan Server, slots)
+	for _, server := range servers {
+		d.servers[server.name] = server
+		for i := 0; i < server.concurrent; i++ {
+			d.free <- server
+		}
 	}
+	return d
+}
 
-	jsonPayload, err := json.Marshal(payload)
+// submit records a dispatch of video to server and submits it there. A named
+// profile is sent by name, for the worker to run with the settings it fetches
+// from this coordinator.
+func (d *dispatcher) submit(server Server, video datatypes.VideoObject, profile string, resolution string, bitrate int, autoDelete bool, batchID int) error {
+	dispatchID, err := db.InsertDispatch(batchID, server.name, server.addr, video.FullFilePath)
 	if err != nil {
-		return fmt.Errorf("error creating payload: %w", err)
+		return err
 	}
+	// Tag the callback with the server and dispatch so the slot is released
+	// and the right job is recorded
+	callbackURL := fmt.Sprintf("%s?server=%s&dispatch=%d", config.GetCallbackURL(), url.QueryEscape(server.name), dispatchID)
 
-	// Send request to server
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonPayload))
+	job, err := client.New(server.addr).SubmitJob(datatypes.TranscodeRequest{
+		Video:       video,
+		Resolution:  resolution,
+		Bitrate:     bitrate,
+		Profile:     profile,
+		AutoDelete:  autoDelete,
+		CallbackURL: callbackURL,
+		User:        config.GetCurrentUser(),
+		Tags:        currentRun.jobTags(),
+	})
 	if err != nil {
-		return fmt.Errorf("error sending request to server: %w", err)
+		err = fmt.Errorf("error submitting job to server %s: %w", server.name, err)
+		db.FinishDispatch(dispatchID, "failed", err.Error())
+		return err
 	}
-	defer resp.Body.Close()
-
-	// Handle server response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server %s responded with status: %d", server.name, resp.StatusCode)
+	if err := db.SetDispatchRemoteID(dispatchID, job.ID); err != nil {
+		// Polls still need the ID to follow the job
+		log.Println(err)
+		d.mu.Lock()
+		if d.remoteIDs == nil {
+			d.remoteIDs = map[int]int{}
+		}
+		d.remoteIDs[dispatchID] = job.ID
+		d.mu.Unlock()
 	}
 
+	fmt.Printf("Server %s accepted job %d for %s\n", server.name, job.ID, video.FullFilePath)
 	return nil
 }
 
-func startCallbackServer(serverSemaphores map[string]chan struct{}, numVids *int) {
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		var payload struct {
-			ServerName string                    `json:"server_name"`
-			NewObject  datatypes.TranscodedVideo `json:"new_object"`
+// finish records the outcome of a dispatched job and frees its worker slot.
+// Outcomes already recorded, e.g. by a poll after the callback, are ignored.
+func (d *dispatcher) finish(dispatch datatypes.Dispatch, failure error, result *datatypes.TranscodedVideo) {
+	status, message := "completed", ""
+	if failure != nil {
+		status, message = "failed", failure.Error()
+	}
+	won, err := db.FinishDispatch(dispatch.ID, status, message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !won {
+		return
+	}
+
+	currentRun.record(failure)
+	if failure != nil {
+		fmt.Printf("Server %s failed to transcode %s: %s\n", dispatch.Server, dispatch.FilePath, failure)
+		if err := db.InsertFailure(dispatch.FilePath, failure, dispatch.BatchID); err != nil {
+			log.Println(err)
 		}
+	} else if result != nil {
+		result.BatchID = dispatch.BatchID
+		db.InsertTranscode(*result)
+		refreshSpaceSavedMetric()
+	} else {
+		fmt.Printf("Server %s finished %s without reporting the result\n", dispatch.Server, dispatch.FilePath)
+	}
 
-		// Parse callback payload
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid payload", http.StatusBadRequest)
-			return
+	if server, known := d.servers[dispatch.Server]; known {
+		select {
+		case d.free <- server:
+			fmt.Printf("Server %s is now available.\n", dispatch.Server)
+		default:
 		}
+	}
+	select {
+	case d.finished <- struct{}{}:
+	default:
+	}
+}
 
-		db.InsertTranscode(payload.NewObject)
+// handleCallback records a result posted by a worker
+func (d *dispatcher) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ServerName string                    `json:"server_name"`
+		Status     string                    `json:"status"`
+		Error      string                    `json:"error"`
+		Video      datatypes.VideoObject     `json:"video"`
+		NewObject  datatypes.TranscodedVideo `json:"new_object"`
+	}
 
-		*numVids--
-		fmt.Printf("Files remaining: %d\n", *numVids)
+	// Parse callback payload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	if payload.ServerName == "" {
+		payload.ServerName = r.URL.Query().Get("server")
+	}
+	// Progress callbacks, sent when a job asks for them, finish nothing
+	if payload.Status == "progress" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-		// Find the corresponding server semaphore and release it
-		if sem, exists := serverSemaphores[payload.ServerName]; exists {
-			select {
-			case sem <- struct{}{}:
-				// Semaphore slot freed
-				fmt.Printf("Server %s is now available.\n", payload.ServerName)
-			default:
-				fmt.Printf("Server %s was already available.\n", payload.ServerName)
-			}
+	// Callbacks from before dispatches were tagged are matched by file
+	var dispatch *datatypes.Dispatch
+	var err error
+	if id, convErr := strconv.Atoi(r.URL.Query().Get("dispatch")); convErr == nil {
+		dispatch, err = db.QueryDispatch(id)
+	} else {
+		path := payload.Video.FullFilePath
+		if path == "" {
+			path = payload.NewObject.OriginalVideoPath
 		}
+		dispatch, err = db.FindOutstandingDispatch(payload.ServerName, path)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dispatch == nil {
+		http.Error(w, "Unknown dispatch", http.StatusNotFound)
+		return
+	}
 
-		// Acknowledge the callback
-		w.WriteHeader(http.StatusOK)
-	})
+	if payload.Status == "failed" {
+		d.finish(*dispatch, errors.New(payload.Error), nil)
+	} else {
+		d.finish(*dispatch, nil, &payload.NewObject)
+	}
+
+	// Acknowledge the callback
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Start the callback server
+// startCallbackServer receives the results workers post back and serves
+// the profiles they run named jobs with
+func (d *dispatcher) startCallbackServer() {
+	http.HandleFunc("/callback", d.handleCallback)
+	http.HandleFunc("GET /profiles", handleProfiles)
 	go func() {
 		fmt.Println("Starting callback server on :8080")
 		if err := http.ListenAndServe(":8080", nil); err != nil {
@@ -99,14 +211,107 @@ func startCallbackServer(serverSemaphores map[string]chan struct{}, numVids *int
 	}()
 }
 
+// poll asks the workers about the unfinished jobs of a batch (every batch
+// when batchID is 0) and records those whose callback never arrived. It
+// returns how many are still running; unreachable workers are asked again
+// on the next poll. Jobs are only polled once every submission has
+// returned, so a dispatch without a worker job ID can never be followed and
+// is failed.
+func (d *dispatcher) poll(batchID int) (int, error) {
+	outstanding, err := db.QueryOutstandingDispatches(batchID)
+	if err != nil {
+		return 0, err
+	}
+	workerJobs := map[string]map[int]datatypes.Job{}
+	remaining := 0
+	for _, dispatch := range outstanding {
+		if dispatch.RemoteJobID == 0 {
+			d.mu.Lock()
+			dispatch.RemoteJobID = d.remoteIDs[dispatch.ID]
+			d.mu.Unlock()
+		}
+		if dispatch.RemoteJobID == 0 {
+			d.finish(dispatch, fmt.Errorf("no job ID was recorded for the submission to server %s", dispatch.Server), nil)
+			continue
+		}
+		byID, polled := workerJobs[dispatch.Addr]
+		if !polled {
+			list, err := client.New(dispatch.Addr).ListJobs()
+			if err != nil {
+				log.Printf("Error polling server %s: %s\n", dispatch.Server, err)
+			} else {
+				byID = make(map[int]datatypes.Job, len(list))
+				for _, job := range list {
+					byID[job.ID] = job
+				}
+			}
+			workerJobs[dispatch.Addr] = byID
+		}
+		if byID == nil {
+			remaining++
+			continue
+		}
+		job, known := byID[dispatch.RemoteJobID]
+		switch {
+		case !known:
+			d.finish(dispatch, fmt.Errorf("server %s no longer has job %d", dispatch.Server, dispatch.RemoteJobID), nil)
+		case job.Status == datatypes.JobCompleted:
+			d.finish(dispatch, nil, job.Result)
+		case job.Status == datatypes.JobFailed || job.Status == datatypes.JobCancelled:
+			d.finish(dispatch, fmt.Errorf("%s", cmp.Or(job.Error, string(job.Status))), nil)
+		default:
+			remaining++
+		}
+	}
+	return remaining, nil
+}
+
+// wait blocks until every dispatched job of a batch (every batch when
+// batchID is 0) has finished, polling the workers every
+// DISPATCH_POLL_INTERVAL in case a callback is missed
+func (d *dispatcher) wait(batchID int) {
+	ticker := time.NewTicker(config.GetDispatchPollInterval())
+	defer ticker.Stop()
+	for {
+		outstanding, err := db.QueryOutstandingDispatches(batchID)
+		if err != nil {
+			log.Println(err)
+		} else if len(outstanding) == 0 {
+			return
+		} else {
+			fmt.Printf("Files remaining: %d\n", len(outstanding))
+		}
+		select {
+		case <-d.finished:
+		case <-ticker.C:
+			if _, err := d.poll(batchID); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// configuredServers returns the workers in TRANSCODE_WORKERS
+func configuredServers() ([]Server, error) {
+	workers, err := config.GetWorkers()
+	if err != nil {
+		return nil, err
+	}
+	var servers []Server
+	for _, worker := range workers {
+		servers = append(servers, Server{name: worker.Name, addr: worker.Addr, concurrent: worker.Concurrent})
+	}
+	return servers, nil
+}
+
 func StartAPITranscoding() {
-	Servers := Servers{
-		servers: []Server{
-			{name: "Server1", addr: "server1_address", concurrent: 2},
-			{name: "Server2", addr: "server2_address", concurrent: 3},
-			{name: "Server3", addr: "server3_address", concurrent: 3},
-		},
+	// Workers are read when the run starts; a reload applies to the next run
+	servers, err := configuredServers()
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	Servers := Servers{servers: servers}
 
 	// Build the directory tree from the database
 	directoryTree, err := db.BuildDirectoryTree()
@@ -119,24 +324,37 @@ func StartAPITranscoding() {
 	// Ask user for input preferences
 	var resolution string
 	var minSize float64
+	var profileName string
 	var outputResolution string
 	var outputBitrate int
 	var autoDelete bool
 
-	fmt.Print("Enter desired input resolution (e.g., 720p,1080p,4k): ")
+	fmt.Print("Enter desired input resolution (480p, 720p, 1080p, 1440p, 4k or 8k): ")
 	fmt.Scanln(&resolution)
 	fmt.Print("Enter desired minimum filesize for transcoding (GB): ")
 	fmt.Scanln(&minSize)
-	fmt.Print("Enter desired output resolution (e.g., 1280x720): ")
-	fmt.Scanln(&outputResolution)
-	fmt.Print("Enter desired output bitrate in kbps (e.g., 3500): ")
-	fmt.Scanln(&outputBitrate)
+	fmt.Print("Enter a profile name (leave empty to enter resolution and bitrate): ")
+	fmt.Scanln(&profileName)
+	label := profileName
+	if profileName != "" {
+		profile, err := profiles.Get(profileName)
+		if err != nil || profile == nil {
+			fmt.Printf("Profile %s not found\n", profileName)
+			return
+		}
+	} else {
+		fmt.Print("Enter desired output resolution (e.g., 1280x720): ")
+		fmt.Scanln(&outputResolution)
+		fmt.Print("Enter desired output bitrate in kbps (e.g., 3500): ")
+		fmt.Scanln(&outputBitrate)
+		label = profileLabel(outputResolution, outputBitrate)
+	}
 	fmt.Println("Auto delete original files after transcoding? (true/false): ")
 	fmt.Scanln(&autoDelete)
 
 	// Create a filter function for eligible files
 	fileFilter := func(video datatypes.VideoObject) bool {
-		return float64(video.Size)/(1024*1024*1024) >= minSize && shouldTranscode(video.Width, video.Height, resolution)
+		return units.GB(int64(video.Size)) >= minSize && shouldTranscode(video.Width, video.Height, resolution)
 	}
 
 	// Navigate the directory tree and select files for transcoding
@@ -144,50 +362,74 @@ func StartAPITranscoding() {
 	if selectedNode == nil {
 		return
 	}
-	selectedFiles := selectedNode.FilterFiles(fileFilter, recursive)
+	selectedFiles, err := applyExclusions(dropLinks(selectedNode.FilterFiles(fileFilter, recursive)), profileName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(selectedFiles) == 0 {
+		fmt.Println("No files found matching criteria")
+		return
+	}
 
-	// Prepare server-specific semaphores
-	serverSemaphores := make(map[string]chan struct{})
-	for _, server := range Servers.servers {
-		serverSemaphores[server.name] = make(chan struct{}, server.concurrent)
+	// Hand every file to the next free worker slot
+	d := newDispatcher(Servers.servers)
+	batchID := beginBatch("", label, len(selectedFiles))
+	d.startCallbackServer()
+	utils.NotifySummary(fmt.Sprintf("Starting transcoding of %d videos", len(selectedFiles)))
 
-		// Initially, fill semaphore slots to max capacity
-		for i := 0; i < server.concurrent; i++ {
-			serverSemaphores[server.name] <- struct{}{}
+	for _, video := range selectedFiles {
+		server := <-d.free
+		if err := d.submit(server, video, profileName, outputResolution, outputBitrate, autoDelete, batchID); err != nil {
+			fmt.Printf("Error transcoding video on server %s: %v\n", server.name, err)
+			recordResult(video, err)
+			d.free <- server
 		}
 	}
 
-	// Start the callback server
-	numVids := len(selectedFiles)
-	startCallbackServer(serverSemaphores, &numVids)
-
-	var wg sync.WaitGroup
-	utils.SendTelegramMessage(fmt.Sprintf("Starting transcoding of %d videos", numVids))
+	d.wait(batchID)
+	finishBatch(batchID)
+	fmt.Println("All selected videos have been transcoded.")
+}
 
-	serverIndex := 0
-	for _, video := range selectedFiles {
-		// Find an available server using round-robin
-		server := Servers.servers[serverIndex]
-		serverIndex = (serverIndex + 1) % len(Servers.servers)
+// ResumeAPITranscoding follows the jobs a previous coordinator dispatched
+// that had not finished when it stopped: it listens for their callbacks again
+// and polls the workers for results it missed, until all have finished.
+func ResumeAPITranscoding() error {
+	outstanding, err := db.QueryOutstandingDispatches(0)
+	if err != nil {
+		return err
+	}
+	if len(outstanding) == 0 {
+		fmt.Println("No dispatched jobs are outstanding.")
+		return nil
+	}
+	fmt.Printf("Resuming %d dispatched jobs\n", len(outstanding))
 
-		select {
-		case <-serverSemaphores[server.name]: // Wait for server to become available
-			wg.Add(1)
-			go func(server Server, video datatypes.VideoObject) {
-				defer wg.Done()
-
-				err := sendToTranscodingServer(server, video, outputResolution, outputBitrate, autoDelete)
-				if err != nil {
-					fmt.Printf("Error transcoding video on server %s: %v\n", server.name, err)
-					serverSemaphores[server.name] <- struct{}{} // Retry semaphore release on error
-				}
-			}(server, video)
-		default:
-			// All servers at capacity; wait for callback
-			continue
+	servers, err := configuredServers()
+	if err != nil {
+		return err
+	}
+	d := newDispatcher(servers)
+	for _, dispatch := range outstanding {
+		if dispatch.RemoteJobID == 0 {
+			// The previous coordinator stopped before the worker answered
+			d.finish(dispatch, fmt.Errorf("submission to server %s was interrupted", dispatch.Server), nil)
 		}
 	}
+	d.startCallbackServer()
+	if _, err := d.poll(0); err != nil {
+		return err
+	}
+	d.wait(0)
 
-	wg.Wait()
-	fmt.Println("All selected videos have been transcoded.")
+	batches := map[int]bool{}
+	for _, dispatch := range outstanding {
+		if dispatch.BatchID != 0 && !batches[dispatch.BatchID] {
+			batches[dispatch.BatchID] = true
+			finishBatch(dispatch.BatchID)
+		}
+	}
+	fmt.Println("All dispatched videos have finished.")
+	return currentRun.err()
 }
@@ -0,0 +1,52 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+func TestPollFailsDispatchWithoutJobID(t *testing.T) {
+	openTestDatabase(t)
+	if _, err := db.InsertDispatch(0, "worker", "localhost:1", "/media/a.mkv"); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining, err := newDispatcher(nil).poll(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Errorf("%d dispatches still running, want the one without a job ID failed", remaining)
+	}
+	if outstanding, _ := db.QueryOutstandingDispatches(0); len(outstanding) != 0 {
+		t.Errorf("%d dispatches left outstanding", len(outstanding))
+	}
+}
+
+func TestPollFollowsUnrecordedJobID(t *testing.T) {
+	openTestDatabase(t)
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]datatypes.Job{{ID: 7, Status: datatypes.JobRunning}})
+	}))
+	defer worker.Close()
+	dispatchID, err := db.InsertDispatch(0, "worker", worker.URL, "/media/a.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As if the worker accepted job 7 but recording its ID failed
+	d := newDispatcher(nil)
+	d.remoteIDs = map[int]int{dispatchID: 7}
+	remaining, err := d.poll(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 1 {
+		t.Errorf("%d dispatches still running, want the running job followed", remaining)
+	}
+}
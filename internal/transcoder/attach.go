@@ -0,0 +1,193 @@
+package transcoder
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/pkg/client"
+)
+
+// Attach shows the live queue and progress of the transcode server at addr
+// in the terminal, redrawn every interval, until q or Ctrl-C is pressed.
+// f toggles the list of finished jobs.
+func Attach(addr string, interval time.Duration) error {
+	c := client.New(addr)
+	status, err := fetchQueue(c, addr)
+	if err != nil {
+		return apperr.Wrap(serverCategory(err), err, "error attaching to server")
+	}
+
+	// Single keypresses need the terminal out of line mode; without a
+	// terminal only Ctrl-C detaches
+	keys := make(chan byte)
+	if restore, err := rawTerminal(int(os.Stdin.Fd())); err == nil {
+		defer restore()
+		go func() {
+			buf := make([]byte, 1)
+			for {
+				if n, err := os.Stdin.Read(buf); err != nil {
+					return
+				} else if n == 1 {
+					keys <- buf[0]
+				}
+			}
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// Draw on the alternate screen so the shell is left as it was
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	showFinished := true
+	for {
+		fmt.Print(attachFrame(status, err, showFinished))
+		select {
+		case <-signals:
+			return nil
+		case key := <-keys:
+			switch key {
+			case 'q', 'Q':
+				return nil
+			case 'f', 'F':
+				showFinished = !showFinished
+			}
+			continue
+		case <-ticker.C:
+		}
+		// Keep the last good view while the server is unreachable
+		if latest, fetchErr := fetchQueue(c, addr); fetchErr == nil {
+			status, err = latest, nil
+		} else {
+			err = fetchErr
+		}
+	}
+}
+
+// fetchQueue reads the jobs and progress of the server at addr
+func fetchQueue(c *client.Client, addr string) (QueueStatus, error) {
+	jobs, err := c.ListJobs()
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	progress, err := c.GetProgress()
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	return QueueStatus{Server: addr, Jobs: jobs, Progress: progress}, nil
+}
+
+// attachFrame renders one screen of the attached view, cut to the terminal
+func attachFrame(status QueueStatus, fetchErr error, showFinished bool) string {
+	cols, rows := terminalSize(int(os.Stdout.Fd()))
+	if cols <= 0 || rows <= 0 {
+		cols, rows = 80, 24
+	}
+
+	counts := map[datatypes.JobStatus]int{}
+	var running, queued, finished []datatypes.Job
+	for _, job := range status.Jobs {
+		counts[job.Status]++
+		switch job.Status {
+		case datatypes.JobRunning:
+			running = append(running, job)
+		case datatypes.JobQueued:
+			queued = append(queued, job)
+		default:
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].ID > finished[j].ID })
+
+	lines := []string{
+		fmt.Sprintf("Queue on %s at %s   q quit, f finished jobs", status.Server, time.Now().Format("15:04:05")),
+		fmt.Sprintf("Running %d | Queued %d | Completed %d | Failed %d | Cancelled %d",
+			counts[datatypes.JobRunning], counts[datatypes.JobQueued], counts[datatypes.JobCompleted],
+			counts[datatypes.JobFailed], counts[datatypes.JobCancelled]),
+	}
+	if fetchErr != nil {
+		lines = append(lines, fmt.Sprintf("Cannot reach %s, retrying: %s", status.Server, fetchErr))
+	}
+
+	lines = append(lines, "", "Running:")
+	progress := map[string]datatypes.JobProgress{}
+	for _, p := range status.Progress {
+		progress[p.File] = p
+	}
+	for _, job := range running {
+		p, known := progress[job.Video.FullFilePath]
+		delete(progress, job.Video.FullFilePath)
+		if !known {
+			lines = append(lines, fmt.Sprintf("  #%d %s starting", job.ID, filepath.Base(job.Video.FullFilePath)))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("  #%d %s", job.ID, progressBarLine(p)))
+	}
+	// Progress the server reports without a job, such as a worker's own run
+	for _, p := range status.Progress {
+		if _, untracked := progress[p.File]; untracked {
+			lines = append(lines, "  "+progressBarLine(p))
+		}
+	}
+	if len(running) == 0 && len(progress) == 0 {
+		lines = append(lines, "  nothing")
+	}
+
+	lines = append(lines, "", "Queued:")
+	for _, job := range queued {
+		lines = append(lines, fmt.Sprintf("  #%d %s", job.ID, job.Video.FullFilePath))
+	}
+	if len(queued) == 0 {
+		lines = append(lines, "  nothing")
+	}
+
+	if showFinished && len(finished) > 0 {
+		lines = append(lines, "", "Finished:")
+		for _, job := range finished {
+			line := fmt.Sprintf("  #%d %-9s %s", job.ID, job.Status, job.Video.FullFilePath)
+			if job.Error != "" {
+				line += " | " + job.Error
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) > rows {
+		lines = lines[:rows]
+	}
+	var frame strings.Builder
+	frame.WriteString("\033[H")
+	for i, line := range lines {
+		if len(line) > cols {
+			line = line[:cols]
+		}
+		frame.WriteString(line + "\033[K")
+		if i < len(lines)-1 {
+			frame.WriteString("\n")
+		}
+	}
+	frame.WriteString("\033[J")
+	return frame.String()
+}
+
+// progressBarLine renders a running file with a bar of its progress
+func progressBarLine(p datatypes.JobProgress) string {
+	const width = 20
+	filled := int(p.Percentage / 100 * width)
+	filled = max(0, min(width, filled))
+	return fmt.Sprintf("%s [%s%s] %6.2f%%  elapsed %s remaining %s", filepath.Base(p.File),
+		strings.Repeat("#", filled), strings.Repeat(".", width-filled), p.Percentage,
+		time.Duration(p.ElapsedSeconds)*time.Second, time.Duration(p.RemainingSeconds)*time.Second)
+}
@@ -0,0 +1,158 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// language returns the track's ISO 639-2 language, or "" when it is untagged
+func (s mediaStream) language() string {
+	language := strings.ToLower(s.Tags["language"])
+	if language == "und" {
+		return ""
+	}
+	return language
+}
+
+// tag returns a tag, including the per-language variants mkvmerge writes,
+// such as NUMBER_OF_BYTES-eng
+func (s mediaStream) tag(name string) string {
+	for key, value := range s.Tags {
+		if key == name || strings.HasPrefix(key, name+"-") {
+			return value
+		}
+	}
+	return ""
+}
+
+// size estimates the bytes the track occupies in a video of length seconds,
+// preferring the exact count mkvmerge records
+func (s mediaStream) size(length int) int64 {
+	if bytes, err := strconv.ParseInt(s.tag("NUMBER_OF_BYTES"), 10, 64); err == nil {
+		return bytes
+	}
+	bitrate, err := strconv.ParseInt(s.BitRate, 10, 64)
+	if err != nil {
+		bitrate, _ = strconv.ParseInt(s.tag("BPS"), 10, 64)
+	}
+	return bitrate * int64(length) / 8
+}
+
+// splitAudio sorts tracks into those in one of languages and the rest.
+// Untagged tracks are always kept, and when no track matches every track is
+// kept rather than leaving the output silent.
+func splitAudio(streams []mediaStream, languages []string) (kept, dropped []mediaStream) {
+	for _, stream := range streams {
+		if stream.language() == "" || keepsLanguage(languages, stream.language()) {
+			kept = append(kept, stream)
+		} else {
+			dropped = append(dropped, stream)
+		}
+	}
+	if len(kept) == 0 {
+		return streams, nil
+	}
+	return kept, dropped
+}
+
+// keepsLanguage reports whether language is one of languages
+func keepsLanguage(languages []string, language string) bool {
+	for _, wanted := range languages {
+		if strings.EqualFold(wanted, language) {
+			return true
+		}
+	}
+	return false
+}
+
+// AudioTrack is one track in an audio pruning report
+type AudioTrack struct {
+	Index    int    `json:"index"`
+	Language string `json:"language"`
+	Codec    string `json:"codec"`
+	Size     int64  `json:"size"` // Estimated bytes
+}
+
+// AudioPruning lists the tracks a profile would drop from one video
+type AudioPruning struct {
+	Path    string       `json:"path"`
+	Dropped []AudioTrack `json:"dropped"`
+	Size    int64        `json:"size"` // Estimated bytes freed
+}
+
+// AudioReport is the dry run of a profile's audio language rules
+type AudioReport struct {
+	Profile   string         `json:"profile"`
+	Languages []string       `json:"languages"`
+	Files     []AudioPruning `json:"files"`
+	Size      int64          `json:"size"` // Estimated bytes freed in total
+}
+
+// BuildAudioReport probes the videos under directory, or the whole library,
+// and works out which audio tracks the profile would drop without changing anything
+func BuildAudioReport(profileName, directory string) (AudioReport, error) {
+	profile, err := profiles.Get(profileName)
+	if err != nil {
+		return AudioReport{}, apperr.Wrap(apperr.Config, err, "error loading profiles")
+	}
+	if profile == nil {
+		return AudioReport{}, apperr.New(apperr.NotFound, "profile %s not found", profileName)
+	}
+	if len(profile.KeepAudioLanguages) == 0 {
+		return AudioReport{}, apperr.New(apperr.Config, "profile %s has no keep_audio_languages", profileName)
+	}
+	videos, err := db.QueryFilteredVideos(db.VideoFilter{Directory: directory, Recursive: true})
+	if err != nil {
+		return AudioReport{}, apperr.Wrap(apperr.Database, err, "error querying videos")
+	}
+
+	report := AudioReport{Profile: profile.Name, Languages: profile.KeepAudioLanguages, Files: []AudioPruning{}}
+	for _, video := range dropLinks(videos) {
+		streams, err := probeStreams(video.FullFilePath)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		_, dropped := splitAudio(streamsOfType(streams, "audio"), profile.KeepAudioLanguages)
+		if len(dropped) == 0 {
+			continue
+		}
+		pruning := AudioPruning{Path: video.FullFilePath}
+		for _, stream := range dropped {
+			track := AudioTrack{Index: stream.Index, Language: stream.language(), Codec: stream.Codec, Size: stream.size(video.Length)}
+			pruning.Dropped = append(pruning.Dropped, track)
+			pruning.Size += track.Size
+		}
+		report.Files = append(report.Files, pruning)
+		report.Size += pruning.Size
+	}
+	return report, nil
+}
+
+// ShowAudioReport prints which audio tracks the profile would drop and how much space they take
+func ShowAudioReport(profileName, directory string) error {
+	report, err := BuildAudioReport(profileName, directory)
+	if err != nil {
+		return err
+	}
+	if output.JSON() {
+		return output.Print(report)
+	}
+	for _, file := range report.Files {
+		fmt.Println(file.Path)
+		for _, track := range file.Dropped {
+			fmt.Printf("  drop track %d: %s %s, %s\n", track.Index, track.Language, track.Codec, units.Bytes(track.Size))
+		}
+	}
+	fmt.Printf("Profile %s keeps %s audio: %d file(s) would lose tracks, freeing about %s\n",
+		report.Profile, strings.Join(report.Languages, "/"), len(report.Files), units.Bytes(report.Size))
+	return nil
+}
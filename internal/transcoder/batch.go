@@ -0,0 +1,75 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// defaultBatchName names a batch after the time it was submitted
+func defaultBatchName() string {
+	return "batch-" + time.Now().Format("20060102-150405")
+}
+
+// profileLabel describes the output settings of a batch
+func profileLabel(resolution string, bitrate int) string {
+	return fmt.Sprintf("%s@%s", resolution, bitrateLabel(bitrate))
+}
+
+// beginBatch records a queue submission and makes it the current run.
+// A failure to record the batch is logged but never blocks transcoding.
+func beginBatch(name, profile string, fileCount int) int {
+	if name == "" {
+		name = defaultBatchName()
+	}
+	batchID, err := db.CreateBatch(name, profile, config.GetCurrentUser(), fileCount)
+	if err != nil {
+		log.Printf("Error recording batch %s: %s\n", name, err)
+	}
+	currentRun.reset(batchID, name, fileCount)
+	log.Printf("Started batch %s (%s) with %d files\n", name, profile, fileCount)
+	return batchID
+}
+
+// finishBatch closes the batch and sends its summary
+func finishBatch(batchID int) {
+	if batchID == 0 {
+		return
+	}
+	if err := db.FinishBatch(batchID); err != nil {
+		log.Printf("Error finishing batch: %s\n", err)
+		return
+	}
+	batch, err := db.QueryBatch(batchID)
+	if err != nil || batch == nil {
+		log.Printf("Error loading batch summary: %v\n", err)
+		return
+	}
+	summary := fmt.Sprintf("Batch %s finished: %d/%d files transcoded, %s saved in %s",
+		batch.Name, batch.Completed, batch.FileCount, units.Bytes(batch.SpaceSaved),
+		(time.Duration(batch.Duration) * time.Second).String())
+	if energy := energyMessage(*batch); energy != "" {
+		summary += "\n" + energy
+	}
+	summary += "\n" + lifetimeSavingsMessage()
+	log.Println(summary)
+	utils.NotifySummary(summary)
+}
+
+// recordResult counts a finished job towards the current run and keeps a
+// record of failures so they can be reported later
+func recordResult(video datatypes.VideoObject, err error) {
+	currentRun.record(err)
+	if err == nil {
+		return
+	}
+	if dbErr := db.InsertFailure(video.FullFilePath, err, currentRun.batch()); dbErr != nil {
+		log.Println(dbErr)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package transcoder
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, supported by btrfs, XFS and other CoW filesystems
+const ficlone = 0x40049409
+
+// cloneFile creates dst as a reflink of src, sharing its blocks until either is modified
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+		out.Close()
+		os.Remove(dst)
+		return errno
+	}
+	return out.Close()
+}
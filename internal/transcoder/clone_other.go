@@ -0,0 +1,10 @@
+//go:build !linux
+
+package transcoder
+
+import "errors"
+
+// cloneFile is only implemented on Linux
+func cloneFile(src, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,175 @@
+package transcoder
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/pkg/client"
+)
+
+// WorkerStatus is what one worker reports about itself. Throughput and
+// failures cover the jobs finished in the last 24 hours that the worker
+// still lists.
+type WorkerStatus struct {
+	Name       string                  `json:"name"`
+	Addr       string                  `json:"addr"`
+	Concurrent int                     `json:"concurrent"`
+	Error      string                  `json:"error,omitempty"` // Set when the worker could not be reached
+	Version    string                  `json:"version,omitempty"`
+	Platform   string                  `json:"platform,omitempty"`
+	Hardware   string                  `json:"hardware,omitempty"`
+	Queued     int                     `json:"queued"`
+	Running    []datatypes.JobProgress `json:"running"`
+	Completed  int                     `json:"completed_24h"`
+	Failed     int                     `json:"failed_24h"`
+	SpaceSaved int64                   `json:"space_saved_24h"`
+	AvgFPS     float64                 `json:"avg_encode_fps_24h,omitempty"`
+	FPS        float64                 `json:"fps"` // Sum over the running jobs
+}
+
+// ClusterStatus rolls up every worker in TRANSCODE_WORKERS
+type ClusterStatus struct {
+	Workers     []WorkerStatus `json:"workers"`
+	Reachable   int            `json:"reachable"`
+	Running     int            `json:"running"`
+	Queued      int            `json:"queued"`
+	Completed   int            `json:"completed_24h"`
+	Failed      int            `json:"failed_24h"`
+	SpaceSaved  int64          `json:"space_saved_24h"`
+	FPS         float64        `json:"fps"`
+	GeneratedAt time.Time      `json:"generated_at"`
+}
+
+// fetchWorkerStatus asks one worker for its build, jobs and progress
+func fetchWorkerStatus(worker config.Worker, since time.Time) WorkerStatus {
+	status := WorkerStatus{Name: worker.Name, Addr: worker.Addr, Concurrent: worker.Concurrent, Running: []datatypes.JobProgress{}}
+	c := client.New(worker.Addr)
+	c.HTTPClient.Timeout = 5 * time.Second
+
+	info, err := c.Version()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Version, status.Platform, status.Hardware = info.Version, info.Platform, info.Hardware
+
+	jobs, err := c.ListJobs()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	var fpsTotal float64
+	var fpsCount int
+	for _, job := range jobs {
+		switch job.Status {
+		case datatypes.JobQueued:
+			status.Queued++
+		case datatypes.JobCompleted, datatypes.JobFailed:
+			if job.FinishedAt == nil || job.FinishedAt.Before(since) {
+				continue
+			}
+			if job.Status == datatypes.JobFailed {
+				status.Failed++
+				continue
+			}
+			status.Completed++
+			if job.Result != nil {
+				status.SpaceSaved += int64(job.Result.OldSize - job.Result.NewSize)
+				if job.Result.EncodeFPS > 0 {
+					fpsTotal += job.Result.EncodeFPS
+					fpsCount++
+				}
+			}
+		}
+	}
+	if fpsCount > 0 {
+		status.AvgFPS = fpsTotal / float64(fpsCount)
+	}
+
+	progress, err := c.GetProgress()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Running = progress
+	for _, p := range progress {
+		status.FPS += p.FPS
+	}
+	return status
+}
+
+// BuildClusterStatus queries every configured worker at once
+func BuildClusterStatus() (ClusterStatus, error) {
+	workers, err := config.GetWorkers()
+	if err != nil {
+		return ClusterStatus{}, err
+	}
+	now := time.Now()
+	cluster := ClusterStatus{Workers: make([]WorkerStatus, len(workers)), GeneratedAt: now}
+
+	var wg sync.WaitGroup
+	for i, worker := range workers {
+		wg.Add(1)
+		go func(i int, worker config.Worker) {
+			defer wg.Done()
+			cluster.Workers[i] = fetchWorkerStatus(worker, now.Add(-24*time.Hour))
+		}(i, worker)
+	}
+	wg.Wait()
+
+	for _, worker := range cluster.Workers {
+		if worker.Error != "" {
+			continue
+		}
+		cluster.Reachable++
+		cluster.Running += len(worker.Running)
+		cluster.Queued += worker.Queued
+		cluster.Completed += worker.Completed
+		cluster.Failed += worker.Failed
+		cluster.SpaceSaved += worker.SpaceSaved
+		cluster.FPS += worker.FPS
+	}
+	return cluster, nil
+}
+
+// ShowClusterStatus prints every worker's hardware, jobs and recent
+// throughput, and the cluster totals
+func ShowClusterStatus() error {
+	cluster, err := BuildClusterStatus()
+	if err != nil {
+		return err
+	}
+	if output.JSON() {
+		return output.Print(cluster)
+	}
+
+	for _, worker := range cluster.Workers {
+		if worker.Error != "" {
+			fmt.Printf("%s (%s): unreachable, %s\n", worker.Name, worker.Addr, worker.Error)
+			continue
+		}
+		fmt.Printf("%s (%s) %s %s %s\n", worker.Name, worker.Addr, worker.Version, worker.Platform, worker.Hardware)
+		line := fmt.Sprintf("  %d/%d running, %d queued | 24h: %d completed, %d failed, %s saved",
+			len(worker.Running), worker.Concurrent, worker.Queued, worker.Completed, worker.Failed, units.Bytes(worker.SpaceSaved))
+		if worker.AvgFPS > 0 {
+			line += fmt.Sprintf(", %.1f fps avg", worker.AvgFPS)
+		}
+		fmt.Println(line)
+		for _, p := range worker.Running {
+			fmt.Printf("  %s | %.2f%% | %.1f fps | Remaining: %ds\n", p.File, p.Percentage, p.FPS, p.RemainingSeconds)
+		}
+	}
+
+	var summary []string
+	summary = append(summary, fmt.Sprintf("%d/%d workers up", cluster.Reachable, len(cluster.Workers)))
+	summary = append(summary, fmt.Sprintf("%d running", cluster.Running), fmt.Sprintf("%d queued", cluster.Queued))
+	summary = append(summary, fmt.Sprintf("24h: %d completed, %d failed, %s saved", cluster.Completed, cluster.Failed, units.Bytes(cluster.SpaceSaved)))
+	fmt.Printf("Cluster: %s | %.1f fps\n", strings.Join(summary, ", "), cluster.FPS)
+	return nil
+}
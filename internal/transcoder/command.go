@@ -0,0 +1,117 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/profiles"
+)
+
+// buildFFmpegCommand returns the full command line that transcodes input to
+// output using the detected hardware encoder, wrapped with the profile's
+// process isolation, together with the name of the encoder used.
+func buildFFmpegCommand(input, output, resolution string, bitrate int, profile string) ([]string, string) {
+	named := profiles.Profile{}
+	if profile != "" {
+		if p, err := profiles.Get(profile); err == nil && p != nil {
+			named = *p
+		}
+	}
+	hdr, err := probeHDR(input)
+	if err != nil {
+		log.Printf("Treating %s as SDR: %s\n", input, err)
+	}
+
+	// Determine the encoding method based on hardware support
+	hardware := DetectHardware()
+	encoder := encoderFor(hardware, named.Codec)
+	scaleFilter := fmt.Sprintf("scale=%s", resolution) // QSV and CPU use standard scaling
+	if hardware == "nvidia" {
+		scaleFilter = fmt.Sprintf("scale_npp=%s", resolution)
+	}
+	// HDR sources are tone-mapped by software or Vulkan filters, which cannot
+	// read frames left in CUDA memory
+	tonemap := tonemapFilter(input, resolution, hdr, named, encoder)
+	if tonemap != "" {
+		scaleFilter = tonemap
+	}
+
+	// Prepare FFmpeg command with selected encoder. Only the mapped video
+	// streams are scaled and encoded, so cover art mapped after them can be copied.
+	maps, videos := streamMapArgs(input, profile)
+	ffmpegCmd := append([]string{"ffmpeg", "-y", "-i", ffmpegPath(input)}, maps...)
+	for i := 0; i < videos; i++ {
+		ffmpegCmd = append(ffmpegCmd, fmt.Sprintf("-filter:v:%d", i), scaleFilter, fmt.Sprintf("-c:v:%d", i), encoder)
+		ffmpegCmd = append(ffmpegCmd, rateArgs(encoder, i, bitrate, named.CRF)...)
+	}
+	ffmpegCmd = append(ffmpegCmd, dynamicHDRArgs(input, hdr, named, encoder)...)
+	ffmpegCmd = append(ffmpegCmd, "-c:a", "copy", "-nostats", "-progress", "pipe:2", ffmpegPath(output))
+
+	// Add hardware acceleration flags if supported
+	prefix := []string{"ffmpeg", "-y"}
+	if hardware == "nvidia" && tonemap == "" {
+		prefix = append(prefix, "-hwaccel", "cuda", "-hwaccel_output_format", "cuda")
+	} else if hardware == "nvidia" {
+		prefix = append(prefix, "-hwaccel", "cuda")
+	} else if hardware == "intel" {
+		prefix = append(prefix, "-hwaccel", "qsv")
+	}
+	if strings.HasPrefix(tonemap, "libplacebo") {
+		prefix = append(prefix, "-init_hw_device", "vulkan")
+	}
+	ffmpegCmd = append(prefix, ffmpegCmd[2:]...)
+	return isolationFor(profile).wrap(ffmpegCmd), encoder
+}
+
+// rateArgs returns the rate control of output video stream i: the bitrate,
+// or with crf set a constant quality capped at the bitrate, in the option
+// the encoder takes it as
+func rateArgs(encoder string, i, bitrate, crf int) []string {
+	rate := fmt.Sprintf("%dk", bitrate)
+	if crf == 0 {
+		return []string{fmt.Sprintf("-b:v:%d", i), rate}
+	}
+	quality := strconv.Itoa(crf)
+	capped := []string{fmt.Sprintf("-maxrate:v:%d", i), rate, fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", 2*bitrate)}
+	switch {
+	case strings.HasSuffix(encoder, "_nvenc"):
+		return append([]string{fmt.Sprintf("-rc:v:%d", i), "vbr", fmt.Sprintf("-cq:v:%d", i), quality, fmt.Sprintf("-b:v:%d", i), "0"}, capped...)
+	case strings.HasSuffix(encoder, "_qsv"):
+		return append([]string{fmt.Sprintf("-global_quality:v:%d", i), quality}, capped...)
+	default:
+		return append([]string{fmt.Sprintf("-crf:v:%d", i), quality}, capped...)
+	}
+}
+
+// encoders names the encoder of each output codec by hardware, "" being
+// software encoding
+var encoders = map[string]map[string]string{
+	"h264": {"nvidia": "h264_nvenc", "intel": "h264_qsv", "": "libx264"},
+	"hevc": {"nvidia": "hevc_nvenc", "intel": "hevc_qsv", "": "libx265"},
+	"av1":  {"nvidia": "av1_nvenc", "intel": "av1_qsv", "": "libsvtav1"},
+}
+
+// encoderFor returns the encoder of codec, h264 when empty, on the detected hardware
+func encoderFor(hardware, codec string) string {
+	if codec == "" {
+		codec = "h264"
+	}
+	if encoder, ok := encoders[codec][hardware]; ok {
+		return encoder
+	}
+	return encoders[codec][""]
+}
+
+// ffmpegPath marks a path as a plain file, so ffmpeg does not read a name
+// containing ":" as a protocol. Arguments are passed without a shell, so
+// quotes, brackets and emoji need no escaping. HTTP(S) URLs are read by
+// ffmpeg directly.
+func ffmpegPath(path string) string {
+	if pathutil.IsURL(path) {
+		return path
+	}
+	return "file:" + path
+}
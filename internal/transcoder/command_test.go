@@ -0,0 +1,88 @@
+package transcoder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+func TestEncoderFor(t *testing.T) {
+	tests := []struct {
+		hardware, codec, want string
+	}{
+		{"cpu", "", "libx264"},
+		{"nvidia", "", "h264_nvenc"},
+		{"intel", "h264", "h264_qsv"},
+		{"cpu", "hevc", "libx265"},
+		{"nvidia", "hevc", "hevc_nvenc"},
+		{"cpu", "av1", "libsvtav1"},
+		{"intel", "av1", "av1_qsv"},
+	}
+	for _, tt := range tests {
+		if got := encoderFor(tt.hardware, tt.codec); got != tt.want {
+			t.Errorf("encoderFor(%q, %q) = %q, want %q", tt.hardware, tt.codec, got, tt.want)
+		}
+	}
+}
+
+func TestDynamicHDRPassthrough(t *testing.T) {
+	dv := hdrInfo{DolbyVision: true, DVCompatible: true}
+	for encoder, want := range map[string]string{"libx265": "passthrough", "libsvtav1": "passthrough", "libx264": "strip", "hevc_nvenc": "strip"} {
+		if got, _ := dynamicHDRAction(dv, "passthrough", encoder); got != want {
+			t.Errorf("passthrough with %s = %q, want %q", encoder, got, want)
+		}
+	}
+}
+
+func TestRateArgs(t *testing.T) {
+	tests := []struct {
+		encoder string
+		crf     int
+		want    []string
+	}{
+		{"libx264", 0, []string{"-b:v:0", "3000k"}},
+		{"libx265", 24, []string{"-crf:v:0", "24", "-maxrate:v:0", "3000k", "-bufsize:v:0", "6000k"}},
+		{"h264_nvenc", 24, []string{"-rc:v:0", "vbr", "-cq:v:0", "24", "-b:v:0", "0", "-maxrate:v:0", "3000k", "-bufsize:v:0", "6000k"}},
+		{"h264_qsv", 24, []string{"-global_quality:v:0", "24", "-maxrate:v:0", "3000k", "-bufsize:v:0", "6000k"}},
+	}
+	for _, tt := range tests {
+		if got := rateArgs(tt.encoder, 0, 3000, tt.crf); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rateArgs(%s, crf %d) = %v, want %v", tt.encoder, tt.crf, got, tt.want)
+		}
+	}
+}
+
+func TestBuildFFmpegCommand(t *testing.T) {
+	t.Setenv("HARDWARE_ACCEL", "cpu")
+	fake := &runner.Fake{Respond: func(name string, args []string) ([]byte, error) {
+		if strings.Contains(strings.Join(args, " "), "color_transfer") {
+			return []byte(`{"streams": [{"color_transfer": "bt709"}], "frames": []}`), nil
+		}
+		return []byte(`{"streams": [{"index": 0, "codec_type": "video", "codec_name": "h264"}, {"index": 1, "codec_type": "audio"}]}`), nil
+	}}
+	defer runner.Use(fake)()
+
+	command, encoder := buildFFmpegCommand("/media/in:put.mkv", "/media/out.mkv", "1280x720", 3000, "")
+	if encoder != "libx264" {
+		t.Errorf("encoder = %s, want libx264", encoder)
+	}
+	line := strings.Join(command, " ")
+	for _, want := range []string{"-i file:/media/in:put.mkv", "-filter:v:0 scale=1280x720 -c:v:0 libx264 -b:v:0 3000k", "-c:a copy"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("command %q lacks %q", line, want)
+		}
+	}
+	if last := command[len(command)-1]; last != "file:/media/out.mkv" {
+		t.Errorf("command ends with %q, want the output", last)
+	}
+	for _, call := range fake.Calls() {
+		if call[0] != "ffprobe" || call[len(call)-1] != "file:/media/in:put.mkv" {
+			t.Errorf("unexpected command %v while building the encode", call)
+		}
+	}
+	if len(fake.Calls()) == 0 {
+		t.Error("the source was never probed")
+	}
+}
@@ -0,0 +1,241 @@
+package transcoder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// encodePathFor returns where ffmpeg writes the output of video. An output on
+// another device than the source is encoded to a hidden file in the output
+// directory first and renamed into place by deliverOutput once it is
+// finished, so the original is never removed before its replacement is
+// complete on the destination, and read-only sources need no space or write
+// access. Outputs for an ssh host are encoded in the staging directory.
+func encodePathFor(video datatypes.VideoObject, outputPath string) string {
+	if sshpath.Is(outputPath) {
+		if staged, err := stagingPath(".zinocoder-", outputPath); err == nil {
+			return staged
+		}
+	}
+	source, sourceKnown := pathutil.DeviceID(video.Location)
+	dest, destKnown := pathutil.DeviceID(filepath.Dir(outputPath))
+	if !sourceKnown || !destKnown || source == dest {
+		return outputPath
+	}
+	return filepath.Join(filepath.Dir(outputPath), ".zinocoder-"+filepath.Base(outputPath))
+}
+
+// checksumPath returns the file recording the checksum of a finished staged encode
+func checksumPath(staged string) string {
+	return staged + ".sha256"
+}
+
+// stagedOutputReady reports whether an earlier run finished encoding to
+// staged but was interrupted before delivering it, so only the copy remains
+func stagedOutputReady(staged string) bool {
+	_, size, err := readChecksum(staged)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(staged)
+	return err == nil && info.Size() == size
+}
+
+// recordChecksum marks a staged encode as finished by storing its checksum and
+// size, which a copy to another device or host is verified against
+func recordChecksum(staged string) error {
+	sum, size, err := fileChecksum(staged, -1)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(checksumPath(staged), []byte(fmt.Sprintf("%s %d\n", sum, size)), 0644)
+}
+
+// readChecksum returns the checksum and size recorded for a staged encode
+func readChecksum(staged string) (string, int64, error) {
+	data, err := os.ReadFile(checksumPath(staged))
+	if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("invalid checksum file %s", checksumPath(staged))
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid checksum file %s", checksumPath(staged))
+	}
+	return fields[0], size, nil
+}
+
+// fileChecksum returns the SHA-256 of the first limit bytes of path, or of
+// the whole file when limit is negative, and how many bytes were read
+func fileChecksum(path string, limit int64) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if limit >= 0 {
+		reader = io.LimitReader(file, limit)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// VerifyCopy checks that copied has the same SHA-256 and size as original
+func VerifyCopy(original, copied string) error {
+	want, wantSize, err := fileChecksum(original, -1)
+	if err != nil {
+		return err
+	}
+	got, gotSize, err := fileChecksum(copied, -1)
+	if err != nil {
+		return err
+	}
+	if got != want || gotSize != wantSize {
+		return fmt.Errorf("copy %s does not match %s", copied, original)
+	}
+	return nil
+}
+
+// finishStagedEncode records the checksum of a freshly staged encode, unless
+// it was resumed, and delivers it to outputPath; outputs written in place
+// need nothing more
+func finishStagedEncode(staged, outputPath string, resumed bool) error {
+	if staged == outputPath {
+		return nil
+	}
+	if !resumed {
+		if err := recordChecksum(staged); err != nil {
+			return fmt.Errorf("error checksumming %s: %w", staged, err)
+		}
+	}
+	return deliverOutput(staged, outputPath)
+}
+
+// deliverOutput moves a staged encode to outputPath. On the same device it is
+// renamed, which cannot leave a partial file. A staged file on another device
+// is copied through a .partial file instead, which is checked against the
+// checksum recorded when the encode finished before it is moved into place
+// and the staged file removed. A .partial left by an interrupted copy is
+// resumed when it matches the start of the staged file.
+func deliverOutput(staged, outputPath string) error {
+	if staged == outputPath {
+		return nil
+	}
+	if sshpath.Is(outputPath) {
+		return pushOutput(staged, outputPath)
+	}
+	stagedDevice, stagedKnown := pathutil.DeviceID(filepath.Dir(staged))
+	destDevice, destKnown := pathutil.DeviceID(filepath.Dir(outputPath))
+	if stagedKnown && destKnown && stagedDevice == destDevice {
+		return moveStaged(staged, outputPath)
+	}
+	return copyStaged(staged, outputPath)
+}
+
+// copyStaged copies a staged encode to outputPath on another device through
+// a .partial file, verified against the checksum recorded for it, and
+// removes the staged file once the copy is in place
+func copyStaged(staged, outputPath string) error {
+	sum, size, err := readChecksum(staged)
+	if err != nil {
+		return fmt.Errorf("error reading checksum of %s: %w", staged, err)
+	}
+
+	partial := outputPath + ".partial"
+	offset := int64(0)
+	if info, err := os.Stat(partial); err == nil && info.Size() > 0 && info.Size() <= size {
+		copied, _, err := fileChecksum(partial, -1)
+		if err != nil {
+			return err
+		}
+		prefix, _, err := fileChecksum(staged, info.Size())
+		if err != nil {
+			return err
+		}
+		if copied == prefix {
+			offset = info.Size()
+			log.Printf("Resuming copy of %s at %s\n", outputPath, units.Bytes(offset))
+		}
+	}
+
+	if err := copyFrom(staged, partial, offset); err != nil {
+		return err
+	}
+	copied, copiedSize, err := fileChecksum(partial, -1)
+	if err != nil {
+		return err
+	}
+	if copied != sum || copiedSize != size {
+		os.Remove(partial)
+		return fmt.Errorf("copy of %s to %s failed verification", staged, outputPath)
+	}
+	if err := os.Rename(partial, outputPath); err != nil {
+		return fmt.Errorf("error moving %s into place: %w", outputPath, err)
+	}
+	os.Remove(staged)
+	os.Remove(checksumPath(staged))
+	log.Printf("Copied and verified %s\n", outputPath)
+	return nil
+}
+
+// moveStaged renames a staged encode on the output's device into place
+func moveStaged(staged, outputPath string) error {
+	if err := os.Rename(staged, outputPath); err != nil {
+		return fmt.Errorf("error moving %s into place: %w", outputPath, err)
+	}
+	os.Remove(checksumPath(staged))
+	log.Printf("Moved %s into place\n", outputPath)
+	return nil
+}
+
+// copyFrom copies src to dst starting at offset, replacing the rest of dst,
+// and syncs it to disk
+func copyFrom(src, dst string, offset int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", dst, err)
+	}
+	defer out.Close()
+
+	if err := out.Truncate(offset); err != nil {
+		return fmt.Errorf("error preparing %s: %w", dst, err)
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("error copying to %s: %w", dst, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("error syncing %s: %w", dst, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,63 @@
+package transcoder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stageEncode writes a finished staged encode with its checksum
+func stageEncode(t *testing.T, dir, content string) string {
+	t.Helper()
+	staged := filepath.Join(dir, ".zinocoder-Film_ZinoCoded.mkv")
+	if err := os.WriteFile(staged, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordChecksum(staged); err != nil {
+		t.Fatal(err)
+	}
+	return staged
+}
+
+func TestCopyStagedDeliversVerifiedCopy(t *testing.T) {
+	staged := stageEncode(t, t.TempDir(), "encoded video")
+	output := filepath.Join(t.TempDir(), "Film_ZinoCoded.mkv")
+	// An interrupted copy is resumed where it stopped
+	if err := os.WriteFile(output+".partial", []byte("encoded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyStaged(staged, output); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(output); err != nil || string(data) != "encoded video" {
+		t.Errorf("output holds %q (%v), want the staged encode", data, err)
+	}
+	for _, leftover := range []string{staged, checksumPath(staged), output + ".partial"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", leftover)
+		}
+	}
+}
+
+func TestCopyStagedKeepsStagedFileOnMismatch(t *testing.T) {
+	staged := stageEncode(t, t.TempDir(), "encoded video")
+	// The staged file changed after it was checksummed
+	if err := os.WriteFile(staged, []byte("corrupted video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), "Film_ZinoCoded.mkv")
+
+	if err := copyStaged(staged, output); err == nil {
+		t.Fatal("copyStaged accepted a copy that does not match the recorded checksum")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("unverified output %s was moved into place", output)
+	}
+	if _, err := os.Stat(output + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("unverified copy %s.partial was left behind", output)
+	}
+	if _, err := os.Stat(staged); err != nil {
+		t.Errorf("staged encode was removed after a failed copy: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+package transcoder
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/fswatch"
+	"github.com/palzino/vidanalyser/internal/safety"
+)
+
+// WatchDeletions keeps the database and the job queue in step with files
+// deleted or renamed outside the program, such as a Radarr upgrade replacing
+// a movie, while watch mode runs. It blocks, and returns straight away when
+// watch mode (SCHEDULE_WATCH) or DELETION_SYNC is off.
+func WatchDeletions() {
+	if config.GetMaintenanceSchedule("watch") == "" || config.GetDeletionSync() == "off" {
+		return
+	}
+	roots := config.GetLibraryPaths()
+	if len(roots) == 0 {
+		return
+	}
+	if err := fswatch.Watch(roots, fswatch.Handlers{Removed: syncRemoval, Moved: syncMove, Lost: syncLost}); err != nil {
+		log.Printf("Deletion sync stopped: %s\n", err)
+	}
+}
+
+// syncRemoval cancels the queued jobs of every recorded video that was at
+// path and removes or soft-deletes its record, as DELETION_SYNC says.
+// Paths that exist again, e.g. a file replaced in one step, are left alone.
+func syncRemoval(path string) {
+	if _, err := os.Lstat(path); err == nil {
+		return
+	}
+	if err := safety.Check("remove record of deleted " + path); err != nil {
+		log.Println(err)
+		return
+	}
+	videos, err := db.QueryVideosUnder(path)
+	if err != nil {
+		log.Printf("Error looking up deleted %s: %s\n", path, err)
+		return
+	}
+	for _, video := range videos {
+		for _, id := range cancelQueuedJobs(video.FullFilePath, "input was deleted") {
+			log.Printf("Cancelled job %d: %s was deleted\n", id, video.FullFilePath)
+		}
+		remove := db.DeleteVideo
+		if config.GetDeletionSync() == "soft" {
+			remove = db.SoftDeleteVideo
+		}
+		if err := remove(video.FullFilePath); err != nil {
+			log.Printf("Error removing deleted %s: %s\n", video.FullFilePath, err)
+			continue
+		}
+		log.Printf("Removed record of deleted %s\n", video.FullFilePath)
+	}
+}
+
+// syncLost syncs the removal of every video recorded under root that is gone,
+// after the watch dropped events and may have missed their deletion
+func syncLost(root string) {
+	log.Printf("Missed changes under %s, checking its records\n", root)
+	videos, err := db.QueryVideosUnder(root)
+	if err != nil {
+		log.Printf("Error looking up videos under %s: %s\n", root, err)
+		return
+	}
+	for _, video := range videos {
+		if _, err := os.Lstat(video.FullFilePath); os.IsNotExist(err) {
+			syncRemoval(video.FullFilePath)
+		}
+	}
+}
+
+// syncMove points the records and queued jobs of the videos at or below from
+// at their new path, keeping their history
+func syncMove(from, to string) {
+	videos, err := db.QueryVideosUnder(from)
+	if err != nil {
+		log.Printf("Error looking up moved %s: %s\n", from, err)
+		return
+	}
+	for _, video := range videos {
+		newPath := to + strings.TrimPrefix(video.FullFilePath, from)
+		if err := db.MoveVideo(video.FullFilePath, newPath); err != nil {
+			log.Printf("Error recording move of %s: %s\n", video.FullFilePath, err)
+			continue
+		}
+		retargetQueuedJobs(video.FullFilePath, newPath)
+		log.Printf("Recorded move of %s to %s\n", video.FullFilePath, newPath)
+	}
+}
@@ -0,0 +1,134 @@
+package transcoder
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+)
+
+// deviceSlots counts the running jobs per limited device, so a slow disk
+// such as a USB archive drive is read by few jobs while others run in parallel
+var deviceSlots = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	running map[string]int
+}{running: make(map[string]int)}
+
+func init() {
+	deviceSlots.cond = sync.NewCond(&deviceSlots.Mutex)
+}
+
+// deviceLimitFor returns the DEVICE_CONCURRENCY entry covering path: one on the
+// same device, or failing that one the path lies under. The longest entry
+// path wins. ok is false when the device is not limited.
+func deviceLimitFor(path string) (limit config.DeviceLimit, ok bool) {
+	limits := config.GetDeviceLimits()
+	if len(limits) == 0 {
+		return limit, false
+	}
+	path = filepath.Clean(path)
+	source, sourceKnown := pathutil.DeviceID(path)
+	for _, candidate := range limits {
+		matches := strings.HasPrefix(path, candidate.Path+string(filepath.Separator)) || path == candidate.Path
+		if !matches && sourceKnown {
+			if device, known := pathutil.DeviceID(candidate.Path); known && device == source {
+				matches = true
+			}
+		}
+		if matches && (!ok || len(candidate.Path) > len(limit.Path)) {
+			limit, ok = candidate, true
+		}
+	}
+	return limit, ok
+}
+
+// tryDeviceSlotLocked takes a slot on the device of limit if one is free
+func tryDeviceSlotLocked(limit config.DeviceLimit) bool {
+	if deviceSlots.running[limit.Path] >= limit.Concurrent {
+		return false
+	}
+	deviceSlots.running[limit.Path]++
+	return true
+}
+
+// releaseDeviceSlot returns a slot taken for a job reading from limit's device
+func releaseDeviceSlot(limit config.DeviceLimit) func() {
+	return func() {
+		deviceSlots.Lock()
+		deviceSlots.running[limit.Path]--
+		deviceSlots.Unlock()
+		deviceSlots.cond.Broadcast()
+	}
+}
+
+// waitForDevice blocks until the device holding path has a free slot. The
+// returned function must be called when the job finishes.
+func waitForDevice(path string) func() {
+	limit, limited := deviceLimitFor(path)
+	if !limited {
+		return func() {}
+	}
+	deviceSlots.Lock()
+	defer deviceSlots.Unlock()
+	if !tryDeviceSlotLocked(limit) {
+		log.Printf("Waiting for a free slot on %s for %s\n", limit.Path, path)
+		for !tryDeviceSlotLocked(limit) {
+			deviceSlots.cond.Wait()
+		}
+	}
+	return releaseDeviceSlot(limit)
+}
+
+// queuedSource is a video waiting to start with the device limit it falls
+// under, and whether it is too long for the slot kept for short jobs
+type queuedSource struct {
+	video   datatypes.VideoObject
+	limit   config.DeviceLimit
+	limited bool
+	long    bool
+}
+
+// queueSources looks up the device limit of every video once, in order
+func queueSources(videos []datatypes.VideoObject) []queuedSource {
+	queue := make([]queuedSource, len(videos))
+	for i, video := range videos {
+		queue[i].video = video
+		queue[i].limit, queue[i].limited = deviceLimitFor(video.FullFilePath)
+	}
+	return queue
+}
+
+// nextStartable removes and returns the first queued video whose device has
+// a free slot, and that fits the slot kept for short jobs when only that one
+// is left, waiting when no queued video can start, along with the function
+// releasing its slots
+func nextStartable(queue *[]queuedSource) (datatypes.VideoObject, func()) {
+	deviceSlots.Lock()
+	defer deviceSlots.Unlock()
+	for {
+		for i, source := range *queue {
+			if source.long && !longSlotFreeLocked() {
+				continue
+			}
+			if source.limited && !tryDeviceSlotLocked(source.limit) {
+				continue
+			}
+			*queue = append((*queue)[:i:i], (*queue)[i+1:]...)
+			release := func() {}
+			if source.limited {
+				release = releaseDeviceSlot(source.limit)
+			}
+			if source.long {
+				longJobs.running++
+				release = releaseLongSlot(release)
+			}
+			return source.video, release
+		}
+		deviceSlots.cond.Wait()
+	}
+}
@@ -0,0 +1,195 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// runStats tracks the overall state of the current transcode run so a single
+// periodic digest can be sent instead of one notification per file.
+type runStats struct {
+	mu        sync.Mutex
+	batchID   int
+	batchName string
+	total     int
+	completed int
+	failed    int
+	started   time.Time
+	tags      []string // Recorded on every transcode of the run
+}
+
+var currentRun = &runStats{}
+
+func (r *runStats) reset(batchID int, batchName string, total int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batchID = batchID
+	r.batchName = batchName
+	r.total = total
+	r.completed = 0
+	r.failed = 0
+	r.started = time.Now()
+}
+
+// batch returns the ID of the batch the current run belongs to, 0 if none
+func (r *runStats) batch() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batchID
+}
+
+// setTags sets the tags recorded on the transcodes of the run
+func (r *runStats) setTags(tags []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tags = tags
+}
+
+// jobTags returns the tags recorded on the transcodes of the run
+func (r *runStats) jobTags() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tags
+}
+
+// record counts a finished job, successful or not
+func (r *runStats) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failed++
+		return
+	}
+	r.completed++
+}
+
+// err summarises the failures of the run: an ffmpeg error when nothing
+// succeeded, a partial failure when only some jobs failed
+func (r *runStats) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed == 0 {
+		return nil
+	}
+	if r.completed == 0 {
+		return apperr.New(apperr.FFmpeg, "all %d transcodes failed", r.failed)
+	}
+	return apperr.New(apperr.PartialFailure, "%d of %d transcodes failed", r.failed, r.total)
+}
+
+// eta estimates the remaining time of the run, counting the partial progress
+// of in-flight jobs so the estimate moves between completions.
+func (r *runStats) eta() (time.Duration, bool) {
+	r.mu.Lock()
+	finished := float64(r.completed + r.failed)
+	total := float64(r.total)
+	elapsed := time.Since(r.started)
+	r.mu.Unlock()
+
+	progressMutex.Lock()
+	for _, progress := range progressMap {
+		finished += progress.Percentage / 100
+	}
+	progressMutex.Unlock()
+
+	if finished <= 0 || finished > total {
+		return 0, false
+	}
+	return time.Duration(float64(elapsed) * (total - finished) / finished), true
+}
+
+// digestMessage builds a summary such as "23/112 done, 41.20 GB saved, ETA 14h0m"
+func (r *runStats) digestMessage() string {
+	r.mu.Lock()
+	message := fmt.Sprintf("%d/%d done", r.completed, r.total)
+	if r.batchName != "" {
+		message = fmt.Sprintf("[%s] %s", r.batchName, message)
+	}
+	if r.failed > 0 {
+		message += fmt.Sprintf(", %d failed", r.failed)
+	}
+	r.mu.Unlock()
+
+	spaceSavedMutex.Lock()
+	message += fmt.Sprintf(", %s saved", units.Bytes(totalSpaceSaved))
+	spaceSavedMutex.Unlock()
+
+	if eta, ok := r.eta(); ok {
+		message += fmt.Sprintf(", ETA %s", formatETA(eta))
+	}
+	return message
+}
+
+func formatETA(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	if d < time.Minute {
+		return "<1m"
+	}
+	return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// inQuietHours reports whether now falls inside the configured quiet window.
+// Windows may wrap past midnight (e.g. 23-7).
+func inQuietHours(now time.Time) bool {
+	start, end, ok := config.GetQuietHours()
+	if !ok || start == end {
+		return false
+	}
+	hour := now.Hour()
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+// digestEnabled reports whether per-file notifications are replaced by digests
+func digestEnabled() bool {
+	return config.GetDigestInterval() > 0
+}
+
+// notifyFileEvent sends a per-file notification unless digests are enabled
+func notifyFileEvent(message string) {
+	if digestEnabled() {
+		return
+	}
+	utils.NotifyVerbose(message)
+}
+
+// startDigest sends a progress digest every configured interval until the
+// returned stop function is called. It does nothing when digests are disabled.
+func startDigest() func() {
+	interval := config.GetDigestInterval()
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if inQuietHours(now) {
+					log.Println("Skipping progress digest during quiet hours")
+					continue
+				}
+				utils.NotifySummary("Transcode progress: " + currentRun.digestMessage())
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,78 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// hardwareEncoderSuffixes mark ffmpeg encoders that run on a GPU or media engine
+var hardwareEncoderSuffixes = []string{"_nvenc", "_qsv", "_vaapi", "_amf", "_videotoolbox"}
+
+// isHardwareEncoder reports whether an encode drew ENCODE_WATTS_GPU rather than ENCODE_WATTS_CPU
+func isHardwareEncoder(encoder string) bool {
+	for _, suffix := range hardwareEncoderSuffixes {
+		if strings.HasSuffix(encoder, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// addEnergy estimates the kWh used by a batch's encodes from their encode time
+// and the configured wattage, and what it cost. It reports false, leaving the
+// batch unchanged, when no wattage is set.
+func addEnergy(batch *datatypes.Batch) bool {
+	settings, ok := config.GetEnergySettings()
+	if !ok {
+		return false
+	}
+	seconds, err := db.QueryBatchEncodeSeconds(batch.ID)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	var wattSeconds float64
+	for encoder, total := range seconds {
+		watts := settings.CPUWatts
+		if isHardwareEncoder(encoder) {
+			watts = settings.GPUWatts
+		}
+		wattSeconds += watts * float64(total)
+	}
+	batch.EnergyKWh = wattSeconds / 3600 / 1000
+	batch.Cost = batch.EnergyKWh * settings.Price
+	return true
+}
+
+// energyMessage describes the energy and cost of a batch, e.g.
+// "Energy: 1.84 kWh, about 0.55 EUR (545.45 GB saved per EUR)", or "" when
+// ENCODE_WATTS_* are not set or nothing was encoded
+func energyMessage(batch datatypes.Batch) string {
+	if !addEnergy(&batch) || batch.EnergyKWh == 0 {
+		return ""
+	}
+	message := fmt.Sprintf("Energy: %.2f kWh", batch.EnergyKWh)
+	if batch.Cost <= 0 {
+		return message
+	}
+	settings, _ := config.GetEnergySettings()
+	price := fmt.Sprintf("%.2f", batch.Cost)
+	if settings.Currency != "" {
+		price += " " + settings.Currency
+	}
+	message += ", about " + price
+	if batch.SpaceSaved > 0 {
+		unit := settings.Currency
+		if unit == "" {
+			unit = "unit of cost"
+		}
+		message += fmt.Sprintf(" (%s saved per %s)", units.Bytes(int64(float64(batch.SpaceSaved)/batch.Cost)), unit)
+	}
+	return message
+}
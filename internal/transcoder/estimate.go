@@ -0,0 +1,141 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// assumedAudioKbps approximates the copied audio tracks when there is no history
+const assumedAudioKbps = 160
+
+// minRatioSamples is how many past transcodes are needed before their output
+// sizes are trusted over the nominal bitrate
+const minRatioSamples = 3
+
+// assumedPixelRate is the encode speed assumed without history, in source
+// pixels per second: 1080p at 30 fps
+const assumedPixelRate = 1920 * 1080 * 30
+
+// Estimate is the expected outcome of transcoding one video
+type Estimate struct {
+	Video        datatypes.VideoObject
+	ExpectedSize int64   // Bytes
+	SavingsPct   float64 // Percentage of the original size
+	Low          bool    // Expected savings are below MIN_EXPECTED_SAVINGS
+}
+
+// estimateOutputs predicts each output size from bitrate x duration, corrected
+// by how large past outputs of the profile (or of any profile) turned out
+func estimateOutputs(videos []datatypes.VideoObject, resolution string, bitrate int, profile string) []Estimate {
+	ratio := historicalRatio(profile)
+	minSavings := config.GetMinExpectedSavings()
+
+	estimates := make([]Estimate, 0, len(videos))
+	for _, video := range videos {
+		nominal := float64(video.Length) * float64(targetBitrate(video, resolution, bitrate)) * 1000 / 8
+		expected := nominal + float64(video.Length)*assumedAudioKbps*1000/8
+		if ratio > 0 {
+			expected = nominal * ratio
+		}
+		estimate := Estimate{Video: video, ExpectedSize: int64(expected)}
+		if video.Size > 0 {
+			estimate.SavingsPct = 100 * (1 - expected/float64(video.Size))
+		}
+		estimate.Low = estimate.SavingsPct < minSavings
+		estimates = append(estimates, estimate)
+	}
+	return estimates
+}
+
+// historicalRatio returns the actual/nominal output size ratio of past
+// transcodes, or 0 when there are too few to rely on
+func historicalRatio(profile string) float64 {
+	ratio, count, err := db.QueryOutputSizeRatio(profile)
+	if err == nil && count < minRatioSamples && profile != "" {
+		ratio, count, err = db.QueryOutputSizeRatio("")
+	}
+	if err != nil {
+		log.Printf("Error querying past output sizes: %s\n", err)
+		return 0
+	}
+	if count < minRatioSamples {
+		return 0
+	}
+	return ratio
+}
+
+// encodePixelRate returns the source pixels per second past transcodes
+// encoded at, or assumedPixelRate when there are too few to rely on
+func encodePixelRate() float64 {
+	rate, count, err := db.QueryEncodePixelRate()
+	if err != nil {
+		log.Println(err)
+		return assumedPixelRate
+	}
+	if count < minRatioSamples || rate <= 0 {
+		return assumedPixelRate
+	}
+	return rate
+}
+
+// estimateDuration predicts how long encoding video takes at pixelRate
+func estimateDuration(video datatypes.VideoObject, pixelRate float64) time.Duration {
+	frames := float64(video.Frames)
+	if frames <= 0 {
+		frames = float64(video.Length) * video.Framerate
+	}
+	if frames <= 0 {
+		frames = float64(video.Length) * 30
+	}
+	seconds := frames * float64(video.Width) * float64(video.Height) / pixelRate
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// planSelection puts the queued files in the batch's order, lists the
+// expected output size of each, warns about those expected to save too
+// little and, when skip is set, drops them
+func planSelection(selection TranscodeConfig, skip bool) TranscodeConfig {
+	estimates := estimateOutputs(selection.SelectedFiles, selection.OutputResolution, selection.OutputBitrate, selection.Profile)
+	orderEstimates(estimates, selection.Order)
+	minSavings := config.GetMinExpectedSavings()
+
+	var kept []datatypes.VideoObject
+	var original, expected int64
+	low := 0
+	for _, estimate := range estimates {
+		marker := ""
+		if estimate.Low {
+			low++
+			marker = "  <- low savings"
+			if skip {
+				marker = "  <- skipped, low savings"
+			}
+		}
+		fmt.Printf("%s: %s -> ~%s (%.0f%% saved)%s\n", estimate.Video.FullFilePath,
+			units.Bytes(int64(estimate.Video.Size)), units.Bytes(estimate.ExpectedSize), estimate.SavingsPct, marker)
+		if estimate.Low && skip {
+			continue
+		}
+		kept = append(kept, estimate.Video)
+		original += int64(estimate.Video.Size)
+		expected += estimate.ExpectedSize
+	}
+
+	if low > 0 {
+		if skip {
+			fmt.Printf("Skipping %d file(s) expected to save less than %.0f%%\n", low, minSavings)
+		} else {
+			fmt.Printf("Warning: %d file(s) are expected to save less than %.0f%%, use --skip-low-savings or SKIP_LOW_SAVINGS=true to skip them\n", low, minSavings)
+		}
+	}
+	fmt.Printf("Expected total: %s -> ~%s for %d file(s)\n", units.Bytes(original), units.Bytes(expected), len(kept))
+
+	selection.SelectedFiles = kept
+	return selection
+}
@@ -0,0 +1,184 @@
+package transcoder
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+// jobCheckpoint tracks the last progress event recorded, and the last
+// progress callback sent, for a running job
+type jobCheckpoint struct {
+	jobID int
+	last  int // Last recorded step, in percent
+
+	request  datatypes.TranscodeRequest
+	sentPct  float64 // Percentage in the last progress callback
+	sentAt   time.Time
+	callback *callbackQueue // Set when the job asked for progress callbacks
+}
+
+// callbackQueue posts one job's callbacks in order from a single goroutine,
+// so a slow receiver holds up neither ffmpeg's output nor other jobs, and a
+// progress callback never arrives after the job's final callback
+type callbackQueue struct {
+	url      string
+	payloads chan map[string]interface{}
+	done     chan struct{}
+}
+
+// newCallbackQueue starts the sender for callbacks to url
+func newCallbackQueue(url string) *callbackQueue {
+	q := &callbackQueue{url: url, payloads: make(chan map[string]interface{}, 16), done: make(chan struct{})}
+	go func() {
+		defer close(q.done)
+		for payload := range q.payloads {
+			sendCallback(q.url, payload)
+		}
+	}()
+	return q
+}
+
+// offer queues a progress callback, dropping it while the receiver is behind
+func (q *callbackQueue) offer(payload map[string]interface{}) {
+	select {
+	case q.payloads <- payload:
+	default:
+	}
+}
+
+// close sends the callbacks still queued and waits for them
+func (q *callbackQueue) close() {
+	close(q.payloads)
+	<-q.done
+}
+
+// checkpoints maps progress keys of running server jobs to their checkpoints
+var (
+	checkpoints      = make(map[string]*jobCheckpoint)
+	checkpointsMutex sync.Mutex
+)
+
+// recordJobEvent stores a job event, logging rather than failing the job when
+// the database is unavailable
+func recordJobEvent(jobID int, event string, percentage float64, message string) {
+	if db.DB == nil {
+		return
+	}
+	if err := db.InsertJobEvent(jobID, event, percentage, message); err != nil {
+		log.Println(err)
+	}
+}
+
+// seedJobIDs continues job numbering after the last job with recorded events
+func seedJobIDs() {
+	if db.DB == nil {
+		return
+	}
+	last, err := db.QueryLastJobID()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	jobsMutex.Lock()
+	if last > lastJobID {
+		lastJobID = last
+	}
+	jobsMutex.Unlock()
+}
+
+// watchJobProgress records progress events for job, transcoding key, and
+// sends the progress callbacks it asked for, until the returned function is
+// called, which also waits for the job's queued callbacks to be sent
+func watchJobProgress(key string, job datatypes.Job) func() {
+	checkpoint := &jobCheckpoint{
+		jobID:   job.ID,
+		request: job.TranscodeRequest,
+		sentAt:  time.Now(),
+	}
+	if job.CallbackURL != "" && (job.ProgressEvery > 0 || job.ProgressSeconds > 0) {
+		checkpoint.callback = newCallbackQueue(job.CallbackURL)
+	}
+	checkpointsMutex.Lock()
+	checkpoints[key] = checkpoint
+	checkpointsMutex.Unlock()
+	return func() {
+		checkpointsMutex.Lock()
+		delete(checkpoints, key)
+		checkpointsMutex.Unlock()
+		if checkpoint.callback != nil {
+			checkpoint.callback.close()
+		}
+	}
+}
+
+// postCallback sends a job's final callback after the progress callbacks
+// queued for the job transcoding key, or straight away when it has none
+func postCallback(key, callbackURL string, payload map[string]interface{}) {
+	checkpointsMutex.Lock()
+	checkpoint, exists := checkpoints[key]
+	checkpointsMutex.Unlock()
+	if exists && checkpoint.callback != nil && checkpoint.callback.url == callbackURL {
+		checkpoint.callback.payloads <- payload
+		return
+	}
+	sendCallback(callbackURL, payload)
+}
+
+// checkpointProgress records a progress event each time a watched job passes
+// another JOB_EVENT_STEP percent, and posts progress to its callback URL when due
+func checkpointProgress(key string, progress Progress) {
+	step := config.GetJobEventStep()
+	reached := int(progress.Percentage) / step * step
+
+	checkpointsMutex.Lock()
+	checkpoint, exists := checkpoints[key]
+	if !exists {
+		checkpointsMutex.Unlock()
+		return
+	}
+	jobID := checkpoint.jobID
+	record := reached > 0 && reached < 100 && reached > checkpoint.last
+	if record {
+		checkpoint.last = reached
+	}
+	queue := checkpoint.callback
+	notify := queue != nil && progressCallbackDue(checkpoint, progress.Percentage)
+	if notify {
+		checkpoint.sentPct, checkpoint.sentAt = progress.Percentage, time.Now()
+	}
+	request := checkpoint.request
+	checkpointsMutex.Unlock()
+
+	if record {
+		recordJobEvent(jobID, "progress", float64(reached), "")
+	}
+	if notify {
+		queue.offer(map[string]interface{}{
+			"status":            "progress",
+			"job_id":            jobID,
+			"video":             request.Video,
+			"percentage":        progress.Percentage,
+			"elapsed_seconds":   int(progress.Elapsed.Seconds()),
+			"remaining_seconds": int(progress.Remaining.Seconds()),
+			"fps":               progress.FPS,
+		})
+	}
+}
+
+// progressCallbackDue reports whether a job has moved on far enough, or long
+// enough ago, since its last progress callback. Completion has its own callback.
+func progressCallbackDue(checkpoint *jobCheckpoint, percentage float64) bool {
+	if percentage >= 100 {
+		return false
+	}
+	if every := checkpoint.request.ProgressEvery; every > 0 && percentage-checkpoint.sentPct >= float64(every) {
+		return true
+	}
+	seconds := checkpoint.request.ProgressSeconds
+	return seconds > 0 && time.Since(checkpoint.sentAt) >= time.Duration(seconds)*time.Second
+}
@@ -0,0 +1,82 @@
+package transcoder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// applyExclusions drops the videos the named profile excludes by extension,
+// codec, bits per pixel or dynamic HDR metadata, listing each one. Without a
+// profile the SKIP_BELOW_BPP and DYNAMIC_HDR settings still apply.
+func applyExclusions(videos []datatypes.VideoObject, profileName string) ([]datatypes.VideoObject, error) {
+	profile := profiles.Profile{}
+	if profileName != "" {
+		named, err := profiles.Get(profileName)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.Config, err, "error loading profiles")
+		}
+		if named == nil {
+			return nil, apperr.New(apperr.NotFound, "profile %s not found", profileName)
+		}
+		profile = *named
+	}
+
+	kept := make([]datatypes.VideoObject, 0, len(videos))
+	for _, video := range videos {
+		if reason := excludedBy(profile, video); reason != "" {
+			if profile.Name == "" {
+				fmt.Printf("Skipping %s: %s\n", video.FullFilePath, reason)
+			} else {
+				fmt.Printf("Skipping %s: profile %s excludes %s\n", video.FullFilePath, profile.Name, reason)
+			}
+			continue
+		}
+		kept = append(kept, video)
+	}
+	return kept, nil
+}
+
+// excludedBy returns what the profile excludes about the video, or "" when it
+// may be transcoded. The codec is only probed when the profile excludes codecs,
+// and dynamic HDR metadata only when the HDR policy can skip the video.
+func excludedBy(profile profiles.Profile, video datatypes.VideoObject) string {
+	if ext := filepath.Ext(video.FullFilePath); profile.ExcludesExtension(ext) {
+		return ext + " files"
+	}
+	if threshold := profile.BPPThreshold(); threshold > 0 {
+		if bpp := video.BitsPerPixel(); bpp > 0 && bpp < threshold {
+			return fmt.Sprintf("already efficient video (%.3f bpp, below %g)", bpp, threshold)
+		}
+	}
+	if len(profile.ExcludeCodecs) > 0 {
+		if codec := recordedCodec(video); codec != "" && profile.ExcludesCodec(codec) {
+			return codec + " video"
+		}
+	}
+	return dynamicHDRSkip(profile, video.FullFilePath)
+}
+
+// recordedCodec returns the video codec recorded when the video was scanned,
+// probing files scanned before codecs were recorded
+func recordedCodec(video datatypes.VideoObject) string {
+	if video.VideoCodec != "" {
+		return video.VideoCodec
+	}
+	return VideoCodec(video.FullFilePath)
+}
+
+// VideoCodec returns the codec of the first video stream, or "" if it cannot be probed
+func VideoCodec(path string) string {
+	out, err := runner.Output("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name", "-of", "csv=p=0", path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
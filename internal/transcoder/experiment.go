@@ -0,0 +1,202 @@
+package transcoder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// vmafTolerance is how many VMAF points the smaller profile may lose and still be recommended
+const vmafTolerance = 1.0
+
+var vmafScorePattern = regexp.MustCompile(`VMAF score[:=]\s*([0-9.]+)`)
+
+// ExperimentResult totals one profile's encodes of the sampled files
+type ExperimentResult struct {
+	Profile      string  `json:"profile"`
+	Encoded      int     `json:"encoded"`
+	Failed       int     `json:"failed"`
+	OriginalSize int64   `json:"original_size"`
+	OutputSize   int64   `json:"output_size"`
+	SavingsPct   float64 `json:"savings_pct"`
+	AvgVMAF      float64 `json:"avg_vmaf,omitempty"` // 0 when ffmpeg has no libvmaf
+	TotalSeconds float64 `json:"total_seconds"`
+
+	vmafTotal   float64
+	vmafSamples int
+}
+
+// ExperimentReport compares two profiles on the same sample of the library
+type ExperimentReport struct {
+	Samples        int                 `json:"samples"`
+	Results        [2]ExperimentResult `json:"results"`
+	Recommendation string              `json:"recommendation"`
+	Reason         string              `json:"reason"`
+}
+
+// RunExperiment encodes a random sample of up to n videos under directory with
+// both profiles into a scratch directory, measures size, time and VMAF, and
+// recommends one. Originals and the database are left untouched.
+func RunExperiment(profileA, profileB, directory string, n int) (ExperimentReport, error) {
+	var report ExperimentReport
+	var selected [2]profiles.Profile
+	for i, name := range []string{profileA, profileB} {
+		profile, err := profiles.Get(name)
+		if err != nil {
+			return report, apperr.Wrap(apperr.Config, err, "error loading profiles")
+		}
+		if profile == nil {
+			return report, apperr.New(apperr.NotFound, "profile %s not found", name)
+		}
+		selected[i] = *profile
+		report.Results[i].Profile = name
+	}
+
+	videos, err := db.QuerySampleVideos(directory, n)
+	if err != nil {
+		return report, apperr.Wrap(apperr.Database, err, "error sampling library")
+	}
+	if len(videos) == 0 {
+		return report, apperr.New(apperr.NotFound, "no videos found to sample")
+	}
+	report.Samples = len(videos)
+
+	workDir, err := os.MkdirTemp("", "zinocoder-experiment-")
+	if err != nil {
+		return report, apperr.Wrap(apperr.Internal, err, "error creating scratch directory")
+	}
+	defer os.RemoveAll(workDir)
+
+	for i, video := range videos {
+		fmt.Printf("[%d/%d] %s\n", i+1, len(videos), video.FullFilePath)
+		for p, profile := range selected {
+			result := &report.Results[p]
+			outputPath := filepath.Join(workDir, fmt.Sprintf("%s-%d%s", profile.Name, i, filepath.Ext(video.FullFilePath)))
+			ffmpegCmd, _ := buildFFmpegCommand(video.FullFilePath, outputPath, profile.Resolution, targetBitrate(video, profile.Resolution, profile.Bitrate), profile.Name)
+
+			start := time.Now()
+			if _, err := runner.RunToExit(ffmpegCmd[0], ffmpegCmd[1:]...); err != nil {
+				fmt.Printf("  %s: error encoding: %s\n", profile.Name, err)
+				result.Failed++
+				continue
+			}
+			elapsed := time.Since(start).Seconds()
+
+			outputSize, err := getFileSize(outputPath)
+			if err != nil {
+				fmt.Printf("  %s: error reading output: %s\n", profile.Name, err)
+				result.Failed++
+				continue
+			}
+			result.Encoded++
+			result.OriginalSize += int64(video.Size)
+			result.OutputSize += outputSize
+			result.TotalSeconds += elapsed
+
+			line := fmt.Sprintf("  %s: %s in %.0fs", profile.Name, units.Bytes(outputSize), elapsed)
+			if score, ok := vmafScore(outputPath, video.FullFilePath, video.Width, video.Height); ok {
+				result.vmafTotal += score
+				result.vmafSamples++
+				line += fmt.Sprintf(", VMAF %.2f", score)
+			}
+			fmt.Println(line)
+			os.Remove(outputPath)
+		}
+	}
+
+	for i := range report.Results {
+		result := &report.Results[i]
+		if result.OriginalSize > 0 {
+			result.SavingsPct = 100 * float64(result.OriginalSize-result.OutputSize) / float64(result.OriginalSize)
+		}
+		if result.vmafSamples > 0 {
+			result.AvgVMAF = result.vmafTotal / float64(result.vmafSamples)
+		}
+	}
+	report.Recommendation, report.Reason = recommend(report.Results)
+	return report, nil
+}
+
+// vmafScore compares an encode against its source with libvmaf, scaling the
+// encode back to the source resolution. ok is false if VMAF is unavailable.
+func vmafScore(encoded, reference string, width, height int) (float64, bool) {
+	filter := fmt.Sprintf("[0:v]scale=%d:%d:flags=bicubic[d];[d][1:v]libvmaf", width, height)
+	out, err := runner.RunToExit("ffmpeg", "-i", ffmpegPath(encoded), "-i", ffmpegPath(reference), "-lavfi", filter, "-f", "null", "-")
+	if err != nil {
+		return 0, false
+	}
+	match := vmafScorePattern.FindSubmatch(out)
+	if match == nil {
+		return 0, false
+	}
+	score, err := strconv.ParseFloat(string(match[1]), 64)
+	return score, err == nil
+}
+
+// recommend picks the profile that saves more space unless it costs more than
+// vmafTolerance points of quality
+func recommend(results [2]ExperimentResult) (string, string) {
+	a, b := results[0], results[1]
+	if a.Encoded == 0 && b.Encoded == 0 {
+		return "", "neither profile encoded any sample"
+	}
+	if a.Encoded == 0 || b.Encoded == 0 {
+		winner := a
+		if a.Encoded == 0 {
+			winner = b
+		}
+		return winner.Profile, "the other profile failed on every sample"
+	}
+
+	smaller, larger := a, b
+	if b.SavingsPct > a.SavingsPct {
+		smaller, larger = b, a
+	}
+	if smaller.AvgVMAF == 0 || larger.AvgVMAF == 0 {
+		return smaller.Profile, fmt.Sprintf("saves %.1f%% vs %.1f%%; quality not measured (ffmpeg has no libvmaf)",
+			smaller.SavingsPct, larger.SavingsPct)
+	}
+	if larger.AvgVMAF-smaller.AvgVMAF > vmafTolerance {
+		return larger.Profile, fmt.Sprintf("VMAF %.2f vs %.2f outweighs saving %.1f%% vs %.1f%%",
+			larger.AvgVMAF, smaller.AvgVMAF, larger.SavingsPct, smaller.SavingsPct)
+	}
+	return smaller.Profile, fmt.Sprintf("saves %.1f%% vs %.1f%% with VMAF %.2f vs %.2f",
+		smaller.SavingsPct, larger.SavingsPct, smaller.AvgVMAF, larger.AvgVMAF)
+}
+
+// ShowExperiment runs an experiment and prints the comparison and recommendation
+func ShowExperiment(profileA, profileB, directory string, n int) error {
+	report, err := RunExperiment(profileA, profileB, directory, n)
+	if err != nil {
+		return err
+	}
+	if output.JSON() {
+		return output.Print(report)
+	}
+
+	fmt.Printf("\nCompared %d samples:\n", report.Samples)
+	for _, result := range report.Results {
+		vmaf := "n/a"
+		if result.AvgVMAF > 0 {
+			vmaf = fmt.Sprintf("%.2f", result.AvgVMAF)
+		}
+		fmt.Printf("%-12s %3d encoded  %3d failed  %5.1f%% saved  VMAF %-6s  %6.0fs total\n",
+			result.Profile, result.Encoded, result.Failed, result.SavingsPct, vmaf, result.TotalSeconds)
+	}
+	if report.Recommendation == "" {
+		fmt.Println("No recommendation:", report.Reason)
+		return nil
+	}
+	fmt.Printf("Recommendation: %s (%s)\n", report.Recommendation, report.Reason)
+	return nil
+}
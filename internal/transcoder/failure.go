@@ -0,0 +1,104 @@
+package transcoder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// stderrTailLines is how much ffmpeg output a failure notification quotes
+const stderrTailLines = 20
+
+// stderrTail keeps the last lines ffmpeg wrote to stderr, without the
+// key=value lines of -progress
+type stderrTail struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+// progressLine matches the key=value lines ffmpeg writes for -progress
+var progressLine = regexp.MustCompile(`^[a-z0-9_]+=\S*$`)
+
+func (t *stderrTail) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || progressLine.MatchString(line) {
+		return
+	}
+	if len(line) > 200 {
+		line = line[:200] + "..."
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > stderrTailLines {
+		t.lines = t.lines[len(t.lines)-stderrTailLines:]
+	}
+}
+
+func (t *stderrTail) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// ffmpegError is a failed ffmpeg run with the context needed to act on it
+type ffmpegError struct {
+	Err     error
+	Encoder string
+	Stderr  string // Last lines of ffmpeg's output
+}
+
+// Error gives the exit status and ffmpeg's last line, usually the reason
+func (e *ffmpegError) Error() string {
+	if e.Stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err, e.Stderr[strings.LastIndex(e.Stderr, "\n")+1:])
+}
+
+func (e *ffmpegError) Unwrap() error {
+	return e.Err
+}
+
+// failureMessage describes a failed transcode of path for notifications:
+// the encoder, ffmpeg's last output and what to try next
+func failureMessage(path string, err *ffmpegError) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Transcode failed: %s\nEncoder: %s\nError: %s\n", path, err.Encoder, err.Err)
+	if err.Stderr != "" {
+		fmt.Fprintf(&b, "Last ffmpeg output:\n%s\n", err.Stderr)
+	}
+	fmt.Fprintf(&b, "Next step: %s", suggestNextStep(err))
+	return b.String()
+}
+
+// suggestNextStep guesses from ffmpeg's output whether to retry with
+// software encoding, fix the environment, or skip or quarantine the source
+func suggestNextStep(err *ffmpegError) string {
+	output := strings.ToLower(err.Stderr)
+	hardware := strings.Contains(err.Encoder, "nvenc") || strings.Contains(err.Encoder, "qsv") || strings.Contains(err.Encoder, "vaapi")
+	containsAny := func(phrases ...string) bool {
+		for _, phrase := range phrases {
+			if strings.Contains(output, phrase) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case containsAny("no space left on device"):
+		return "free up space on the output drive, then retry"
+	case containsAny("permission denied", "read-only file system"):
+		return "check the permissions of the source and output directories, then retry"
+	case hardware && containsAny("openencodesessionex", "no capable devices", "cannot load", "out of memory",
+		"device creation failed", "failed to initialise", "hwaccel", "cuda", "driver"):
+		return "the hardware encoder failed; retry with software encoding (HARDWARE_ACCEL=cpu)"
+	case containsAny("invalid data found", "moov atom not found", "corrupt", "error while decoding",
+		"invalid nal", "truncat", "end of file"):
+		return "the source looks damaged; skip it, or quarantine it (move it out of the library) and replace it"
+	case hardware:
+		return "retry with software encoding (HARDWARE_ACCEL=cpu); if that fails too, skip the file"
+	}
+	return "retry once; if it fails again, skip the file or quarantine it (move it out of the library)"
+}
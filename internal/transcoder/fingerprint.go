@@ -0,0 +1,25 @@
+package transcoder
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+var (
+	encoderVersionOnce  sync.Once
+	encoderVersionValue string
+)
+
+// encoderVersion returns the first line of `ffmpeg -version`, looked up once per process
+func encoderVersion() string {
+	encoderVersionOnce.Do(func() {
+		out, err := runner.Output("ffmpeg", "-version")
+		if err != nil {
+			return
+		}
+		encoderVersionValue, _, _ = strings.Cut(string(out), "\n")
+	})
+	return encoderVersionValue
+}
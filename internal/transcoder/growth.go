@@ -0,0 +1,63 @@
+package transcoder
+
+import (
+	"log"
+
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// libraryCollector exports the latest scan snapshot of every library root,
+// read from the database at each scrape so scans run from the CLI count too
+type libraryCollector struct {
+	files           *prometheus.Desc
+	size            *prometheus.Desc
+	diskSize        *prometheus.Desc
+	resolutionFiles *prometheus.Desc
+	resolutionSize  *prometheus.Desc
+	scannedAt       *prometheus.Desc
+}
+
+func newLibraryCollector() *libraryCollector {
+	root := []string{"root"}
+	resolution := []string{"root", "resolution"}
+	return &libraryCollector{
+		files:           prometheus.NewDesc("library_files", "Video files under a library root at its last scan.", root, nil),
+		size:            prometheus.NewDesc("library_size_bytes", "Apparent size of a library root at its last scan.", root, nil),
+		diskSize:        prometheus.NewDesc("library_disk_bytes", "Space a library root took on disk at its last scan.", root, nil),
+		resolutionFiles: prometheus.NewDesc("library_resolution_files", "Video files at each resolution under a library root at its last scan.", resolution, nil),
+		resolutionSize:  prometheus.NewDesc("library_resolution_size_bytes", "Apparent size of the files at each resolution under a library root at its last scan.", resolution, nil),
+		scannedAt:       prometheus.NewDesc("library_last_scan_timestamp_seconds", "When a library root was last scanned.", root, nil),
+	}
+}
+
+func init() {
+	prometheus.MustRegister(newLibraryCollector())
+}
+
+func (c *libraryCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.files, c.size, c.diskSize, c.resolutionFiles, c.resolutionSize, c.scannedAt} {
+		ch <- desc
+	}
+}
+
+func (c *libraryCollector) Collect(ch chan<- prometheus.Metric) {
+	if db.DB == nil {
+		return
+	}
+	snapshots, err := db.QueryScanSnapshots("", true)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, s := range snapshots {
+		ch <- prometheus.MustNewConstMetric(c.files, prometheus.GaugeValue, float64(s.Files), s.Root)
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(s.Size), s.Root)
+		ch <- prometheus.MustNewConstMetric(c.diskSize, prometheus.GaugeValue, float64(s.DiskSize), s.Root)
+		ch <- prometheus.MustNewConstMetric(c.scannedAt, prometheus.GaugeValue, float64(s.TakenAt.Unix()), s.Root)
+		for _, r := range s.Resolutions {
+			ch <- prometheus.MustNewConstMetric(c.resolutionFiles, prometheus.GaugeValue, float64(r.Files), s.Root, r.Resolution)
+			ch <- prometheus.MustNewConstMetric(c.resolutionSize, prometheus.GaugeValue, float64(r.Size), s.Root, r.Resolution)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// keepOriginal reports whether an output saved too little to replace the
+// original, according to MIN_ACTUAL_SAVINGS
+func keepOriginal(originalSize, newSize int64) bool {
+	minSavings, enabled := config.GetMinActualSavings()
+	if !enabled || originalSize <= 0 {
+		return false
+	}
+	if newSize >= originalSize {
+		return true
+	}
+	return 100*float64(originalSize-newSize)/float64(originalSize) < minSavings
+}
+
+// discardOutput deletes an output that saved too little, leaving the original in place
+func discardOutput(originalPath, outputPath string, originalSize, newSize int64) {
+	if err := removeOutput(outputPath); err != nil {
+		log.Printf("Error removing discarded output %s: %s\n", outputPath, err)
+	}
+	message := fmt.Sprintf("Kept original %s: output was %s against %s, below the minimum savings",
+		originalPath, units.Bytes(newSize), units.Bytes(originalSize))
+	log.Println(message)
+	notifyFileEvent(message)
+}
@@ -0,0 +1,195 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// hdrInfo describes the HDR format of a video's first stream
+type hdrInfo struct {
+	Transfer    string // ffprobe color_transfer, e.g. smpte2084 (PQ) or arib-std-b67 (HLG)
+	DolbyVision bool
+	DVProfile   int
+	// The base layer is viewable without the Dolby Vision layer (HDR10, SDR
+	// or HLG), which profile 5 is not: its colours come out purple without it
+	DVCompatible bool
+	HDR10Plus    bool
+}
+
+// hdr reports whether the video is HDR and needs tonemapping for SDR output
+func (h hdrInfo) hdr() bool {
+	return h.Transfer == "smpte2084" || h.Transfer == "arib-std-b67" || h.DolbyVision
+}
+
+// dynamic reports whether there is any dynamic metadata
+func (h hdrInfo) dynamic() bool {
+	return h.DolbyVision || h.HDR10Plus
+}
+
+// String names the metadata, e.g. "Dolby Vision profile 8 + HDR10+"
+func (h hdrInfo) String() string {
+	var parts []string
+	if h.DolbyVision {
+		parts = append(parts, fmt.Sprintf("Dolby Vision profile %d", h.DVProfile))
+	}
+	if h.HDR10Plus {
+		parts = append(parts, "HDR10+")
+	}
+	return strings.Join(parts, " + ")
+}
+
+// probeHDR reads the transfer and Dolby Vision configuration of the first
+// video stream and the side data of its first frame, where HDR10+ metadata lives
+func probeHDR(path string) (hdrInfo, error) {
+	return probeHDRMetadata(path, true)
+}
+
+// probeHDRMetadata reads the HDR metadata of the first video stream, decoding
+// its first frame for HDR10+ only when frames is set
+func probeHDRMetadata(path string, frames bool) (hdrInfo, error) {
+	args := []string{"-v", "error", "-select_streams", "v:0"}
+	if frames {
+		args = append(args, "-read_intervals", "%+#1",
+			"-show_entries", "stream=color_transfer:stream_side_data:frame_side_data=side_data_type")
+	} else {
+		args = append(args, "-show_entries", "stream=color_transfer:stream_side_data")
+	}
+	out, err := runner.Output("ffprobe", append(args, "-of", "json", ffmpegPath(path))...)
+	if err != nil {
+		return hdrInfo{}, fmt.Errorf("error probing HDR metadata of %s: %w", path, err)
+	}
+	type sideData struct {
+		Type            string `json:"side_data_type"`
+		DVProfile       int    `json:"dv_profile"`
+		DVCompatibility int    `json:"dv_bl_signal_compatibility_id"`
+	}
+	var probe struct {
+		Streams []struct {
+			Transfer string     `json:"color_transfer"`
+			SideData []sideData `json:"side_data_list"`
+		} `json:"streams"`
+		Frames []struct {
+			SideData []sideData `json:"side_data_list"`
+		} `json:"frames"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return hdrInfo{}, fmt.Errorf("error decoding HDR metadata of %s: %w", path, err)
+	}
+
+	var hdr hdrInfo
+	for _, stream := range probe.Streams {
+		hdr.Transfer = stream.Transfer
+		for _, data := range stream.SideData {
+			if strings.Contains(data.Type, "DOVI") {
+				hdr.DolbyVision = true
+				hdr.DVProfile = data.DVProfile
+				hdr.DVCompatible = data.DVCompatibility != 0
+			}
+		}
+	}
+	for _, frame := range probe.Frames {
+		for _, data := range frame.SideData {
+			if strings.Contains(data.Type, "HDR10+") || strings.Contains(data.Type, "SMPTE2094-40") {
+				hdr.HDR10Plus = true
+			}
+		}
+	}
+	return hdr, nil
+}
+
+// dynamicHDRPolicy returns what the profile does with dynamic HDR metadata:
+// skip, strip or passthrough, falling back to DYNAMIC_HDR
+func dynamicHDRPolicy(profile profiles.Profile) string {
+	if profile.DynamicHDR != "" {
+		return profile.DynamicHDR
+	}
+	return config.GetDynamicHDR()
+}
+
+// carriesDynamicHDR reports whether the encoder can write the metadata. Only
+// libx265 and SVT-AV1, the software encoders of profiles with codec hevc or
+// av1, take Dolby Vision and HDR10+ from ffmpeg; the H.264 and hardware
+// encoders cannot carry either.
+func carriesDynamicHDR(encoder string) bool {
+	return encoder == "libx265" || encoder == "libsvtav1"
+}
+
+// dynamicHDRAction settles what happens to a video's dynamic HDR metadata
+// under policy: "" when it has none, "passthrough", "strip", or "skip" with
+// the reason. Passthrough falls back to stripping when the encoder cannot
+// carry the metadata, and stripping to skipping when the base layer would be
+// unwatchable without it.
+func dynamicHDRAction(hdr hdrInfo, policy, encoder string) (string, string) {
+	if !hdr.dynamic() {
+		return "", ""
+	}
+	if policy == "skip" {
+		return "skip", hdr.String() + " video"
+	}
+	if policy == "passthrough" && carriesDynamicHDR(encoder) {
+		return "passthrough", ""
+	}
+	if hdr.DolbyVision && !hdr.DVCompatible {
+		return "skip", hdr.String() + " video, which has no base layer to keep without its dynamic metadata"
+	}
+	return "strip", ""
+}
+
+// currentEncoder returns the encoder buildFFmpegCommand will use for codec,
+// without DetectHardware's console output. The hardware is only probed once.
+func currentEncoder(codec string) string {
+	hardware := config.GetHardwareAccel()
+	if hardware == "auto" {
+		hardware = probeHardware()
+	}
+	return encoderFor(hardware, codec)
+}
+
+// dynamicHDRSkip returns why the profile skips the video for its dynamic HDR
+// metadata, or "" when it may be transcoded. The video is only probed when the
+// policy can skip it: every dynamic HDR video under skip, otherwise only Dolby
+// Vision without a compatible base layer, which needs no frame decoded, and
+// nothing when the encoder passes the metadata through. Videos that cannot be
+// probed are not skipped.
+func dynamicHDRSkip(profile profiles.Profile, path string) string {
+	policy := dynamicHDRPolicy(profile)
+	encoder := currentEncoder(profile.Codec)
+	if policy == "passthrough" && carriesDynamicHDR(encoder) {
+		return ""
+	}
+	hdr, err := probeHDRMetadata(path, policy == "skip")
+	if err != nil || !hdr.dynamic() {
+		return ""
+	}
+	action, reason := dynamicHDRAction(hdr, policy, encoder)
+	if action != "skip" {
+		return ""
+	}
+	return reason
+}
+
+// dynamicHDRArgs returns the encoder options that pass dynamic HDR metadata
+// through or strip it, as the profile's policy settles for input
+func dynamicHDRArgs(input string, hdr hdrInfo, profile profiles.Profile, encoder string) []string {
+	if !hdr.dynamic() {
+		return nil
+	}
+	action, _ := dynamicHDRAction(hdr, dynamicHDRPolicy(profile), encoder)
+	log.Printf("%s has %s metadata: %s\n", input, hdr, action)
+	if !carriesDynamicHDR(encoder) || !hdr.DolbyVision {
+		return nil
+	}
+	switch action {
+	case "passthrough":
+		return []string{"-dolbyvision:v:0", "1"}
+	case "strip":
+		return []string{"-dolbyvision:v:0", "0"}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package transcoder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// ShowHistory prints the most recent batches with their per-batch results
+func ShowHistory(limit int) error {
+	batches, err := db.QueryBatches(limit)
+	if err != nil {
+		return err
+	}
+	for i := range batches {
+		addEnergy(&batches[i])
+	}
+	if output.JSON() {
+		return output.Print(batches)
+	}
+	if len(batches) == 0 {
+		fmt.Println("No transcode batches recorded yet.")
+		return nil
+	}
+
+	for _, batch := range batches {
+		duration := "running"
+		if batch.FinishedAt != nil {
+			duration = (time.Duration(batch.Duration) * time.Second).String()
+		}
+		fmt.Printf("#%d %s | %s | started %s | %d/%d files | %s saved | %s\n",
+			batch.ID, batch.Name, batch.Profile, batch.StartedAt.Format("2006-01-02 15:04"),
+			batch.Completed, batch.FileCount, units.Bytes(batch.SpaceSaved), duration)
+		if energy := energyMessage(batch); energy != "" {
+			fmt.Printf("    %s\n", energy)
+		}
+	}
+	return nil
+}
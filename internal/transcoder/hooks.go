@@ -0,0 +1,95 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// withHooks runs a job between PRE_JOB_HOOK and POST_JOB_HOOK. A failing
+// pre-job hook fails the job without starting it; the post-job hook runs
+// after every job that started, and its failure is only logged.
+func withHooks(video datatypes.VideoObject, profile string, job func() (*datatypes.TranscodedVideo, error)) (*datatypes.TranscodedVideo, error) {
+	env := hookEnv(video, profile)
+	if command := config.GetPreJobHook(); command != "" {
+		if err := runHook(command, append(env, "ZINOCODER_HOOK=pre")); err != nil {
+			log.Printf("Skipping %s: pre-job hook failed: %s\n", video.FullFilePath, err)
+			return nil, fmt.Errorf("pre-job hook failed: %w", err)
+		}
+	}
+
+	result, err := job()
+
+	if command := config.GetPostJobHook(); command != "" {
+		env = append(env, "ZINOCODER_HOOK=post")
+		env = append(env, resultEnv(result, err)...)
+		if hookErr := runHook(command, env); hookErr != nil {
+			log.Printf("Post-job hook failed for %s: %s\n", video.FullFilePath, hookErr)
+		}
+	}
+	return result, err
+}
+
+// hookEnv describes the source of a job to its hooks
+func hookEnv(video datatypes.VideoObject, profile string) []string {
+	return []string{
+		"ZINOCODER_INPUT=" + video.FullFilePath,
+		"ZINOCODER_INPUT_SIZE=" + strconv.Itoa(video.Size),
+		"ZINOCODER_RESOLUTION=" + fmt.Sprintf("%dx%d", video.Width, video.Height),
+		"ZINOCODER_PROFILE=" + profile,
+	}
+}
+
+// resultEnv describes the outcome of a job to the post-job hook: its status
+// (completed, discarded or failed) and, once recorded, its output
+func resultEnv(result *datatypes.TranscodedVideo, err error) []string {
+	switch {
+	case err != nil:
+		return []string{"ZINOCODER_STATUS=failed", "ZINOCODER_ERROR=" + err.Error()}
+	case result == nil:
+		return []string{"ZINOCODER_STATUS=completed"}
+	}
+	status := "completed"
+	if result.Discarded {
+		status = "discarded"
+	}
+	env := []string{
+		"ZINOCODER_STATUS=" + status,
+		"ZINOCODER_OUTPUT_SIZE=" + strconv.Itoa(result.NewSize),
+		"ZINOCODER_SPACE_SAVED=" + strconv.Itoa(result.OldSize-result.NewSize),
+		"ZINOCODER_TIME_TAKEN=" + strconv.Itoa(result.TimeTaken),
+	}
+	if !result.Discarded {
+		env = append(env, "ZINOCODER_OUTPUT="+result.TranscodedPath)
+	}
+	if len(result.Tags) > 0 {
+		env = append(env, "ZINOCODER_TAGS="+strings.Join(result.Tags, ","))
+	}
+	return env
+}
+
+// runHook runs command with sh through env, which adds env to the
+// environment, and kills it after HOOK_TIMEOUT. Its output, stderr
+// included, goes to the log.
+func runHook(command string, env []string) error {
+	args := append(append([]string(nil), env...), "sh", "-c", "exec 2>&1\n"+command)
+	output, err := runner.OutputWithin(config.GetHookTimeout(), "env", args...)
+	if text := strings.TrimSpace(string(output)); text != "" {
+		log.Printf("Hook output: %s\n", text)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", config.GetHookTimeout())
+	}
+	var runErr *runner.Error
+	if errors.As(err, &runErr) {
+		return runErr.Err
+	}
+	return err
+}
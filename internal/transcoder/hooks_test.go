@@ -0,0 +1,42 @@
+package transcoder
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+func TestRunHookGoesThroughRunner(t *testing.T) {
+	fake := &runner.Fake{}
+	defer runner.Use(fake)()
+	if err := runHook("notify.sh", []string{"ZINOCODER_HOOK=pre"}); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("ran %v, want one command", calls)
+	}
+	want := []string{"env", "ZINOCODER_HOOK=pre", "sh", "-c", "exec 2>&1\nnotify.sh"}
+	if len(calls[0]) != len(want) {
+		t.Fatalf("ran %q, want %q", calls[0], want)
+	}
+	for i := range want {
+		if calls[0][i] != want[i] {
+			t.Errorf("ran %q, want %q", calls[0], want)
+			break
+		}
+	}
+}
+
+func TestRunHookEnvironment(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run hooks with")
+	}
+	if err := runHook(`test "$ZINOCODER_HOOK" = pre`, []string{"ZINOCODER_HOOK=pre"}); err != nil {
+		t.Errorf("hook did not see its environment: %s", err)
+	}
+	if err := runHook("echo failing >&2; exit 3", nil); err == nil {
+		t.Error("failing hook reported success")
+	}
+}
@@ -0,0 +1,126 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// idleSampleInterval is how often load and utilisation are sampled in idle-only mode
+const idleSampleInterval = 30 * time.Second
+
+// idleMutex makes concurrent workers wait for the same idle window
+var idleMutex sync.Mutex
+
+// waitForIdle blocks in idle-only mode until load, disk and GPU utilisation
+// have stayed under their thresholds for the configured duration. The
+// settings are read again after every sample, so a reload applies to a
+// job already waiting.
+func waitForIdle() {
+	settings, ok := config.GetIdleSettings()
+	if !ok {
+		return
+	}
+
+	idleMutex.Lock()
+	defer idleMutex.Unlock()
+
+	var quietSince time.Time
+	waiting := false
+	for {
+		if busy := busyReason(settings, idleSampleInterval); busy != "" {
+			if !waiting {
+				log.Printf("Idle-only mode: waiting for the system to go quiet (%s)\n", busy)
+				waiting = true
+			}
+			quietSince = time.Time{}
+		} else if quietSince.IsZero() {
+			// The sample just taken covered the last interval
+			quietSince = time.Now().Add(-idleSampleInterval)
+		}
+		if settings, ok = config.GetIdleSettings(); !ok {
+			break
+		}
+		if !quietSince.IsZero() && time.Since(quietSince) >= settings.Duration {
+			break
+		}
+	}
+	if waiting {
+		log.Println("Idle-only mode: system is quiet, starting job")
+	}
+}
+
+// busyReason samples the system over interval and describes the first
+// threshold exceeded, or returns "" if the system is idle
+func busyReason(settings config.IdleSettings, interval time.Duration) string {
+	before := diskBusyTicks()
+	time.Sleep(interval)
+	after := diskBusyTicks()
+
+	if load, ok := loadAverage(); ok && load > settings.MaxLoad {
+		return fmt.Sprintf("load %.2f > %.2f", load, settings.MaxLoad)
+	}
+	busiest := 0.0
+	for device, ticks := range after {
+		if start, ok := before[device]; ok {
+			util := float64(ticks-start) / float64(interval.Milliseconds()) * 100
+			if util > busiest {
+				busiest = util
+			}
+		}
+	}
+	if busiest > settings.MaxDiskUtil {
+		return fmt.Sprintf("disk %.0f%% busy > %.0f%%", busiest, settings.MaxDiskUtil)
+	}
+	if util, ok := gpuUtilisation(); ok && util > settings.MaxGPUUtil {
+		return fmt.Sprintf("GPU %.0f%% busy > %.0f%%", util, settings.MaxGPUUtil)
+	}
+	return ""
+}
+
+// loadAverage returns the 1 minute load average
+func loadAverage() (float64, bool) {
+	fields := strings.Fields(readSysFile("/proc/loadavg"))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, err == nil
+}
+
+// diskBusyTicks returns the milliseconds each disk has spent doing I/O
+func diskBusyTicks() map[string]uint64 {
+	ticks := map[string]uint64{}
+	for _, line := range strings.Split(readSysFile("/proc/diskstats"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 13 || strings.HasPrefix(fields[2], "loop") || strings.HasPrefix(fields[2], "ram") {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[12], 10, 64); err == nil {
+			ticks[fields[2]] = value
+		}
+	}
+	return ticks
+}
+
+// gpuUtilisation returns the busiest NVIDIA GPU in percent
+func gpuUtilisation() (float64, bool) {
+	out, err := runner.Output("nvidia-smi", "--query-gpu=utilization.gpu", "--format=csv,noheader,nounits")
+	if err != nil {
+		return 0, false
+	}
+	busiest, found := 0.0, false
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		util, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
+		if err == nil && (!found || util > busiest) {
+			busiest, found = util, true
+		}
+	}
+	return busiest, found
+}
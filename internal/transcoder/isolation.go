@@ -0,0 +1,75 @@
+package transcoder
+
+import (
+	"log"
+	"os/exec"
+	"strconv"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/profiles"
+)
+
+// isolation holds the process priority settings ffmpeg runs under
+type isolation struct {
+	nice   int
+	ionice string
+	slice  string
+}
+
+// isolationFor returns the FFMPEG_* defaults overlaid with the named profile's settings
+func isolationFor(profileName string) isolation {
+	iso := isolation{
+		nice:   config.GetFFmpegNice(),
+		ionice: config.GetFFmpegIONice(),
+		slice:  config.GetFFmpegSlice(),
+	}
+	if profileName == "" {
+		return iso
+	}
+	profile, err := profiles.Get(profileName)
+	if err != nil || profile == nil {
+		log.Printf("Profile %s not found, using default process priority\n", profileName)
+		return iso
+	}
+	if profile.Nice != 0 {
+		iso.nice = profile.Nice
+	}
+	if profile.IONice != "" {
+		iso.ionice = profile.IONice
+	}
+	if profile.Slice != "" {
+		iso.slice = profile.Slice
+	}
+	return iso
+}
+
+// wrap prefixes an ffmpeg command line with systemd-run, ionice and nice as
+// configured. Wrappers that are not installed are skipped with a log message.
+func (iso isolation) wrap(args []string) []string {
+	var prefix []string
+	if iso.slice != "" && available("systemd-run") {
+		prefix = append(prefix, "systemd-run", "--scope", "--quiet", "--collect", "--slice="+iso.slice, "--")
+	}
+	if iso.ionice != "" && available("ionice") {
+		class, level, err := profiles.ParseIONice(iso.ionice)
+		if err != nil {
+			log.Printf("Ignoring ionice setting: %s\n", err)
+		} else if class == 3 {
+			prefix = append(prefix, "ionice", "-c", "3")
+		} else {
+			prefix = append(prefix, "ionice", "-c", strconv.Itoa(class), "-n", strconv.Itoa(level))
+		}
+	}
+	if iso.nice != 0 && available("nice") {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(iso.nice))
+	}
+	return append(prefix, args...)
+}
+
+func available(tool string) bool {
+	if _, err := exec.LookPath(tool); err != nil {
+		log.Printf("%s not found, running ffmpeg without it\n", tool)
+		return false
+	}
+	return true
+}
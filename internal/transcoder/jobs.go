@@ -0,0 +1,164 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// jobs tracks every request accepted by this transcode server
+var (
+	jobs      = make(map[int]*datatypes.Job)
+	jobsMutex sync.Mutex
+	lastJobID int
+)
+
+// addJob registers a new queued job and returns a copy of it. settings is
+// the profile with the request's overrides applied, or nil without overrides,
+// and is kept as the job's settings event so it outlives a restart.
+func addJob(req datatypes.TranscodeRequest, settings json.RawMessage) datatypes.Job {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	lastJobID++
+	job := &datatypes.Job{
+		ID:               lastJobID,
+		TranscodeRequest: req,
+		Settings:         settings,
+		Status:           datatypes.JobQueued,
+		SubmittedAt:      time.Now(),
+	}
+	jobs[job.ID] = job
+	recordJobEvent(job.ID, string(datatypes.JobQueued), 0, job.Video.FullFilePath)
+	if settings != nil {
+		recordJobEvent(job.ID, "settings", 0, string(settings))
+	}
+	return *job
+}
+
+// setJobStatus moves a job to a new state, recording the error for failures
+func setJobStatus(id int, status datatypes.JobStatus, err error) {
+	jobsMutex.Lock()
+	job, exists := jobs[id]
+	if !exists {
+		jobsMutex.Unlock()
+		return
+	}
+	job.Status = status
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if status == datatypes.JobCompleted || status == datatypes.JobFailed || status == datatypes.JobCancelled {
+		now := time.Now()
+		job.FinishedAt = &now
+	}
+	message := job.Error
+	jobsMutex.Unlock()
+
+	switch status {
+	case datatypes.JobRunning:
+		recordJobEvent(id, "started", 0, "")
+	case datatypes.JobCompleted:
+		recordJobEvent(id, string(status), 100, "")
+	default:
+		recordJobEvent(id, string(status), 0, message)
+	}
+}
+
+// cancelQueuedJobs cancels every job for path that has not started yet and
+// returns their IDs
+func cancelQueuedJobs(path, reason string) []int {
+	jobsMutex.Lock()
+	var cancelled []int
+	for id, job := range jobs {
+		if job.Status == datatypes.JobQueued && job.Video.FullFilePath == path {
+			cancelled = append(cancelled, id)
+		}
+	}
+	jobsMutex.Unlock()
+	for _, id := range cancelled {
+		setJobStatus(id, datatypes.JobCancelled, errors.New(reason))
+	}
+	return cancelled
+}
+
+// hasActiveJob reports whether a job for path is queued or running
+func hasActiveJob(path string) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, job := range jobs {
+		if (job.Status == datatypes.JobQueued || job.Status == datatypes.JobRunning) && job.Video.FullFilePath == path {
+			return true
+		}
+	}
+	return false
+}
+
+// retargetQueuedJobs points the jobs for a renamed input that have not
+// started yet at its new path
+func retargetQueuedJobs(from, to string) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, job := range jobs {
+		if job.Status == datatypes.JobQueued && job.Video.FullFilePath == from {
+			job.Video.FullFilePath = to
+			job.Video.Name = filepath.Base(to)
+			job.Video.Location = filepath.Dir(to)
+		}
+	}
+}
+
+// getJob returns a copy of a job known to this server
+func getJob(id int) (datatypes.Job, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job, exists := jobs[id]
+	if !exists {
+		return datatypes.Job{}, false
+	}
+	return *job, true
+}
+
+// setJobResult keeps the transcode a completed job recorded
+func setJobResult(id int, result *datatypes.TranscodedVideo) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	if job, exists := jobs[id]; exists {
+		job.Result = result
+	}
+}
+
+// listJobs returns a snapshot of all jobs ordered by ID
+func listJobs() []datatypes.Job {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	list := make([]datatypes.Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, *job)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// listProgress returns the progress of every transcode currently running
+func listProgress() []datatypes.JobProgress {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	list := make([]datatypes.JobProgress, 0, len(progressMap))
+	for _, key := range progressKeys {
+		if progress, exists := progressMap[key]; exists {
+			list = append(list, datatypes.JobProgress{
+				File:             key,
+				Percentage:       progress.Percentage,
+				ElapsedSeconds:   int(progress.Elapsed.Seconds()),
+				RemainingSeconds: int(progress.Remaining.Seconds()),
+				FPS:              progress.FPS,
+			})
+		}
+	}
+	return list
+}
@@ -0,0 +1,68 @@
+package transcoder
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/profiles"
+)
+
+// defaultFramerate is assumed when the source framerate is unknown
+const defaultFramerate = 30
+
+// targetBitrate returns the bitrate in kbps to encode video at. Fixed bitrates
+// are returned unchanged; AutoBitrate is resolved from the source.
+func targetBitrate(video datatypes.VideoObject, resolution string, bitrate int) int {
+	if bitrate != profiles.AutoBitrate {
+		return bitrate
+	}
+	return autoBitrate(video, resolution, config.GetAutoBitrateSettings())
+}
+
+// autoBitrate takes a share of the source video bitrate, scaled down with the
+// pixel count when downscaling, and clamps it to a bits-per-pixel range for
+// the output resolution and framerate. It never exceeds the source bitrate.
+func autoBitrate(video datatypes.VideoObject, resolution string, settings config.AutoBitrateSettings) int {
+	sourceKbps := float64(video.Bitrate) / 1000
+	if sourceKbps <= 0 && video.Length > 0 {
+		sourceKbps = float64(video.Size) * 8 / 1000 / float64(video.Length)
+	}
+
+	framerate := video.Framerate
+	if framerate <= 0 {
+		framerate = defaultFramerate
+	}
+	outWidth, outHeight := video.Width, video.Height
+	fmt.Sscanf(resolution, "%dx%d", &outWidth, &outHeight)
+	outPixels := float64(outWidth * outHeight)
+	sourcePixels := float64(video.Width * video.Height)
+
+	target := sourceKbps * settings.Percent / 100
+	if sourcePixels > 0 && outPixels > 0 && outPixels < sourcePixels {
+		// Bitrate needs grow more slowly than the pixel count
+		target *= math.Pow(outPixels/sourcePixels, 0.75)
+	}
+
+	if outPixels > 0 {
+		minKbps := outPixels * framerate * settings.MinBPP / 1000
+		maxKbps := outPixels * framerate * settings.MaxBPP / 1000
+		target = math.Max(minKbps, math.Min(target, maxKbps))
+	}
+	if sourceKbps > 0 {
+		target = math.Min(target, sourceKbps)
+	}
+	if target < 1 {
+		target = 1
+	}
+	return int(target)
+}
+
+// bitrateLabel describes a bitrate for logs and batch labels
+func bitrateLabel(bitrate int) string {
+	if bitrate == profiles.AutoBitrate {
+		return "auto"
+	}
+	return fmt.Sprintf("%dk", bitrate)
+}
@@ -0,0 +1,62 @@
+package transcoder
+
+import (
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+)
+
+// ShowLineage prints every transcode leading to and made from the file at path
+func ShowLineage(path string) error {
+	links, err := db.QueryLineage(path)
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error querying lineage")
+	}
+	if output.JSON() {
+		return output.Print(links)
+	}
+	if len(links) == 0 {
+		fmt.Printf("No transcodes recorded for %s.\n", path)
+		return nil
+	}
+	for _, link := range links {
+		printLineageLink(link)
+	}
+	return nil
+}
+
+// ShowOrphanedOriginals prints the originals whose outputs were later deleted
+func ShowOrphanedOriginals() error {
+	links, err := db.QueryOrphanedOriginals()
+	if err != nil {
+		return apperr.Wrap(apperr.Database, err, "error querying orphaned originals")
+	}
+	if output.JSON() {
+		return output.Print(links)
+	}
+	if len(links) == 0 {
+		fmt.Println("Every transcoded original still has its output.")
+		return nil
+	}
+	for _, link := range links {
+		printLineageLink(link)
+	}
+	return nil
+}
+
+// printLineageLink prints one transcode, marking files no longer recorded
+func printLineageLink(link datatypes.LineageLink) {
+	original, output := link.Original, link.Output
+	if !link.OriginalExists {
+		original += " (gone)"
+	}
+	if link.Discarded {
+		output += " (discarded)"
+	} else if !link.OutputExists {
+		output += " (gone)"
+	}
+	fmt.Printf("#%d %s | %s -> %s | %s\n", link.TranscodeID, link.CreatedAt.Format("2006-01-02 15:04"), original, output, link.Profile)
+}
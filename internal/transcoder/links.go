@@ -0,0 +1,90 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/safety"
+	"github.com/palzino/vidanalyser/internal/scanner"
+)
+
+// dropLinks keeps one name per file so hard links are not transcoded twice,
+// and drops recorded symbolic links, whose targets are transcoded instead
+func dropLinks(videos []datatypes.VideoObject) []datatypes.VideoObject {
+	seen := map[[2]int64]string{}
+	kept := make([]datatypes.VideoObject, 0, len(videos))
+	for _, video := range videos {
+		if video.LinkTarget != "" {
+			fmt.Printf("Skipping %s: symbolic link to %s\n", video.FullFilePath, video.LinkTarget)
+			continue
+		}
+		if video.Inode != 0 {
+			id := [2]int64{video.Device, video.Inode}
+			if first, ok := seen[id]; ok {
+				fmt.Printf("Skipping %s: hard link of %s\n", video.FullFilePath, first)
+				continue
+			}
+			seen[id] = video.FullFilePath
+		}
+		kept = append(kept, video)
+	}
+	return kept
+}
+
+// replaceLinks deals with the other names of an original that has just been
+// deleted. They still hold its data, so unless LINK_REPLACE is set the space
+// is not freed and only a warning is logged.
+func replaceLinks(video datatypes.VideoObject, outputPath string) {
+	if video.Inode == 0 || video.Links <= 1 {
+		return
+	}
+	links, err := db.QueryHardLinks(video.Device, video.Inode, video.FullFilePath)
+	if err != nil {
+		log.Printf("Error looking up hard links of %s: %s\n", video.FullFilePath, err)
+		return
+	}
+
+	mode := config.GetLinkReplace()
+	if mode == "" {
+		log.Printf("%s has %d other hard link(s); its space is not freed until they are removed (set LINK_REPLACE)\n",
+			video.FullFilePath, video.Links-1)
+		return
+	}
+	for _, link := range links {
+		newPath := filepath.Join(link.Location, generateNewName(link.Name))
+		if err := linkOutput(mode, outputPath, newPath); err != nil {
+			log.Printf("Error replacing hard link %s: %s\n", link.FullFilePath, err)
+			continue
+		}
+		if err := safety.Remove(link.FullFilePath); err != nil {
+			log.Printf("Error removing hard link %s: %s\n", link.FullFilePath, err)
+			continue
+		}
+		if err := db.DeleteVideo(link.FullFilePath); err != nil {
+			log.Printf("Error deleting video %s from database: %s\n", link.FullFilePath, err)
+		}
+		renamedFilesMutex.Lock()
+		scanner.ProcessFile(newPath)
+		renamedFilesMutex.Unlock()
+		log.Printf("Replaced hard link %s with %s (%s)\n", link.FullFilePath, newPath, mode)
+	}
+}
+
+// linkOutput makes newPath share the output's data: as another hard link, or
+// as a reflink (copy-on-write clone) falling back to a hard link where the
+// filesystem cannot clone
+func linkOutput(mode, outputPath, newPath string) error {
+	if mode == "reflink" {
+		err := cloneFile(outputPath, newPath)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Reflink of %s failed, hard linking instead: %s\n", outputPath, err)
+	}
+	return os.Link(outputPath, newPath)
+}
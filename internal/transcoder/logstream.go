@@ -0,0 +1,190 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogRecord is one line of the server log, as served by GET /logs
+type LogRecord struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`     // info, warn or error
+	Subsystem string    `json:"subsystem"` // Package that logged it, e.g. transcoder or maintenance
+	Message   string    `json:"message"`
+}
+
+// logLevels orders the levels for ?level=, which keeps that level and above
+var logLevels = map[string]int{"info": 0, "warn": 1, "error": 2}
+
+// logBacklog is how many recent records are kept for new readers
+const logBacklog = 1000
+
+// logHub keeps the recent log and fans new records out to followers
+type logHub struct {
+	mutex     sync.Mutex
+	records   []LogRecord
+	followers map[chan LogRecord]struct{}
+}
+
+var serverLog = &logHub{followers: make(map[chan LogRecord]struct{})}
+
+// logTimestamp matches the date and time the standard logger prefixes
+var logTimestamp = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
+// CaptureLogs records everything written with the standard logger, alongside
+// its usual output, so GET /logs can serve it. Output printed with fmt goes
+// to stdout only and is not captured.
+func CaptureLogs() {
+	log.SetOutput(io.MultiWriter(log.Writer(), serverLog))
+}
+
+// Write records one line written by the standard logger. It runs on the
+// logging goroutine, so the caller's package names the subsystem.
+func (h *logHub) Write(p []byte) (int, error) {
+	message := strings.TrimRight(logTimestamp.ReplaceAllString(string(p), ""), "\n")
+	record := LogRecord{Time: time.Now(), Level: logLevel(message), Subsystem: loggingPackage(), Message: message}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = append(h.records, record)
+	if len(h.records) > logBacklog {
+		h.records = h.records[len(h.records)-logBacklog:]
+	}
+	for follower := range h.followers {
+		select {
+		case follower <- record:
+		default: // Drop records for followers that fall behind
+		}
+	}
+	return len(p), nil
+}
+
+// follow returns the recorded backlog and a channel receiving every later
+// record, until unfollow is called
+func (h *logHub) follow() ([]LogRecord, chan LogRecord, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	follower := make(chan LogRecord, 256)
+	h.followers[follower] = struct{}{}
+	backlog := append([]LogRecord(nil), h.records...)
+	return backlog, follower, func() {
+		h.mutex.Lock()
+		delete(h.followers, follower)
+		h.mutex.Unlock()
+	}
+}
+
+// logLevel infers the level of a message from its wording, as the code logs
+// plain text without a level. It is a guess: a message that mentions an
+// error in passing is filed as one, and a problem worded otherwise as info.
+func logLevel(message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "error"), strings.Contains(lower, "failed"), strings.Contains(lower, "panic"):
+		return "error"
+	case strings.Contains(lower, "warning"), strings.Contains(lower, "invalid"), strings.Contains(lower, "skipping"),
+		strings.Contains(lower, "not set"):
+		return "warn"
+	}
+	return "info"
+}
+
+// loggingPackage returns the name of the package that called the logger
+func loggingPackage() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function
+		if slash := strings.LastIndex(name, "/"); slash >= 0 {
+			name = name[slash+1:]
+		}
+		pkg, _, _ := strings.Cut(name, ".")
+		if pkg != "log" && pkg != "io" && pkg != "" {
+			return pkg
+		}
+		if !more {
+			return "main"
+		}
+	}
+}
+
+// handleLogs returns the recent server log as JSON, or with ?follow=1 streams
+// it as server-sent events until the client disconnects. ?level= keeps that
+// level and above, ?subsystem= one package and ?lines= the last N records.
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	minLevel, known := logLevels[strings.ToLower(query.Get("level"))]
+	if !known && query.Get("level") != "" {
+		http.Error(w, "Invalid level, expected info, warn or error.", http.StatusBadRequest)
+		return
+	}
+	lines := logBacklog
+	if value := query.Get("lines"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid lines.", http.StatusBadRequest)
+			return
+		}
+		lines = parsed
+	}
+	subsystem := query.Get("subsystem")
+	matches := func(record LogRecord) bool {
+		return logLevels[record.Level] >= minLevel && (subsystem == "" || record.Subsystem == subsystem)
+	}
+
+	backlog, follower, unfollow := serverLog.follow()
+	defer unfollow()
+	recent := []LogRecord{}
+	for _, record := range backlog {
+		if matches(record) {
+			recent = append(recent, record)
+		}
+	}
+	if len(recent) > lines {
+		recent = recent[len(recent)-lines:]
+	}
+
+	follow, _ := strconv.ParseBool(query.Get("follow"))
+	if !follow {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recent)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(record LogRecord) {
+		data, _ := json.Marshal(record)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	for _, record := range recent {
+		send(record)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case record := <-follower:
+			if matches(record) {
+				send(record)
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package transcoder
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// queueOrders are the orders a batch can run its files in: as selected, the
+// smallest files first, the shortest estimated encodes first, the largest
+// expected savings first, or the least recently modified files first
+var queueOrders = []string{"fifo", "smallest", "shortest", "savings", "oldest"}
+
+// isQueueOrder reports whether order names one of queueOrders
+func isQueueOrder(order string) bool {
+	for _, known := range queueOrders {
+		if order == known {
+			return true
+		}
+	}
+	return false
+}
+
+// orderEstimates sorts the planned files of a batch into order. The sort is
+// stable, so files that compare equal keep their selection order.
+func orderEstimates(estimates []Estimate, order string) {
+	switch order {
+	case "smallest":
+		sort.SliceStable(estimates, func(i, j int) bool {
+			return estimates[i].Video.Size < estimates[j].Video.Size
+		})
+	case "shortest":
+		rate := encodePixelRate()
+		durations := make(map[string]time.Duration, len(estimates))
+		for _, estimate := range estimates {
+			durations[estimate.Video.FullFilePath] = estimateDuration(estimate.Video, rate)
+		}
+		sort.SliceStable(estimates, func(i, j int) bool {
+			return durations[estimates[i].Video.FullFilePath] < durations[estimates[j].Video.FullFilePath]
+		})
+	case "savings":
+		sort.SliceStable(estimates, func(i, j int) bool {
+			return expectedSaving(estimates[i]) > expectedSaving(estimates[j])
+		})
+	case "oldest":
+		// Files that cannot be stat'ed here, such as URLs, go last
+		modified := make(map[string]time.Time, len(estimates))
+		for _, estimate := range estimates {
+			if info, err := os.Stat(estimate.Video.FullFilePath); err == nil {
+				modified[estimate.Video.FullFilePath] = info.ModTime()
+			}
+		}
+		sort.SliceStable(estimates, func(i, j int) bool {
+			a, b := modified[estimates[i].Video.FullFilePath], modified[estimates[j].Video.FullFilePath]
+			if a.IsZero() || b.IsZero() {
+				return !a.IsZero() && b.IsZero()
+			}
+			return a.Before(b)
+		})
+	}
+}
+
+// expectedSaving returns the bytes transcoding a file is expected to free
+func expectedSaving(estimate Estimate) int64 {
+	return int64(estimate.Video.Size) - estimate.ExpectedSize
+}
@@ -0,0 +1,183 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/safety"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+	"github.com/palzino/vidanalyser/pkg/scanner"
+)
+
+// outputPathFor returns where the transcode of video is written. OUTPUT_ROOTS
+// mappings come first, then the profile's output root or OUTPUT_ROOT, under
+// which the source's path inside its library is recreated; otherwise the
+// output goes next to the source. The output directory is created, and checked
+// to be writable so read-only sources fail before ffmpeg starts.
+func outputPathFor(video datatypes.VideoObject, profileName string) (string, error) {
+	dir := video.Location
+	if pathutil.IsURL(video.FullFilePath) {
+		if dir = config.GetRemoteOutputDir(); dir == "" {
+			return "", fmt.Errorf("%s is a remote file; set REMOTE_OUTPUT_DIR to a local directory for its output", video.FullFilePath)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("error creating output directory %s: %w", dir, err)
+		}
+	} else if p, err := sshpath.Parse(video.FullFilePath); err == nil {
+		// Outputs go back next to their source on the host
+		return p.Dir().Join(generateNewName(video.Name)).String(), nil
+	} else if mapped, ok := mappedOutputDir(video.Location, profileName); ok {
+		dir = mapped
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("error creating output directory %s: %w", dir, err)
+		}
+	}
+	if !writable(dir) {
+		return "", fmt.Errorf("output directory %s is not writable; map its library to a writable tree in OUTPUT_ROOTS", dir)
+	}
+	return filepath.Join(dir, generateNewName(video.Name)), nil
+}
+
+// mappedOutputDir returns the mirror directory for a source directory, if any
+func mappedOutputDir(location, profileName string) (string, bool) {
+	for _, root := range config.GetOutputRoots() {
+		if rel, ok := relativeTo(root.Library, location); ok {
+			return filepath.Join(root.Output, rel), true
+		}
+	}
+
+	outputRoot := config.GetOutputRoot()
+	if profileName != "" {
+		if profile, err := profiles.Get(profileName); err == nil && profile != nil && profile.OutputRoot != "" {
+			outputRoot = profile.OutputRoot
+		}
+	}
+	if outputRoot == "" {
+		return "", false
+	}
+	for _, library := range config.GetLibraryPaths() {
+		if rel, ok := relativeTo(filepath.Clean(library), location); ok {
+			return filepath.Join(outputRoot, rel), true
+		}
+	}
+	// Outside every library the whole source path is mirrored
+	return filepath.Join(outputRoot, location), true
+}
+
+// relativeTo returns path relative to root when path is root or inside it
+func relativeTo(root, path string) (string, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// writable reports whether files can be created in dir, which also catches
+// read-only mounts that permission bits alone do not reveal
+func writable(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".zinocoder-write-test-*")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
+}
+
+// collisionTarget returns the path the output for outputPath is written to
+// under the profile's collision policy. An existing output is either skipped,
+// left alone by writing the next free name_vN, or overwritten: replacing is
+// then true and the new output goes to a hidden file first, which
+// replaceVerified moves over the existing one only once it checks out.
+func collisionTarget(outputPath, profileName string) (target string, replacing bool, err error) {
+	if !outputExists(outputPath) {
+		return outputPath, false, nil
+	}
+	profile := profiles.Profile{}
+	if named, err := profiles.Get(profileName); err == nil && named != nil {
+		profile = *named
+	}
+
+	sibling := func(name string) string { return filepath.Join(filepath.Dir(outputPath), name) }
+	if p, err := sshpath.Parse(outputPath); err == nil {
+		sibling = func(name string) string { return p.Dir().Join(name).String() }
+	}
+	name := filepath.Base(outputPath)
+	switch profile.CollisionPolicy() {
+	case "skip":
+		return "", false, fmt.Errorf("output %s already exists", outputPath)
+	case "version":
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; ; n++ {
+			candidate := sibling(fmt.Sprintf("%s_v%d%s", base, n, ext))
+			if !outputExists(candidate) {
+				log.Printf("Output %s exists, writing %s\n", outputPath, candidate)
+				return candidate, false, nil
+			}
+		}
+	default:
+		if err := safety.Check("replace existing output " + outputPath); err != nil {
+			return "", false, err
+		}
+		return sibling(".zinocoder-new-" + name), true, nil
+	}
+}
+
+// outputExists reports whether a file is at path, asking the host of an
+// ssh:// path
+func outputExists(path string) bool {
+	if sshpath.Is(path) {
+		_, err := scanner.StatSSH(path)
+		return err == nil
+	}
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// replaceVerified moves a new output written to target over the existing
+// outputPath once it can be probed and is as long as the source. A new
+// output that fails the check is removed and the existing one kept, as it
+// is in read-only mode.
+func replaceVerified(target, outputPath string, video datatypes.VideoObject) error {
+	meta, err := scanner.FFProbe{}.Probe(target)
+	if err == nil && video.Length > 0 {
+		tolerance := max(2, video.Length/50)
+		if diff := meta.Length - video.Length; diff > tolerance || diff < -tolerance {
+			err = fmt.Errorf("it is %ds long, the source %ds", meta.Length, video.Length)
+		}
+	}
+	if err != nil {
+		removeOutput(target)
+		return fmt.Errorf("new output for %s failed verification, kept the existing one: %w", outputPath, err)
+	}
+	if err := safety.Check("replace existing output " + outputPath); err != nil {
+		removeOutput(target)
+		return err
+	}
+	if err := renameOutput(target, outputPath); err != nil {
+		return fmt.Errorf("error replacing %s: %w", outputPath, err)
+	}
+	log.Printf("Replaced existing output %s\n", outputPath)
+	return nil
+}
+
+// renameOutput moves an output over another, on its ssh host when it has one
+func renameOutput(from, to string) error {
+	if p, err := sshpath.Parse(from); err == nil {
+		dest, err := sshpath.Parse(to)
+		if err != nil {
+			return err
+		}
+		return p.Rename(dest)
+	}
+	return os.Rename(from, to)
+}
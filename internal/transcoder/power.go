@@ -0,0 +1,126 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// powerMutex makes concurrent workers share a single pause notification
+var powerMutex sync.Mutex
+
+// waitForPower blocks before a new job starts while the machine is on battery
+// or running too hot, and returns once conditions recover. Running jobs are
+// not interrupted.
+func waitForPower() {
+	settings, ok := config.GetPowerSettings()
+	if !ok {
+		return
+	}
+
+	powerMutex.Lock()
+	defer powerMutex.Unlock()
+
+	reason := powerPauseReason(settings)
+	if reason == "" {
+		return
+	}
+	message := fmt.Sprintf("Pausing new transcodes: %s", reason)
+	log.Println(message)
+	utils.NotifySummary(message)
+
+	for reason != "" {
+		time.Sleep(settings.CheckInterval)
+		settings, ok = config.GetPowerSettings()
+		if !ok {
+			break
+		}
+		reason = powerPauseReason(settings)
+	}
+	log.Println("Resuming transcodes")
+	utils.NotifySummary("Resuming transcodes")
+}
+
+// powerPauseReason returns why new jobs should wait, or "" if they can start
+func powerPauseReason(settings config.PowerSettings) string {
+	if settings.PauseOnBattery && onBattery() {
+		return "running on battery"
+	}
+	if settings.MaxCPUTemp > 0 {
+		if temp, ok := cpuTemperature(); ok && temp > settings.MaxCPUTemp {
+			return fmt.Sprintf("CPU at %.0f°C (limit %.0f°C)", temp, settings.MaxCPUTemp)
+		}
+	}
+	if settings.MaxGPUTemp > 0 {
+		if temp, ok := gpuTemperature(); ok && temp > settings.MaxGPUTemp {
+			return fmt.Sprintf("GPU at %.0f°C (limit %.0f°C)", temp, settings.MaxGPUTemp)
+		}
+	}
+	return ""
+}
+
+// onBattery reports whether the machine has a mains supply that is offline
+func onBattery() bool {
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+	for _, supply := range supplies {
+		if readSysFile(filepath.Join(supply, "type")) != "Mains" {
+			continue
+		}
+		if readSysFile(filepath.Join(supply, "online")) == "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// cpuTemperature returns the hottest thermal zone in degrees Celsius
+func cpuTemperature() (float64, bool) {
+	zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*/temp")
+	hottest, found := 0.0, false
+	for _, zone := range zones {
+		milli, err := strconv.ParseFloat(readSysFile(zone), 64)
+		if err != nil {
+			continue
+		}
+		if temp := milli / 1000; !found || temp > hottest {
+			hottest, found = temp, true
+		}
+	}
+	return hottest, found
+}
+
+// gpuTemperature returns the hottest NVIDIA GPU in degrees Celsius
+func gpuTemperature() (float64, bool) {
+	out, err := runner.Output("nvidia-smi", "--query-gpu=temperature.gpu", "--format=csv,noheader,nounits")
+	if err != nil {
+		return 0, false
+	}
+	hottest, found := 0.0, false
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		temp, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
+		if err != nil {
+			continue
+		}
+		if !found || temp > hottest {
+			hottest, found = temp, true
+		}
+	}
+	return hottest, found
+}
+
+func readSysFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,59 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+	"github.com/palzino/vidanalyser/pkg/scanner"
+)
+
+// waitForStableSource checks that a source still exists and is no longer
+// being written, as when watch mode or an *arr import picks a file up
+// mid-copy. It waits while the size or modification time keeps changing, up
+// to SOURCE_STABLE_TIMEOUT.
+func waitForStableSource(path string) error {
+	window := config.GetSourceStableFor()
+	before, err := statSource(path)
+	if err != nil {
+		return fmt.Errorf("source is missing: %w", err)
+	}
+	if window == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(config.GetSourceStableTimeout())
+	for waited := false; ; {
+		time.Sleep(window)
+		after, err := statSource(path)
+		if err != nil {
+			return fmt.Errorf("source disappeared: %w", err)
+		}
+		if after.Size() == before.Size() && after.ModTime().Equal(before.ModTime()) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("source was still being written after %s", config.GetSourceStableTimeout())
+		}
+		if !waited {
+			log.Printf("Waiting for %s to finish being written\n", path)
+			waited = true
+		}
+		before = after
+	}
+}
+
+// statSource stats a local source, or asks the host of a source at a URL or
+// on an ssh host
+func statSource(path string) (os.FileInfo, error) {
+	if pathutil.IsURL(path) {
+		return scanner.StatURL(path)
+	}
+	if sshpath.Is(path) {
+		return scanner.StatSSH(path)
+	}
+	return os.Stat(path)
+}
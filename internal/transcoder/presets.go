@@ -0,0 +1,65 @@
+package transcoder
+
+import (
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/presets"
+)
+
+// loadPreset returns the named filter preset or a not-found error
+func loadPreset(name string) (presets.Preset, error) {
+	preset, err := presets.Get(name)
+	if err != nil {
+		return presets.Preset{}, apperr.Wrap(apperr.Config, err, "error loading presets")
+	}
+	if preset == nil {
+		return presets.Preset{}, apperr.New(apperr.NotFound, "preset %s not found", name)
+	}
+	return *preset, nil
+}
+
+// ApplyPreset fills the filters opts leaves unset from the named preset
+func ApplyPreset(opts SelectionOptions, name string) (SelectionOptions, error) {
+	preset, err := loadPreset(name)
+	if err != nil {
+		return opts, err
+	}
+	if opts.MinSizeGB == 0 {
+		opts.MinSizeGB = preset.MinSizeGB
+	}
+	if opts.MinBitrate == 0 {
+		opts.MinBitrate = preset.MinBitrate
+	}
+	if opts.MinBPP == 0 {
+		opts.MinBPP = preset.MinBPP
+	}
+	if opts.MinDuration == 0 {
+		opts.MinDuration = preset.MinDuration
+	}
+	if opts.InputRes == "" {
+		opts.InputRes = preset.InputRes
+	}
+	if len(opts.Codecs) == 0 {
+		opts.Codecs = preset.Codecs
+	}
+	with, without, err := preset.StreamMatches()
+	if err != nil {
+		return opts, apperr.Wrap(apperr.Config, err, "invalid preset "+name)
+	}
+	if len(opts.WithStreams) == 0 {
+		opts.WithStreams = with
+	}
+	if len(opts.WithoutStreams) == 0 {
+		opts.WithoutStreams = without
+	}
+	return opts, nil
+}
+
+// matchesCodecs reports whether the video is in one of codecs. Videos whose
+// codec was not recorded by a scan are only probed when codecs is not empty.
+func matchesCodecs(video datatypes.VideoObject, codecs []string) bool {
+	if len(codecs) == 0 {
+		return true
+	}
+	return presets.Preset{Codecs: codecs}.MatchesCodec(recordedCodec(video))
+}
@@ -0,0 +1,118 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShowProgress enables the live progress display; --no-progress turns it off
+var ShowProgress = true
+
+// trackProgress registers a running job so it is shown and reported
+func trackProgress(key string) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	if _, exists := progressMap[key]; !exists {
+		progressMap[key] = &Progress{}
+		progressKeys = append(progressKeys, key) // Maintain order
+	}
+}
+
+// untrackProgress forgets a finished job, including its metrics
+func untrackProgress(key string) {
+	progressMutex.Lock()
+	delete(progressMap, key)
+	for i, existing := range progressKeys {
+		if existing == key {
+			progressKeys = append(progressKeys[:i], progressKeys[i+1:]...)
+			break
+		}
+	}
+	progressMutex.Unlock()
+
+	transcodingProgress.DeleteLabelValues(key)
+	transcodingDuration.DeleteLabelValues(key)
+	transcodingRemaining.DeleteLabelValues(key)
+}
+
+// progressLines renders one compact line per running job
+func progressLines() []string {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	lines := make([]string, 0, len(progressKeys))
+	for _, key := range progressKeys {
+		if progress, exists := progressMap[key]; exists {
+			lines = append(lines, fmt.Sprintf("%-50.50s %6.2f%%  elapsed %-9s remaining %s",
+				filepath.Base(key), progress.Percentage, progress.Elapsed.Truncate(time.Second), progress.Remaining.Truncate(time.Second)))
+		}
+	}
+	return lines
+}
+
+// DisplayProgress shows running jobs until the returned stop function is
+// called. In the foreground the lines are redrawn in place; in the background
+// they are written to the log once a minute. It does nothing when
+// ShowProgress is false.
+func DisplayProgress(background bool) func() {
+	if !ShowProgress {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		interval := time.Second
+		if background {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		drawn := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			lines := progressLines()
+			if background {
+				for _, line := range lines {
+					log.Println(line)
+				}
+				continue
+			}
+
+			// Move back over the previous frame and clear it line by line
+			var frame strings.Builder
+			if drawn > 0 {
+				fmt.Fprintf(&frame, "\033[%dA", drawn)
+			}
+			for _, line := range lines {
+				frame.WriteString("\033[2K" + line + "\n")
+			}
+			for i := len(lines); i < drawn; i++ {
+				frame.WriteString("\033[2K\n")
+			}
+			if extra := drawn - len(lines); extra > 0 {
+				fmt.Fprintf(&frame, "\033[%dA", extra)
+			}
+			fmt.Print(frame.String())
+			drawn = len(lines)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	projectPercentComplete = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "project_percent_complete",
+			Help: "Share of a migration project's files already in the target codec.",
+		},
+		[]string{"project"},
+	)
+	projectRemainingBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "project_remaining_bytes",
+			Help: "Bytes of a migration project's files still to convert.",
+		},
+		[]string{"project"},
+	)
+	projectRemainingFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "project_remaining_files",
+			Help: "Number of a migration project's files still to convert.",
+		},
+		[]string{"project"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(projectPercentComplete)
+	prometheus.MustRegister(projectRemainingBytes)
+	prometheus.MustRegister(projectRemainingFiles)
+}
+
+// ErrUnknownProject is returned for a project name that is not recorded
+var ErrUnknownProject = errors.New("unknown project")
+
+// codecAliases maps common encoder and marketing names to ffprobe codec names
+var codecAliases = map[string]string{
+	"h265":  "hevc",
+	"x265":  "hevc",
+	"h.265": "hevc",
+	"x264":  "h264",
+	"h.264": "h264",
+	"avc":   "h264",
+}
+
+// normalizeCodec returns the ffprobe name for a codec, e.g. hevc for H.265
+func normalizeCodec(codec string) string {
+	codec = strings.ToLower(strings.TrimSpace(codec))
+	if alias, ok := codecAliases[codec]; ok {
+		return alias
+	}
+	return codec
+}
+
+// CreateProject starts tracking the migration of the library, or of
+// directory, to codec
+func CreateProject(name, codec, directory string) error {
+	if name == "" || codec == "" {
+		return fmt.Errorf("a project needs a name and a target codec")
+	}
+	existing, err := db.QueryProject(name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("project %s already exists", name)
+	}
+	project := datatypes.Project{Name: name, Codec: normalizeCodec(codec), Directory: directory}
+	if _, err := db.CreateProject(project); err != nil {
+		return err
+	}
+	fmt.Printf("Created project %s: migrate %s to %s\n", name, projectScope(project), project.Codec)
+	return nil
+}
+
+// projectScope describes what a project covers
+func projectScope(project datatypes.Project) string {
+	if project.Directory == "" {
+		return "the library"
+	}
+	return project.Directory
+}
+
+// ProbeMissingCodecs probes and records the codec of every video matching
+// filter, codecs aside, whose codec was not recorded when it was scanned
+func ProbeMissingCodecs(filter db.VideoFilter) error {
+	paths, err := db.QueryUnprobedPaths(filter)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	log.Printf("Probing the codec of %d file(s)\n", len(paths))
+
+	codecs := make([]string, len(paths))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				codecs[i] = VideoCodec(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i, path := range paths {
+		// Files that cannot be probed are retried next time
+		if codecs[i] == "" {
+			continue
+		}
+		if err := db.SetVideoCodec(path, codecs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// projectStatus measures a project's progress, optionally probing the codecs
+// not yet recorded and recording it as a burn-down snapshot, and updates its
+// Prometheus gauges. Unprobed files count as not yet converted.
+func projectStatus(project datatypes.Project, record, probe bool) (datatypes.ProjectStatus, error) {
+	status := datatypes.ProjectStatus{Project: project}
+	filter := db.VideoFilter{Directory: project.Directory, Recursive: true}
+	if probe {
+		if err := ProbeMissingCodecs(filter); err != nil {
+			return status, err
+		}
+	}
+	current, err := db.AggregateProject(filter, project.Codec)
+	if err != nil {
+		return status, err
+	}
+	current.TakenAt = time.Now()
+	status.Current = current
+	if current.Files > 0 {
+		status.PercentComplete = 100 * float64(current.DoneFiles) / float64(current.Files)
+	}
+
+	if record {
+		if err := db.InsertProjectSnapshot(project.ID, current); err != nil {
+			return status, err
+		}
+	}
+	if status.Burndown, err = db.QueryProjectBurndown(project.ID); err != nil {
+		return status, err
+	}
+	status.ETA = projectETA(status.Burndown, current)
+
+	projectPercentComplete.WithLabelValues(project.Name).Set(status.PercentComplete)
+	projectRemainingBytes.WithLabelValues(project.Name).Set(float64(current.RemainingSize))
+	projectRemainingFiles.WithLabelValues(project.Name).Set(float64(current.Files - current.DoneFiles))
+	return status, nil
+}
+
+// projectETA extrapolates when nothing will remain from the rate the remaining
+// bytes fell since the first snapshot, or nil while there is no progress to go on
+func projectETA(burndown []datatypes.ProjectSnapshot, current datatypes.ProjectSnapshot) *time.Time {
+	if len(burndown) == 0 || current.RemainingSize == 0 {
+		return nil
+	}
+	first := burndown[0]
+	elapsed := current.TakenAt.Sub(first.TakenAt)
+	converted := first.RemainingSize - current.RemainingSize
+	if elapsed <= 0 || converted <= 0 {
+		return nil
+	}
+	rate := float64(converted) / elapsed.Seconds()
+	eta := current.TakenAt.Add(time.Duration(float64(current.RemainingSize)/rate) * time.Second)
+	return &eta
+}
+
+// ProjectStatuses measures every project, or only the named one
+func ProjectStatuses(name string, record, probe bool) ([]datatypes.ProjectStatus, error) {
+	projects, err := db.QueryProjects()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []datatypes.ProjectStatus{}
+	for _, project := range projects {
+		if name != "" && project.Name != name {
+			continue
+		}
+		status, err := projectStatus(project, record, probe)
+		if err != nil {
+			return nil, fmt.Errorf("error measuring project %s: %w", project.Name, err)
+		}
+		statuses = append(statuses, status)
+	}
+	if name != "" && len(statuses) == 0 {
+		return nil, fmt.Errorf("%w %s", ErrUnknownProject, name)
+	}
+	return statuses, nil
+}
+
+// SnapshotProjects records the progress of every project, for SCHEDULE_PROJECTS
+func SnapshotProjects() error {
+	_, err := ProjectStatuses("", true, true)
+	return err
+}
+
+// ShowProjectStatus prints the progress and burn-down of every project, or only the named one
+func ShowProjectStatus(name string) error {
+	statuses, err := ProjectStatuses(name, true, true)
+	if err != nil {
+		return err
+	}
+	if output.JSON() {
+		return output.Print(statuses)
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No projects yet. Create one with: project create <name> --codec hevc [--dir path]")
+		return nil
+	}
+
+	for i, status := range statuses {
+		if i > 0 {
+			fmt.Println()
+		}
+		current := status.Current
+		fmt.Printf("%s: migrate %s to %s\n", status.Project.Name, projectScope(status.Project), status.Project.Codec)
+		fmt.Printf("  %.1f%% complete, %d/%d files, %s of %s remaining\n", status.PercentComplete,
+			current.DoneFiles, current.Files, units.Bytes(current.RemainingSize), units.Bytes(current.Size))
+		if status.ETA != nil {
+			fmt.Printf("  At the current rate, done around %s\n", status.ETA.Format("2006-01-02"))
+		}
+		if len(status.Burndown) > 1 {
+			fmt.Println("  Burn-down:")
+			for _, snapshot := range status.Burndown {
+				fmt.Printf("    %s  %6d files  %10s remaining\n", snapshot.TakenAt.Format("2006-01-02"),
+					snapshot.Files-snapshot.DoneFiles, units.Bytes(snapshot.RemainingSize))
+			}
+		}
+	}
+	return nil
+}
+
+// ShowProjects lists the projects without measuring them
+func ShowProjects() error {
+	projects, err := db.QueryProjects()
+	if err != nil {
+		return err
+	}
+	if output.JSON() {
+		return output.Print(projects)
+	}
+	if len(projects) == 0 {
+		fmt.Println("No projects yet.")
+	}
+	for _, project := range projects {
+		fmt.Printf("%s: migrate %s to %s (since %s)\n", project.Name, projectScope(project), project.Codec,
+			project.CreatedAt.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// DeleteProject stops tracking a project and drops its burn-down history
+func DeleteProject(name string) error {
+	deleted, err := db.DeleteProject(name)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("%w %s", ErrUnknownProject, name)
+	}
+	projectPercentComplete.DeleteLabelValues(name)
+	projectRemainingBytes.DeleteLabelValues(name)
+	projectRemainingFiles.DeleteLabelValues(name)
+	fmt.Printf("Deleted project %s\n", name)
+	return nil
+}
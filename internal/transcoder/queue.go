@@ -0,0 +1,64 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/pkg/client"
+)
+
+// QueueStatus is the job queue of a transcode server together with live progress
+type QueueStatus struct {
+	Server   string                  `json:"server"`
+	Jobs     []datatypes.Job         `json:"jobs"`
+	Progress []datatypes.JobProgress `json:"progress"`
+}
+
+// serverCategory classifies an error from a transcode server: a resource
+// the server does not have is NotFound, and an unreachable or failing
+// server Internal
+func serverCategory(err error) apperr.Category {
+	var status *client.StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusNotFound {
+		return apperr.NotFound
+	}
+	return apperr.Internal
+}
+
+// ShowQueue prints the jobs and running progress of the transcode server at addr
+func ShowQueue(addr string) error {
+	c := client.New(addr)
+	jobs, err := c.ListJobs()
+	if err != nil {
+		return apperr.Wrap(serverCategory(err), err, "error reading queue")
+	}
+	progress, err := c.GetProgress()
+	if err != nil {
+		return apperr.Wrap(serverCategory(err), err, "error reading queue")
+	}
+
+	status := QueueStatus{Server: addr, Jobs: jobs, Progress: progress}
+	if output.JSON() {
+		return output.Print(status)
+	}
+
+	if len(jobs) == 0 {
+		fmt.Printf("No jobs on %s.\n", addr)
+		return nil
+	}
+	for _, job := range jobs {
+		line := fmt.Sprintf("#%d %-9s %s", job.ID, job.Status, job.Video.FullFilePath)
+		if job.Error != "" {
+			line += " | " + job.Error
+		}
+		fmt.Println(line)
+	}
+	for _, p := range progress {
+		fmt.Printf("%s | Progress: %.2f%% | Elapsed: %ds | Remaining: %ds\n", p.File, p.Percentage, p.ElapsedSeconds, p.RemainingSeconds)
+	}
+	return nil
+}
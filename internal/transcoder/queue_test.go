@@ -0,0 +1,29 @@
+package transcoder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+)
+
+func TestShowQueueCategorisesServerErrors(t *testing.T) {
+	for status, want := range map[int]apperr.Category{
+		http.StatusNotFound:            apperr.NotFound,
+		http.StatusInternalServerError: apperr.Internal,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "failing", status)
+		}))
+		err := ShowQueue(server.URL)
+		server.Close()
+		if got := apperr.CategoryOf(err); got != want {
+			t.Errorf("status %d: got category %s (%v), want %s", status, got, err, want)
+		}
+	}
+
+	if got := apperr.CategoryOf(ShowQueue("127.0.0.1:1")); got != apperr.Internal {
+		t.Errorf("unreachable server: got category %s, want %s", got, apperr.Internal)
+	}
+}
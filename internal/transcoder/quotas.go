@@ -0,0 +1,322 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/quotas"
+	"github.com/palzino/vidanalyser/internal/safety"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// quotaJobTag labels the transcodes queued to bring a directory under its quota
+const quotaJobTag = "quota"
+
+// quotaJobs tracks the background runs of queued quota transcodes
+var quotaJobs sync.WaitGroup
+
+// QuotaFile is a file picked to bring a directory back under its quota
+type QuotaFile struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	ExpectedSize int64  `json:"expected_size"` // 0 for files flagged for deletion
+	// Already flagged, or with a transcode queued or running, by an earlier run
+	Pending bool `json:"pending,omitempty"`
+}
+
+// QuotaPlan is how far a directory is over its quota and the files picked to
+// bring it back under
+type QuotaPlan struct {
+	Quota      quotas.Quota `json:"quota"`
+	Used       int64        `json:"used"`  // Bytes recorded under the path
+	Over       int64        `json:"over"`  // Bytes above the quota, 0 when under
+	Freed      int64        `json:"freed"` // Bytes the picked files are expected to free
+	Files      []QuotaFile  `json:"files"`
+	NotifiedAt *time.Time   `json:"notified_at,omitempty"`
+}
+
+// Short reports whether the picked files are not expected to bring the
+// directory back under its quota
+func (p QuotaPlan) Short() bool {
+	return p.Freed < p.Over
+}
+
+// newFiles returns the picked files no earlier run has acted on
+func (p QuotaPlan) newFiles() []QuotaFile {
+	var files []QuotaFile
+	for _, file := range p.Files {
+		if !file.Pending {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// describe summarises the plan for a notification
+func (p QuotaPlan) describe() string {
+	action := "transcoding %d file(s) with " + p.Quota.Profile
+	if p.Quota.Flags() {
+		action = "flagging %d file(s) for deletion"
+	}
+	message := fmt.Sprintf("%s holds %s, %s over its %g GB quota; "+action+" should free %s.",
+		p.Quota.Path, units.Bytes(p.Used), units.Bytes(p.Over), p.Quota.MaxGB, len(p.newFiles()), units.Bytes(p.Freed))
+	if pending := len(p.Files) - len(p.newFiles()); pending > 0 {
+		message += fmt.Sprintf(" That includes %d file(s) already acted on.", pending)
+	}
+	if p.Short() {
+		message += " That is not enough to get back under the quota."
+	}
+	return message
+}
+
+// planQuota measures a quota's directory and, when it is over, picks the
+// files expected to save the most until it would be back under. Files an
+// earlier run already flagged, or queued a transcode for, count first as
+// pending, so they are neither picked again nor made up for with more files.
+// Hard links, symbolic links and outputs of earlier transcodes are never picked.
+func planQuota(quota quotas.Quota) (QuotaPlan, error) {
+	plan := QuotaPlan{Quota: quota, Files: []QuotaFile{}}
+	filter := db.VideoFilter{Directory: quota.Path, Recursive: true}
+	totals, err := db.AggregateVideos(filter)
+	if err != nil {
+		return plan, err
+	}
+	plan.Used = totals.Size
+	if plan.NotifiedAt, err = db.QueryQuotaNotice(quota.Path); err != nil {
+		return plan, err
+	}
+	if plan.Used <= quota.Limit() {
+		return plan, nil
+	}
+	plan.Over = plan.Used - quota.Limit()
+
+	videos, err := db.QueryFilteredVideos(filter)
+	if err != nil {
+		return plan, err
+	}
+	flagged := pathutil.NewSet()
+	if quota.Flags() {
+		tagged, err := db.QueryFilteredVideos(db.VideoFilter{Directory: quota.Path, Recursive: true, Tags: []string{quotas.DeleteTag}})
+		if err != nil {
+			return plan, err
+		}
+		for _, video := range tagged {
+			flagged.Add(video.FullFilePath)
+		}
+	}
+	pending := func(path string) bool {
+		return flagged.Has(path) || hasActiveJob(path)
+	}
+	var candidates []datatypes.VideoObject
+	for _, video := range videos {
+		if video.LinkTarget != "" || video.Links > 1 {
+			continue
+		}
+		if !quota.Flags() && video.SourcePath != "" {
+			continue
+		}
+		candidates = append(candidates, video)
+	}
+
+	var picks []QuotaFile
+	if quota.Flags() {
+		for _, video := range candidates {
+			picks = append(picks, QuotaFile{Path: video.FullFilePath, Size: int64(video.Size), Pending: pending(video.FullFilePath)})
+		}
+	} else {
+		profile, err := profiles.Get(quota.Profile)
+		if err != nil {
+			return plan, err
+		}
+		if profile == nil {
+			return plan, fmt.Errorf("quota %s names unknown profile %s", quota.Path, quota.Profile)
+		}
+		var eligible []datatypes.VideoObject
+		for _, video := range candidates {
+			if excludedBy(*profile, video) == "" {
+				eligible = append(eligible, video)
+			}
+		}
+		for _, estimate := range estimateOutputs(eligible, profile.Resolution, profile.Bitrate, profile.Name) {
+			if !estimate.Low && estimate.ExpectedSize < int64(estimate.Video.Size) {
+				picks = append(picks, QuotaFile{Path: estimate.Video.FullFilePath, Size: int64(estimate.Video.Size),
+					ExpectedSize: estimate.ExpectedSize, Pending: pending(estimate.Video.FullFilePath)})
+			}
+		}
+	}
+	sort.SliceStable(picks, func(i, j int) bool {
+		if picks[i].Pending != picks[j].Pending {
+			return picks[i].Pending
+		}
+		return picks[i].Size-picks[i].ExpectedSize > picks[j].Size-picks[j].ExpectedSize
+	})
+	for _, pick := range picks {
+		if plan.Freed >= plan.Over && !pick.Pending {
+			break
+		}
+		plan.Files = append(plan.Files, pick)
+		plan.Freed += pick.Size - pick.ExpectedSize
+	}
+	return plan, nil
+}
+
+// EnforceQuotas checks every quota. The first time a directory is found over
+// its quota the plan is sent as a notification; once QUOTA_GRACE has passed
+// and it is still over, the picked files are queued for transcoding,
+// replacing their originals, or tagged quota-delete for someone to delete.
+// The notice is kept until the directory is back under, so later runs only
+// act on files no earlier run did. Transcoding is refused in read-only mode.
+func EnforceQuotas() error {
+	list, err := quotas.Load()
+	if err != nil {
+		return err
+	}
+	var failed error
+	for _, quota := range list {
+		if err := enforceQuota(quota, time.Now()); err != nil {
+			log.Printf("Error enforcing quota on %s: %s\n", quota.Path, err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// enforceQuota notifies about or acts on one quota
+func enforceQuota(quota quotas.Quota, now time.Time) error {
+	plan, err := planQuota(quota)
+	if err != nil {
+		return err
+	}
+	if plan.Over == 0 {
+		if plan.NotifiedAt != nil {
+			log.Printf("%s is back under its quota\n", quota.Path)
+		}
+		return db.ClearQuotaNotice(quota.Path)
+	}
+	grace := config.GetQuotaGrace()
+	if plan.NotifiedAt == nil {
+		utils.NotifySummary(fmt.Sprintf("%s Acting in %s unless it is back under its quota by then.", plan.describe(), grace))
+		if err := db.RecordQuotaNotice(quota.Path, now); err != nil {
+			return err
+		}
+		plan.NotifiedAt = &now
+	}
+	if now.Sub(*plan.NotifiedAt) < grace {
+		return nil
+	}
+	files := plan.newFiles()
+	if len(files) == 0 {
+		return nil
+	}
+
+	if quota.Flags() {
+		for _, file := range files {
+			if _, err := db.TagVideos(file.Path, []string{quotas.DeleteTag}); err != nil {
+				return err
+			}
+		}
+		utils.NotifySummary(fmt.Sprintf("Flagged %d file(s) under %s for deletion, see 'tags' for %s", len(files), quota.Path, quotas.DeleteTag))
+	} else {
+		// Quota transcodes replace their originals, which read-only mode refuses
+		if err := safety.Check("enforce quota on " + quota.Path); err != nil {
+			return err
+		}
+		profile, err := profiles.Get(quota.Profile)
+		if err != nil || profile == nil {
+			return fmt.Errorf("quota %s names unknown profile %s", quota.Path, quota.Profile)
+		}
+		var queued []datatypes.Job
+		for _, file := range files {
+			video, err := db.QueryVideoByPath(file.Path)
+			if err != nil || video == nil {
+				log.Printf("Skipping %s, no longer recorded\n", file.Path)
+				continue
+			}
+			job := addJob(datatypes.TranscodeRequest{
+				Video:      *video,
+				Resolution: profile.Resolution,
+				Bitrate:    profile.Bitrate,
+				AutoDelete: true,
+				Profile:    profile.Name,
+				Tags:       []string{quotaJobTag},
+			}, nil)
+			log.Printf("Queued %s with profile %s (quota on %s) as job %d\n", file.Path, profile.Name, quota.Path, job.ID)
+			queued = append(queued, job)
+		}
+		utils.NotifySummary(fmt.Sprintf("Queued %d transcode(s) with %s to bring %s under its quota", len(queued), profile.Name, quota.Path))
+		// The jobs run one at a time in the background, each still waiting for
+		// its device slot and the throttles, so a full directory cannot flood
+		// the server or hold up the other maintenance tasks
+		quotaJobs.Add(1)
+		go func() {
+			defer quotaJobs.Done()
+			for _, job := range queued {
+				runJob(job)
+			}
+		}()
+	}
+	return nil
+}
+
+// WaitForQuotaJobs blocks until the transcodes queued by EnforceQuotas have
+// run, for the CLI, which would otherwise exit before they start
+func WaitForQuotaJobs() {
+	quotaJobs.Wait()
+}
+
+// ShowQuotas lists the quotas with how full their directories are and, as a
+// dry run, the files that would be transcoded or flagged
+func ShowQuotas() error {
+	list, err := quotas.Load()
+	if err != nil {
+		return apperr.Wrap(apperr.Config, err, "error loading quotas")
+	}
+	plans := []QuotaPlan{}
+	for _, quota := range list {
+		plan, err := planQuota(quota)
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error checking quota on "+quota.Path)
+		}
+		plans = append(plans, plan)
+	}
+	if output.JSON() {
+		return output.Print(plans)
+	}
+
+	if len(plans) == 0 {
+		fmt.Printf("No quotas in %s\n", config.GetQuotasFile())
+	}
+	for _, plan := range plans {
+		fmt.Printf("%s: %s used\n", plan.Quota.Describe(), units.Bytes(plan.Used))
+		if plan.Over == 0 {
+			continue
+		}
+		fmt.Printf("  %s\n", plan.describe())
+		if plan.NotifiedAt != nil {
+			fmt.Printf("  Notified %s\n", plan.NotifiedAt.Local().Format("2006-01-02 15:04"))
+		}
+		for _, file := range plan.Files {
+			pending := ""
+			if file.Pending {
+				pending = ", pending"
+			}
+			if plan.Quota.Flags() {
+				fmt.Printf("  %s (%s%s)\n", file.Path, units.Bytes(file.Size), pending)
+			} else {
+				fmt.Printf("  %s (%s -> %s%s)\n", file.Path, units.Bytes(file.Size), units.Bytes(file.ExpectedSize), pending)
+			}
+		}
+	}
+	return nil
+}
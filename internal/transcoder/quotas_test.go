@@ -0,0 +1,103 @@
+package transcoder
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/quotas"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/safety"
+)
+
+// useSmallProfile points PROFILES_FILE at a file defining the profile "small"
+func useSmallProfile(t *testing.T) {
+	t.Helper()
+	profilesFile := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(profilesFile, []byte(`[{"name": "small", "resolution": "1280x720", "bitrate": 1000}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PROFILES_FILE", profilesFile)
+}
+
+func TestEnforceQuotaReplacesOriginals(t *testing.T) {
+	openTestDatabase(t)
+	useSmallProfile(t)
+	dir := t.TempDir()
+	t.Setenv("QUOTA_GRACE", "0s")
+	t.Setenv("SOURCE_STABLE_FOR", "0s")
+	t.Setenv("HARDWARE_ACCEL", "cpu")
+
+	library := filepath.Join(dir, "kids")
+	if err := os.Mkdir(library, 0755); err != nil {
+		t.Fatal(err)
+	}
+	original := filepath.Join(library, "film.mkv")
+	if err := os.WriteFile(original, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	video := datatypes.VideoObject{Name: "film.mkv", Location: library, FullFilePath: original, Size: 1 << 30,
+		Width: 1920, Height: 1080, Length: 600, Bitrate: 14000000, Framerate: 25, FileExtension: ".mkv"}
+	if err := db.InsertVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	// ffmpeg writes a small encode to the path it is given last
+	fake := &runner.Fake{Respond: func(name string, args []string) ([]byte, error) {
+		if name == "ffmpeg" && len(args) > 1 {
+			return nil, os.WriteFile(strings.TrimPrefix(args[len(args)-1], "file:"), []byte("encoded"), 0644)
+		}
+		return []byte("{}"), nil
+	}}
+	defer runner.Use(fake)()
+
+	quota := quotas.Quota{Path: library, MaxGB: 0.5, Profile: "small"}
+	if err := enforceQuota(quota, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	WaitForQuotaJobs()
+
+	if _, err := os.Stat(original); !os.IsNotExist(err) {
+		t.Errorf("original %s was kept after its replacement was encoded", original)
+	}
+	transcodes, err := db.QueryFilteredVideos(db.VideoFilter{Directory: library, Recursive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcodes) != 1 || transcodes[0].FullFilePath == original || transcodes[0].SourcePath != original {
+		t.Errorf("library records %+v, want only the transcode of %s", transcodes, original)
+	}
+}
+
+func TestEnforceQuotaRefusesReplacingInReadOnlyMode(t *testing.T) {
+	openTestDatabase(t)
+	useSmallProfile(t)
+	t.Setenv("READ_ONLY", "true")
+	t.Setenv("QUOTA_GRACE", "0s")
+	fake := &runner.Fake{}
+	defer runner.Use(fake)()
+	library := t.TempDir()
+	video := datatypes.VideoObject{Name: "film.mkv", Location: library, FullFilePath: filepath.Join(library, "film.mkv"), Size: 1 << 30, FileExtension: ".mkv"}
+	if err := db.InsertVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	quota := quotas.Quota{Path: library, MaxGB: 0.5, Profile: "small"}
+	if err := enforceQuota(quota, time.Now()); !errors.Is(err, safety.ErrReadOnly) {
+		t.Errorf("enforceQuota returned %v in read-only mode, want it refused", err)
+	}
+	WaitForQuotaJobs()
+	for _, call := range fake.Calls() {
+		if call[0] == "ffmpeg" {
+			t.Errorf("ran %v in read-only mode", call)
+		}
+	}
+	if recorded, err := db.QueryVideoByPath(video.FullFilePath); err != nil || recorded == nil {
+		t.Errorf("original record was dropped in read-only mode: %v", err)
+	}
+}
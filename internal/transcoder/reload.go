@@ -0,0 +1,86 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/profiles"
+)
+
+// reloadMutex stops a SIGHUP and an API reload from interleaving
+var reloadMutex sync.Mutex
+
+// Reload re-reads the config file and profiles. Settings are read when they
+// are used, so running jobs keep the values they started with and new jobs,
+// notifications and coordinator runs pick up the changes.
+func Reload() (datatypes.ReloadResult, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if err := config.Reload(); err != nil {
+		return datatypes.ReloadResult{}, err
+	}
+	profiles.Refresh()
+	list, err := profiles.Load()
+	if err != nil {
+		return datatypes.ReloadResult{}, err
+	}
+	for _, profile := range list {
+		if err := profile.Validate(); err != nil {
+			return datatypes.ReloadResult{}, err
+		}
+	}
+
+	workers, err := config.GetWorkers()
+	if err != nil && !errors.Is(err, config.ErrNoWorkers) {
+		return datatypes.ReloadResult{}, err
+	}
+
+	result := datatypes.ReloadResult{
+		Profiles:   len(list),
+		Workers:    len(workers),
+		ReloadedAt: time.Now(),
+	}
+	log.Printf("Configuration reloaded: %d profiles, %d workers\n", result.Profiles, result.Workers)
+	return result, nil
+}
+
+// handleReload reloads the configuration on POST /config/reload
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method. Only POST is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := Reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reloading configuration: %s", err), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Serve runs the transcode server as a daemon and reloads the configuration
+// whenever the process receives SIGHUP.
+func Serve() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if _, err := Reload(); err != nil {
+				log.Printf("Error reloading configuration: %s\n", err)
+			}
+		}
+	}()
+	TranscodeServer()
+}
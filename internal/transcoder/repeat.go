@@ -0,0 +1,41 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+)
+
+// lastSelectionFile keeps the criteria of the last interactive selection
+const lastSelectionFile = "last_selection.json"
+
+// saveLastSelection remembers interactive criteria for transcode --repeat-last.
+// Failing to save only costs the shortcut, so it is reported and ignored.
+func saveLastSelection(opts SelectionOptions) {
+	data, err := json.MarshalIndent(opts, "", "  ")
+	if err == nil {
+		err = os.WriteFile(lastSelectionFile, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Printf("Error saving selection for --repeat-last: %s\n", err)
+	}
+}
+
+// LoadLastSelection returns the criteria of the last interactive selection,
+// to be run again against the current contents of the database
+func LoadLastSelection() (SelectionOptions, error) {
+	var opts SelectionOptions
+	data, err := os.ReadFile(lastSelectionFile)
+	if os.IsNotExist(err) {
+		return opts, apperr.New(apperr.NotFound, "no previous selection, run transcode foreground first")
+	}
+	if err != nil {
+		return opts, apperr.Wrap(apperr.Config, err, "error reading last selection")
+	}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return opts, apperr.Wrap(apperr.Config, err, "error decoding last selection")
+	}
+	return opts, nil
+}
@@ -0,0 +1,122 @@
+package transcoder
+
+import (
+	"fmt"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// RetranscodeCandidate is a past output expected to shrink enough under a
+// profile's current settings to be worth encoding again
+type RetranscodeCandidate struct {
+	Output       string  `json:"output"`
+	Source       string  `json:"source"` // The original when it is still recorded, otherwise the output itself
+	OldProfile   string  `json:"old_profile,omitempty"`
+	Profile      string  `json:"profile"`
+	Size         int64   `json:"size"`          // Bytes of the current output
+	ExpectedSize int64   `json:"expected_size"` // Bytes
+	SavingsPct   float64 `json:"savings_pct"`
+}
+
+// FindRetranscodes lists the outputs that would save at least minSavings
+// percent of their size if encoded again. With profileName every output is
+// judged against that profile; without it each output is judged against the
+// current settings of the profile it was made with, and outputs whose profile
+// still has the same resolution and bitrate are left out.
+func FindRetranscodes(profileName string, minSavings float64) ([]RetranscodeCandidate, error) {
+	var target *profiles.Profile
+	if profileName != "" {
+		profile, err := profiles.Get(profileName)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.Config, err, "error loading profiles")
+		}
+		if profile == nil {
+			return nil, apperr.New(apperr.NotFound, "profile %s not found", profileName)
+		}
+		target = profile
+	}
+	transcodes, err := db.QueryLiveTranscodes()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.Database, err, "error querying past transcodes")
+	}
+
+	candidates := []RetranscodeCandidate{}
+	for _, t := range transcodes {
+		profile := target
+		if profile == nil {
+			if t.Profile == "" {
+				continue
+			}
+			if profile, err = profiles.Get(t.Profile); err != nil || profile == nil {
+				continue
+			}
+			if profile.Resolution == t.NewRES && (profile.Bitrate == t.NewBitrate || profile.Bitrate == profiles.AutoBitrate) {
+				continue
+			}
+		}
+		video, err := db.QueryVideoByPath(t.TranscodedPath)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.Database, err, "error querying output")
+		}
+		if video == nil || excludedBy(*profile, *video) != "" {
+			continue
+		}
+		estimate := estimateOutputs([]datatypes.VideoObject{*video}, profile.Resolution, profile.Bitrate, profile.Name)[0]
+		if estimate.SavingsPct < minSavings {
+			continue
+		}
+		source := t.TranscodedPath
+		if original, err := db.QueryVideoByPath(t.OriginalVideoPath); err == nil && original != nil {
+			source = original.FullFilePath
+		}
+		candidates = append(candidates, RetranscodeCandidate{
+			Output:       t.TranscodedPath,
+			Source:       source,
+			OldProfile:   t.Profile,
+			Profile:      profile.Name,
+			Size:         int64(video.Size),
+			ExpectedSize: estimate.ExpectedSize,
+			SavingsPct:   estimate.SavingsPct,
+		})
+	}
+	return candidates, nil
+}
+
+// ShowRetranscodes prints the outputs worth encoding again. A negative
+// minSavings uses RETRANSCODE_MIN_SAVINGS.
+func ShowRetranscodes(profileName string, minSavings float64) error {
+	if minSavings < 0 {
+		minSavings = config.GetRetranscodeMinSavings()
+	}
+	candidates, err := FindRetranscodes(profileName, minSavings)
+	if err != nil {
+		return err
+	}
+	if output.JSON() {
+		return output.Print(candidates)
+	}
+	if len(candidates) == 0 {
+		fmt.Printf("No past outputs would save %g%% or more.\n", minSavings)
+		return nil
+	}
+
+	var size, expected int64
+	for _, candidate := range candidates {
+		from := candidate.Profile
+		if candidate.OldProfile != "" && candidate.OldProfile != candidate.Profile {
+			from = candidate.OldProfile + " -> " + candidate.Profile
+		}
+		fmt.Printf("%s | %s | %s -> %s (%.0f%% saved)\n", candidate.Output, from,
+			units.Bytes(candidate.Size), units.Bytes(candidate.ExpectedSize), candidate.SavingsPct)
+		size += candidate.Size
+		expected += candidate.ExpectedSize
+	}
+	fmt.Printf("%d output(s) worth re-encoding, %s -> %s.\n", len(candidates), units.Bytes(size), units.Bytes(expected))
+	return nil
+}
@@ -0,0 +1,154 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/rules"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// matchesRule reports whether the video meets every condition of the rule.
+// The HDR probe and tag lookup only run for rules that ask about them.
+func matchesRule(rule rules.Rule, video datatypes.VideoObject) bool {
+	if rule.InputRes != "" && !shouldTranscode(video.Width, video.Height, rule.InputRes) {
+		return false
+	}
+	if units.GB(int64(video.Size)) < rule.MinSizeGB || !exceedsBitrate(video, rule.MinBitrate) {
+		return false
+	}
+	if !matchesCodecs(video, rule.Codecs) {
+		return false
+	}
+	if len(rule.Tags) > 0 && !hasTags(video.FullFilePath, rule.Tags) {
+		return false
+	}
+	if rule.HDR != nil {
+		hdr, err := probeHDR(video.FullFilePath)
+		if err != nil {
+			log.Printf("Treating %s as SDR: %s\n", video.FullFilePath, err)
+		}
+		if hdr.hdr() != *rule.HDR {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTags reports whether the file carries every one of tags; a failed
+// lookup counts as untagged
+func hasTags(path string, tags []string) bool {
+	carried, err := db.QueryFileTags(path)
+	if err != nil {
+		log.Printf("Treating %s as untagged: %s\n", path, err)
+		return false
+	}
+	for _, tag := range tags {
+		if !slices.Contains(carried, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRule returns the first rule the video matches, or the RULES_DEFAULT fall-through
+func matchRule(list []rules.Rule, video datatypes.VideoObject) rules.Rule {
+	for _, rule := range list {
+		if matchesRule(rule, video) {
+			return rule
+		}
+	}
+	return rules.Fallthrough()
+}
+
+// QueueByRules queues each video on this server with the profile of the
+// first rule it matches, leaving ignored and excluded videos alone. It
+// returns the number of jobs queued.
+func QueueByRules(videos []datatypes.VideoObject) (int, error) {
+	list, err := rules.Load()
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for _, video := range videos {
+		rule := matchRule(list, video)
+		if rule.Ignores() {
+			log.Printf("Ignoring %s (rule %s)\n", video.FullFilePath, rule.Name)
+			continue
+		}
+		profile, err := profiles.Get(rule.Profile)
+		if err != nil || profile == nil {
+			log.Printf("Rule %s names unknown profile %s, ignoring %s\n", rule.Name, rule.Profile, video.FullFilePath)
+			continue
+		}
+		if reason := excludedBy(*profile, video); reason != "" {
+			log.Printf("Skipping %s: %s\n", video.FullFilePath, reason)
+			continue
+		}
+		job := addJob(datatypes.TranscodeRequest{
+			Video:      video,
+			Resolution: profile.Resolution,
+			Bitrate:    profile.Bitrate,
+			Profile:    profile.Name,
+		}, nil)
+		log.Printf("Queued %s with profile %s (rule %s) as job %d\n", video.FullFilePath, profile.Name, rule.Name, job.ID)
+		go runJob(job)
+		queued++
+	}
+	return queued, nil
+}
+
+// RuleDecision is what watch mode would do with one file
+type RuleDecision struct {
+	Path    string `json:"path"`
+	Rule    string `json:"rule"`
+	Profile string `json:"profile,omitempty"`
+	Ignored bool   `json:"ignored"`
+}
+
+// ShowRules lists the watch mode rules in the order they are tried and, as a
+// dry run, which rule each of the given recorded files would get
+func ShowRules(paths []string) error {
+	list, err := rules.Load()
+	if err != nil {
+		return apperr.Wrap(apperr.Config, err, "error loading rules")
+	}
+	var decisions []RuleDecision
+	for _, path := range paths {
+		video, err := db.QueryVideoByPath(path)
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error querying video")
+		}
+		if video == nil {
+			return apperr.New(apperr.NotFound, "%s is not in the database; scan it first", path)
+		}
+		rule := matchRule(list, *video)
+		decisions = append(decisions, RuleDecision{Path: path, Rule: rule.Name, Profile: rule.Profile, Ignored: rule.Ignores()})
+	}
+	if output.JSON() {
+		if len(paths) > 0 {
+			return output.Print(decisions)
+		}
+		return output.Print(list)
+	}
+
+	for i, rule := range list {
+		fmt.Printf("%d. %s: %s\n", i+1, rule.Name, rule.Describe())
+	}
+	fallthroughRule := rules.Fallthrough()
+	fmt.Printf("Otherwise: %s\n", fallthroughRule.Describe())
+	for _, decision := range decisions {
+		outcome := "ignored"
+		if !decision.Ignored {
+			outcome = "profile " + decision.Profile
+		}
+		fmt.Printf("%s: %s (rule %s)\n", decision.Path, outcome, decision.Rule)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lifetimeSpaceSaved = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "transcoding_space_saved_bytes",
+		Help: "Total space saved by all recorded transcodes in bytes.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(lifetimeSpaceSaved)
+}
+
+// queryLifetimeSpaceSaved reads the lifetime savings from the transcodes table,
+// falling back to the savings of the current run if the database is unavailable
+func queryLifetimeSpaceSaved() int64 {
+	_, saved, err := db.QueryLifetimeSpaceSaved()
+	if err != nil {
+		log.Printf("Error querying lifetime space saved: %s\n", err)
+		spaceSavedMutex.Lock()
+		defer spaceSavedMutex.Unlock()
+		return totalSpaceSaved
+	}
+	return saved
+}
+
+// refreshSpaceSavedMetric updates the Prometheus gauge from the database
+func refreshSpaceSavedMetric() {
+	lifetimeSpaceSaved.Set(float64(queryLifetimeSpaceSaved()))
+}
+
+// lifetimeSavingsMessage describes the savings of this run and of all runs
+func lifetimeSavingsMessage() string {
+	spaceSavedMutex.Lock()
+	runSaved := totalSpaceSaved
+	spaceSavedMutex.Unlock()
+	return fmt.Sprintf("Space saved this run: %s, lifetime: %s", units.Bytes(runSaved), units.Bytes(queryLifetimeSpaceSaved()))
+}
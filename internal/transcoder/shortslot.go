@@ -0,0 +1,58 @@
+package transcoder
+
+import (
+	"log"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+)
+
+// longJobs counts the running jobs estimated to take longer than
+// RESERVE_SHORT_SLOT. It is guarded by deviceSlots, whose condition signals
+// a long job finishing. While running reaches limit, the free slot only
+// starts shorter jobs.
+var longJobs struct {
+	limit   int // 0 when no slot is reserved
+	running int
+}
+
+// reserveShortSlot marks the queued videos estimated to encode for longer
+// than RESERVE_SHORT_SLOT and lets them fill all but one of maxConcurrent
+// slots, so the queue keeps moving behind multi-hour encodes
+func reserveShortSlot(queue []queuedSource, maxConcurrent int) {
+	limit := config.GetShortSlotLimit()
+	deviceSlots.Lock()
+	defer deviceSlots.Unlock()
+	longJobs.limit, longJobs.running = 0, 0
+	if limit <= 0 || maxConcurrent < 2 {
+		return
+	}
+
+	rate := encodePixelRate()
+	long := 0
+	for i := range queue {
+		if estimateDuration(queue[i].video, rate) > limit {
+			queue[i].long = true
+			long++
+		}
+	}
+	longJobs.limit = maxConcurrent - 1
+	log.Printf("Reserving 1 of %d slots for jobs estimated under %s; %d of %d queued files are longer\n",
+		maxConcurrent, limit.Round(time.Second), long, len(queue))
+}
+
+// longSlotFreeLocked reports whether another long job may start
+func longSlotFreeLocked() bool {
+	return longJobs.limit == 0 || longJobs.running < longJobs.limit
+}
+
+// releaseLongSlot wraps release so it also ends a long job's hold on its slot
+func releaseLongSlot(release func()) func() {
+	return func() {
+		release()
+		deviceSlots.Lock()
+		longJobs.running--
+		deviceSlots.Unlock()
+		deviceSlots.cond.Broadcast()
+	}
+}
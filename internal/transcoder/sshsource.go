@@ -0,0 +1,105 @@
+package transcoder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// stagingPath returns where a file on an ssh host is kept locally while it
+// is transcoded, creating the staging directory. The name starts with a hash
+// of the full ssh path, so files of the same name on different hosts or in
+// different directories never share a staging file.
+func stagingPath(prefix, remote string) (string, error) {
+	p, err := sshpath.Parse(remote)
+	if err != nil {
+		return "", err
+	}
+	dir := config.GetRemoteStagingDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating staging directory %s: %w", dir, err)
+	}
+	sum := sha256.Sum256([]byte(remote))
+	return filepath.Join(dir, prefix+hex.EncodeToString(sum[:6])+"-"+path.Base(p.Path)), nil
+}
+
+// localSource returns the file ffmpeg reads for video. A source on an ssh
+// host is copied to the staging directory first, unless its output is
+// already encoded and only needs copying back.
+func localSource(video datatypes.VideoObject, encoded bool) (string, error) {
+	if !sshpath.Is(video.FullFilePath) {
+		return video.FullFilePath, nil
+	}
+	local, err := stagingPath(".zinocoder-src-", video.FullFilePath)
+	if err != nil || encoded {
+		return local, err
+	}
+	p, _ := sshpath.Parse(video.FullFilePath)
+	log.Printf("Copying %s from %s\n", path.Base(p.Path), p.Dest)
+	if err := p.Pull(local); err != nil {
+		os.Remove(local)
+		return "", err
+	}
+	if info, err := os.Stat(local); err == nil {
+		log.Printf("Copied %s of %s\n", units.Bytes(info.Size()), video.FullFilePath)
+	}
+	return local, nil
+}
+
+// releaseSource removes the local copy of a source from an ssh host
+func releaseSource(video datatypes.VideoObject, local string) {
+	if local != video.FullFilePath {
+		os.Remove(local)
+	}
+}
+
+// pushOutput copies a staged encode to its ssh host through a .partial
+// file, checks the copy against the staged checksum on the host and only
+// then moves it into place and removes the staged file
+func pushOutput(staged, outputPath string) error {
+	sum, _, err := readChecksum(staged)
+	if err != nil {
+		return fmt.Errorf("error reading checksum of %s: %w", staged, err)
+	}
+	target, err := sshpath.Parse(outputPath)
+	if err != nil {
+		return err
+	}
+	partial := target
+	partial.Path += ".partial"
+	if err := partial.Push(staged); err != nil {
+		return err
+	}
+	copied, err := partial.Checksum()
+	if err != nil {
+		return err
+	}
+	if copied != sum {
+		partial.Remove()
+		return fmt.Errorf("copy of %s to %s failed verification", staged, outputPath)
+	}
+	if err := partial.Rename(target); err != nil {
+		return err
+	}
+	os.Remove(staged)
+	os.Remove(checksumPath(staged))
+	log.Printf("Copied and verified %s\n", outputPath)
+	return nil
+}
+
+// removeOutput deletes an output, on its ssh host when it has one
+func removeOutput(outputPath string) error {
+	if p, err := sshpath.Parse(outputPath); err == nil {
+		return p.Remove()
+	}
+	return os.Remove(outputPath)
+}
@@ -0,0 +1,142 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/runner"
+)
+
+// mediaStream is one stream of a video as ffprobe reports it
+type mediaStream struct {
+	Index       int               `json:"index"`
+	Type        string            `json:"codec_type"` // video, audio, subtitle or attachment
+	Codec       string            `json:"codec_name"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	BitRate     string            `json:"bit_rate"`
+	Tags        map[string]string `json:"tags"`
+	Disposition map[string]int    `json:"disposition"`
+}
+
+// coverArt reports whether the stream is an embedded picture, such as an
+// mjpeg or png cover, rather than the video itself
+func (s mediaStream) coverArt() bool {
+	return s.Type == "video" && s.Disposition["attached_pic"] == 1
+}
+
+// probeStreams lists every stream of a video
+func probeStreams(path string) ([]mediaStream, error) {
+	out, err := runner.Output("ffprobe", "-v", "error",
+		"-show_entries", "stream=index,codec_type,codec_name,width,height,bit_rate:stream_tags:stream_disposition=attached_pic",
+		"-of", "json", ffmpegPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("error probing streams of %s: %w", path, err)
+	}
+	var probe struct {
+		Streams []mediaStream `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("error decoding streams of %s: %w", path, err)
+	}
+	return probe.Streams, nil
+}
+
+// streamsOfType returns the streams of one codec type, e.g. audio
+func streamsOfType(streams []mediaStream, codecType string) []mediaStream {
+	var matched []mediaStream
+	for _, stream := range streams {
+		if stream.Type == codecType {
+			matched = append(matched, stream)
+		}
+	}
+	return matched
+}
+
+// selectVideoStreams picks the video streams to transcode by policy: the
+// first, the one with the most pixels, or all of them
+func selectVideoStreams(videos []mediaStream, policy string) []mediaStream {
+	if len(videos) <= 1 {
+		return videos
+	}
+	switch policy {
+	case "all":
+		return videos
+	case "largest":
+		largest := videos[0]
+		for _, video := range videos[1:] {
+			if video.Width*video.Height > largest.Width*largest.Height {
+				largest = video
+			}
+		}
+		return []mediaStream{largest}
+	default:
+		return videos[:1]
+	}
+}
+
+// streamMapArgs returns the ffmpeg -map arguments for input under the named
+// profile and how many video streams they send to the encoder, or nil and 1
+// to let ffmpeg choose the streams. Streams are mapped explicitly when the
+// video has several video streams or cover art, which ffmpeg could
+// otherwise pick and encode as the video, when audio languages are pruned,
+// or when attachments are to be kept. The transcoded videos are output
+// streams v:0 onwards; kept cover art follows them and is copied untouched.
+// Outputs keep the source container, so subtitles and attachments are
+// copied as they are.
+func streamMapArgs(input, profileName string) ([]string, int) {
+	profile := profiles.Profile{}
+	if profileName != "" {
+		if named, err := profiles.Get(profileName); err == nil && named != nil {
+			profile = *named
+		}
+	}
+	streams, err := probeStreams(input)
+	if err != nil {
+		log.Printf("Letting ffmpeg choose the streams: %s\n", err)
+		return nil, 1
+	}
+
+	var videos, covers []mediaStream
+	for _, stream := range streamsOfType(streams, "video") {
+		if stream.coverArt() {
+			covers = append(covers, stream)
+		} else {
+			videos = append(videos, stream)
+		}
+	}
+	audio, dropped := streamsOfType(streams, "audio"), []mediaStream(nil)
+	if len(profile.KeepAudioLanguages) > 0 {
+		audio, dropped = splitAudio(audio, profile.KeepAudioLanguages)
+	}
+	keepAttachments := profile.KeepsAttachments() && len(streamsOfType(streams, "attachment")) > 0
+	if len(videos) == 0 || (len(videos) == 1 && len(covers) == 0 && len(dropped) == 0 && !keepAttachments) {
+		return nil, 1
+	}
+
+	selected := selectVideoStreams(videos, profile.VideoStreamPolicy())
+	if len(videos) > 1 {
+		log.Printf("%s has %d video streams, transcoding %d (%s)\n", input, len(videos), len(selected), profile.VideoStreamPolicy())
+	}
+	var args []string
+	for _, video := range selected {
+		args = append(args, "-map", fmt.Sprintf("0:%d", video.Index))
+	}
+	for _, stream := range audio {
+		args = append(args, "-map", fmt.Sprintf("0:%d", stream.Index))
+	}
+	args = append(args, "-map", "0:s?", "-c:s", "copy")
+	if keepAttachments {
+		args = append(args, "-map", "0:t", "-c:t", "copy")
+	}
+	if profile.KeepsCoverArt() {
+		for i, cover := range covers {
+			out := len(selected) + i
+			args = append(args, "-map", fmt.Sprintf("0:%d", cover.Index),
+				fmt.Sprintf("-c:v:%d", out), "copy", fmt.Sprintf("-disposition:v:%d", out), "attached_pic")
+		}
+	}
+	return args, len(selected)
+}
@@ -0,0 +1,199 @@
+package transcoder
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/safety"
+	"github.com/palzino/vidanalyser/internal/scanner"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+	"github.com/palzino/vidanalyser/internal/units"
+)
+
+// orphanKind names what a leftover file is, or returns "" for any other file.
+// Only videos count as tiny outputs, so small subtitles or .nfo files named
+// after an output are kept.
+func orphanKind(name string, size, tiny int64) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, ".zinocoder-"):
+		return "temp output"
+	case strings.HasSuffix(lower, ".partial") && strings.Contains(lower, "zinocoded"):
+		return "partial copy"
+	case strings.HasPrefix(name, "ffmpeg2pass-") && (strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.mbtree")),
+		strings.HasPrefix(name, "x265_2pass.log"):
+		return "two-pass log"
+	case strings.Contains(lower, "zinocoded") && size < tiny && scanner.CheckExtension(name):
+		return "tiny output"
+	}
+	return ""
+}
+
+// sweepRoots returns the local directories jobs write to: the libraries and
+// the output and staging directories
+func sweepRoots() []string {
+	candidates := append([]string{}, config.GetLibraryPaths()...)
+	for _, root := range config.GetOutputRoots() {
+		candidates = append(candidates, root.Output)
+	}
+	candidates = append(candidates, config.GetOutputRoot(), config.GetRemoteOutputDir(), config.GetRemoteStagingDir())
+
+	var roots []string
+	seen := map[string]bool{}
+	for _, root := range candidates {
+		if root == "" || pathutil.IsURL(root) || sshpath.Is(root) {
+			continue
+		}
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		if info, err := os.Stat(root); err == nil && info.IsDir() {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// FindOrphans lists the leftovers under roots, and two-pass logs in the
+// working directory where ffmpeg leaves them, untouched for at least minAge
+func FindOrphans(roots []string, minAge time.Duration) ([]datatypes.Orphan, error) {
+	tiny := config.GetSweepTinySize()
+	cutoff := time.Now().Add(-minAge)
+	orphans := []datatypes.Orphan{}
+	seen := map[string]bool{}
+	check := func(path string, entry fs.DirEntry) {
+		if !entry.Type().IsRegular() || seen[path] {
+			return
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return
+		}
+		if kind := orphanKind(entry.Name(), info.Size(), tiny); kind != "" {
+			seen[path] = true
+			orphans = append(orphans, datatypes.Orphan{Path: path, Kind: kind, Size: info.Size(), ModifiedAt: info.ModTime()})
+		}
+	}
+
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("Error sweeping %s: %s\n", path, err)
+				return nil
+			}
+			if !entry.IsDir() {
+				check(path, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return orphans, fmt.Errorf("error sweeping %s: %w", root, err)
+		}
+	}
+
+	if cwd, err := os.Getwd(); err == nil {
+		entries, _ := os.ReadDir(cwd)
+		for _, entry := range entries {
+			if orphanKind(entry.Name(), 0, 0) == "two-pass log" {
+				check(filepath.Join(cwd, entry.Name()), entry)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// removeOrphans deletes the orphans and any entries recorded for them
+func removeOrphans(orphans []datatypes.Orphan) {
+	for i, orphan := range orphans {
+		if err := safety.Remove(orphan.Path); err != nil {
+			log.Printf("Error removing %s: %s\n", orphan.Path, err)
+			continue
+		}
+		orphans[i].Removed = true
+		if video, err := db.QueryVideoByPath(orphan.Path); err == nil && video != nil {
+			if err := db.DeleteVideo(orphan.Path); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// SweepOrphans finds leftovers and reports or deletes them as SWEEP_ORPHANS
+// says. The daemon runs it at startup and on SCHEDULE_SWEEP.
+func SweepOrphans() error {
+	policy := config.GetSweepPolicy()
+	if policy == "off" {
+		return nil
+	}
+	orphans, err := FindOrphans(sweepRoots(), config.GetSweepMinAge())
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	if policy == "delete" {
+		removeOrphans(orphans)
+	}
+	var size int64
+	removed := 0
+	for _, orphan := range orphans {
+		size += orphan.Size
+		if orphan.Removed {
+			removed++
+		}
+		log.Printf("Leftover %s (%s, %s)\n", orphan.Path, orphan.Kind, units.Bytes(orphan.Size))
+	}
+	message := fmt.Sprintf("Sweep found %d leftover file(s) using %s, removed %d", len(orphans), units.Bytes(size), removed)
+	log.Println(message)
+	notifyFileEvent(message)
+	return nil
+}
+
+// ShowSweep lists the leftovers under the sweep roots, deleting them when
+// remove is set, whatever SWEEP_ORPHANS says
+func ShowSweep(remove bool, minAge time.Duration) error {
+	orphans, err := FindOrphans(sweepRoots(), minAge)
+	if err != nil {
+		return err
+	}
+	if remove {
+		removeOrphans(orphans)
+	}
+	if output.JSON() {
+		return output.Print(orphans)
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No leftover files found.")
+		return nil
+	}
+	var size int64
+	for _, orphan := range orphans {
+		size += orphan.Size
+		state := ""
+		if orphan.Removed {
+			state = "  removed"
+		}
+		fmt.Printf("%-12s %10s  %s  %s%s\n", orphan.Kind, units.Bytes(orphan.Size),
+			orphan.ModifiedAt.Format("2006-01-02 15:04"), orphan.Path, state)
+	}
+	fmt.Printf("%d leftover file(s), %s\n", len(orphans), units.Bytes(size))
+	if !remove {
+		fmt.Println("Delete them with: sweep --delete")
+	}
+	return nil
+}
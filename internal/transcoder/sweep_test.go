@@ -0,0 +1,108 @@
+package transcoder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+func TestOrphanKind(t *testing.T) {
+	const tiny = 1024 * 1024
+	tests := []struct {
+		name string
+		size int64
+		want string
+	}{
+		{".zinocoder-Film_ZinoCoded.mkv", 5 * tiny, "temp output"},
+		{"Film_ZinoCoded.mkv.partial", 5 * tiny, "partial copy"},
+		{"ffmpeg2pass-0.log", 100, "two-pass log"},
+		{"ffmpeg2pass-0.log.mbtree", 100, "two-pass log"},
+		{"x265_2pass.log", 100, "two-pass log"},
+		{"Film_ZinoCoded.mkv", 100, "tiny output"},
+		{"Film_ZinoCoded.MP4", 100, "tiny output"},
+		// Finished outputs and everything that is not a video are kept
+		{"Film_ZinoCoded.mkv", 5 * tiny, ""},
+		{"Film_ZinoCoded.srt", 100, ""},
+		{"Film_ZinoCoded.nfo", 100, ""},
+		{"Film.mkv.partial", 100, ""},
+		{"Film.mkv", 100, ""},
+	}
+	for _, tt := range tests {
+		if got := orphanKind(tt.name, tt.size, tiny); got != tt.want {
+			t.Errorf("orphanKind(%q, %d) = %q, want %q", tt.name, tt.size, got, tt.want)
+		}
+	}
+}
+
+// writeAged writes a file last modified age ago
+func writeAged(t *testing.T, path string, size int, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSweepDeletesOnlyLeftovers(t *testing.T) {
+	openTestDatabase(t)
+	t.Setenv("SWEEP_TINY_MB", "1")
+	dir := t.TempDir()
+	temp := filepath.Join(dir, ".zinocoder-Film_ZinoCoded.mkv")
+	tiny := filepath.Join(dir, "Show_ZinoCoded.mkv")
+	fresh := filepath.Join(dir, ".zinocoder-Running_ZinoCoded.mkv")
+	kept := []string{filepath.Join(dir, "Film.mkv"), filepath.Join(dir, "Film_ZinoCoded.srt"), fresh}
+	for _, path := range []string{temp, tiny, kept[0], kept[1]} {
+		writeAged(t, path, 100, 2*time.Hour)
+	}
+	writeAged(t, fresh, 100, time.Minute)
+	if err := db.InsertVideo(datatypes.VideoObject{Name: filepath.Base(tiny), Location: dir, FullFilePath: tiny, Size: 100, FileExtension: ".mkv"}); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := FindOrphans([]string{dir}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeOrphans(orphans)
+
+	for _, path := range []string{temp, tiny} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", path)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s should have been kept: %s", path, err)
+		}
+	}
+	if video, _ := db.QueryVideoByPath(tiny); video != nil {
+		t.Errorf("the record of %s was kept after deleting it", tiny)
+	}
+}
+
+func TestSweepKeepsFilesInReadOnlyMode(t *testing.T) {
+	openTestDatabase(t)
+	t.Setenv("READ_ONLY", "true")
+	dir := t.TempDir()
+	temp := filepath.Join(dir, ".zinocoder-Film_ZinoCoded.mkv")
+	writeAged(t, temp, 100, 2*time.Hour)
+
+	orphans, err := FindOrphans([]string{dir}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeOrphans(orphans)
+	if len(orphans) != 1 || orphans[0].Removed {
+		t.Errorf("orphans %+v, want the temp output found but not removed", orphans)
+	}
+	if _, err := os.Stat(temp); err != nil {
+		t.Errorf("%s was deleted in read-only mode", temp)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package transcoder
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// rawTerminal turns off line buffering and echo on the terminal fd so single
+// keypresses can be read, keeping Ctrl-C. The returned function restores it.
+func rawTerminal(fd int) (func(), error) {
+	var saved syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&saved))); errno != 0 {
+		return nil, errno
+	}
+	raw := saved
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); errno != 0 {
+		return nil, errno
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(&saved)))
+	}, nil
+}
+
+// terminalSize returns the columns and rows of the terminal fd, zero when it
+// is not a terminal
+func terminalSize(fd int) (int, int) {
+	var size struct{ rows, cols, x, y uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, 0
+	}
+	return int(size.cols), int(size.rows)
+}
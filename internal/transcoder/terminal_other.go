@@ -0,0 +1,15 @@
+//go:build !linux
+
+package transcoder
+
+import "errors"
+
+// rawTerminal is only implemented on Linux; elsewhere attach detaches with Ctrl-C
+func rawTerminal(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
+
+// terminalSize is unknown off Linux, so the default size is used
+func terminalSize(fd int) (int, int) {
+	return 0, 0
+}
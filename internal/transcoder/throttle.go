@@ -0,0 +1,127 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/utils"
+)
+
+// runningJobs counts the transcodes currently running in this process
+var runningJobs int32
+
+// streamMutex makes concurrent workers share a single throttle notification
+var streamMutex sync.Mutex
+
+var mediaServerClient = &http.Client{Timeout: 10 * time.Second}
+
+// waitToStart blocks until a new job is allowed to start and marks it as
+// running. The returned function must be called when the job finishes.
+func waitToStart() func() {
+	waitForPower()
+	waitForStreams()
+	waitForIdle()
+	atomic.AddInt32(&runningJobs, 1)
+	return func() { atomic.AddInt32(&runningJobs, -1) }
+}
+
+// waitForStreams holds new jobs while the media server has more than the
+// allowed number of streams playing and the throttled job limit is reached.
+func waitForStreams() {
+	settings, ok := config.GetMediaServerSettings()
+	if !ok {
+		return
+	}
+
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+
+	throttled := false
+	for {
+		streams, err := activeStreams(settings)
+		if err != nil {
+			// Never block transcoding on an unreachable media server
+			log.Printf("Error checking media server streams: %s\n", err)
+			break
+		}
+		if streams <= settings.MaxStreams || int(atomic.LoadInt32(&runningJobs)) < settings.Concurrent {
+			break
+		}
+		if !throttled {
+			message := fmt.Sprintf("Throttling transcodes: %d streams playing on %s", streams, settings.Kind)
+			log.Println(message)
+			utils.NotifySummary(message)
+			throttled = true
+		}
+		time.Sleep(30 * time.Second)
+		if settings, ok = config.GetMediaServerSettings(); !ok {
+			break
+		}
+	}
+	if throttled {
+		log.Println("Media server streams back under the limit, resuming transcodes")
+		utils.NotifySummary("Resuming transcodes, media server streams back under the limit")
+	}
+}
+
+// activeStreams asks Plex or Jellyfin how many sessions are currently playing
+func activeStreams(settings config.MediaServerSettings) (int, error) {
+	var endpoint string
+	switch settings.Kind {
+	case "plex":
+		endpoint = settings.URL + "/status/sessions"
+	case "jellyfin":
+		endpoint = settings.URL + "/Sessions?activeWithinSeconds=60"
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if settings.Kind == "plex" {
+		req.Header.Set("X-Plex-Token", settings.Token)
+	} else {
+		req.Header.Set("X-Emby-Token", settings.Token)
+	}
+
+	resp, err := mediaServerClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s responded with status %d", settings.Kind, resp.StatusCode)
+	}
+
+	if settings.Kind == "plex" {
+		var body struct {
+			MediaContainer struct {
+				Size int `json:"size"`
+			} `json:"MediaContainer"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return 0, fmt.Errorf("error decoding plex sessions: %w", err)
+		}
+		return body.MediaContainer.Size, nil
+	}
+
+	var sessions []struct {
+		NowPlayingItem json.RawMessage `json:"NowPlayingItem"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		return 0, fmt.Errorf("error decoding jellyfin sessions: %w", err)
+	}
+	playing := 0
+	for _, session := range sessions {
+		if len(session.NowPlayingItem) > 0 && string(session.NowPlayingItem) != "null" {
+			playing++
+		}
+	}
+	return playing, nil
+}
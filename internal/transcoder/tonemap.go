@@ -0,0 +1,38 @@
+package transcoder
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/profiles"
+)
+
+// tonemapFilter returns the filter chain that scales an HDR source to
+// resolution and tone-maps it to SDR BT.709, or "" when the source is SDR,
+// keeps its HDR metadata, or the profile turns tone-mapping off. Without it
+// the PQ or HLG picture is encoded as if it were BT.709 and comes out grey
+// and washed out.
+func tonemapFilter(input, resolution string, hdr hdrInfo, profile profiles.Profile, encoder string) string {
+	if !hdr.hdr() {
+		return ""
+	}
+	if action, _ := dynamicHDRAction(hdr, dynamicHDRPolicy(profile), encoder); action == "passthrough" {
+		return ""
+	}
+	method, curve := profile.TonemapMethod(), profile.TonemapCurve()
+	if method == "off" {
+		return ""
+	}
+	log.Printf("%s is HDR (%s), tone-mapping to SDR with %s (%s)\n", input, hdr.Transfer, method, curve)
+
+	if method == "libplacebo" {
+		width, height, _ := strings.Cut(strings.Replace(resolution, ":", "x", 1), "x")
+		return fmt.Sprintf("libplacebo=w=%s:h=%s:tonemapping=%s:colorspace=bt709:color_primaries=bt709:color_trc=bt709:range=tv:format=yuv420p",
+			width, height, curve)
+	}
+	// Scale first, while the frames are still small, then linearise, convert
+	// the primaries and tone-map in float before returning to limited-range BT.709
+	return fmt.Sprintf("scale=%s,zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=%s:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p",
+		resolution, curve)
+}
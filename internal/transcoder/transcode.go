@@ -17,11 +17,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/config"
 	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/safety"
 	"github.com/palzino/vidanalyser/internal/scanner"
 
 	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/presets"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/runner"
 	"github.com/palzino/vidanalyser/internal/tree"
+	"github.com/palzino/vidanalyser/internal/units"
 	"github.com/palzino/vidanalyser/internal/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -81,6 +89,7 @@ type Progress struct {
 	Percentage float64
 	Elapsed    time.Duration
 	Remaining  time.Duration
+	FPS        float64 // Current encode speed in frames per second
 }
 
 var progressMap = make(map[string]*Progress)
@@ -97,22 +106,23 @@ type TranscodeConfig struct {
 	OutputBitrate    int
 	MaxConcurrent    int
 	AutoDelete       bool
+	BatchName        string
+	Profile          string
+	Order            string   // One of queueOrders; files are queued as selected otherwise
+	Tags             []string `json:",omitempty"` // Recorded on every transcode of the run
+	// The one-off profile named by Profile when the selection has overrides,
+	// so a background process can find it again
+	Settings *profiles.Profile `json:",omitempty"`
 }
 
-// BuildDirectoryTree creates a nested map representing the directory structure from the video metadata.
-
 // StartInteractiveTranscoding handles the transcoding process based on user selections.
-
-//define a list of servers here
-
-func StartInteractiveTranscoding(background bool) {
+func StartInteractiveTranscoding(background bool) error {
 	startPrometheusEndpoint()
 	// If we're already the background process, set up logging first
 	if os.Getenv("BACKGROUND_PROCESS") == "1" {
 		logFile, err := os.OpenFile("transcode.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
-			fmt.Printf("Error creating log file: %s\n", err)
-			return
+			return apperr.Wrap(apperr.Config, err, "error creating log file")
 		}
 		defer logFile.Close()
 
@@ -125,97 +135,157 @@ func StartInteractiveTranscoding(background bool) {
 		configFile, err := os.Open("transcode_config.json")
 		if err != nil {
 			log.Printf("Error opening config file: %s\n", err)
-			return
+			return apperr.Wrap(apperr.Config, err, "error opening config file")
 		}
 		var config TranscodeConfig
 		if err := json.NewDecoder(configFile).Decode(&config); err != nil {
 			log.Printf("Error decoding config: %s\n", err)
-			return
+			return apperr.Wrap(apperr.Config, err, "error decoding config")
 		}
 		configFile.Close()
 
 		// Start the actual transcoding process
-		startTranscoding(config.SelectedFiles, config.OutputResolution, config.OutputBitrate, config.MaxConcurrent, config.AutoDelete)
-		return
+		return startTranscoding(config)
 	}
 
 	// Get user input and selections first
-	selectedFiles, outputResolution, outputBitrate, maxConcurrent, autoDelete, err := getUserSelections()
+	config, err := getUserSelections()
 	if err != nil {
-		fmt.Printf("Error getting user selections: %s\n", err)
-		return
+		return err
 	}
 
 	// If we need to start a background process
 	if background {
-		// Save config and start background process
-		config := TranscodeConfig{
-			SelectedFiles:    selectedFiles,
-			OutputResolution: outputResolution,
-			OutputBitrate:    outputBitrate,
-			MaxConcurrent:    maxConcurrent,
-			AutoDelete:       autoDelete,
+		return startBackgroundProcess(config)
+	}
+
+	// Start the actual transcoding process in the foreground
+	return startTranscoding(config)
+}
+
+// selectVideos resolves directories and file entries (paths or database IDs)
+// to their database records, without duplicates
+func selectVideos(directories, files []string) ([]datatypes.VideoObject, error) {
+	seen := pathutil.NewSet()
+	var videos []datatypes.VideoObject
+	add := func(video datatypes.VideoObject) {
+		if seen.Add(video.FullFilePath) {
+			videos = append(videos, video)
 		}
+	}
 
-		configFile, err := os.Create("transcode_config.json")
+	for _, directory := range directories {
+		found, err := db.QueryVideosByDirectory(directory)
 		if err != nil {
-			fmt.Printf("Error creating config file: %s\n", err)
-			return
+			return nil, apperr.Wrap(apperr.Database, err, "error querying videos from the database")
 		}
-		json.NewEncoder(configFile).Encode(config)
-		configFile.Close()
-
-		// Start the background process
-		cmd := exec.Command(os.Args[0], "transcode", "background")
-		cmd.Env = append(os.Environ(), "BACKGROUND_PROCESS=1")
+		for _, video := range found {
+			add(video)
+		}
+	}
 
-		// Set up logging for the new process
-		logFile, err := os.OpenFile("transcode.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	for _, entry := range files {
+		var video *datatypes.VideoObject
+		var err error
+		if id, convErr := strconv.Atoi(entry); convErr == nil {
+			video, err = db.QueryVideoByID(id)
+		} else {
+			video, err = db.QueryVideoByPath(entry)
+		}
 		if err != nil {
-			fmt.Printf("Error creating log file: %s\n", err)
-			return
+			return nil, apperr.Wrap(apperr.Database, err, "error querying videos from the database")
 		}
-		cmd.Stdout = logFile
-		cmd.Stderr = logFile
-
-		if err := cmd.Start(); err != nil {
-			fmt.Printf("Error starting background process: %s\n", err)
-			return
+		if video == nil {
+			return nil, apperr.New(apperr.NotFound, "%s is not in the database, scan it first", entry)
 		}
+		add(*video)
+	}
+	return videos, nil
+}
 
-		fmt.Println("Transcoding process started in background. Check transcode.log for progress.")
-		return
+// startBackgroundProcess saves the selection and re-runs the binary in the
+// background to transcode it, logging to transcode.log
+func startBackgroundProcess(config TranscodeConfig) error {
+	// Save config and start background process
+	configFile, err := os.Create("transcode_config.json")
+	if err != nil {
+		return apperr.Wrap(apperr.Config, err, "error creating config file")
 	}
+	json.NewEncoder(configFile).Encode(config)
+	configFile.Close()
 
-	// Start the actual transcoding process in the foreground
-	startTranscoding(selectedFiles, outputResolution, outputBitrate, maxConcurrent, autoDelete)
+	// Start the background process
+	cmd := exec.Command(os.Args[0], "transcode", "background")
+	cmd.Env = append(os.Environ(), "BACKGROUND_PROCESS=1")
+
+	// Set up logging for the new process
+	logFile, err := os.OpenFile("transcode.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return apperr.Wrap(apperr.Config, err, "error creating log file")
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		return apperr.Wrap(apperr.Internal, err, "error starting background process")
+	}
+
+	fmt.Println("Transcoding process started in background. Check transcode.log for progress.")
+	return nil
 }
 
+// startPrometheusEndpoint serves /metrics, and nothing else, on :2112. A
+// port already in use is logged rather than stopping the caller.
 func startPrometheusEndpoint() {
-	http.Handle("/metrics", promhttp.Handler())
+	refreshSpaceSavedMetric()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
 	go func() {
-		log.Fatal(http.ListenAndServe(":2112", nil))
+		if err := http.ListenAndServe(":2112", mux); err != nil {
+			log.Printf("Error serving metrics on :2112: %s\n", err)
+		}
 	}()
 }
 
-func startTranscoding(selectedFiles []datatypes.VideoObject, outputResolution string, outputBitrate int, maxConcurrent int, autoDelete bool) {
+// startTranscoding runs the configured selection to completion. It returns a
+// categorised error when some or all of the jobs failed.
+func startTranscoding(config TranscodeConfig) error {
+	if config.Settings != nil {
+		profiles.AddTemporary(*config.Settings)
+	}
+
 	// Start progress display
-	go DisplayProgress(false)
+	stopProgress := DisplayProgress(os.Getenv("BACKGROUND_PROCESS") == "1")
+	defer stopProgress()
 
 	// Start transcoding
 	var wg sync.WaitGroup
-	sem := make(chan struct{}, maxConcurrent)
-
-	transcodingQueueSize.Set(float64(len(selectedFiles)))
-	log.Printf("Starting transcoding of %d files\n", len(selectedFiles))
-	for _, video := range selectedFiles {
-		log.Printf("Queueing %s for transcoding\n", video.FullFilePath)
+	sem := make(chan struct{}, config.MaxConcurrent)
+
+	transcodingQueueSize.Set(float64(len(config.SelectedFiles)))
+	log.Printf("Starting transcoding of %d files\n", len(config.SelectedFiles))
+	batchID := beginBatch(config.BatchName, profileLabel(config.OutputResolution, config.OutputBitrate), len(config.SelectedFiles))
+	currentRun.setTags(config.Tags)
+	stopDigest := startDigest()
+	// Files on a device at its DEVICE_CONCURRENCY limit, or too long for the
+	// RESERVE_SHORT_SLOT slot when only that is free, wait while later files start
+	queue := queueSources(config.SelectedFiles)
+	reserveShortSlot(queue, config.MaxConcurrent)
+	for len(queue) > 0 {
 		wg.Add(1)
 		sem <- struct{}{}
+		video, releaseDevice := nextStartable(&queue)
+		log.Printf("Queueing %s for transcoding\n", video.FullFilePath)
+		done := waitToStart()
 		go func(video datatypes.VideoObject) {
 			defer wg.Done()
+			defer done()
+			defer releaseDevice()
 			start := time.Now()
-			TranscodeAndRenameVideo(video, outputResolution, outputBitrate, autoDelete)
+			_, err := withHooks(video, config.Profile, func() (*datatypes.TranscodedVideo, error) {
+				return TranscodeAndRenameVideo(video, config.OutputResolution, config.OutputBitrate, config.AutoDelete, config.Profile)
+			})
+			recordResult(video, err)
 			elapsed := time.Since(start).Seconds()
 			totalTranscodingTime.Add(elapsed)
 			transcodingQueueSize.Dec()
@@ -224,15 +294,50 @@ func startTranscoding(selectedFiles []datatypes.VideoObject, outputResolution st
 	}
 
 	wg.Wait()
+	stopProgress()
+	stopDigest()
 	log.Println("All selected videos have been transcoded.")
+	finishBatch(batchID)
 	os.Remove("transcode_config.json")
+	return currentRun.err()
+}
+
+// exceedsBitrate reports whether the source bitrate is above minKbps; 0 matches every video
+func exceedsBitrate(video datatypes.VideoObject, minKbps int) bool {
+	return minKbps <= 0 || video.Bitrate/1000 > minKbps
+}
+
+// streamMatchingPaths returns the paths of the videos with a stream matching
+// each of with and none matching without, and carrying every one of tags, or
+// nil when there is nothing to match
+func streamMatchingPaths(with, without []db.StreamMatch, tags []string) (pathutil.Set, error) {
+	if len(with) == 0 && len(without) == 0 && len(tags) == 0 {
+		return nil, nil
+	}
+	paths := pathutil.NewSet()
+	filter := db.VideoFilter{Recursive: true, WithStreams: with, WithoutStreams: without, Tags: tags}
+	err := db.EachVideo(filter, func(video datatypes.VideoObject) error {
+		paths.Add(video.FullFilePath)
+		return nil
+	})
+	if err != nil {
+		return nil, apperr.Wrap(apperr.Database, err, "error matching streams and tags")
+	}
+	return paths, nil
+}
+
+// reachesBPP reports whether the video spends at least minBPP bits per pixel
+// per frame; videos whose bits per pixel are unknown are kept
+func reachesBPP(video datatypes.VideoObject, minBPP float64) bool {
+	bpp := video.BitsPerPixel()
+	return minBPP <= 0 || bpp == 0 || bpp >= minBPP
 }
 
 // Helper function to get user selections
-func getUserSelections() ([]datatypes.VideoObject, string, int, int, bool, error) {
+func getUserSelections() (TranscodeConfig, error) {
 	directoryTree, err := db.BuildDirectoryTree()
 	if err != nil {
-		return nil, "", 0, 0, false, fmt.Errorf("error building directory tree: %w", err)
+		return TranscodeConfig{}, apperr.Wrap(apperr.Database, err, "error building directory tree")
 	}
 
 	// Get user input
@@ -242,38 +347,122 @@ func getUserSelections() ([]datatypes.VideoObject, string, int, int, bool, error
 	var outputBitrate int
 	var autoDelete bool
 	var minSize float64
-
-	fmt.Print("Enter desired input resolution (e.g., 720p,1080p,4k): ")
-	fmt.Scanln(&resolution)
-	fmt.Print("Enter desired minimum filesize for transcoding: ")
-	fmt.Scanln(&minSize)
+	var minBitrate int
+	var minBPP float64
+	var minDuration int
+	var batchName string
+	var profileName string
+	var presetName string
+	var codecs []string
+	var withStreams, withoutStreams []db.StreamMatch
+
+	fmt.Print("Enter a filter preset name (leave empty to enter filters): ")
+	fmt.Scanln(&presetName)
+	if presetName != "" {
+		preset, err := loadPreset(presetName)
+		if err != nil {
+			return TranscodeConfig{}, err
+		}
+		resolution, minSize, minBitrate, minBPP, codecs = preset.InputRes, preset.MinSizeGB, preset.MinBitrate, preset.MinBPP, preset.Codecs
+		minDuration = preset.MinDuration
+		if withStreams, withoutStreams, err = preset.StreamMatches(); err != nil {
+			return TranscodeConfig{}, apperr.Wrap(apperr.Config, err, "invalid preset "+presetName)
+		}
+	} else {
+		fmt.Print("Enter desired input resolution (480p, 720p, 1080p, 1440p, 4k or 8k, leave empty for any): ")
+		fmt.Scanln(&resolution)
+		fmt.Print("Enter desired minimum filesize for transcoding: ")
+		fmt.Scanln(&minSize)
+		fmt.Print("Enter minimum source bitrate in kbps (or 0 for any): ")
+		fmt.Scanln(&minBitrate)
+		presets.OfferSave(presets.Preset{InputRes: resolution, MinSizeGB: minSize, MinBitrate: minBitrate})
+	}
 	fmt.Print("Enter desired concurrent transcodes: ")
 	fmt.Scanln(&maxConcurrent)
-	fmt.Print("Enter desired output resolution (e.g., 1280x720): ")
-	fmt.Scanln(&outputResolution)
-	fmt.Print("Enter desired output bitrate in kbps (e.g., 3500): ")
-	fmt.Scanln(&outputBitrate)
+	fmt.Print("Enter a profile name (leave empty to enter resolution and bitrate): ")
+	fmt.Scanln(&profileName)
+	if profileName != "" {
+		profile, err := profiles.Get(profileName)
+		if err != nil {
+			return TranscodeConfig{}, apperr.Wrap(apperr.Config, err, "error loading profiles")
+		}
+		if profile == nil {
+			return TranscodeConfig{}, apperr.New(apperr.NotFound, "profile %s not found", profileName)
+		}
+		outputResolution, outputBitrate = profile.Resolution, profile.Bitrate
+	} else {
+		fmt.Print("Enter desired output resolution (e.g., 1280x720): ")
+		fmt.Scanln(&outputResolution)
+		fmt.Print("Enter desired output bitrate in kbps (e.g., 3500): ")
+		fmt.Scanln(&outputBitrate)
+	}
 	fmt.Println("Auto delete original files after transcoding? (true/false)")
 	fmt.Scanln(&autoDelete)
+	fmt.Print("Enter a name for this batch (leave empty for a generated name): ")
+	fmt.Scanln(&batchName)
+
+	streamMatches, err := streamMatchingPaths(withStreams, withoutStreams, nil)
+	if err != nil {
+		return TranscodeConfig{}, err
+	}
 
 	// Create filter function
 	fileFilter := func(video datatypes.VideoObject) bool {
-		return float64(video.Size)/(1024*1024*1024) >= minSize && shouldTranscode(video.Width, video.Height, resolution)
+		if streamMatches != nil && !streamMatches.Has(video.FullFilePath) {
+			return false
+		}
+		return units.GB(int64(video.Size)) >= minSize && exceedsBitrate(video, minBitrate) && reachesBPP(video, minBPP) &&
+			video.Length >= minDuration && (resolution == "" || shouldTranscode(video.Width, video.Height, resolution)) && matchesCodecs(video, codecs)
 	}
 
 	// Get directory selection
 	selectedNode, recursive := displayDirectoryAndGetSelection(directoryTree)
 	if selectedNode == nil {
-		return nil, "", 0, 0, false, fmt.Errorf("no directory selected")
+		return TranscodeConfig{}, apperr.New(apperr.Usage, "no directory selected")
 	}
 
-	selectedFiles := selectedNode.FilterFiles(fileFilter, recursive)
+	selectedFiles, err := applyExclusions(dropLinks(selectedNode.FilterFiles(fileFilter, recursive)), profileName)
+	if err != nil {
+		return TranscodeConfig{}, err
+	}
 	if len(selectedFiles) == 0 {
-		return nil, "", 0, 0, false, fmt.Errorf("no files found matching criteria")
+		return TranscodeConfig{}, apperr.New(apperr.NotFound, "no files found matching criteria")
 	}
 
 	fmt.Printf("Found %d files to transcode\n", len(selectedFiles))
-	return selectedFiles, outputResolution, outputBitrate, maxConcurrent, autoDelete, nil
+	selection := planSelection(TranscodeConfig{
+		SelectedFiles:    selectedFiles,
+		OutputResolution: outputResolution,
+		OutputBitrate:    outputBitrate,
+		MaxConcurrent:    maxConcurrent,
+		AutoDelete:       autoDelete,
+		BatchName:        batchName,
+		Profile:          profileName,
+		Order:            config.GetQueueOrder(),
+	}, config.GetSkipLowSavings())
+	if len(selection.SelectedFiles) == 0 {
+		return TranscodeConfig{}, apperr.New(apperr.NotFound, "no files left after skipping low savings")
+	}
+
+	saveLastSelection(SelectionOptions{
+		Directories:    []string{selectedNode.Path},
+		Shallow:        !recursive,
+		MinSizeGB:      minSize,
+		MinBitrate:     minBitrate,
+		MinBPP:         minBPP,
+		MinDuration:    minDuration,
+		WithStreams:    withStreams,
+		WithoutStreams: withoutStreams,
+		InputRes:       resolution,
+		Codecs:         codecs,
+		OutputRes:      outputResolution,
+		Bitrate:        outputBitrate,
+		Concurrent:     maxConcurrent,
+		AutoDelete:     autoDelete,
+		Profile:        profileName,
+		Order:          selection.Order,
+	})
+	return selection, nil
 }
 
 func FindCommonBaseDir(videos datatypes.VideoObjects) string {
@@ -299,175 +488,144 @@ func FindCommonBaseDir(videos datatypes.VideoObjects) string {
 	return commonBaseDir
 }
 
-func containsVideo(selectedFiles []datatypes.VideoObject, video datatypes.VideoObject) bool {
-	for _, v := range selectedFiles {
-		if v.FullFilePath == video.FullFilePath {
-			return true
-		}
-	}
-	return false
-}
-
 func generateNewName(originalName string) string {
 	resolutionRegex := regexp.MustCompile(`(?i)(4k|2160p|1080p|720p)`)
 	if resolutionRegex.MatchString(originalName) {
-		return resolutionRegex.ReplaceAllString(originalName, "zinoCoded")
+		return pathutil.TruncateName(resolutionRegex.ReplaceAllString(originalName, "zinoCoded"))
 	}
 	ext := filepath.Ext(originalName)
 	base := strings.TrimSuffix(originalName, ext)
-	return fmt.Sprintf("%s_ZinoCoded%s", base, ext)
-}
-
-func IsInSelectedDirectory(location string, selectedDirs []string, recursive bool) bool {
-	for _, dir := range selectedDirs {
-		if recursive {
-			if strings.HasPrefix(location, dir) {
-				return true
-			}
-		} else {
-			if filepath.Dir(location) == dir {
-				return true
-			}
-		}
-	}
-	return false
+	return pathutil.TruncateName(fmt.Sprintf("%s_ZinoCoded%s", base, ext))
 }
 
+// shouldTranscode reports whether a width and height fall in the resolution
+// class, e.g. 1080p
 func shouldTranscode(width, height int, resolution string) bool {
-	if resolution == "4k" && width >= 3840 && height >= 2160 {
-		return true
-	}
-	if resolution == "1080p" && width == 1920 && height == 1080 {
-		return true
-	}
-	if resolution == "720p" && width == 1280 && height == 720 {
-		return true
-	}
-	return false
+	class := datatypes.ResolutionClass(width, height)
+	return class != "" && strings.EqualFold(class, resolution)
 }
 
-func TranscodeAndRenameVideo(video datatypes.VideoObject, resolution string, bitrate int, autoDelete bool) {
+// TranscodeAndRenameVideo transcodes a single video next to the original and
+// returns the recorded transcode. The returned error is only used for run
+// accounting and hooks; it has already been logged and notified.
+func TranscodeAndRenameVideo(video datatypes.VideoObject, resolution string, bitrate int, autoDelete bool, profile string) (*datatypes.TranscodedVideo, error) {
 	// Add logging at the start
 	log.Printf("Starting transcode of %s\n", video.FullFilePath)
+	bitrate = targetBitrate(video, resolution, bitrate)
 
-	newName := generateNewName(video.Name)
-	outputPath := filepath.Join(video.Location, newName)
+	outputPath, err := outputPathFor(video, profile)
+	if err != nil {
+		log.Printf("Error choosing output for %s: %s\n", video.FullFilePath, err)
+		utils.NotifyError(fmt.Sprintf("Error choosing output for %s: %s", video.FullFilePath, err))
+		return nil, err
+	}
+
+	// Make sure the source is there and complete before starting ffmpeg
+	if err := waitForStableSource(video.FullFilePath); err != nil {
+		log.Printf("Skipping %s: %s\n", video.FullFilePath, err)
+		utils.NotifyError(fmt.Sprintf("Skipping %s: %s", video.FullFilePath, err))
+		return nil, err
+	}
 
 	// Get the original file size
 	originalSize, err := getFileSize(video.FullFilePath)
 	if err != nil {
 		log.Printf("Error getting file size for %s: %s\n", video.FullFilePath, err)
-		utils.SendTelegramMessage(fmt.Sprintf("Error getting file size: %s", err))
-		return
+		utils.NotifyError(fmt.Sprintf("Error getting file size: %s", err))
+		return nil, err
 	}
 
 	// Log the FFmpeg command
 	log.Printf("Transcoding %s to %s\n", video.FullFilePath, outputPath)
 
-	// Determine the encoding method based on hardware support
-	var encoder string
-	var scaleFilter string
-	hardware := detectHardware()
-
-	switch hardware {
-	case "nvidia":
-		encoder = "h264_nvenc"
-		scaleFilter = fmt.Sprintf("scale_npp=%s", resolution)
-	case "intel":
-		encoder = "h264_qsv"
-		scaleFilter = fmt.Sprintf("scale=%s", resolution) // QSV uses standard scaling
-	default:
-		encoder = "libx264"
-		scaleFilter = fmt.Sprintf("scale=%s", resolution) // CPU uses standard scaling
-	}
-
-	// Prepare FFmpeg command with selected encoder
-	ffmpegCmd := []string{
-		"ffmpeg", "-y", "-i", video.FullFilePath, "-vf", scaleFilter, "-c:a", "copy",
-		"-c:v", encoder, "-b:v", fmt.Sprintf("%dk", bitrate), "-nostats", "-progress", "pipe:2", outputPath,
+	// An existing output is skipped, versioned or replaced once the new one checks out
+	target, replacing, err := collisionTarget(outputPath, profile)
+	if err != nil {
+		message := fmt.Sprintf("Skipping %s: %s", video.FullFilePath, err)
+		fmt.Println(message)
+		utils.NotifyError(message)
+		return nil, err
 	}
-
-	// Add hardware acceleration flags if supported
-	if hardware == "nvidia" {
-		ffmpegCmd = append([]string{"ffmpeg", "-y", "-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}, ffmpegCmd[2:]...)
-	} else if hardware == "intel" {
-		ffmpegCmd = append([]string{"ffmpeg", "-y", "-hwaccel", "qsv"}, ffmpegCmd[2:]...)
+	if !replacing {
+		outputPath = target
 	}
 
-	cmd := exec.Command(ffmpegCmd[0], ffmpegCmd[1:]...)
-
-	// Print the FFmpeg command for debugging
-	commandMessage := fmt.Sprintf("Running FFmpeg command: %s", strings.Join(ffmpegCmd, " "))
-	fmt.Println(commandMessage)
-	utils.SendTelegramMessage(commandMessage)
+	// Outputs for another device are staged in the output directory and moved after
+	encodePath := encodePathFor(video, target)
+	// A staged encode finished by an interrupted run only needs its copy
+	resumed := stagedOutputReady(encodePath)
 
-	// Capture stderr for progress updates
-	stderr, err := cmd.StderrPipe()
+	// Sources on an ssh host are copied here for ffmpeg and its probes
+	input, err := localSource(video, resumed)
 	if err != nil {
-		message := fmt.Sprintf("Error capturing FFmpeg stderr: %s", err)
+		message := fmt.Sprintf("Error fetching %s: %s", video.FullFilePath, err)
 		fmt.Println(message)
-		utils.SendTelegramMessage(message)
-		return
+		utils.NotifyError(message)
+		return nil, err
 	}
+	defer releaseSource(video, input)
+	ffmpegCmd, encoder := buildFFmpegCommand(input, encodePath, resolution, bitrate, profile)
 
-	// Initialize progress tracking
-	progressKey := video.FullFilePath
-	progressMutex.Lock()
-	if _, exists := progressMap[progressKey]; !exists {
-		progressMap[progressKey] = &Progress{}
-		progressKeys = append(progressKeys, progressKey) // Maintain order
-	}
-	progressMutex.Unlock()
+	var timeTaken time.Duration
+	if resumed {
+		log.Printf("Resuming delivery of %s, already encoded\n", outputPath)
+	} else {
+		// Print the FFmpeg command for debugging
+		commandMessage := fmt.Sprintf("Running FFmpeg command: %s", strings.Join(ffmpegCmd, " "))
+		fmt.Println(commandMessage)
+		notifyFileEvent(commandMessage)
+
+		// Track progress until this job finishes, successfully or not
+		progressKey := video.FullFilePath
+		trackProgress(progressKey)
+		defer untrackProgress(progressKey)
+
+		// Start the FFmpeg process
+		timer := time.Now()
+		cmd, err := runner.Start(ffmpegCmd[0], ffmpegCmd[1:]...)
+		if err != nil {
+			message := fmt.Sprintf("Error starting FFmpeg process: %s", err)
+			fmt.Println(message)
+			utils.NotifyError(message)
+			return nil, err
+		}
 
-	// Start the FFmpeg process
-	timer := time.Now()
-	if err := cmd.Start(); err != nil {
-		message := fmt.Sprintf("Error starting FFmpeg process: %s", err)
+		// Parse progress until ffmpeg closes stderr, keeping its last lines
+		tail := &stderrTail{}
+		parseProgress(cmd.Stderr(), video.Length, time.Now(), progressKey, tail)
+
+		// Wait for FFmpeg to finish
+		if err := cmd.Wait(); err != nil {
+			failure := &ffmpegError{Err: err, Encoder: encoder, Stderr: tail.String()}
+			log.Printf("Error during transcoding: %s\n", failure)
+			utils.NotifyError(failureMessage(video.FullFilePath, failure))
+			return nil, failure
+		}
+		timeTaken = time.Since(timer)
+	}
+	if err := finishStagedEncode(encodePath, target, resumed); err != nil {
+		message := fmt.Sprintf("Error delivering %s: %s", target, err)
 		fmt.Println(message)
-		utils.SendTelegramMessage(message)
-		return
+		utils.NotifyError(message)
+		return nil, err
 	}
-
-	// Goroutine to parse progress
-	go parseProgress(stderr, video.Length, time.Now(), progressKey)
-
-	// Wait for FFmpeg to finish
-	if err := cmd.Wait(); err != nil {
-		log.Printf("Error during transcoding: %s\n", err)
-		utils.SendTelegramMessage(fmt.Sprintf("Error during transcoding: %s", err))
-		return
+	if replacing {
+		if err := replaceVerified(target, outputPath, video); err != nil {
+			fmt.Println(err)
+			utils.NotifyError(err.Error())
+			return nil, err
+		}
 	}
-	timeTaken := time.Since(timer)
-
-	// Remove progress tracking entry after completion
-	progressMutex.Lock()
-	delete(progressMap, progressKey)
-	progressMutex.Unlock()
 
 	// Get the new file size
 	newSize, err := getFileSize(outputPath)
 	if err != nil {
 		message := fmt.Sprintf("Error getting file size for %s: %s", outputPath, err)
 		fmt.Println(message)
-		utils.SendTelegramMessage(message)
-		return
+		utils.NotifyError(message)
+		return nil, err
 	}
 
-	// Calculate space saved
-	spaceSaved := originalSize - newSize
-
-	// Update the total space saved
-	spaceSavedMutex.Lock()
-	totalSpaceSaved += spaceSaved
-	spaceSavedMutex.Unlock()
-
-	// Record the renamed file
-	renamedFilesMutex.Lock()
-	scanner.ProcessFile(outputPath)
-	renamedFilesMutex.Unlock()
-
-	// Display individual file completion and updated total space saved
-
 	newObj := datatypes.TranscodedVideo{
 		OriginalVideoPath: video.FullFilePath,
 		TranscodedPath:    outputPath,
@@ -480,55 +638,125 @@ func TranscodeAndRenameVideo(video datatypes.VideoObject, resolution string, bit
 		OldBitrate:        video.Bitrate,
 		NewBitrate:        bitrate,
 		TimeTaken:         int(timeTaken.Seconds()),
+		AchievedBitrate:   achievedBitrate(video, newSize),
+		EncodeFPS:         encodeFPS(video, timeTaken),
+		FFmpegArgs:        strings.Join(ffmpegCmd, " "),
+		Encoder:           encoder,
+		EncoderVersion:    encoderVersion(),
+		Profile:           profile,
+		BatchID:           currentRun.batch(),
+		User:              config.GetCurrentUser(),
+		Tags:              currentRun.jobTags(),
+	}
+
+	// Keep the original when the output saved too little, recording the attempt
+	if keepOriginal(originalSize, newSize) {
+		newObj.Discarded = true
+		discardOutput(video.FullFilePath, outputPath, originalSize, newSize)
+		db.InsertTranscode(newObj)
+		return &newObj, nil
+	}
+
+	// Calculate space saved
+	spaceSaved := originalSize - newSize
+
+	// Update the total space saved
+	spaceSavedMutex.Lock()
+	totalSpaceSaved += spaceSaved
+	spaceSavedMutex.Unlock()
+
+	// Record the renamed file
+	renamedFilesMutex.Lock()
+	scanner.ProcessFile(outputPath)
+	renamedFilesMutex.Unlock()
+	if err := db.SetSourcePath(outputPath, video.FullFilePath); err != nil {
+		log.Println(err)
 	}
+
 	db.InsertTranscode(newObj)
+	refreshSpaceSavedMetric()
 
 	// Display total space saved
 	displaySpaceSaved() // CLI notification
 
 	if autoDelete {
-		err := os.Remove(video.FullFilePath)
-		if err != nil {
-			fmt.Println("Error deleting file", video.FullFilePath)
+		if err := safety.Remove(video.FullFilePath); err != nil {
+			fmt.Println("Error deleting file", video.FullFilePath, err)
+		} else {
+			fmt.Println("file has been deleted: ", video.FullFilePath)
+			if err := db.DeleteVideo(video.FullFilePath); err != nil {
+				fmt.Printf("Error deleting video %s from database: %s\n", video.FullFilePath, err)
+			}
+			replaceLinks(video, outputPath)
 		}
-		fmt.Println("file has been deleted: ", video.FullFilePath)
 	}
-	completionMessage := fmt.Sprintf("Transcoding completed: %s -> %s\nSpace saved for this file: %.2f GB",
-		video.FullFilePath, outputPath, float64(spaceSaved)/(1024*1024*1024), "Total space saved so far: %.2f GB", float64(totalSpaceSaved)/(1024*1024*1024))
-	utils.SendTelegramMessage(completionMessage)
+	completionMessage := fmt.Sprintf("Transcoding completed: %s -> %s\nSpace saved for this file: %s\nTotal space saved so far: %s",
+		video.FullFilePath, outputPath, units.Bytes(spaceSaved), units.Bytes(queryLifetimeSpaceSaved()))
+	notifyFileEvent(completionMessage)
 
 	// Log completion
 	log.Printf("Successfully transcoded %s\n", video.FullFilePath)
+	return &newObj, nil
 }
 
-func detectHardware() string {
-	// Check for NVIDIA GPU support
-	cmd := exec.Command("nvidia-smi")
-	if err := cmd.Run(); err == nil {
-		fmt.Println("NVIDIA GPU detected.")
-		return "nvidia"
+// DetectHardware returns the encoder hardware to use: the HARDWARE_ACCEL
+// override when set, otherwise the first of nvidia, intel or cpu found
+func DetectHardware() string {
+	if forced := config.GetHardwareAccel(); forced != "auto" {
+		return forced
 	}
-
-	// Check for Intel Quick Sync Video (QSV) support
-	cmd = exec.Command("vainfo")
-	output, err := cmd.Output()
-	if err == nil && strings.Contains(string(output), "Intel") {
+	switch hardware := probeHardware(); hardware {
+	case "nvidia":
+		fmt.Println("NVIDIA GPU detected.")
+		return hardware
+	case "intel":
 		fmt.Println("Intel QSV detected.")
-		return "intel"
+		return hardware
+	default:
+		fmt.Println("No hardware acceleration detected. Using CPU encoding.")
+		return hardware
 	}
+}
 
-	// Default to CPU-based encoding
-	fmt.Println("No hardware acceleration detected. Using CPU encoding.")
-	return "cpu"
+// detectedHardware holds what probeHardware found, since the hardware cannot
+// change while the process runs
+var detectedHardware struct {
+	once     sync.Once
+	hardware string
+}
+
+// probeHardware looks for an NVIDIA GPU, then Intel Quick Sync Video (QSV),
+// falling back to cpu. The probe runs once per process.
+func probeHardware() string {
+	detectedHardware.once.Do(func() {
+		detectedHardware.hardware = "cpu"
+		if err := runner.Run("nvidia-smi"); err == nil {
+			detectedHardware.hardware = "nvidia"
+			return
+		}
+		output, err := runner.Output("vainfo")
+		if err == nil && strings.Contains(string(output), "Intel") {
+			detectedHardware.hardware = "intel"
+		}
+	})
+	return detectedHardware.hardware
 }
 
-func parseProgress(stderr io.ReadCloser, totalDuration int, startTime time.Time, key string) {
+func parseProgress(stderr io.Reader, totalDuration int, startTime time.Time, key string, tail *stderrTail) {
 	progressRegex := regexp.MustCompile(`out_time=(\d+:\d+:\d+\.\d+)`)
+	fpsRegex := regexp.MustCompile(`^fps=(\d+(?:\.\d+)?)`)
+	var fps float64
 
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
 		line := scanner.Text()
+		tail.add(line)
 
+		// -progress reports fps before out_time in every block
+		if matches := fpsRegex.FindStringSubmatch(line); matches != nil {
+			fps, _ = strconv.ParseFloat(matches[1], 64)
+			continue
+		}
 		if matches := progressRegex.FindStringSubmatch(line); matches != nil {
 			currentTimeStr := matches[1]
 			currentTime := parseTimestamp(currentTimeStr)
@@ -540,12 +768,16 @@ func parseProgress(stderr io.ReadCloser, totalDuration int, startTime time.Time,
 			elapsed := time.Since(startTime)
 			remaining := time.Duration(float64(elapsed) * (100/progress - 1))
 
-			// Update progress map
-			progressMutex.Lock()
-			progressMap[key] = &Progress{
+			// Update progress map, unless the job has already been untracked
+			current := Progress{
 				Percentage: progress,
 				Elapsed:    elapsed,
 				Remaining:  remaining,
+				FPS:        fps,
+			}
+			progressMutex.Lock()
+			if entry, exists := progressMap[key]; exists {
+				*entry = current
 			}
 			progressMutex.Unlock()
 
@@ -553,40 +785,11 @@ func parseProgress(stderr io.ReadCloser, totalDuration int, startTime time.Time,
 			transcodingProgress.WithLabelValues(key).Set(progress)
 			transcodingDuration.WithLabelValues(key).Set(elapsed.Seconds())
 			transcodingRemaining.WithLabelValues(key).Set(remaining.Seconds())
+			checkpointProgress(key, current)
 		}
 	}
 }
 
-func DisplayProgress(background bool) {
-	for {
-		time.Sleep(1 * time.Second)
-		progressMutex.Lock()
-
-		if background {
-			// Write progress to log
-			log.Println("\n--- Current Transcoding Progress ---")
-			for _, key := range progressKeys {
-				if progress, exists := progressMap[key]; exists {
-					log.Printf("%s | Progress: %.2f%% | Elapsed: %s | Remaining: %s\n",
-						key, progress.Percentage, progress.Elapsed.Truncate(time.Second), progress.Remaining.Truncate(time.Second))
-				}
-			}
-		} else {
-			// Clear terminal and show progress
-			fmt.Print("\033[H\033[2J")
-			fmt.Println("Current Transcoding Progress:")
-			for _, key := range progressKeys {
-				if progress, exists := progressMap[key]; exists {
-					fmt.Printf("%s | Progress: %.2f%% | Elapsed: %s | Remaining: %s\n",
-						key, progress.Percentage, progress.Elapsed.Truncate(time.Second), progress.Remaining.Truncate(time.Second))
-				}
-			}
-		}
-
-		progressMutex.Unlock()
-	}
-}
-
 func parseTimestamp(timestamp string) int {
 	parts := strings.Split(timestamp, ":")
 	if len(parts) != 3 {
@@ -601,108 +804,215 @@ func parseTimestamp(timestamp string) int {
 }
 
 func getFileSize(filePath string) (int64, error) {
-	fileInfo, err := os.Stat(filePath)
+	fileInfo, err := statSource(filePath)
 	if err != nil {
 		return 0, err
 	}
 	return fileInfo.Size(), nil
 }
 
-// displaySpaceSaved displays the total space saved
+// displaySpaceSaved displays the space saved by this run and across all runs
 func displaySpaceSaved() {
-	spaceSavedMutex.Lock()
-	defer spaceSavedMutex.Unlock()
-
-	savedGB := float64(totalSpaceSaved) / (1024 * 1024 * 1024)
-	fmt.Printf("Total space saved so far: %.2f GB\n", savedGB)
+	fmt.Println(lifetimeSavingsMessage())
 }
 
-func StartTranscodingFromAnalysis(videos datatypes.VideoObjects, selectedDirs []string, selectedFiles []datatypes.VideoObject, recursive bool, resolution string, bitrate int, autoDelete bool) {
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, 3) // Example: max concurrent jobs = 3
+// achievedBitrate returns the output's average bitrate in kbps, 0 when the
+// source's length is unknown
+func achievedBitrate(video datatypes.VideoObject, newSize int64) int {
+	if video.Length <= 0 {
+		return 0
+	}
+	return int(newSize * 8 / 1000 / int64(video.Length))
+}
 
-	for _, video := range videos.Object {
-		if IsInSelectedDirectory(video.Location, selectedDirs, recursive) || containsVideo(selectedFiles, video) {
-			wg.Add(1)
-			sem <- struct{}{}
-			go func(video datatypes.VideoObject) {
-				defer wg.Done()
-				TranscodeAndRenameVideo(video, resolution, bitrate, autoDelete)
-				<-sem
-			}(video)
-		}
+// encodeFPS returns how many source frames were encoded per second
+func encodeFPS(video datatypes.VideoObject, timeTaken time.Duration) float64 {
+	frames := float64(video.Frames)
+	if frames <= 0 {
+		frames = float64(video.Length) * video.Framerate
+	}
+	if frames <= 0 || timeTaken <= 0 {
+		return 0
 	}
+	return frames / timeTaken.Seconds()
+}
 
-	wg.Wait()
-	fmt.Println("All selected files have been transcoded.")
+// SelectionOptions configures a non-interactive transcode of directories or
+// an explicit list of files
+type SelectionOptions struct {
+	Directories []string // Every video under these directories
+	Shallow     bool     // Only videos directly in Directories, not in subdirectories
+	Files       []string // Video paths or database IDs
+	MinSizeGB   float64
+	MinBitrate  int     // Source bitrate in kbps files must exceed, 0 for any
+	MinBPP      float64 // Bits per pixel per frame files must reach, 0 for any
+	MinDuration int     // Seconds files must last, 0 for any
+	// Streams files must have, or lack, e.g. audio:dts-hd or subtitle::eng
+	WithStreams    []db.StreamMatch `json:",omitempty"`
+	WithoutStreams []db.StreamMatch `json:",omitempty"`
+	Tags           []string         `json:",omitempty"` // Tags files must all carry
+	JobTags        []string         `json:",omitempty"` // Tags recorded on the transcodes
+	InputRes       string           // A resolution class, e.g. 1080p; empty matches any resolution
+	Codecs         []string         // ffprobe codec names files must be in; empty matches any codec
+	OutputRes      string           // e.g. 1280x720
+	Bitrate        int              // kbps
+	Concurrent     int
+	AutoDelete     bool
+	Profile        string
+	Overrides      profiles.Overrides `json:",omitempty"` // Profile fields replaced for this run only
+	BatchName      string
+	Order          string // Order the files run in, one of queueOrders
+	Detach         bool   // Run in a background process instead of blocking
+	// Drop files expected to save less than MIN_EXPECTED_SAVINGS
+	SkipLowSavings bool
 }
 
-func NonInteractiveTranscodingByDirectory(
-	directory string, minSize float64, resolution string, bitrate int, maxConcurrent int, autoDelete bool,
-) error {
-	// Query the database for videos
-	videos, err := db.QueryVideosByDirectory(directory)
+// TranscodeSelection transcodes every matching video in the selection without
+// prompting. It blocks until all jobs have finished unless Detach is set.
+func TranscodeSelection(opts SelectionOptions) error {
+	opts, err := resolveOutput(opts)
+	if err != nil {
+		return err
+	}
+
+	videos, err := selectVideos(opts.Directories, opts.Files)
 	if err != nil {
-		return fmt.Errorf("error querying videos from the database: %s", err)
+		return err
+	}
+
+	streamMatches, err := streamMatchingPaths(opts.WithStreams, opts.WithoutStreams, opts.Tags)
+	if err != nil {
+		return err
 	}
 
 	// Filter videos that match the requirements
 	filteredVideos := []datatypes.VideoObject{}
+	selectedDirs := pathutil.NewDirSet(opts.Directories, false)
 	for _, video := range videos {
-		if float64(video.Size)/(1024*1024*1024) >= minSize && // Meets size requirement
-			shouldTranscode(video.Width, video.Height, resolution) { // Matches resolution
+		if opts.Shallow && !selectedDirs.Contains(video.Location) {
+			continue
+		}
+		if streamMatches != nil && !streamMatches.Has(video.FullFilePath) {
+			continue
+		}
+		if units.GB(int64(video.Size)) >= opts.MinSizeGB && // Meets size requirement
+			exceedsBitrate(video, opts.MinBitrate) && // Bloated enough
+			reachesBPP(video, opts.MinBPP) && // Not already efficiently encoded
+			video.Length >= opts.MinDuration && // Long enough
+			(opts.InputRes == "" || shouldTranscode(video.Width, video.Height, opts.InputRes)) && // Matches resolution
+			matchesCodecs(video, opts.Codecs) { // Matches codec
 			filteredVideos = append(filteredVideos, video)
 		}
 	}
 
 	if len(filteredVideos) == 0 {
-		fmt.Printf("No videos found in the directory %s matching the criteria.\n", directory)
-		return nil
+		return apperr.New(apperr.NotFound, "no videos found matching the criteria")
 	}
+	fmt.Printf("Found %d video(s) matching the criteria.\n", len(filteredVideos))
+	return runSelection(filteredVideos, opts)
+}
 
-	fmt.Printf("Found %d video(s) in directory %s matching the criteria.\n", len(filteredVideos), directory)
+// StartTranscodingFromAnalysis queues the exact files chosen in an analysis
+// session; only the output, concurrency and delete settings of opts are used.
+func StartTranscodingFromAnalysis(videos []datatypes.VideoObject, opts SelectionOptions) error {
+	opts, err := resolveOutput(opts)
+	if err != nil {
+		return err
+	}
+	if len(videos) == 0 {
+		return apperr.New(apperr.NotFound, "no files selected")
+	}
+	return runSelection(videos, opts)
+}
 
-	// Run transcoding in the background
-	go func() {
-		var wg sync.WaitGroup
-		sem := make(chan struct{}, maxConcurrent) // Semaphore to limit concurrency
-
-		for _, video := range filteredVideos {
-			wg.Add(1)
-			sem <- struct{}{}
-			go func(video datatypes.VideoObject) {
-				defer wg.Done()
-				TranscodeAndRenameVideo(video, resolution, bitrate, autoDelete)
-
-				// Update the database after transcoding
-				newName := generateNewName(video.Name)
-				outputPath := filepath.Join(video.Location, newName)
-				newSize, _ := getFileSize(outputPath)
-
-				// Update or delete video entry in the database
-				if autoDelete {
-					if err := db.DeleteVideo(video.FullFilePath); err != nil {
-						fmt.Printf("Error deleting video %s from database: %s\n", video.FullFilePath, err)
-					}
-				} else {
-					if err := db.UpdateVideoAfterTranscode(video.FullFilePath, outputPath, newSize); err != nil {
-						fmt.Printf("Error updating video %s in database: %s\n", video.FullFilePath, err)
-					}
-				}
-			}(video)
-			<-sem
+// resolveOutput fills the output settings from the profile and checks they are complete
+func resolveOutput(opts SelectionOptions) (SelectionOptions, error) {
+	if opts.Profile != "" {
+		profile, err := profiles.Get(opts.Profile)
+		if err != nil {
+			return opts, apperr.Wrap(apperr.Config, err, "error loading profiles")
 		}
+		if profile == nil {
+			return opts, apperr.New(apperr.NotFound, "profile %s not found", opts.Profile)
+		}
+		if opts.OutputRes == "" {
+			opts.OutputRes = profile.Resolution
+		}
+		if opts.Bitrate <= 0 {
+			opts.Bitrate = profile.Bitrate
+		}
+	}
+	if len(opts.Overrides) > 0 {
+		base := profiles.Profile{Resolution: opts.OutputRes, Bitrate: opts.Bitrate}
+		if opts.Profile != "" {
+			named, _ := profiles.Get(opts.Profile)
+			base = *named
+			base.Resolution, base.Bitrate = opts.OutputRes, opts.Bitrate
+		}
+		custom, err := base.Override(opts.Overrides)
+		if err != nil {
+			return opts, apperr.Wrap(apperr.Usage, err, "invalid --set")
+		}
+		profiles.AddTemporary(custom)
+		opts.Profile, opts.OutputRes, opts.Bitrate = custom.Name, custom.Resolution, custom.Bitrate
+		opts.Overrides = nil
+		fmt.Printf("Using profile %s for this run only.\n", custom.Name)
+	}
+	if opts.OutputRes == "" || (opts.Bitrate <= 0 && opts.Bitrate != profiles.AutoBitrate) {
+		return opts, apperr.New(apperr.Usage, "an output resolution and bitrate, or a profile, are required")
+	}
+	if opts.Concurrent <= 0 {
+		opts.Concurrent = 1
+	}
+	if opts.Order == "" {
+		opts.Order = config.GetQueueOrder()
+	}
+	if !isQueueOrder(opts.Order) {
+		return opts, apperr.New(apperr.Usage, "unknown order %q, expected one of %s", opts.Order, strings.Join(queueOrders, ", "))
+	}
+	return opts, nil
+}
 
-		wg.Wait()
-		fmt.Println("All non-interactive transcoding jobs completed successfully.")
-	}()
-
-	fmt.Println("Non-interactive transcoding job has started. Logs and progress will be saved.")
-	return nil
+// runSelection transcodes videos in the foreground, or in a background process when detached
+func runSelection(videos []datatypes.VideoObject, opts SelectionOptions) error {
+	videos, err := applyExclusions(dropLinks(videos), opts.Profile)
+	if err != nil {
+		return err
+	}
+	if len(videos) == 0 {
+		if opts.Profile == "" {
+			return apperr.New(apperr.NotFound, "every selected video was skipped")
+		}
+		return apperr.New(apperr.NotFound, "every selected video is excluded by profile %s", opts.Profile)
+	}
+	config := TranscodeConfig{
+		SelectedFiles:    videos,
+		OutputResolution: opts.OutputRes,
+		OutputBitrate:    opts.Bitrate,
+		MaxConcurrent:    opts.Concurrent,
+		AutoDelete:       opts.AutoDelete,
+		BatchName:        opts.BatchName,
+		Profile:          opts.Profile,
+		Order:            opts.Order,
+		Tags:             opts.JobTags,
+	}
+	if profiles.IsTemporary(opts.Profile) {
+		// Overridden profiles only live in this process
+		config.Settings, _ = profiles.Get(opts.Profile)
+	}
+	config = planSelection(config, opts.SkipLowSavings)
+	if len(config.SelectedFiles) == 0 {
+		return apperr.New(apperr.NotFound, "no videos left after skipping low savings")
+	}
+	if opts.Detach {
+		return startBackgroundProcess(config)
+	}
+	startPrometheusEndpoint()
+	return startTranscoding(config)
 }
 
-func StartBackgroundTranscoding() {
-	StartInteractiveTranscoding(true)
+func StartBackgroundTranscoding() error {
+	return StartInteractiveTranscoding(true)
 }
 
 func displayDirectoryAndGetSelection(tree *tree.DirectoryNode) (*tree.DirectoryNode, bool) {
@@ -0,0 +1,74 @@
+package transcoder
+
+import (
+	"sort"
+
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+	"github.com/palzino/vidanalyser/internal/profiles"
+	"github.com/palzino/vidanalyser/internal/tree"
+)
+
+// maxTreeDepth bounds how many levels of children a treemap returns
+const maxTreeDepth = 10
+
+// BuildTreemap totals the library below dir (the whole library when empty),
+// listing children depth levels deep. Savings are estimated for the named
+// profile and left at zero without one.
+func BuildTreemap(dir string, depth int, profileName string) (*datatypes.TreeNode, error) {
+	root, err := db.BuildDirectoryTree()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.Database, err, "error building directory tree")
+	}
+	if dir != "" {
+		if root = root.GetSubDirectory(dir); root == nil {
+			return nil, apperr.New(apperr.NotFound, "%s is not in the library", dir)
+		}
+	}
+	if depth > maxTreeDepth {
+		depth = maxTreeDepth
+	}
+
+	savings := map[string]int64{}
+	if profileName != "" {
+		profile, err := profiles.Get(profileName)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.Config, err, "error loading profiles")
+		}
+		if profile == nil {
+			return nil, apperr.New(apperr.NotFound, "profile %s not found", profileName)
+		}
+		for _, estimate := range estimateOutputs(root.GetAllFiles(true), profile.Resolution, profile.Bitrate, profile.Name) {
+			if saved := int64(estimate.Video.Size) - estimate.ExpectedSize; saved > 0 {
+				savings[estimate.Video.FullFilePath] = saved
+			}
+		}
+	}
+
+	node := treemapNode(root, depth, savings)
+	return &node, nil
+}
+
+// treemapNode totals a directory and, while depth remains, its children,
+// largest first
+func treemapNode(dir *tree.DirectoryNode, depth int, savings map[string]int64) datatypes.TreeNode {
+	node := datatypes.TreeNode{Name: dir.Name, Path: dir.Path, Files: len(dir.Files)}
+	for _, video := range dir.Files {
+		node.Size += int64(video.Size)
+		node.DiskSize += int64(video.DiskSize)
+		node.Savings += savings[video.FullFilePath]
+	}
+	for _, child := range dir.Children {
+		childNode := treemapNode(child, depth-1, savings)
+		node.Files += childNode.Files
+		node.Size += childNode.Size
+		node.DiskSize += childNode.DiskSize
+		node.Savings += childNode.Savings
+		if depth > 0 {
+			node.Children = append(node.Children, childNode)
+		}
+	}
+	sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Size > node.Children[j].Size })
+	return node
+}
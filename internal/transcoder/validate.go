@@ -0,0 +1,84 @@
+package transcoder
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/db"
+)
+
+// validateRequestPath checks a path submitted to the API before ffmpeg reads it
+// or --auto-delete removes it, and returns the video recorded for it. The path
+// must pass checkLibraryPath and, unless ALLOW_UNINDEXED_PATHS is set, be in
+// the database. Only the recorded row is trusted: the name, directory and
+// metadata a client sends along are ignored. The returned status is the HTTP
+// code to reject the request with.
+func validateRequestPath(path string) (datatypes.VideoObject, int, error) {
+	if status, err := checkLibraryPath(path); err != nil {
+		return datatypes.VideoObject{}, status, err
+	}
+	video, err := db.QueryVideoByPath(path)
+	if err != nil {
+		return datatypes.VideoObject{}, http.StatusInternalServerError, fmt.Errorf("error looking up %s: %w", path, err)
+	}
+	if video != nil {
+		return *video, http.StatusOK, nil
+	}
+	if !config.GetAllowUnindexedPaths() {
+		return datatypes.VideoObject{}, http.StatusNotFound, fmt.Errorf("path %s is not in the database, scan it first", path)
+	}
+	// An unscanned file is described by what is on disk alone
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return datatypes.VideoObject{}, http.StatusNotFound, fmt.Errorf("path %s is not a file", path)
+	}
+	return datatypes.VideoObject{
+		Name:          filepath.Base(path),
+		Location:      filepath.Dir(path),
+		FullFilePath:  path,
+		Size:          int(info.Size()),
+		FileExtension: filepath.Ext(path),
+	}, http.StatusOK, nil
+}
+
+// checkLibraryPath checks that a path submitted to the API is absolute without
+// ".." parts and resolves (following symlinks) inside a LIBRARY_PATHS root
+func checkLibraryPath(path string) (int, error) {
+	if !filepath.IsAbs(path) {
+		return http.StatusBadRequest, fmt.Errorf("path %s must be absolute", path)
+	}
+	for _, part := range strings.Split(path, string(filepath.Separator)) {
+		if part == ".." {
+			return http.StatusBadRequest, fmt.Errorf("path %s must not contain ..", path)
+		}
+	}
+
+	libraries := config.GetLibraryPaths()
+	if len(libraries) == 0 {
+		return http.StatusForbidden, fmt.Errorf("LIBRARY_PATHS is not set, so no paths are accepted")
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return http.StatusNotFound, fmt.Errorf("path %s does not exist", path)
+	}
+	inside := false
+	for _, library := range libraries {
+		root, err := filepath.EvalSymlinks(library)
+		if err != nil {
+			root = filepath.Clean(library)
+		}
+		if _, ok := relativeTo(root, real); ok {
+			inside = true
+			break
+		}
+	}
+	if !inside {
+		return http.StatusForbidden, fmt.Errorf("path %s is outside LIBRARY_PATHS", path)
+	}
+	return http.StatusOK, nil
+}
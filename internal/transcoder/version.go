@@ -0,0 +1,96 @@
+package transcoder
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/version"
+)
+
+// BuildInfo describes this binary, the ffmpeg it runs and the optional
+// integrations configured for it
+func BuildInfo() datatypes.BuildInfo {
+	build := version.Get()
+	info := datatypes.BuildInfo{
+		Version:   build.Version,
+		Commit:    build.Commit,
+		BuildTime: build.Time,
+		Modified:  build.Modified,
+		GoVersion: build.GoVersion,
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		FFmpeg:    encoderVersion(),
+		Hardware:  config.GetHardwareAccel(),
+		Features:  []string{},
+	}
+	if info.Hardware == "auto" {
+		info.Hardware = probeHardware()
+	}
+
+	if info.FFmpeg != "" && hasLibVMAF() {
+		info.Features = append(info.Features, "vmaf")
+	}
+	if token, _ := config.GetSecret("TELEGRAM_BOT_TOKEN"); token != "" {
+		info.Features = append(info.Features, "telegram")
+	}
+	if _, ok := config.GetSMTPSettings(); ok {
+		info.Features = append(info.Features, "email")
+	}
+	if workers, err := config.GetWorkers(); err == nil && len(workers) > 0 {
+		info.Features = append(info.Features, "workers")
+	}
+	if _, ok := config.GetMediaServerSettings(); ok {
+		info.Features = append(info.Features, "media-server-throttle")
+	}
+	if _, ok := config.GetPowerSettings(); ok {
+		info.Features = append(info.Features, "power-aware")
+	}
+	if _, ok := config.GetIdleSettings(); ok {
+		info.Features = append(info.Features, "idle-only")
+	}
+	if config.GetOutputRoot() != "" || len(config.GetOutputRoots()) > 0 {
+		info.Features = append(info.Features, "output-roots")
+	}
+	return info
+}
+
+// hasLibVMAF reports whether ffmpeg was built with the libvmaf filter
+func hasLibVMAF() bool {
+	out, err := runner.Output("ffmpeg", "-hide_banner", "-filters")
+	return err == nil && strings.Contains(string(out), " libvmaf ")
+}
+
+// ShowVersion prints the build information
+func ShowVersion() error {
+	info := BuildInfo()
+	if output.JSON() {
+		return output.Print(info)
+	}
+
+	commit := info.Commit
+	if commit == "" {
+		commit = "unknown"
+	}
+	if info.Modified {
+		commit += " (modified)"
+	}
+	ffmpeg := info.FFmpeg
+	if ffmpeg == "" {
+		ffmpeg = "not found"
+	}
+	features := strings.Join(info.Features, ", ")
+	if features == "" {
+		features = "none"
+	}
+	fmt.Printf("ZinoCoder %s\n", info.Version)
+	fmt.Printf("Commit:   %s %s\n", commit, info.BuildTime)
+	fmt.Printf("Go:       %s %s\n", info.GoVersion, info.Platform)
+	fmt.Printf("FFmpeg:   %s\n", ffmpeg)
+	fmt.Printf("Hardware: %s\n", info.Hardware)
+	fmt.Printf("Features: %s\n", features)
+	return nil
+}
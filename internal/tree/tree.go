@@ -128,3 +128,52 @@ func (n *DirectoryNode) FilterFiles(filter func(datatypes.VideoObject) bool, rec
 
 	return result
 }
+
+// Contains reports whether location is this directory or below it
+func (n *DirectoryNode) Contains(location string) bool {
+	relPath, err := filepath.Rel(n.Path, location)
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+// RemoveVideo removes the video at path, pruning directories left empty, and
+// reports whether it was found
+func (n *DirectoryNode) RemoveVideo(path string) bool {
+	dir := filepath.Dir(path)
+	if dir == n.Path {
+		for i, file := range n.Files {
+			if file.FullFilePath == path {
+				n.Files = append(n.Files[:i], n.Files[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	if !n.Contains(dir) {
+		return false
+	}
+
+	relPath, _ := filepath.Rel(n.Path, dir)
+	part := strings.Split(relPath, string(filepath.Separator))[0]
+	child, exists := n.Children[part]
+	if !exists || !child.RemoveVideo(path) {
+		return false
+	}
+	if len(child.Files) == 0 && len(child.Children) == 0 {
+		delete(n.Children, part)
+	}
+	return true
+}
+
+// Copy returns a deep copy of the tree, sharing nothing with the original
+func (n *DirectoryNode) Copy() *DirectoryNode {
+	copied := &DirectoryNode{
+		Name:     n.Name,
+		Path:     n.Path,
+		Children: make(map[string]*DirectoryNode, len(n.Children)),
+		Files:    append(make([]datatypes.VideoObject, 0, len(n.Files)), n.Files...),
+	}
+	for name, child := range n.Children {
+		copied.Children[name] = child.Copy()
+	}
+	return copied
+}
@@ -0,0 +1,55 @@
+// Package units formats byte counts consistently across the CLI, reports and
+// notifications. SIZE_UNITS picks binary multiples labelled KB/MB/GB (the
+// default), decimal (SI) multiples, or binary multiples labelled KiB/MiB/GiB.
+package units
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/palzino/vidanalyser/internal/config"
+)
+
+var (
+	plainLabels = []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	iecLabels   = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+)
+
+// system returns the multiple between units and their labels
+func system() (float64, []string) {
+	switch config.GetSizeUnits() {
+	case "decimal":
+		return 1000, plainLabels
+	case "iec":
+		return 1024, iecLabels
+	default:
+		return 1024, plainLabels
+	}
+}
+
+// Bytes formats n in the largest unit that keeps it at least 1, e.g. "41.20 GB"
+func Bytes(n int64) string {
+	base, labels := system()
+	value := float64(n)
+	unit := 0
+	for math.Abs(value) >= base && unit < len(labels)-1 {
+		value /= base
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", n, labels[0])
+	}
+	return fmt.Sprintf("%.2f %s", value, labels[unit])
+}
+
+// GB converts bytes to gigabytes in the configured system, for size filters
+func GB(n int64) float64 {
+	base, _ := system()
+	return float64(n) / (base * base * base)
+}
+
+// FromGB converts a size filter given in gigabytes to bytes
+func FromGB(gb float64) int64 {
+	base, _ := system()
+	return int64(gb * base * base * base)
+}
@@ -0,0 +1,70 @@
+// Package users stores the people sharing a library, each with their own
+// default profile and notification targets, so jobs and stats can be attributed.
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/palzino/vidanalyser/internal/config"
+)
+
+// User is a named member of the household
+type User struct {
+	Name           string   `json:"name"`
+	DefaultProfile string   `json:"default_profile,omitempty"`  // Used instead of DEFAULT_PROFILE
+	TelegramChatID string   `json:"telegram_chat_id,omitempty"` // Receives this user's notifications
+	Email          []string `json:"email,omitempty"`            // Recipients for this user's notifications
+}
+
+// Load reads all users from the users file. A missing file means no users.
+func Load() ([]User, error) {
+	data, err := os.ReadFile(config.GetUsersFile())
+	if os.IsNotExist(err) {
+		return []User{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading users: %w", err)
+	}
+
+	var list []User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error decoding users: %w", err)
+	}
+	return list, nil
+}
+
+// Get returns the named user, or nil if it does not exist
+func Get(name string) (*User, error) {
+	if name == "" {
+		return nil, nil
+	}
+	list, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		if u.Name == name {
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+// Current returns the user selected with --user, or nil if none is
+func Current() (*User, error) {
+	return Get(config.GetCurrentUser())
+}
+
+// DefaultProfile returns the named user's default profile, falling back to DEFAULT_PROFILE
+func DefaultProfile(name string) string {
+	user, err := Get(name)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if user != nil && user.DefaultProfile != "" {
+		return user.DefaultProfile
+	}
+	return config.GetDefaultProfile()
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+)
+
+// SendEmail sends a plain text email to the configured SMTP recipients
+func SendEmail(subject, body string) error {
+	settings, enabled := config.GetSMTPSettings()
+	return sendEmail(settings, enabled, subject, body)
+}
+
+func sendEmail(settings config.SMTPSettings, enabled bool, subject, body string) error {
+	if !enabled {
+		fmt.Println("SMTP host or recipients not set. Skipping email.")
+		return nil
+	}
+
+	message := strings.Join([]string{
+		"From: " + settings.From,
+		"To: " + strings.Join(settings.To, ", "),
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if settings.Username != "" {
+		auth = smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)
+	}
+
+	addr := net.JoinHostPort(settings.Host, settings.Port)
+	if err := smtp.SendMail(addr, auth, settings.From, settings.To, []byte(message)); err != nil {
+		return fmt.Errorf("error sending email via %s: %w", addr, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"log"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/config"
+	"github.com/palzino/vidanalyser/internal/users"
+)
+
+// Level is how important a notification is. Each backend only sends messages
+// at or above the verbosity it is configured for.
+type Level int
+
+const (
+	LevelError   Level = iota + 1 // Failures that need attention
+	LevelSummary                  // Batch summaries, digests, pauses and resumes
+	LevelVerbose                  // Per-file commands, completions and queue updates
+)
+
+var levelNames = map[string]Level{
+	"off":     0,
+	"errors":  LevelError,
+	"summary": LevelSummary,
+	"verbose": LevelVerbose,
+}
+
+// Notify sends a message to every backend whose verbosity includes level,
+// and to the targets of the user selected with --user
+func Notify(level Level, message string) {
+	// File names are not always valid UTF-8, which the notification APIs reject
+	message = strings.ToValidUTF8(message, "\uFFFD")
+	if level <= levelNames[config.GetNotifyLevel("telegram")] {
+		SendTelegramMessage(message)
+	}
+	if level <= levelNames[config.GetNotifyLevel("email")] {
+		if err := SendEmail("ZinoCoder notification", message); err != nil {
+			log.Printf("Error sending notification email: %s\n", err)
+		}
+	}
+	NotifyUser(config.GetCurrentUser(), level, message)
+}
+
+// NotifyUser sends a message to the named user's own Telegram chat and email
+// recipients, at the same verbosity as the household backends
+func NotifyUser(name string, level Level, message string) {
+	user, err := users.Get(name)
+	if err != nil {
+		log.Println(err)
+	}
+	if user == nil {
+		return
+	}
+	message = strings.ToValidUTF8(message, "\uFFFD")
+	if level <= levelNames[config.GetNotifyLevel("telegram")] && user.TelegramChatID != "" &&
+		user.TelegramChatID != config.GetTelegramChatID() {
+		sendTelegram(user.TelegramChatID, message)
+	}
+	if level <= levelNames[config.GetNotifyLevel("email")] && len(user.Email) > 0 {
+		settings, _ := config.GetSMTPSettings()
+		settings.To = user.Email
+		if err := sendEmail(settings, settings.Host != "", "ZinoCoder notification", message); err != nil {
+			log.Printf("Error sending notification email to %s: %s\n", user.Name, err)
+		}
+	}
+}
+
+// NotifyError sends a failure notification
+func NotifyError(message string) {
+	Notify(LevelError, message)
+}
+
+// NotifySummary sends a summary-level notification
+func NotifySummary(message string) {
+	Notify(LevelSummary, message)
+}
+
+// NotifyVerbose sends a per-file notification
+func NotifyVerbose(message string) {
+	Notify(LevelVerbose, message)
+}
@@ -151,8 +151,11 @@ func getSubTree(tree map[string]interface{}, relativePath string) map[string]int
 	return current
 }
 func SendTelegramMessage(message string) {
+	sendTelegram(config.GetTelegramChatID(), message)
+}
+
+func sendTelegram(chatID, message string) {
 	botToken := config.GetTelegramBotToken()
-	chatID := config.GetTelegramChatID()
 	if botToken == "" || chatID == "" {
 		fmt.Println("Telegram bot token or chat ID not set. Skipping message sending.")
 		return
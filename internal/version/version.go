@@ -0,0 +1,53 @@
+// Package version identifies the running build. Version and Commit are set
+// at link time (see the Makefile); otherwise they come from the Go build info.
+package version
+
+import (
+	"runtime/debug"
+)
+
+var (
+	Version = "" // e.g. v1.4.0, set with -ldflags "-X .../internal/version.Version=..."
+	Commit  = "" // Git revision, set with -ldflags "-X .../internal/version.Commit=..."
+)
+
+// Build describes the source a binary was built from
+type Build struct {
+	Version   string
+	Commit    string
+	Time      string // Commit time, RFC 3339
+	Modified  bool   // Built from a tree with uncommitted changes
+	GoVersion string
+}
+
+// Get returns the build description, preferring the link-time values
+func Get() Build {
+	build := Build{Version: Version, Commit: Commit}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if build.Version == "" {
+			build.Version = "dev"
+		}
+		return build
+	}
+	build.GoVersion = info.GoVersion
+	if build.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		build.Version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if build.Commit == "" {
+				build.Commit = setting.Value
+			}
+		case "vcs.time":
+			build.Time = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	if build.Version == "" {
+		build.Version = "dev"
+	}
+	return build
+}
@@ -1,73 +1,774 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/palzino/vidanalyser/internal/analyser"
+	"github.com/palzino/vidanalyser/internal/apperr"
+	"github.com/palzino/vidanalyser/internal/archive"
 	"github.com/palzino/vidanalyser/internal/config"
 	"github.com/palzino/vidanalyser/internal/db"
 	"github.com/palzino/vidanalyser/internal/deleter"
+	"github.com/palzino/vidanalyser/internal/maintenance"
+	"github.com/palzino/vidanalyser/internal/output"
+	"github.com/palzino/vidanalyser/internal/presets"
+	"github.com/palzino/vidanalyser/internal/report"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/safety"
 	"github.com/palzino/vidanalyser/internal/scanner"
+	"github.com/palzino/vidanalyser/internal/setup"
 	"github.com/palzino/vidanalyser/internal/transcoder"
+	"github.com/palzino/vidanalyser/internal/units"
+	"github.com/palzino/vidanalyser/internal/users"
+	"github.com/palzino/vidanalyser/pkg/client"
 )
 
+// globalOptions are flags accepted anywhere on the command line
+type globalOptions struct {
+	json       bool
+	noProgress bool
+	readOnly   bool
+	user       string
+}
+
+// parseGlobalFlags strips global flags from args and returns the remaining arguments
+func parseGlobalFlags(args []string) ([]string, globalOptions) {
+	var opts globalOptions
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--json" || arg == "-json":
+			opts.json = true
+		case arg == "--no-progress" || arg == "-no-progress":
+			opts.noProgress = true
+		case arg == "--read-only" || arg == "-read-only":
+			opts.readOnly = true
+		case (arg == "--user" || arg == "-user") && i+1 < len(args):
+			i++
+			opts.user = args[i]
+		case strings.HasPrefix(arg, "--user="):
+			opts.user = strings.TrimPrefix(arg, "--user=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest, opts
+}
+
 func main() {
+	args, opts := parseGlobalFlags(os.Args[1:])
+	if opts.json {
+		output.EnableJSON()
+	}
+	if opts.noProgress {
+		transcoder.ShowProgress = false
+	}
+	if opts.readOnly {
+		// Exported so detached runs and the server stay read-only too
+		os.Setenv("READ_ONLY", "true")
+	}
+	if opts.user != "" {
+		// Exported so detached runs and their notifications keep the user
+		os.Setenv("ZINOCODER_USER", opts.user)
+	}
+	if err := run(args); err != nil {
+		if errors.Is(err, safety.ErrReadOnly) {
+			err = apperr.Wrap(apperr.ReadOnly, err, "")
+		} else if errors.Is(err, transcoder.ErrUnknownProject) {
+			err = apperr.Wrap(apperr.NotFound, err, "")
+		}
+		apperr.Report(os.Stderr, err, opts.json)
+		os.Exit(apperr.ExitCode(err))
+	}
+}
 
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <command> <path>")
-		return
+func run(args []string) error {
+
+	if len(args) < 1 {
+		return apperr.New(apperr.Usage, "Usage: go run main.go <command> <path>")
 	}
 
-	db.InitDatabase("video_metadata.db")
+	// init runs before the database and config are loaded so it can create them
+	if args[0] == "init" {
+		if err := setup.RunWizard(); err != nil {
+			return apperr.Wrap(apperr.Config, err, "setup failed")
+		}
+		return nil
+	}
+
+	// version needs no database, so it works on a fresh install
+	if args[0] == "version" {
+		config.LoadConfig()
+		return transcoder.ShowVersion()
+	}
+
+	// secret encrypt turns a value read from stdin into an "enc:" value for .env
+	if args[0] == "secret" {
+		if len(args) != 2 || args[1] != "encrypt" {
+			return apperr.New(apperr.Usage, "Usage: go run main.go secret encrypt < value")
+		}
+		config.LoadConfig()
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if value = strings.TrimRight(value, "\r\n"); value == "" {
+			return apperr.Wrap(apperr.Usage, err, "no value given on stdin")
+		}
+		encrypted, err := config.EncryptSecret(value)
+		if err != nil {
+			return apperr.Wrap(apperr.Config, err, "error encrypting secret")
+		}
+		fmt.Println(encrypted)
+		return nil
+	}
+
+	if err := db.InitDatabase("video_metadata.db"); err != nil {
+		return apperr.Wrap(apperr.Database, err, "error initialising database")
+	}
 
 	config.LoadConfig()
+	if config.GetProbeCache() {
+		runner.Use(runner.NewProbeCache(runner.Exec{}, db.ProbeStore{}))
+	}
+
+	if name := config.GetCurrentUser(); name != "" {
+		user, err := users.Get(name)
+		if err != nil {
+			return apperr.Wrap(apperr.Config, err, "error loading users")
+		}
+		if user == nil {
+			return apperr.New(apperr.Config, "unknown user %s, add it to %s", name, config.GetUsersFile())
+		}
+	}
 
-	command := os.Args[1]
+	command := args[0]
 
 	switch command {
 	case "scan":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: go run main.go scan <path>")
-			return
+		fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+		workers := fs.Int("workers", 0, "files probed at once (default SCAN_WORKERS, or one per CPU)")
+		incremental := fs.Bool("incremental", false, "skip probing files whose size and modification time are unchanged (default SCAN_INCREMENTAL)")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) != 1 || *workers < 0 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go scan <path> [--workers N] [--incremental]")
 		}
-		path := os.Args[2]
-		wg := scanner.ProcessMasterDirectory(path)
-		wg.Wait()
+		if *workers > 0 {
+			os.Setenv("SCAN_WORKERS", strconv.Itoa(*workers))
+		}
+		if *incremental {
+			os.Setenv("SCAN_INCREMENTAL", "true")
+		}
+		path := positional[0]
+		summary, err := scanner.ScanMasterDirectory(path)
 		fmt.Printf("Total video files: %d\n", scanner.GetTotalVideos())
+		fmt.Printf("Total size: %s apparent, %s on disk\n", units.Bytes(summary.ApparentSize), units.Bytes(summary.DiskSize))
+		if summary.HardLinks > 0 {
+			fmt.Printf("%d hard link(s) of files already counted were left out of the sizes\n", summary.HardLinks)
+		}
+		if summary.Flagged > 0 {
+			fmt.Printf("%d file(s) no longer match their entries and were flagged for review, see 'conflicts'\n", summary.Flagged)
+		}
+		if output.JSON() {
+			errs := []string{}
+			for _, dirErr := range summary.Errors {
+				errs = append(errs, dirErr.Error())
+			}
+			output.Print(map[string]interface{}{
+				"path":          path,
+				"total":         summary.Total,
+				"inserted":      summary.Inserted,
+				"updated":       summary.Updated,
+				"unchanged":     summary.Unchanged,
+				"flagged":       summary.Flagged,
+				"failed":        summary.Failed,
+				"errors":        errs,
+				"apparent_size": summary.ApparentSize,
+				"disk_size":     summary.DiskSize,
+				"hard_links":    summary.HardLinks,
+			})
+		}
+		return err
+
+	case "add":
+		if len(args) < 2 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go add <url>...")
+		}
+		for _, rawURL := range args[1:] {
+			if err := scanner.AddURL(rawURL); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "conflicts":
+		if len(args) == 1 {
+			return scanner.ShowConflicts()
+		}
+		if len(args) != 4 || args[1] != "resolve" {
+			return apperr.New(apperr.Usage, "Usage: go run main.go conflicts [resolve <path> update|keep]")
+		}
+		return scanner.ResolveConflict(args[2], args[3])
+
+	case "versions":
+		if len(args) > 2 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go versions [path]")
+		}
+		path := ""
+		if len(args) == 2 {
+			path = args[1]
+		}
+		return scanner.ShowVersions(path)
+
+	case "probe":
+		fs := flag.NewFlagSet("probe", flag.ContinueOnError)
+		save := fs.Bool("save", false, "record the probed metadata in the database")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) != 1 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go probe [--save] <path>")
+		}
+		return scanner.ShowProbe(positional[0], *save)
+
+	case "tags":
+		usage := "Usage: go run main.go tags [path] | add <path> <tag>... | remove <path> <tag>..."
+		if len(args) >= 2 && (args[1] == "add" || args[1] == "remove") {
+			if len(args) < 4 {
+				return apperr.New(apperr.Usage, usage)
+			}
+			return scanner.EditTags(args[2], args[1] == "add", args[3:])
+		}
+		if len(args) > 2 {
+			return apperr.New(apperr.Usage, usage)
+		}
+		path := ""
+		if len(args) == 2 {
+			path = args[1]
+		}
+		return scanner.ShowTags(path)
 
 	case "analyse":
-		analyser.AnalyzeDatabase()
+		return analyser.AnalyzeDatabase()
 
 	case "transcode":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: go run main.go transcode [background|foreground]")
-			return
+		if len(args) < 2 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go transcode [background|foreground|distributed|resume|dir <path>|--dirs a,b|--from-file list.txt|--repeat-last]")
+		}
+		mode := args[1]
+		if strings.HasPrefix(mode, "-") {
+			return transcodeSelection(args[1:], nil)
 		}
-		mode := os.Args[2]
 		switch mode {
+		case "dir":
+			return transcodeSelection(args[2:], []string{"path"})
 		case "background":
-			transcoder.StartBackgroundTranscoding()
+			return transcoder.StartBackgroundTranscoding()
 		case "foreground":
-			transcoder.StartInteractiveTranscoding(false)
+			return transcoder.StartInteractiveTranscoding(false)
+		case "distributed":
+			transcoder.StartAPITranscoding()
+			return nil
+		case "resume":
+			return transcoder.ResumeAPITranscoding()
+		default:
+			return apperr.New(apperr.Usage, "Invalid mode. Use 'background', 'foreground', 'distributed', 'resume' or 'dir'")
+		}
+
+	case "history":
+		limit := 20
+		if len(args) >= 2 {
+			if parsed, err := strconv.Atoi(args[1]); err == nil && parsed > 0 {
+				limit = parsed
+			}
+		}
+		return apperr.Wrap(apperr.Database, transcoder.ShowHistory(limit), "error showing history")
+
+	case "stats":
+		period := "month"
+		if len(args) >= 2 {
+			period = args[1]
+		}
+		return apperr.Wrap(apperr.Database, report.ShowStats(period, config.GetCurrentUser()), "error showing stats")
+
+	case "queue":
+		addr := "localhost:8080"
+		if len(args) >= 2 {
+			addr = args[1]
+		}
+		return transcoder.ShowQueue(addr)
+
+	case "cluster":
+		if len(args) != 2 || args[1] != "status" {
+			return apperr.New(apperr.Usage, "Usage: go run main.go cluster status")
+		}
+		return apperr.Wrap(apperr.Config, transcoder.ShowClusterStatus(), "error reading cluster status")
+
+	case "attach":
+		fs := flag.NewFlagSet("attach", flag.ContinueOnError)
+		interval := fs.Duration("interval", 2*time.Second, "how often to refresh")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) > 1 || *interval <= 0 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go attach [host:port] [--interval 2s]")
+		}
+		addr := "localhost:8080"
+		if len(positional) == 1 {
+			addr = positional[0]
+		}
+		return transcoder.Attach(addr, *interval)
+
+	case "experiment":
+		fs := flag.NewFlagSet("experiment", flag.ContinueOnError)
+		sample := fs.Int("sample", 10, "number of files to sample")
+		dir := fs.String("dir", "", "only sample files under this directory")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) != 2 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go experiment [-sample N] [-dir path] <profileA> <profileB>")
+		}
+		return transcoder.ShowExperiment(positional[0], positional[1], *dir, *sample)
+
+	case "serve":
+		transcoder.CaptureLogs()
+		go maintenance.Run()
+		go transcoder.WatchDeletions()
+		go func() {
+			if err := transcoder.SweepOrphans(); err != nil {
+				log.Println(err)
+			}
+		}()
+		transcoder.Serve()
+
+	case "sweep":
+		fs := flag.NewFlagSet("sweep", flag.ContinueOnError)
+		remove := fs.Bool("delete", false, "delete the leftovers found")
+		minAge := fs.Duration("min-age", config.GetSweepMinAge(), "only files untouched this long")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) > 0 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go sweep [--delete] [--min-age 24h]")
+		}
+		return apperr.Wrap(apperr.Internal, transcoder.ShowSweep(*remove, *minAge), "error sweeping leftovers")
+
+	case "watch":
+		roots := args[1:]
+		if len(roots) == 0 {
+			roots = config.GetLibraryPaths()
+		}
+		if len(roots) == 0 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go watch [path...] (or set LIBRARY_PATHS)")
+		}
+		return apperr.Wrap(apperr.Internal, scanner.Watch(roots), "error watching files")
+
+	case "config":
+		if len(args) < 2 || args[1] != "reload" {
+			return apperr.New(apperr.Usage, "Usage: go run main.go config reload [host:port]")
+		}
+		addr := "localhost:8080"
+		if len(args) >= 3 {
+			addr = args[2]
+		}
+		result, err := client.New(addr).ReloadConfig()
+		if err != nil {
+			return apperr.Wrap(apperr.Config, err, "error reloading configuration")
+		}
+		if output.JSON() {
+			return output.Print(result)
+		}
+		fmt.Printf("Configuration reloaded: %d profiles, %d workers\n", result.Profiles, result.Workers)
+
+	case "report":
+		mode := ""
+		if len(args) >= 2 {
+			mode = args[1]
+		}
+		switch mode {
+		case "":
+			summary, err := report.BuildSummary(7 * 24 * time.Hour)
+			if err != nil {
+				return apperr.Wrap(apperr.Database, err, "error building report")
+			}
+			if output.JSON() {
+				return output.Print(summary)
+			}
+			fmt.Print(summary.Text())
+		case "email":
+			if _, enabled := config.GetSMTPSettings(); !enabled {
+				return apperr.New(apperr.Config, "SMTP_HOST and SMTP_TO must be set to email reports")
+			}
+			return apperr.Wrap(apperr.Internal, report.SendWeekly(), "error sending report")
+		case "schedule":
+			report.RunScheduler()
+		default:
+			return apperr.New(apperr.Usage, "Usage: go run main.go report [email|schedule]")
+		}
+
+	case "db":
+		usage := apperr.New(apperr.Usage, "Usage: go run main.go db maintain|backup|restore <snapshot>|clear-probe-cache")
+		if len(args) < 2 {
+			return usage
+		}
+		switch args[1] {
+		case "maintain":
+		case "backup":
+			snapshot, err := db.Backup()
+			if err != nil {
+				return apperr.Wrap(apperr.Database, err, "backup failed")
+			}
+			if output.JSON() {
+				return output.Print(map[string]string{"snapshot": snapshot})
+			}
+			fmt.Println("Database backed up to", snapshot)
+			return nil
+		case "clear-probe-cache":
+			cleared, err := db.ClearProbeCache()
+			if err != nil {
+				return apperr.Wrap(apperr.Database, err, "error clearing probe cache")
+			}
+			if output.JSON() {
+				return output.Print(map[string]int64{"cleared": cleared})
+			}
+			fmt.Printf("Cleared %d cached probe(s)\n", cleared)
+			return nil
+		case "restore":
+			if len(args) < 3 {
+				return usage
+			}
+			if err := db.Restore(args[2]); err != nil {
+				return apperr.Wrap(apperr.Database, err, "restore failed")
+			}
+			fmt.Println("Database restored from", args[2])
+			if output.JSON() {
+				return output.Print(map[string]string{"status": "ok", "snapshot": args[2]})
+			}
+			return nil
 		default:
-			fmt.Println("Invalid mode. Use 'background' or 'foreground'")
+			return usage
+		}
+		result, err := db.Maintain()
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "database maintenance failed")
+		}
+		if output.JSON() {
+			return output.Print(result)
 		}
+		fmt.Printf("Integrity: %s\nSize: %s -> %s\n", result.Integrity, units.Bytes(result.SizeBefore), units.Bytes(result.SizeAfter))
 
 	case "clean":
-		db.CleanDatabase()
+		if _, err := db.Backup(); err != nil {
+			return apperr.Wrap(apperr.Database, err, "error backing up database before clean")
+		}
+		result, err := db.CleanDatabase(config.GetLibraryPaths())
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error cleaning database")
+		}
+		if output.JSON() {
+			return output.Print(result)
+		}
+
+	case "relocate":
+		fs := flag.NewFlagSet("relocate", flag.ContinueOnError)
+		from := fs.String("from", "", "old library root")
+		to := fs.String("to", "", "new library root")
+		dryRun := fs.Bool("dry-run", false, "only count the records that would change")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) > 0 || *from == "" || *to == "" {
+			return apperr.New(apperr.Usage, "Usage: go run main.go relocate --from /old/root --to /new/root [--dry-run]")
+		}
+		if !*dryRun {
+			if _, err := db.Backup(); err != nil {
+				return apperr.Wrap(apperr.Database, err, "error backing up database before relocate")
+			}
+		}
+		result, err := db.Relocate(*from, *to, *dryRun)
+		if err != nil {
+			return apperr.Wrap(apperr.Database, err, "error relocating library")
+		}
+		if output.JSON() {
+			return output.Print(result)
+		}
+		verb := "Relocated"
+		if result.DryRun {
+			verb = "Would relocate"
+		}
+		fmt.Printf("%s %s -> %s: %d files, %d transcodes, %d failures, %d projects\n",
+			verb, result.From, result.To, result.Files, result.Transcodes, result.Failures, result.Projects)
+		if result.Missing > 0 {
+			fmt.Printf("%d files are not at their new path yet.\n", result.Missing)
+		}
+		for _, conflict := range result.Conflicts {
+			fmt.Printf("Already recorded: %s\n", conflict)
+		}
+		for _, root := range config.GetLibraryPaths() {
+			if filepath.Clean(root) == result.From && !result.DryRun {
+				fmt.Printf("Remember to replace %s in LIBRARY_PATHS.\n", root)
+			}
+		}
+
+	case "project":
+		usage := "Usage: go run main.go project create <name> --codec hevc [--dir path] | list | status [name] | delete <name>"
+		if len(args) < 2 {
+			return apperr.New(apperr.Usage, usage)
+		}
+		switch args[1] {
+		case "create":
+			fs := flag.NewFlagSet("project create", flag.ContinueOnError)
+			codec := fs.String("codec", "", "target codec, e.g. hevc or av1")
+			dir := fs.String("dir", "", "only track files under this directory")
+			positional, err := parseFlags(fs, args[2:])
+			if err != nil || len(positional) != 1 || *codec == "" {
+				return apperr.New(apperr.Usage, usage)
+			}
+			return apperr.Wrap(apperr.Database, transcoder.CreateProject(positional[0], *codec, *dir), "error creating project")
+		case "list":
+			return apperr.Wrap(apperr.Database, transcoder.ShowProjects(), "error listing projects")
+		case "status":
+			name := ""
+			if len(args) >= 3 {
+				name = args[2]
+			}
+			return apperr.Wrap(apperr.Database, transcoder.ShowProjectStatus(name), "error measuring projects")
+		case "delete":
+			if len(args) != 3 {
+				return apperr.New(apperr.Usage, usage)
+			}
+			return apperr.Wrap(apperr.Database, transcoder.DeleteProject(args[2]), "error deleting project")
+		default:
+			return apperr.New(apperr.Usage, usage)
+		}
+
+	case "audio-report":
+		usage := "Usage: go run main.go audio-report [--profile name] [dir]"
+		fs := flag.NewFlagSet("audio-report", flag.ContinueOnError)
+		profile := fs.String("profile", users.DefaultProfile(config.GetCurrentUser()), "profile whose keep_audio_languages apply")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) > 1 || *profile == "" {
+			return apperr.New(apperr.Usage, usage)
+		}
+		dir := ""
+		if len(positional) == 1 {
+			dir = positional[0]
+		}
+		return transcoder.ShowAudioReport(*profile, dir)
+
+	case "presets":
+		list, err := presets.Load()
+		if err != nil {
+			return apperr.Wrap(apperr.Config, err, "error loading presets")
+		}
+		if output.JSON() {
+			return output.Print(list)
+		}
+		if len(list) == 0 {
+			fmt.Printf("No presets saved in %s yet.\n", config.GetPresetsFile())
+		}
+		for _, preset := range list {
+			fmt.Printf("%s: %s\n", preset.Name, preset.Describe())
+		}
+
+	case "lineage":
+		if len(args) == 2 && args[1] == "--orphaned" {
+			return transcoder.ShowOrphanedOriginals()
+		}
+		if len(args) != 2 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go lineage <path> | --orphaned")
+		}
+		return transcoder.ShowLineage(args[1])
+
+	case "retranscode":
+		fs := flag.NewFlagSet("retranscode", flag.ContinueOnError)
+		profile := fs.String("profile", "", "judge every past output against this profile instead of the one it was made with")
+		minSavings := fs.Float64("min-savings", -1, "percent of an output's size re-encoding must save (default RETRANSCODE_MIN_SAVINGS)")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) > 0 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go retranscode [--profile name] [--min-savings pct]")
+		}
+		return transcoder.ShowRetranscodes(*profile, *minSavings)
+
+	case "rules":
+		return transcoder.ShowRules(args[1:])
+
+	case "archive":
+		fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+		move := fs.Bool("move", false, "move the files instead of listing them")
+		positional, err := parseFlags(fs, args[1:])
+		if err != nil || len(positional) > 0 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go archive [--move]")
+		}
+		return archive.Show(*move)
+
+	case "quotas":
+		if len(args) > 1 && args[1] == "enforce" {
+			err := transcoder.EnforceQuotas()
+			transcoder.WaitForQuotaJobs()
+			return apperr.Wrap(apperr.Internal, err, "error enforcing quotas")
+		}
+		if len(args) > 1 {
+			return apperr.New(apperr.Usage, "Usage: go run main.go quotas [enforce]")
+		}
+		return transcoder.ShowQuotas()
 
 	case "del-og":
 		renamedFilesJSON := "renamed_files.json"
+		if _, err := db.Backup(); err != nil {
+			return apperr.Wrap(apperr.Database, err, "error backing up database before deleting original files")
+		}
 		err := deleter.DeleteOriginalFiles(renamedFilesJSON)
+		if os.IsNotExist(err) {
+			return apperr.Wrap(apperr.NotFound, err, "error deleting original files")
+		}
 		if err != nil {
-			fmt.Printf("Error deleting original files: %s\n", err)
-		} else {
-			fmt.Println("All original files have been successfully deleted.")
+			return apperr.Wrap(apperr.Internal, err, "error deleting original files")
+		}
+		fmt.Println("All original files have been successfully deleted.")
+		if output.JSON() {
+			return output.Print(map[string]string{"status": "ok", "source": renamedFilesJSON})
 		}
 
 	default:
-		fmt.Println("Unknown command. Use 'scan', 'analyse', 'transcode', or 'del-og'.")
+		return apperr.New(apperr.Usage, "Unknown command. Use 'init', 'scan', 'add', 'conflicts', 'versions', 'tags', 'probe', 'analyse', 'transcode', 'stats', 'history', 'queue', 'attach', 'cluster', 'experiment', 'serve', 'config', 'report', 'clean', 'sweep', 'watch', 'relocate', 'db', 'project', 'audio-report', 'presets', 'rules', 'quotas', 'archive', 'retranscode', 'lineage', or 'del-og'.")
+	}
+
+	return nil
+}
+
+// parseFlags parses a command's flags, which may appear before, between or
+// after its positional arguments, and returns the positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// transcodeSelection runs `transcode dir <path>`, `transcode --dirs a,b,c` or
+// `transcode --from-file list.txt` without any prompts. positionalNames lists
+// the positional arguments the form expects; each is taken as a directory.
+func transcodeSelection(args []string, positionalNames []string) error {
+	usage := "Usage: go run main.go transcode dir <path> | --dirs a,b,c | --from-file list.txt | --repeat-last\n" +
+		"  [--preset name] [--min-size GB] [--min-bitrate kbps] [--min-bpp N] [--min-duration s] [--has-stream m] [--lacks-stream m] [--tag t] [--codec c] [--in-res 480p|720p|1080p|1440p|4k|8k] [--out-res WxH] [--bitrate kbps] [--profile name] [--set field=value]\n" +
+		"  [--concurrent N] [--auto-delete] [--batch name] [--job-tag t] [--order fifo|smallest|shortest|savings|oldest] [--detach] [--skip-low-savings]"
+	var opts transcoder.SelectionOptions
+	var dirs, fromFile string
+	fs := flag.NewFlagSet("transcode", flag.ContinueOnError)
+	fs.StringVar(&dirs, "dirs", "", "comma separated directories to transcode")
+	fs.StringVar(&fromFile, "from-file", "", "file listing one video path or database ID per line (- for stdin)")
+	fs.Float64Var(&opts.MinSizeGB, "min-size", 0, "minimum file size in GB")
+	fs.IntVar(&opts.MinBitrate, "min-bitrate", 0, "only transcode files whose source bitrate exceeds this many kbps")
+	fs.Float64Var(&opts.MinBPP, "min-bpp", 0, "skip already efficient files below this many bits per pixel per frame")
+	fs.IntVar(&opts.MinDuration, "min-duration", 0, "only transcode files lasting at least this many seconds")
+	hasStreams := fs.String("has-stream", "", "only files with these streams, comma separated type[:codec][:language], e.g. audio:dts-hd")
+	lacksStreams := fs.String("lacks-stream", "", "only files without these streams, e.g. subtitle::eng")
+	tags := fs.String("tag", "", "only files carrying all of these comma separated tags")
+	jobTags := fs.String("job-tag", "", "comma separated tags to record on the transcodes, e.g. radarr-import")
+	fs.StringVar(&opts.InputRes, "in-res", "", "only transcode files in this resolution class (480p, 720p, 1080p, 1440p, 4k, 8k)")
+	codecs := fs.String("codec", "", "only transcode files in these comma separated video codecs, e.g. h264,mpeg2video")
+	fs.StringVar(&opts.OutputRes, "out-res", "", "output resolution, e.g. 1280x720")
+	fs.IntVar(&opts.Bitrate, "bitrate", 0, "output bitrate in kbps")
+	fs.StringVar(&opts.Profile, "profile", users.DefaultProfile(config.GetCurrentUser()), "profile supplying the output settings")
+	fs.Var(&opts.Overrides, "set", "override a profile field for this run only, e.g. bitrate=1500 (repeatable)")
+	fs.IntVar(&opts.Concurrent, "concurrent", 1, "number of concurrent transcodes")
+	fs.StringVar(&opts.Order, "order", config.GetQueueOrder(), "order the files run in: fifo, smallest, shortest, savings or oldest")
+	fs.BoolVar(&opts.AutoDelete, "auto-delete", false, "delete originals after transcoding")
+	fs.StringVar(&opts.BatchName, "batch", "", "name for this batch")
+	fs.BoolVar(&opts.Detach, "detach", false, "run in the background and return immediately")
+	fs.BoolVar(&opts.SkipLowSavings, "skip-low-savings", config.GetSkipLowSavings(), "skip files expected to save less than MIN_EXPECTED_SAVINGS percent")
+	repeatLast := fs.Bool("repeat-last", false, "re-run the criteria of the last interactive selection")
+	preset := fs.String("preset", "", "filter preset supplying any filters not given")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil || len(positional) != len(positionalNames) {
+		return apperr.New(apperr.Usage, usage)
+	}
+	if opts.AutoDelete {
+		if err := safety.Check("--auto-delete"); err != nil {
+			return err
+		}
+	}
+	if opts.WithStreams, err = db.ParseStreamMatches(*hasStreams); err != nil {
+		return apperr.Wrap(apperr.Usage, err, "invalid --has-stream")
+	}
+	if opts.WithoutStreams, err = db.ParseStreamMatches(*lacksStreams); err != nil {
+		return apperr.Wrap(apperr.Usage, err, "invalid --lacks-stream")
+	}
+	for _, codec := range strings.Split(*codecs, ",") {
+		if codec = strings.ToLower(strings.TrimSpace(codec)); codec != "" {
+			opts.Codecs = append(opts.Codecs, codec)
+		}
+	}
+	if opts.Tags, err = parseTagList(*tags); err != nil {
+		return apperr.Wrap(apperr.Usage, err, "invalid --tag")
+	}
+	if opts.JobTags, err = parseTagList(*jobTags); err != nil {
+		return apperr.Wrap(apperr.Usage, err, "invalid --job-tag")
+	}
+	if *repeatLast {
+		last, err := transcoder.LoadLastSelection()
+		if err != nil {
+			return err
+		}
+		last.Detach, last.SkipLowSavings, last.BatchName, last.JobTags = opts.Detach, opts.SkipLowSavings, opts.BatchName, opts.JobTags
+		return transcoder.TranscodeSelection(last)
+	}
+	opts.Directories = positional
+	for _, dir := range strings.Split(dirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			opts.Directories = append(opts.Directories, dir)
+		}
+	}
+	if fromFile != "" {
+		if opts.Files, err = readSelectionFile(fromFile); err != nil {
+			return apperr.Wrap(apperr.NotFound, err, "error reading selection file")
+		}
+	}
+	if len(opts.Directories) == 0 && len(opts.Files) == 0 {
+		return apperr.New(apperr.Usage, usage)
+	}
+	if *preset != "" {
+		if opts, err = transcoder.ApplyPreset(opts, *preset); err != nil {
+			return err
+		}
+	}
+	return transcoder.TranscodeSelection(opts)
+}
+
+// parseTagList reads comma separated tags, none when value is empty
+func parseTagList(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	return db.ParseTags([]string{value})
+}
+
+// readSelectionFile reads one entry per line, skipping blank lines and # comments
+func readSelectionFile(path string) ([]string, error) {
+	in := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
 	}
 
+	var entries []string
+	lines := bufio.NewScanner(in)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, lines.Err()
 }
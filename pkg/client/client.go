@@ -0,0 +1,192 @@
+// Package client is a typed Go client for the ZinoCoder transcode server API.
+// The coordinator uses it to talk to its workers; third-party tools can use it
+// to submit jobs and read progress without hand-rolling HTTP requests.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// Types shared with the server
+type (
+	Video            = datatypes.VideoObject
+	TranscodeRequest = datatypes.TranscodeRequest
+	Job              = datatypes.Job
+	JobStatus        = datatypes.JobStatus
+	JobProgress      = datatypes.JobProgress
+	ReloadResult     = datatypes.ReloadResult
+	BuildInfo        = datatypes.BuildInfo
+)
+
+// Client talks to a single transcode server
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// StatusError is returned when the server answers with a non-2xx status
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string // Body of the response, trimmed
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s responded with status %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// New creates a client for the server at baseURL, e.g. "http://worker1:8080".
+// A bare host:port is accepted and assumed to be plain HTTP.
+func New(baseURL string) *Client {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// SubmitJob queues a transcode on the server and returns the accepted job
+func (c *Client) SubmitJob(req TranscodeRequest) (*Job, error) {
+	var job Job
+	if err := c.do(http.MethodPost, "/transcode", nil, req, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListJobs returns every job the server has accepted
+func (c *Client) ListJobs() ([]Job, error) {
+	var jobs []Job
+	if err := c.do(http.MethodGet, "/jobs", nil, nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetProgress returns the live progress of the server's running transcodes
+func (c *Client) GetProgress() ([]JobProgress, error) {
+	var progress []JobProgress
+	if err := c.do(http.MethodGet, "/progress", nil, nil, &progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// ListVideos returns videos under directory that are at least minSizeGB in size
+func (c *Client) ListVideos(directory string, minSizeGB float64) ([]Video, error) {
+	query := url.Values{}
+	if directory != "" {
+		query.Set("dir", directory)
+	}
+	if minSizeGB > 0 {
+		query.Set("min_size", strconv.FormatFloat(minSizeGB, 'f', -1, 64))
+	}
+	var videos []Video
+	if err := c.do(http.MethodGet, "/videos", query, nil, &videos); err != nil {
+		return nil, err
+	}
+	return videos, nil
+}
+
+// ListVideosPage returns up to limit videos under directory that are at least
+// minSizeGB in size, starting after the cursor, and the cursor of the next
+// page ("" after the last page)
+func (c *Client) ListVideosPage(directory string, minSizeGB float64, after string, limit int) ([]Video, string, error) {
+	query := url.Values{}
+	if directory != "" {
+		query.Set("dir", directory)
+	}
+	if minSizeGB > 0 {
+		query.Set("min_size", strconv.FormatFloat(minSizeGB, 'f', -1, 64))
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	query.Set("limit", strconv.Itoa(limit))
+	var videos []Video
+	header, err := c.send(http.MethodGet, "/videos", query, nil, &videos)
+	if err != nil {
+		return nil, "", err
+	}
+	return videos, header.Get("X-Next-After"), nil
+}
+
+// ReloadConfig asks the server to re-read its config file and profiles
+func (c *Client) ReloadConfig() (*ReloadResult, error) {
+	var result ReloadResult
+	if err := c.do(http.MethodPost, "/config/reload", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Version returns the server's build, ffmpeg version and enabled features
+func (c *Client) Version() (*BuildInfo, error) {
+	var info BuildInfo
+	if err := c.do(http.MethodGet, "/version", nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response into out
+func (c *Client) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	_, err := c.send(method, path, query, body, out)
+	return err
+}
+
+// send is do, also returning the response headers
+func (c *Client) send(method, path string, query url.Values, body interface{}, out interface{}) (http.Header, error) {
+	endpoint := c.BaseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request: %w", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request to %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &StatusError{Method: method, Path: path, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if out == nil {
+		return resp.Header, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("error decoding response from %s: %w", path, err)
+	}
+	return resp.Header, nil
+}
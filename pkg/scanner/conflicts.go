@@ -0,0 +1,127 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConflictPolicy decides what a scan does with a file whose recorded
+// metadata is wildly different from what is now on disk, such as a file
+// replaced by another under the same name
+type ConflictPolicy string
+
+const (
+	// ConflictUpdate overwrites the record, as any other change (the default)
+	ConflictUpdate ConflictPolicy = "update"
+	// ConflictKeep keeps the old record as a version before updating it
+	ConflictKeep ConflictPolicy = "keep"
+	// ConflictFlag leaves the record alone and flags the file for review
+	ConflictFlag ConflictPolicy = "flag"
+	// ConflictPrompt asks the function given to SetConflictPolicy
+	ConflictPrompt ConflictPolicy = "prompt"
+)
+
+// Conflict is a recorded file that no longer looks like the file on disk
+type Conflict struct {
+	Path     string
+	Recorded Video
+	Found    Video
+	Reasons  []string
+}
+
+// ConflictStore is implemented by stores that can keep replaced records and
+// flag conflicts. Without it, every conflict is updated.
+type ConflictStore interface {
+	KeepVersion(recorded Video, reason string) error
+	FlagConflict(conflict Conflict) error
+}
+
+// SetConflictPolicy changes how later scans treat conflicts. ask answers
+// ConflictPrompt; without it, prompted conflicts are flagged. Unknown
+// policies fall back to ConflictUpdate.
+func (s *Scanner) SetConflictPolicy(policy ConflictPolicy, ask func(Conflict) ConflictPolicy) {
+	switch policy {
+	case ConflictKeep, ConflictFlag, ConflictPrompt:
+	default:
+		policy = ConflictUpdate
+	}
+	s.conflictMu.Lock()
+	s.conflicts = policy
+	s.ask = ask
+	s.conflictMu.Unlock()
+}
+
+// conflictPolicy returns the policy for a conflict, asking when configured to
+func (s *Scanner) conflictPolicy(conflict Conflict) ConflictPolicy {
+	s.conflictMu.Lock()
+	policy, ask := s.conflicts, s.ask
+	s.conflictMu.Unlock()
+	if policy != ConflictPrompt {
+		if policy == "" {
+			return ConflictUpdate
+		}
+		return policy
+	}
+	if ask == nil {
+		return ConflictFlag
+	}
+	switch answer := ask(conflict); answer {
+	case ConflictUpdate, ConflictKeep:
+		return answer
+	}
+	return ConflictFlag
+}
+
+// conflictReasons lists how found differs from recorded beyond an ordinary
+// change, like a remux or a re-encode at the same resolution. Metadata
+// missing on either side, such as after a failed probe, is not compared.
+func conflictReasons(recorded, found Video) []string {
+	var reasons []string
+	if recorded.Length > 0 && found.Length > 0 {
+		diff := recorded.Length - found.Length
+		if diff < 0 {
+			diff = -diff
+		}
+		tolerance := recorded.Length / 50
+		if tolerance < 2 {
+			tolerance = 2
+		}
+		if diff > tolerance {
+			reasons = append(reasons, fmt.Sprintf("length %ds -> %ds", recorded.Length, found.Length))
+		}
+	}
+	if recorded.Width > 0 && found.Width > 0 && (recorded.Width != found.Width || recorded.Height != found.Height) {
+		reasons = append(reasons, fmt.Sprintf("resolution %dx%d -> %dx%d", recorded.Width, recorded.Height, found.Width, found.Height))
+	}
+	return reasons
+}
+
+// resolveConflict applies the conflict policy to a changed file. It reports
+// whether the record should still be updated.
+func (s *Scanner) resolveConflict(recorded, found Video) (bool, error) {
+	reasons := conflictReasons(recorded, found)
+	if len(reasons) == 0 {
+		return true, nil
+	}
+	store, ok := s.store.(ConflictStore)
+	if !ok {
+		return true, nil
+	}
+	conflict := Conflict{Path: found.FullFilePath, Recorded: recorded, Found: found, Reasons: reasons}
+	summary := strings.Join(reasons, ", ")
+	switch s.conflictPolicy(conflict) {
+	case ConflictKeep:
+		s.logger.Printf("%s was replaced (%s), keeping the old entry as a version\n", conflict.Path, summary)
+		if err := store.KeepVersion(recorded, summary); err != nil {
+			return false, fmt.Errorf("error keeping previous version: %w", err)
+		}
+		return true, nil
+	case ConflictFlag:
+		s.logger.Printf("%s no longer matches its entry (%s), flagged for review\n", conflict.Path, summary)
+		if err := store.FlagConflict(conflict); err != nil {
+			return false, fmt.Errorf("error flagging conflict: %w", err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package scanner
+
+import "os"
+
+// diskSize falls back to the apparent size where st_blocks is not available
+func diskSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package scanner
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskSize returns the bytes allocated to a file (st_blocks × 512), which is
+// below its apparent size on compressed or sparse filesystems such as ZFS and btrfs
+func diskSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+	return info.Size()
+}
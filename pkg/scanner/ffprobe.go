@@ -0,0 +1,222 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/runner"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+)
+
+// Metadata is the stream information extracted from a video file
+type Metadata struct {
+	Width     int
+	Height    int
+	Length    int     // Length of the video in seconds
+	Framerate float64 // Framerate of the video
+	Frames    int     // Total number of frames, 0 when the container does not report it
+	Bitrate   int     // Bitrate of the video in bits per second
+
+	// Every stream other than cover art; the fields above describe the first
+	// video stream only, so multi-title sources need these
+	Streams []datatypes.Stream
+	// Why Streams is empty when listing them failed; the fields above are
+	// still valid
+	StreamsErr error
+}
+
+// Prober extracts metadata from a video file
+type Prober interface {
+	Probe(filePath string) (Metadata, error)
+}
+
+// FFProbe is the default Prober, shelling out to the ffprobe binary on PATH
+type FFProbe struct{}
+
+// Probe runs ffprobe with the arguments suited to the file's container
+func (FFProbe) Probe(filePath string) (Metadata, error) {
+	var meta Metadata
+	var err error
+	ext := strings.ToLower(splitPath(filePath).ext)
+	switch ext {
+	case ".mp4", ".mov", ".m4v", ".avi":
+		meta, err = probeMP4(filePath)
+	case ".mkv":
+		meta, err = probeMKV(filePath)
+	default:
+		return Metadata{}, fmt.Errorf("unsupported file type %s", ext)
+	}
+	if err != nil {
+		return meta, err
+	}
+	meta.Streams, meta.StreamsErr = probeStreams(filePath)
+	return meta, nil
+}
+
+// VideoCodec returns the codec of the first video stream, or "" without one
+func VideoCodec(streams []datatypes.Stream) string {
+	for _, stream := range streams {
+		if stream.Type == "video" {
+			return stream.Codec
+		}
+	}
+	return ""
+}
+
+// ffprobe runs ffprobe with args on filePath, on its host for ssh:// files
+func ffprobe(filePath string, args ...string) ([]byte, error) {
+	if sshpath.Is(filePath) {
+		p, err := sshpath.Parse(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return p.Output("ffprobe", append(args, p.Path)...)
+	}
+	return runner.Output("ffprobe", append(args, filePath)...)
+}
+
+// probeStreams lists every stream except embedded cover art. Streams
+// without their own bitrate, as in MKV, fall back to the BPS tag.
+func probeStreams(filePath string) ([]datatypes.Stream, error) {
+	out, err := ffprobe(filePath, "-v", "error", "-show_entries",
+		"stream=index,codec_type,codec_name,profile,channels,sample_rate,width,height,avg_frame_rate,bit_rate:stream_tags=BPS,language:stream_disposition=attached_pic,default,forced,hearing_impaired",
+		"-of", "json")
+	if err != nil {
+		return nil, fmt.Errorf("error listing streams of %s: %w", filePath, err)
+	}
+	var probe struct {
+		Streams []struct {
+			Index       int               `json:"index"`
+			Type        string            `json:"codec_type"`
+			Codec       string            `json:"codec_name"`
+			Profile     string            `json:"profile"`
+			Channels    int               `json:"channels"`
+			SampleRate  string            `json:"sample_rate"`
+			Width       int               `json:"width"`
+			Height      int               `json:"height"`
+			Framerate   string            `json:"avg_frame_rate"`
+			BitRate     string            `json:"bit_rate"`
+			Tags        map[string]string `json:"tags"`
+			Disposition map[string]int    `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("error decoding streams of %s: %w", filePath, err)
+	}
+
+	var streams []datatypes.Stream
+	for _, s := range probe.Streams {
+		if s.Type == "video" && s.Disposition["attached_pic"] == 1 {
+			continue
+		}
+		bitrate, err := strconv.Atoi(s.BitRate)
+		if err != nil {
+			bitrate, _ = strconv.Atoi(s.Tags["BPS"])
+		}
+		language := strings.ToLower(s.Tags["language"])
+		if language == "und" {
+			language = ""
+		}
+		sampleRate, _ := strconv.Atoi(s.SampleRate)
+		streams = append(streams, datatypes.Stream{
+			Index:      s.Index,
+			Type:       s.Type,
+			Codec:      s.Codec,
+			Profile:    s.Profile,
+			Language:   language,
+			Channels:   s.Channels,
+			SampleRate: sampleRate,
+			Width:      s.Width,
+			Height:     s.Height,
+			Framerate:  parseFramerate(s.Framerate),
+			Bitrate:    bitrate,
+
+			Default:         s.Disposition["default"] == 1,
+			Forced:          s.Disposition["forced"] == 1,
+			HearingImpaired: s.Disposition["hearing_impaired"] == 1,
+		})
+	}
+	return streams, nil
+}
+
+// probeMP4 reads duration, frame count and bitrate from the first video stream
+func probeMP4(filePath string) (Metadata, error) {
+	output, err := ffprobe(filePath, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,avg_frame_rate,nb_frames,bit_rate,duration",
+		"-of", "csv=p=0")
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error running ffprobe for %s: %w", filePath, err)
+	}
+
+	var meta Metadata
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ",")
+		if len(parts) >= 6 {
+			meta.Width, _ = strconv.Atoi(parts[0])
+			meta.Height, _ = strconv.Atoi(parts[1])
+			meta.Framerate = parseFramerate(parts[2]) // Handle framerate as a fraction
+			durationFloat, _ := strconv.ParseFloat(parts[3], 64)
+			meta.Length = int(durationFloat)
+			meta.Frames, _ = strconv.Atoi(parts[4])
+			meta.Bitrate, _ = strconv.Atoi(parts[5])
+		}
+	}
+	return meta, nil
+}
+
+// probeMKV reads duration and bitrate from the format section, since MKV
+// streams rarely carry them
+func probeMKV(filePath string) (Metadata, error) {
+	output, err := ffprobe(filePath, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,avg_frame_rate",
+		"-show_entries", "format=duration,bit_rate", "-of", "csv=p=0")
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error running ffprobe for MKV %s: %w", filePath, err)
+	}
+
+	var meta Metadata
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ",")
+		if len(parts) >= 5 {
+			meta.Width, _ = strconv.Atoi(parts[0])
+			meta.Height, _ = strconv.Atoi(parts[1])
+			meta.Framerate = parseFramerate(parts[2])
+
+			// Handle duration (from format section)
+			if parts[3] != "N/A" {
+				durationFloat, _ := strconv.ParseFloat(parts[3], 64)
+				meta.Length = int(durationFloat)
+			}
+
+			// Handle bitrate (from format section)
+			if parts[4] != "N/A" {
+				meta.Bitrate, _ = strconv.Atoi(parts[4])
+			}
+		}
+	}
+	return meta, nil // MKV does not reliably provide nb_frames
+}
+
+// parseFramerate converts a fraction string like "30000/1001" to a float
+func parseFramerate(fps string) float64 {
+	parts := strings.Split(fps, "/")
+	if len(parts) == 2 {
+		numerator, err1 := strconv.ParseFloat(parts[0], 64)
+		denominator, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 == nil && err2 == nil && denominator != 0 {
+			return numerator / denominator
+		}
+	}
+	// If it's not a fraction, attempt to parse as a float
+	if framerate, err := strconv.ParseFloat(fps, 64); err == nil {
+		return framerate
+	}
+	return 0.0
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package scanner
+
+import "os"
+
+// fileID is not available here, so every file is treated as unique
+func fileID(info os.FileInfo) (device, inode int64, links int) {
+	return 0, 0, 1
+}
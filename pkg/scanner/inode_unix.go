@@ -0,0 +1,17 @@
+//go:build unix
+
+package scanner
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode identifying a file's data, and how many
+// names (hard links) point at it
+func fileID(info os.FileInfo) (device, inode int64, links int) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Dev), int64(stat.Ino), int(stat.Nlink)
+	}
+	return 0, 0, 1
+}
@@ -0,0 +1,120 @@
+package scanner
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+)
+
+// urlClient bounds the requests made to size up remote files
+var urlClient = &http.Client{Timeout: 30 * time.Second}
+
+// remoteInfo describes a file at a URL or on an ssh host. It has no inode or
+// allocated size, so its disk size is its apparent size and it never counts
+// as a hard link.
+type remoteInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i remoteInfo) Name() string       { return i.name }
+func (i remoteInfo) Size() int64        { return i.size }
+func (i remoteInfo) Mode() os.FileMode  { return 0444 }
+func (i remoteInfo) ModTime() time.Time { return i.modTime }
+func (i remoteInfo) IsDir() bool        { return false }
+func (i remoteInfo) Sys() interface{}   { return nil }
+
+// StatURL asks the server for the size and modification time of the file
+// at an HTTP(S) URL. The size is 0 when the server does not report it, and
+// a file the server does not have is reported as os.ErrNotExist.
+func StatURL(rawURL string) (os.FileInfo, error) {
+	response, err := urlClient.Head(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		return nil, fmt.Errorf("%s returned %s: %w", rawURL, response.Status, os.ErrNotExist)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", rawURL, response.Status)
+	}
+	info := remoteInfo{name: splitPath(rawURL).name, size: response.ContentLength}
+	if info.size < 0 {
+		info.size = 0
+	}
+	if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.modTime = modified
+	}
+	return info, nil
+}
+
+// StatSSH asks the host of an ssh:// file for its size
+func StatSSH(name string) (os.FileInfo, error) {
+	p, err := sshpath.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := p.Size()
+	if err != nil {
+		return nil, err
+	}
+	return remoteInfo{name: path.Base(p.Path), size: size}, nil
+}
+
+// stat returns the file information of a local path, URL or ssh:// file
+func stat(filePath string) (os.FileInfo, error) {
+	if pathutil.IsURL(filePath) {
+		return StatURL(filePath)
+	}
+	if sshpath.Is(filePath) {
+		return StatSSH(filePath)
+	}
+	return os.Stat(filePath)
+}
+
+// pathParts is a file's directory, name and extension
+type pathParts struct {
+	dir, name, ext string
+}
+
+// splitPath splits a local path, an ssh:// path, or a URL ignoring its query string
+func splitPath(filePath string) pathParts {
+	if p, err := sshpath.Parse(filePath); err == nil {
+		return pathParts{dir: p.Dir().String(), name: path.Base(p.Path), ext: path.Ext(p.Path)}
+	}
+	if pathutil.IsURL(filePath) {
+		if u, err := url.Parse(filePath); err == nil {
+			dir := url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: path.Dir(u.Path)}
+			return pathParts{dir: dir.String(), name: path.Base(u.Path), ext: path.Ext(u.Path)}
+		}
+	}
+	return pathParts{dir: filepath.Dir(filePath), name: filepath.Base(filePath), ext: filepath.Ext(filePath)}
+}
+
+// scanSSH lists the files under an ssh:// root on its host and passes the
+// videos among them to probe, each probed by the host's ffprobe
+func (s *Scanner) scanSSH(root string, probe func(path string)) error {
+	dir, err := sshpath.Parse(root)
+	if err != nil {
+		return err
+	}
+	files, err := dir.List()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if CheckExtension(file.Path) {
+			probe(file.String())
+		}
+	}
+	return nil
+}
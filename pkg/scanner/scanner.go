@@ -0,0 +1,540 @@
+// Package scanner walks media directories, probes video files and records
+// their metadata in a Store. It is the library behind the `scan` command and
+// can be embedded by other Go programs with their own store, prober and logger.
+package scanner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+	"github.com/palzino/vidanalyser/internal/pathutil"
+	"github.com/palzino/vidanalyser/internal/sshpath"
+)
+
+// Video is the metadata recorded for a single file
+type Video = datatypes.VideoObject
+
+// Store persists scanned videos
+type Store interface {
+	// QueryVideoByPath returns nil without an error when the path is unknown
+	QueryVideoByPath(filePath string) (*Video, error)
+	InsertVideo(video Video) error
+	UpdateVideo(video Video) error
+}
+
+// ModTimeStore is implemented by stores that can record the modification time
+// of an otherwise unchanged file, so later incremental scans can skip it
+type ModTimeStore interface {
+	SetModTime(filePath string, modTime int64) error
+}
+
+// Logger receives informational messages; errors are returned instead
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
+
+// Action describes what happened to a file during a scan
+type Action string
+
+const (
+	ActionInserted  Action = "inserted"
+	ActionUpdated   Action = "updated"
+	ActionUnchanged Action = "unchanged"
+	ActionFlagged   Action = "flagged"
+	ActionFailed    Action = "failed"
+)
+
+// Result is the outcome of processing a single file. Err is set when probing
+// or storing failed; a file whose probe failed is still recorded with its size
+// so it shows up in the library.
+type Result struct {
+	Path   string
+	Action Action
+	Video  Video
+	Err    error
+}
+
+// Summary totals the results of a scan. Errors holds the errors that stopped a
+// directory from being walked; per-file errors are reported through Result.
+type Summary struct {
+	Total     int
+	Inserted  int
+	Updated   int
+	Unchanged int
+	Flagged   int
+	Failed    int
+	Errors    []error
+
+	// Totals over every file seen, so compressed datasets can be compared
+	ApparentSize int64 // Bytes, as reported by ls
+	DiskSize     int64 // Bytes allocated on disk (st_blocks)
+	HardLinks    int   // Extra names of files already counted, left out of the sizes
+
+	seen map[[2]int64]bool // Device and inode of every file counted
+}
+
+func (s *Summary) add(result Result) {
+	s.Total++
+	switch result.Action {
+	case ActionInserted:
+		s.Inserted++
+	case ActionUpdated:
+		s.Updated++
+	case ActionUnchanged:
+		s.Unchanged++
+	case ActionFlagged:
+		s.Flagged++
+	case ActionFailed:
+		s.Failed++
+	}
+
+	// Hard links share their data, so only the first name counts towards the sizes
+	if video := result.Video; video.Inode != 0 {
+		id := [2]int64{video.Device, video.Inode}
+		if s.seen[id] {
+			s.HardLinks++
+			return
+		}
+		if s.seen == nil {
+			s.seen = map[[2]int64]bool{}
+		}
+		s.seen[id] = true
+	}
+	s.ApparentSize += int64(result.Video.Size)
+	s.DiskSize += int64(result.Video.DiskSize)
+}
+
+var videoExtensions = map[string]bool{
+	".mp4":  true,
+	".mkv":  true,
+	".avi":  true,
+	".mov":  true,
+	".m4v":  true,
+	".webm": true,
+}
+
+// CheckExtension checks if the file, or the path of a URL, has a video extension
+func CheckExtension(filename string) bool {
+	ext := strings.ToLower(splitPath(filename).ext)
+	return videoExtensions[ext]
+}
+
+// Scanner records video metadata found on disk into a Store
+type Scanner struct {
+	store  Store
+	prober Prober
+	logger Logger
+
+	mu           sync.Mutex
+	total        int
+	workers      int
+	incremental  bool
+	videoStreams string // Video stream the fields of a multi-stream source describe
+
+	linkMu   sync.Mutex
+	symlinks SymlinkPolicy
+	visited  map[string]bool // Real paths scanned while following links
+
+	conflictMu sync.Mutex
+	conflicts  ConflictPolicy
+	ask        func(Conflict) ConflictPolicy
+}
+
+// New creates a Scanner. A nil prober uses ffprobe and a nil logger discards messages.
+func New(store Store, prober Prober, logger Logger) *Scanner {
+	if prober == nil {
+		prober = FFProbe{}
+	}
+	if logger == nil {
+		logger = discardLogger{}
+	}
+	return &Scanner{store: store, prober: prober, logger: logger}
+}
+
+// Total returns the number of files processed by this Scanner so far
+func (s *Scanner) Total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// SetWorkers sets how many files later scans probe at once; below 1 it
+// probes one at a time
+func (s *Scanner) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	s.mu.Lock()
+	s.workers = n
+	s.mu.Unlock()
+}
+
+// SetIncremental makes later scans trust the entries of files whose size,
+// modification time and inode are unchanged instead of probing them again.
+// Files rewritten in place with the same size and time are only noticed by a
+// full scan.
+func (s *Scanner) SetIncremental(incremental bool) {
+	s.mu.Lock()
+	s.incremental = incremental
+	s.mu.Unlock()
+}
+
+// SetVideoStreamPolicy changes which video stream of a multi-stream source
+// later scans describe in the resolution, framerate, bitrate and codec of
+// its Video: the largest by resolution for "largest", the first otherwise
+func (s *Scanner) SetVideoStreamPolicy(policy string) {
+	s.mu.Lock()
+	s.videoStreams = policy
+	s.mu.Unlock()
+}
+
+// unmodified returns the entry of a file whose recorded size, modification
+// time and, where known, device and inode match info, or nil when the file
+// has to be probed. The inode catches a file replaced by another of the same
+// size and time, e.g. moved over it from a copy that kept its times.
+func (s *Scanner) unmodified(filePath string, info os.FileInfo) (*Video, error) {
+	s.mu.Lock()
+	incremental := s.incremental
+	s.mu.Unlock()
+	if !incremental {
+		return nil, nil
+	}
+	recorded, err := s.store.QueryVideoByPath(filePath)
+	if err != nil || recorded == nil {
+		return nil, err
+	}
+	if recorded.ModTime == 0 || recorded.ModTime != modTime(info) || recorded.Size != int(info.Size()) {
+		return nil, nil
+	}
+	if device, inode, _ := fileID(info); recorded.Inode != 0 && (recorded.Device != device || recorded.Inode != inode) {
+		return nil, nil
+	}
+	return recorded, nil
+}
+
+// modTime is the modification time of a file in Unix nanoseconds, or 0 when
+// it is unknown
+func modTime(info os.FileInfo) int64 {
+	if info.ModTime().IsZero() {
+		return 0
+	}
+	return info.ModTime().UnixNano()
+}
+
+// Probe extracts the metadata of a single file, local or at an HTTP(S) URL,
+// as ProcessFile would record it, without touching the store. When ffprobe
+// fails the video still carries its sizes, next to the error.
+func (s *Scanner) Probe(filePath string) (Video, error) {
+	info, err := stat(filePath)
+	if err != nil {
+		return Video{}, fmt.Errorf("error getting file size: %w", err)
+	}
+	meta, err := s.prober.Probe(filePath)
+	video := describe(filePath, info, meta)
+	s.mu.Lock()
+	if s.videoStreams == "largest" {
+		describeLargestStream(&video)
+	}
+	s.mu.Unlock()
+	return video, err
+}
+
+// describe builds the record of a file from its stat and probed metadata
+func describe(filePath string, info os.FileInfo, meta Metadata) Video {
+	parts := splitPath(filePath)
+	video := Video{
+		Name:          parts.name,
+		Location:      parts.dir,
+		FullFilePath:  filePath,
+		Size:          int(info.Size()),
+		Width:         meta.Width,
+		Height:        meta.Height,
+		Length:        meta.Length,
+		Framerate:     meta.Framerate,
+		Frames:        meta.Frames,
+		Bitrate:       meta.Bitrate,
+		FileExtension: parts.ext,
+		DiskSize:      int(diskSize(info)),
+		Streams:       meta.Streams,
+		VideoCodec:    VideoCodec(meta.Streams),
+		ModTime:       modTime(info),
+		SampleHash:    SampleHash(filePath),
+	}
+	video.Device, video.Inode, video.Links = fileID(info)
+	return video
+}
+
+// describeLargestStream makes the fields of video describe its video stream
+// with the most pixels rather than the first, as that is the one transcoded
+// under the "largest" policy
+func describeLargestStream(video *Video) {
+	videos := video.VideoStreams()
+	if len(videos) == 0 {
+		return
+	}
+	largest := videos[0]
+	for _, stream := range videos[1:] {
+		if stream.Width*stream.Height > largest.Width*largest.Height {
+			largest = stream
+		}
+	}
+	if largest.Index == videos[0].Index {
+		return
+	}
+	video.Width, video.Height, video.VideoCodec = largest.Width, largest.Height, largest.Codec
+	if largest.Framerate > 0 {
+		video.Framerate = largest.Framerate
+	}
+	if largest.Bitrate > 0 {
+		video.Bitrate = largest.Bitrate
+	}
+}
+
+// sampleSize is how much of a file SampleHash reads
+const sampleSize = 1 << 20
+
+// SampleHash returns the SHA-256 of the first MiB of a local file, which
+// tells files of the same size apart without reading all of them. It is
+// empty for files at a URL or on an ssh host and for unreadable files.
+func SampleHash(filePath string) string {
+	if pathutil.IsURL(filePath) || sshpath.Is(filePath) {
+		return ""
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(file, sampleSize)); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ProcessFile probes a single file, local or at an HTTP(S) URL, and inserts
+// or updates its record. Files already recorded with the same size are left
+// untouched, and incremental scans do not probe them when their modification
+// time is unchanged too.
+func (s *Scanner) ProcessFile(filePath string) Result {
+	result := Result{Path: filePath, Action: ActionFailed}
+
+	info, err := stat(filePath)
+	if err != nil {
+		result.Err = fmt.Errorf("error getting file size: %w", err)
+		return result
+	}
+	recorded, err := s.unmodified(filePath, info)
+	if err != nil {
+		result.Err = fmt.Errorf("error querying video from database: %w", err)
+		return result
+	}
+	if recorded != nil {
+		s.mu.Lock()
+		s.total++
+		s.mu.Unlock()
+		result.Action = ActionUnchanged
+		result.Video = *recorded
+		return result
+	}
+	meta, probeErr := s.prober.Probe(filePath)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+
+	result.Video = describe(filePath, info, meta)
+	if meta.StreamsErr != nil {
+		s.logger.Printf("Recording %s without its streams: %s\n", filePath, meta.StreamsErr)
+	}
+	if videos := result.Video.VideoStreams(); len(videos) > 1 {
+		s.logger.Printf("%s has %d video streams\n", filePath, len(videos))
+		if s.videoStreams == "largest" {
+			describeLargestStream(&result.Video)
+		}
+	}
+
+	existingVideo, err := s.store.QueryVideoByPath(filePath)
+	if err != nil {
+		result.Err = fmt.Errorf("error querying video from database: %w", err)
+		return result
+	}
+
+	// If the file exists with the same sizes and links, skip processing
+	if existingVideo != nil && existingVideo.Size == result.Video.Size && existingVideo.DiskSize == result.Video.DiskSize &&
+		existingVideo.Inode == result.Video.Inode && existingVideo.Links == result.Video.Links {
+		if store, ok := s.store.(ModTimeStore); ok && existingVideo.ModTime != result.Video.ModTime {
+			if err := store.SetModTime(filePath, result.Video.ModTime); err != nil {
+				result.Err = fmt.Errorf("error updating video in database: %w", err)
+				return result
+			}
+		}
+		result.Action = ActionUnchanged
+		return result
+	}
+
+	// If the file exists but the size differs, update it unless it conflicts
+	// with its entry; otherwise, insert it
+	if existingVideo != nil {
+		update, err := s.resolveConflict(*existingVideo, result.Video)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		if !update {
+			result.Action = ActionFlagged
+			return result
+		}
+		s.logger.Printf("File exists but size differs. Updating entry: %s\n", filePath)
+		if err := s.store.UpdateVideo(result.Video); err != nil {
+			result.Err = fmt.Errorf("error updating video in database: %w", err)
+			return result
+		}
+		result.Action = ActionUpdated
+	} else {
+		if err := s.store.InsertVideo(result.Video); err != nil {
+			result.Err = fmt.Errorf("error inserting video into database: %w", err)
+			return result
+		}
+		result.Action = ActionInserted
+	}
+
+	result.Err = probeErr
+	return result
+}
+
+// ProcessDirectory walks a directory recursively and processes every video file.
+// onResult, if not nil, is called for each file as soon as it has been processed.
+// Symbolic links are handled according to the scanner's SymlinkPolicy.
+func (s *Scanner) ProcessDirectory(directory string, onResult func(Result)) error {
+	return s.walk(directory, func(path string) { emit(s.ProcessFile(path), onResult) }, onResult)
+}
+
+// walk passes every video file under directory to probe
+func (s *Scanner) walk(directory string, probe func(path string), onResult func(Result)) error {
+	following := s.symlinkPolicy() == SymlinksFollow
+	return filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking path %s: %w", path, err)
+		}
+		if entry.IsDir() {
+			// A directory reached twice through links is a cycle or a duplicate
+			if following && !s.visit(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return s.processEntry(path, entry, probe, onResult)
+	})
+}
+
+// processEntry processes a non-directory entry: a video file or a symbolic link
+func (s *Scanner) processEntry(path string, entry fs.DirEntry, probe func(path string), onResult func(Result)) error {
+	if entry.Type()&fs.ModeSymlink != 0 {
+		return s.processSymlink(path, probe, onResult)
+	}
+	if !CheckExtension(entry.Name()) {
+		return nil
+	}
+	if s.symlinkPolicy() == SymlinksFollow && !s.visit(path) {
+		return nil
+	}
+	probe(path)
+	return nil
+}
+
+// startWorkers starts the scanner's workers, which process the paths passed
+// to probe and report them to collect. wait closes the pool and returns once
+// every path has been processed.
+func (s *Scanner) startWorkers(collect func(Result)) (probe func(path string), wait func()) {
+	s.mu.Lock()
+	workers := s.workers
+	s.mu.Unlock()
+	if workers < 1 {
+		workers = 1
+	}
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				collect(s.ProcessFile(path))
+			}
+		}()
+	}
+	return func(path string) { paths <- path }, func() {
+		close(paths)
+		wg.Wait()
+	}
+}
+
+// Scan walks root and probes the video files found with the scanner's
+// workers, returning once all of them are done.
+func (s *Scanner) Scan(root string, onResult func(Result)) (Summary, error) {
+	var summary Summary
+	var summaryMu sync.Mutex
+	collect := func(result Result) {
+		summaryMu.Lock()
+		summary.add(result)
+		summaryMu.Unlock()
+		if onResult != nil {
+			onResult(result)
+		}
+	}
+
+	if sshpath.Is(root) {
+		probe, wait := s.startWorkers(collect)
+		err := s.scanSSH(root, probe)
+		wait()
+		if err != nil {
+			return summary, fmt.Errorf("error reading master folder: %w", err)
+		}
+		return summary, nil
+	}
+
+	files, err := os.ReadDir(root)
+	if err != nil {
+		return summary, fmt.Errorf("error reading master folder: %w", err)
+	}
+	s.resetVisited()
+	if s.symlinkPolicy() == SymlinksFollow {
+		s.visit(root)
+	}
+
+	// Walk the master directory, then each subdirectory, feeding the workers
+	probe, wait := s.startWorkers(collect)
+	var errs []error
+	for _, file := range files {
+		if !file.IsDir() {
+			if err := s.processEntry(filepath.Join(root, file.Name()), file, probe, collect); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, subdir := range files {
+		if subdir.IsDir() {
+			if err := s.walk(filepath.Join(root, subdir.Name()), probe, collect); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	wait()
+	summary.Errors = append(summary.Errors, errs...)
+
+	return summary, nil
+}
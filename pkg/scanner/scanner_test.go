@@ -0,0 +1,111 @@
+package scanner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/palzino/vidanalyser/internal/datatypes"
+)
+
+// fixedProber returns the same metadata for every file
+type fixedProber Metadata
+
+func (p fixedProber) Probe(string) (Metadata, error) {
+	return Metadata(p), nil
+}
+
+// writeVideo creates a small file standing in for a video
+func writeVideo(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProcessFileDescribesLargestStream(t *testing.T) {
+	prober := fixedProber{Width: 1280, Height: 720, Framerate: 25, Bitrate: 2000000, Streams: []datatypes.Stream{
+		{Index: 0, Type: "video", Codec: "h264", Width: 1280, Height: 720, Framerate: 25, Bitrate: 2000000},
+		{Index: 1, Type: "audio", Codec: "aac"},
+		{Index: 2, Type: "video", Codec: "hevc", Width: 3840, Height: 2160, Framerate: 50, Bitrate: 20000000},
+	}}
+	path := writeVideo(t, "concert.mkv")
+
+	for _, test := range []struct {
+		policy string
+		want   datatypes.Stream
+	}{
+		{"first", prober.Streams[0]},
+		{"all", prober.Streams[0]},
+		{"largest", prober.Streams[2]},
+	} {
+		s := New(&memoryStore{}, prober, nil)
+		s.SetVideoStreamPolicy(test.policy)
+		result := s.ProcessFile(path)
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		video := result.Video
+		if video.Width != test.want.Width || video.Height != test.want.Height || video.Framerate != test.want.Framerate ||
+			video.Bitrate != test.want.Bitrate || video.VideoCodec != test.want.Codec {
+			t.Errorf("%s: recorded %dx%d %gfps %dbps %s, want stream %d", test.policy,
+				video.Width, video.Height, video.Framerate, video.Bitrate, video.VideoCodec, test.want.Index)
+		}
+		if len(video.Streams) != 3 {
+			t.Errorf("%s: recorded %d streams, want 3", test.policy, len(video.Streams))
+		}
+	}
+}
+
+func TestProcessFileRecordsVideoWithoutStreams(t *testing.T) {
+	prober := fixedProber{Width: 1920, Height: 1080, Length: 60, StreamsErr: errors.New("ffprobe crashed")}
+	path := writeVideo(t, "movie.mkv")
+
+	store := &memoryStore{}
+	result := New(store, prober, nil).ProcessFile(path)
+	if result.Err != nil || result.Action != ActionInserted {
+		t.Fatalf("got %s (%v), want the file inserted", result.Action, result.Err)
+	}
+	if recorded := store.videos[path]; recorded.Width != 1920 || recorded.Length != 60 {
+		t.Errorf("recorded %+v, want the probed metadata", recorded)
+	}
+}
+
+func TestIncrementalScanProbesReplacedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "movie.mkv")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(name string) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(path)
+
+	prober := &countingProber{}
+	s := New(&memoryStore{}, prober, nil)
+	s.SetIncremental(true)
+	s.ProcessFile(path)
+	if result := s.ProcessFile(path); result.Action != ActionUnchanged || prober.probes[path] != 1 {
+		t.Fatalf("unchanged file: %s after %d probes, want it trusted", result.Action, prober.probes[path])
+	}
+
+	// A copy with the same size and time moved over the original
+	replacement := filepath.Join(dir, "replacement.mkv")
+	write(replacement)
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	s.ProcessFile(path)
+	if prober.probes[path] != 2 {
+		t.Errorf("probed the replaced file %d times, want it probed again", prober.probes[path])
+	}
+}
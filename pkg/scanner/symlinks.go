@@ -0,0 +1,150 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SymlinkPolicy decides what a scan does with symbolic links
+type SymlinkPolicy string
+
+const (
+	// SymlinksSkip ignores links to files and directories (the default)
+	SymlinksSkip SymlinkPolicy = "skip"
+	// SymlinksFollow scans link targets by their real path, once each, and
+	// stops at link cycles
+	SymlinksFollow SymlinkPolicy = "follow"
+	// SymlinksRecord records links to videos as links without probing them and
+	// does not descend into linked directories
+	SymlinksRecord SymlinkPolicy = "record"
+)
+
+// SetSymlinkPolicy changes how later scans treat symbolic links. Unknown
+// policies fall back to SymlinksSkip.
+func (s *Scanner) SetSymlinkPolicy(policy SymlinkPolicy) {
+	switch policy {
+	case SymlinksFollow, SymlinksRecord:
+	default:
+		policy = SymlinksSkip
+	}
+	s.linkMu.Lock()
+	s.symlinks = policy
+	s.linkMu.Unlock()
+}
+
+// symlinkPolicy returns the current policy
+func (s *Scanner) symlinkPolicy() SymlinkPolicy {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	if s.symlinks == "" {
+		return SymlinksSkip
+	}
+	return s.symlinks
+}
+
+// resetVisited forgets the real paths seen by a previous scan
+func (s *Scanner) resetVisited() {
+	s.linkMu.Lock()
+	s.visited = nil
+	s.linkMu.Unlock()
+}
+
+// visit marks the real path of a file or directory as scanned and reports
+// whether it was new. Only used when following links.
+func (s *Scanner) visit(path string) bool {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		real = path
+	}
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	if s.visited == nil {
+		s.visited = map[string]bool{}
+	}
+	if s.visited[real] {
+		return false
+	}
+	s.visited[real] = true
+	return true
+}
+
+// processSymlink applies the symlink policy to a link found while walking
+func (s *Scanner) processSymlink(path string, probe func(path string), onResult func(Result)) error {
+	switch s.symlinkPolicy() {
+	case SymlinksFollow:
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			s.logger.Printf("Skipping broken link %s: %s\n", path, err)
+			return nil
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			return fmt.Errorf("error reading link target %s: %w", target, err)
+		}
+		if info.IsDir() {
+			return s.walk(target, probe, onResult)
+		}
+		if CheckExtension(target) && s.visit(target) {
+			probe(target)
+		}
+
+	case SymlinksRecord:
+		if CheckExtension(path) {
+			emit(s.recordLink(path), onResult)
+		}
+	}
+	return nil
+}
+
+// recordLink stores a link to a video under its own path with its target,
+// without probing it, so the target is never counted or transcoded twice
+func (s *Scanner) recordLink(path string) Result {
+	result := Result{Path: path, Action: ActionFailed}
+	target, err := os.Readlink(path)
+	if err != nil {
+		result.Err = fmt.Errorf("error reading link: %w", err)
+		return result
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+
+	result.Video = Video{
+		Name:          filepath.Base(path),
+		Location:      filepath.Dir(path),
+		FullFilePath:  path,
+		FileExtension: filepath.Ext(path),
+		LinkTarget:    target,
+	}
+	existingVideo, err := s.store.QueryVideoByPath(path)
+	if err != nil {
+		result.Err = fmt.Errorf("error querying video from database: %w", err)
+		return result
+	}
+	switch {
+	case existingVideo != nil && existingVideo.LinkTarget == target:
+		result.Action = ActionUnchanged
+	case existingVideo != nil:
+		if err := s.store.UpdateVideo(result.Video); err != nil {
+			result.Err = fmt.Errorf("error updating video in database: %w", err)
+			return result
+		}
+		result.Action = ActionUpdated
+	default:
+		if err := s.store.InsertVideo(result.Video); err != nil {
+			result.Err = fmt.Errorf("error inserting video into database: %w", err)
+			return result
+		}
+		result.Action = ActionInserted
+	}
+	return result
+}
+
+// emit passes a result to onResult when it is set
+func emit(result Result, onResult func(Result)) {
+	if onResult != nil {
+		onResult(result)
+	}
+}
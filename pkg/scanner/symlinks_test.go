@@ -0,0 +1,196 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a Store kept in a map
+type memoryStore struct {
+	mu     sync.Mutex
+	videos map[string]Video
+}
+
+func (m *memoryStore) QueryVideoByPath(filePath string) (*Video, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if video, ok := m.videos[filePath]; ok {
+		return &video, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) InsertVideo(video Video) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.videos == nil {
+		m.videos = map[string]Video{}
+	}
+	m.videos[video.FullFilePath] = video
+	return nil
+}
+
+func (m *memoryStore) UpdateVideo(video Video) error {
+	return m.InsertVideo(video)
+}
+
+// countingProber counts how often each path is probed
+type countingProber struct {
+	mu     sync.Mutex
+	probes map[string]int
+}
+
+func (p *countingProber) Probe(filePath string) (Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.probes == nil {
+		p.probes = map[string]int{}
+	}
+	p.probes[filePath]++
+	return Metadata{Width: 1920, Height: 1080, Length: 60}, nil
+}
+
+// symlinkTree builds a library with link cycles, duplicate links to a file
+// and a directory, and dangling links, and returns its root with the real
+// paths of its only two videos
+func symlinkTree(t *testing.T) (string, []string) {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	movies := filepath.Join(root, "movies")
+	if err := os.Mkdir(movies, 0755); err != nil {
+		t.Fatal(err)
+	}
+	videos := []string{filepath.Join(movies, "a.mkv"), filepath.Join(root, "b.mp4")}
+	for _, video := range videos {
+		if err := os.WriteFile(video, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(movies, "up"):         "..",           // Cycle back to the root
+		filepath.Join(movies, "self"):       ".",            // Cycle to its own directory
+		filepath.Join(root, "alias.mkv"):    "movies/a.mkv", // Second name for a video
+		filepath.Join(root, "shortcut"):     "movies",       // Second name for a directory
+		filepath.Join(root, "dangling.mkv"): "gone.mkv",
+		filepath.Join(movies, "nowhere"):    "../missing",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symbolic links are not supported here: %s", err)
+		}
+	}
+	return root, videos
+}
+
+// scanWithin scans root and fails the test if the scan does not finish
+func scanWithin(t *testing.T, s *Scanner, root string) Summary {
+	t.Helper()
+	type outcome struct {
+		summary Summary
+		err     error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		summary, err := s.Scan(root, nil)
+		done <- outcome{summary, err}
+	}()
+	select {
+	case result := <-done:
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		return result.summary
+	case <-time.After(10 * time.Second):
+		t.Fatal("scan did not terminate, stuck in a link cycle")
+	}
+	return Summary{}
+}
+
+// probed returns the probed paths, failing the test for any probed twice
+func probed(t *testing.T, prober *countingProber) []string {
+	t.Helper()
+	var paths []string
+	for path, count := range prober.probes {
+		if count != 1 {
+			t.Errorf("%s was probed %d times, want once", path, count)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestScanFollowsLinksOnceThroughCycles(t *testing.T) {
+	root, videos := symlinkTree(t)
+	prober := &countingProber{}
+	s := New(&memoryStore{}, prober, nil)
+	s.SetSymlinkPolicy(SymlinksFollow)
+	s.SetWorkers(4)
+
+	summary := scanWithin(t, s, root)
+	sort.Strings(videos)
+	got := probed(t, prober)
+	if len(got) != len(videos) || got[0] != videos[0] || got[1] != videos[1] {
+		t.Errorf("probed %v, want each real file once: %v", got, videos)
+	}
+	if summary.Total != len(videos) {
+		t.Errorf("scan counted %d files, want %d", summary.Total, len(videos))
+	}
+
+	// A second scan with the same scanner visits them again
+	scanWithin(t, s, root)
+	for _, video := range videos {
+		if prober.probes[video] != 2 {
+			t.Errorf("%s probed %d times over two scans, want 2", video, prober.probes[video])
+		}
+	}
+}
+
+func TestScanSkipsLinks(t *testing.T) {
+	root, videos := symlinkTree(t)
+	prober := &countingProber{}
+	s := New(&memoryStore{}, prober, nil)
+
+	summary := scanWithin(t, s, root)
+	sort.Strings(videos)
+	got := probed(t, prober)
+	if len(got) != len(videos) || got[0] != videos[0] || got[1] != videos[1] {
+		t.Errorf("probed %v, want only the real files %v", got, videos)
+	}
+	if summary.Total != len(videos) {
+		t.Errorf("scan counted %d files, want %d", summary.Total, len(videos))
+	}
+}
+
+func TestScanRecordsLinks(t *testing.T) {
+	root, videos := symlinkTree(t)
+	prober := &countingProber{}
+	store := &memoryStore{}
+	s := New(store, prober, nil)
+	s.SetSymlinkPolicy(SymlinksRecord)
+
+	scanWithin(t, s, root)
+	if got := probed(t, prober); len(got) != len(videos) {
+		t.Errorf("probed %v, want only the real files %v", got, videos)
+	}
+	for link, target := range map[string]string{
+		filepath.Join(root, "alias.mkv"):    "movies/a.mkv",
+		filepath.Join(root, "dangling.mkv"): "gone.mkv",
+	} {
+		video, ok := store.videos[link]
+		if !ok {
+			t.Errorf("%s was not recorded", link)
+			continue
+		}
+		if video.LinkTarget != target {
+			t.Errorf("%s recorded with target %q, want %q", link, video.LinkTarget, target)
+		}
+	}
+}